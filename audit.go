@@ -0,0 +1,133 @@
+/*
+ *    Copyright (C) 2015 Stefan Luecke
+ *
+ *    This program is free software: you can redistribute it and/or modify
+ *    it under the terms of the GNU Affero General Public License as published
+ *    by the Free Software Foundation, either version 3 of the License, or
+ *    (at your option) any later version.
+ *
+ *    This program is distributed in the hope that it will be useful,
+ *    but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *    GNU Affero General Public License for more details.
+ *
+ *    You should have received a copy of the GNU Affero General Public License
+ *    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ *    Authors: Stefan Luecke <glaxx@glaxx.net>
+ */
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	db "github.com/openlab-aux/lsmsd/database"
+	"gopkg.in/gcfg.v1"
+	"gopkg.in/mgo.v2"
+	"os"
+)
+
+// audit implements "lsmsd audit verify", which checks the hash chains of the
+// item and policy logs. It exits with status 1 if a log was tampered with.
+// A bolt database file can not be checked while lsmsd is running, use
+// GET /audit/verify then.
+func audit(args []string) {
+	if len(args) == 0 || args[0] != "verify" {
+		fmt.Fprintln(os.Stderr, "usage: lsmsd audit verify [flags]")
+		os.Exit(2)
+	}
+	fs := flag.NewFlagSet("audit verify", flag.ExitOnError)
+	cfg := toolConfig(fs, args[1:])
+
+	var (
+		itemp db.ItemProvider
+		polp  db.PolicyProvider
+	)
+	switch cfg.Database.Backend {
+	case "", "mongodb":
+		s, err := mgo.Dial(cfg.Database.Server)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer s.Close()
+		itemp = db.NewItemDBProvider(s, cfg.Database.DB, nil)
+		polp = db.NewPolicyDBProvider(s, cfg.Database.DB)
+	case "bolt":
+		b, err := db.OpenBoltStore(cfg.Database.File)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer b.Close()
+		itemp, err = db.NewItemBoltProvider(b, nil)
+		if err != nil {
+			log.Fatal(err)
+		}
+		polp, err = db.NewPolicyBoltProvider(b)
+		if err != nil {
+			log.Fatal(err)
+		}
+	default:
+		log.WithFields(log.Fields{"Backend": cfg.Database.Backend}).Fatal("Backend has no persistent log")
+	}
+
+	valid := true
+	for _, verify := range []func() (*db.AuditReport, error){itemp.VerifyLog, polp.VerifyLog} {
+		r, err := verify()
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("%v: %v records, head %v %v", r.Log, r.Records, r.Head.Seq, r.Head.Hash)
+		if r.Unchained != 0 {
+			fmt.Printf(", %v older records are not chained", r.Unchained)
+		}
+		fmt.Println()
+		for _, p := range r.Problems {
+			fmt.Printf("  %v (position %v, id %v)\n", p.Problem, p.Seq, p.ID.Hex())
+		}
+		valid = valid && r.Valid
+	}
+	if !valid {
+		os.Exit(1)
+	}
+}
+
+// toolConfig reads the database settings of the config file, overridden by
+// the flags of fs, for commands working on the database directly
+func toolConfig(fs *flag.FlagSet, args []string) *Config {
+	var configpath = fs.String("cfgpath", defaultConfigPath, "path to your config file")
+	var dbbackend = fs.String("dbbackend", "", "storage backend, mongodb or bolt")
+	var dbserver = fs.String("dbserver", "", "address of your mongo db server")
+	var dbdb = fs.String("dbdb", "", "mongo database name")
+	var dbfile = fs.String("dbfile", "", "database file of the bolt backend")
+	fs.Parse(args)
+
+	var cfg Config
+	err := gcfg.ReadFileInto(&cfg, *configpath)
+	if err != nil && !os.IsNotExist(err) {
+		log.Fatal(err)
+	}
+	if *dbbackend != "" {
+		cfg.Database.Backend = *dbbackend
+	}
+	if *dbserver != "" {
+		cfg.Database.Server = *dbserver
+	}
+	if *dbdb != "" {
+		cfg.Database.DB = *dbdb
+	}
+	if *dbfile != "" {
+		cfg.Database.File = *dbfile
+	}
+	if cfg.Database.Server == "" {
+		cfg.Database.Server = defaultDatabaseServer
+	}
+	if cfg.Database.DB == "" {
+		cfg.Database.DB = defaultDatabase
+	}
+	if cfg.Database.File == "" {
+		cfg.Database.File = defaultDatabaseFile
+	}
+	return &cfg
+}
@@ -0,0 +1,112 @@
+/*
+ *    Copyright (C) 2015 Stefan Luecke
+ *
+ *    This program is free software: you can redistribute it and/or modify
+ *    it under the terms of the GNU Affero General Public License as published
+ *    by the Free Software Foundation, either version 3 of the License, or
+ *    (at your option) any later version.
+ *
+ *    This program is distributed in the hope that it will be useful,
+ *    but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *    GNU Affero General Public License for more details.
+ *
+ *    You should have received a copy of the GNU Affero General Public License
+ *    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ *    Authors: Stefan Luecke <glaxx@glaxx.net>
+ */
+
+package database
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"io"
+	"time"
+)
+
+// Attachment describes a file attached to an item, like a manual or a
+// purchase receipt
+type Attachment struct {
+	ID          bson.ObjectId `bson:"-" json:"Id"`
+	ItmRef      uint64
+	User        string
+	Filename    string
+	Description string `bson:",omitempty" json:",omitempty"`
+	Public      bool   `description:"Private attachments are only visible to those managing the item"`
+	ContentType string
+	Size        int64  `description:"Size of the file in bytes"`
+	SHA256      string `description:"Hex encoded SHA-256 of the file"`
+	Uploaded    time.Time
+}
+
+type AttachmentDBProvider struct {
+	c *mgo.GridFS
+}
+
+func NewAttachmentDBProvider(s *mgo.Session, dbname string) *AttachmentDBProvider {
+	res := new(AttachmentDBProvider)
+	res.c = s.DB(dbname).GridFS("attachments")
+	return res
+}
+
+// Create stores the file read from data as described by a and sets its ID,
+// Size, SHA256 and Uploaded. The file is streamed into GridFS.
+func (p *AttachmentDBProvider) Create(data io.Reader, a *Attachment) error {
+	f, err := p.c.Create(a.Filename)
+	if err != nil {
+		return err
+	}
+	f.SetContentType(a.ContentType)
+	h := sha256.New()
+	n, err := io.Copy(f, io.TeeReader(data, h))
+	if err != nil {
+		f.Abort()
+		f.Close()
+		return err
+	}
+	a.Size = n
+	a.SHA256 = hex.EncodeToString(h.Sum(nil))
+	a.Uploaded = time.Now()
+	f.SetMeta(a)
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+	a.ID = f.Id().(bson.ObjectId)
+	return nil
+}
+
+func (p *AttachmentDBProvider) GetAttachmentById(obj bson.ObjectId) (*Attachment, error) {
+	f, err := p.c.OpenId(obj)
+	if err != nil {
+		return nil, err
+	}
+	res := new(Attachment)
+	err = f.GetMeta(res)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	res.ID = obj
+	return res, f.Close()
+}
+
+func (p *AttachmentDBProvider) OpenAttachment(obj bson.ObjectId) (ImageFile, error) {
+	f, err := p.c.OpenId(obj)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (p *AttachmentDBProvider) Remove(obj bson.ObjectId) error {
+	return p.c.RemoveId(obj)
+}
+
+func (p *AttachmentDBProvider) ListAttachments() ([]FileRef, error) {
+	return listFiles(p.c)
+}
@@ -0,0 +1,283 @@
+/*
+ *    Copyright (C) 2015 Stefan Luecke
+ *
+ *    This program is free software: you can redistribute it and/or modify
+ *    it under the terms of the GNU Affero General Public License as published
+ *    by the Free Software Foundation, either version 3 of the License, or
+ *    (at your option) any later version.
+ *
+ *    This program is distributed in the hope that it will be useful,
+ *    but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *    GNU Affero General Public License for more details.
+ *
+ *    You should have received a copy of the GNU Affero General Public License
+ *    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ *    Authors: Stefan Luecke <glaxx@glaxx.net>
+ */
+
+package database
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	log "github.com/Sirupsen/logrus"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// The item and policy logs are hash chains: every record carries its
+// position, the hash of the record before it and its own hash. Editing,
+// removing or reordering records directly in the database breaks the chain,
+// which VerifyLog detects. Rewriting the whole chain from some point on can
+// only be detected by comparing the head with a copy noted earlier.
+
+// AuditLink chains a history record to its predecessor
+type AuditLink struct {
+	Seq  uint64 `bson:",omitempty" json:",omitempty" description:"Position of the record in the log, starting with 1"`
+	Prev string `bson:",omitempty" json:",omitempty" description:"Hash of the previous record"`
+	Hash string `bson:",omitempty" json:",omitempty" description:"SHA-256 of this record"`
+}
+
+// AuditReport is the result of checking a log
+type AuditReport struct {
+	Log       string
+	Valid     bool      `description:"No problems were found"`
+	Records   int       `description:"Number of chained records"`
+	Unchained int       `description:"Records from before the log was chained, they are not covered"`
+	Head      AuditLink `description:"The last record. Note it down to detect later rewrites of the whole log"`
+	Problems  []AuditProblem
+}
+
+// AuditProblem describes a place where the chain is broken
+type AuditProblem struct {
+	Seq     uint64        `json:",omitempty"`
+	ID      bson.ObjectId `json:"Id,omitempty"`
+	Problem string
+}
+
+// auditRecord is a history record which can be chained
+type auditRecord interface {
+	auditLink() (*bson.ObjectId, *AuditLink)
+}
+
+func (h *ItemHistory) auditLink() (*bson.ObjectId, *AuditLink) {
+	return &h.ID, &h.AuditLink
+}
+
+func (h *PolicyHistory) auditLink() (*bson.ObjectId, *AuditLink) {
+	return &h.ID, &h.AuditLink
+}
+
+// auditChain appends records to a log
+type auditChain interface {
+	append(rec auditRecord) error
+}
+
+// chainRecord links rec to head and returns its document form
+func chainRecord(rec auditRecord, head AuditLink) (bson.M, error) {
+	id, link := rec.auditLink()
+	if *id == "" {
+		*id = bson.NewObjectId()
+	}
+	link.Seq = head.Seq + 1
+	link.Prev = head.Hash
+	link.Hash = ""
+	doc, err := toDoc(rec)
+	if err != nil {
+		return nil, err
+	}
+	link.Hash, err = hashRecord(doc)
+	doc["hash"] = link.Hash
+	return doc, err
+}
+
+// hashRecord hashes the stored form of a record, except for its own hash.
+// The fields are sorted, so the order in which the database returns them
+// does not matter.
+func hashRecord(doc bson.M) (string, error) {
+	d := canonicalDoc(doc)
+	for i := 0; i != len(d); i++ {
+		if d[i].Name == "hash" {
+			d = append(d[:i], d[i+1:]...)
+			break
+		}
+	}
+	data, err := bson.Marshal(d)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+func canonicalDoc(m bson.M) bson.D {
+	res := make(bson.D, 0, len(m))
+	for k, v := range m {
+		res = append(res, bson.DocElem{Name: k, Value: canonicalValue(v)})
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Name < res[j].Name })
+	return res
+}
+
+func canonicalValue(v interface{}) interface{} {
+	switch t := v.(type) {
+	case bson.M:
+		return canonicalDoc(t)
+	case map[string]interface{}:
+		return canonicalDoc(bson.M(t))
+	case []interface{}:
+		res := make([]interface{}, len(t))
+		for i := range t {
+			res[i] = canonicalValue(t[i])
+		}
+		return res
+	}
+	return v
+}
+
+// auditRetries bounds how often an append is retried after other writers
+// took the next position
+const auditRetries = 16
+
+// mongoChain appends to a log in mongodb. A unique index on the position
+// makes concurrent writers, also in different processes, retry instead of
+// forking the chain.
+type mongoChain struct {
+	c *mgo.Collection
+}
+
+func newMongoChain(c *mgo.Collection) *mongoChain {
+	res := new(mongoChain)
+	res.c = c
+	err := c.EnsureIndex(mgo.Index{Key: []string{"seq"}, Unique: true, Sparse: true})
+	if err != nil {
+		log.WithFields(log.Fields{"Err": err}).Warn("Could not create log position index")
+	}
+	return res
+}
+
+func (m *mongoChain) append(rec auditRecord) error {
+	var err error
+	for i := 0; i != auditRetries; i++ {
+		head := AuditLink{}
+		err = m.c.Find(bson.M{"seq": bson.M{"$exists": true}}).Sort("-seq").One(&head)
+		if err != nil && err != mgo.ErrNotFound {
+			return err
+		}
+		var doc bson.M
+		doc, err = chainRecord(rec, head)
+		if err != nil {
+			return err
+		}
+		err = m.c.Insert(doc)
+		if !mgo.IsDup(err) {
+			return err
+		}
+	}
+	return err
+}
+
+// memChain appends to a log of the in-memory and bolt backends
+type memChain struct {
+	c    *memCollection
+	mu   sync.Mutex
+	head *AuditLink // read from c on the first append
+}
+
+func (m *memChain) append(rec auditRecord) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.head == nil {
+		docs, err := m.c.find(bson.M{"seq": bson.M{"$exists": true}})
+		if err != nil {
+			return err
+		}
+		m.head = new(AuditLink)
+		for _, d := range docs {
+			if seq := docUint(d["seq"]); seq > m.head.Seq {
+				m.head.Seq = seq
+				m.head.Hash, _ = d["hash"].(string)
+			}
+		}
+	}
+	doc, err := chainRecord(rec, *m.head)
+	if err != nil {
+		return err
+	}
+	err = m.c.insert(doc)
+	if err != nil {
+		return err
+	}
+	_, link := rec.auditLink()
+	*m.head = *link
+	return nil
+}
+
+func docUint(v interface{}) uint64 {
+	if f := memFloat(v); f > 0 {
+		return uint64(f)
+	}
+	return 0
+}
+
+// verifyLog walks the records of log name in the order of their positions
+func verifyLog(name string, docs []bson.M) *AuditReport {
+	res := new(AuditReport)
+	res.Log = name
+	res.Problems = make([]AuditProblem, 0)
+	chained := make([]bson.M, 0, len(docs))
+	unchained := make([]bson.M, 0)
+	for _, d := range docs {
+		if docUint(d["seq"]) != 0 {
+			chained = append(chained, d)
+		} else {
+			unchained = append(unchained, d)
+		}
+	}
+	sort.SliceStable(chained, func(i, j int) bool {
+		return docUint(chained[i]["seq"]) < docUint(chained[j]["seq"])
+	})
+	res.Records = len(chained)
+
+	for _, d := range unchained {
+		id, _ := d["_id"].(bson.ObjectId)
+		// records made before the first chained one are from older versions
+		if len(chained) == 0 || !id.Valid() ||
+			id.Time().Before(chained[0]["_id"].(bson.ObjectId).Time()) {
+			res.Unchained++
+			continue
+		}
+		res.Problems = append(res.Problems, AuditProblem{ID: id, Problem: "Record was added outside of the chain"})
+	}
+
+	next := uint64(1)
+	prev := ""
+	for _, d := range chained {
+		seq := docUint(d["seq"])
+		id, _ := d["_id"].(bson.ObjectId)
+		hash, _ := d["hash"].(string)
+		link, _ := d["prev"].(string)
+		switch {
+		case seq < next:
+			res.Problems = append(res.Problems, AuditProblem{seq, id, "Position is taken by another record"})
+		case seq > next:
+			res.Problems = append(res.Problems, AuditProblem{next, "",
+				"Records " + strconv.FormatUint(next, 10) + " to " + strconv.FormatUint(seq-1, 10) + " are missing"})
+		case link != prev:
+			res.Problems = append(res.Problems, AuditProblem{seq, id, "Record does not link to its predecessor"})
+		}
+		if h, err := hashRecord(d); err != nil || h != hash {
+			res.Problems = append(res.Problems, AuditProblem{seq, id, "Record was modified"})
+		}
+		next = seq + 1
+		prev = hash
+		res.Head = AuditLink{Seq: seq, Prev: link, Hash: hash}
+	}
+	res.Valid = len(res.Problems) == 0
+	return res
+}
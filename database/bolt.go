@@ -0,0 +1,543 @@
+/*
+ *    Copyright (C) 2015 Stefan Luecke
+ *
+ *    This program is free software: you can redistribute it and/or modify
+ *    it under the terms of the GNU Affero General Public License as published
+ *    by the Free Software Foundation, either version 3 of the License, or
+ *    (at your option) any later version.
+ *
+ *    This program is distributed in the hope that it will be useful,
+ *    but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *    GNU Affero General Public License for more details.
+ *
+ *    You should have received a copy of the GNU Affero General Public License
+ *    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ *    Authors: Stefan Luecke <glaxx@glaxx.net>
+ */
+
+package database
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	bolt "go.etcd.io/bbolt"
+	"gopkg.in/mgo.v2/bson"
+	"io"
+	"time"
+)
+
+// The bolt backend keeps everything in a single file. It reuses the in-memory
+// providers: each collection is read from its bucket on startup and every
+// change is written through to the file before it becomes visible. Images
+// and attachments are only read from the file on request.
+
+var (
+	boltCounters    = []byte("counters")
+	boltItemCounter = []byte("item")
+	boltImages      = []byte("images")
+	boltRenditions  = []byte("image_renditions")
+	boltAttachments = []byte("attachments")
+)
+
+var ErrBoltNotEmpty = errors.New("The database file already contains data")
+
+type BoltStore struct {
+	db *bolt.DB
+}
+
+// OpenBoltStore opens or creates the database file at path
+func OpenBoltStore(path string) (*BoltStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	res := new(BoltStore)
+	res.db = db
+	return res, nil
+}
+
+func (b *BoltStore) Close() error {
+	return b.db.Close()
+}
+
+// empty reports whether there is no data in the file yet
+func (b *BoltStore) empty() (bool, error) {
+	empty := true
+	err := b.db.View(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, bk *bolt.Bucket) error {
+			if k, _ := bk.Cursor().First(); k != nil {
+				empty = false
+			}
+			return nil
+		})
+	})
+	return empty, err
+}
+
+// collection loads the bucket name into a memCollection that writes through
+// to it
+func (b *BoltStore) collection(name string) (*memCollection, error) {
+	res := new(memCollection)
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		bk, err := tx.CreateBucketIfNotExists([]byte(name))
+		if err != nil {
+			return err
+		}
+		return bk.ForEach(func(k, v []byte) error {
+			doc := bson.M{}
+			err := bson.Unmarshal(v, &doc)
+			res.docs = append(res.docs, doc)
+			return err
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	res.store = &boltBucket{b.db, []byte(name)}
+	return res, nil
+}
+
+// boltBucket is the docStore of a collection in the bolt backend. Documents
+// are stored under their bson encoded _id.
+type boltBucket struct {
+	db   *bolt.DB
+	name []byte
+}
+
+func boltKey(doc bson.M) ([]byte, error) {
+	return bson.Marshal(bson.M{"_id": doc["_id"]})
+}
+
+func (b *boltBucket) put(docs ...bson.M) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return putDocs(tx.Bucket(b.name), docs)
+	})
+}
+
+func putDocs(bk *bolt.Bucket, docs []bson.M) error {
+	for _, d := range docs {
+		k, err := boltKey(d)
+		if err != nil {
+			return err
+		}
+		v, err := bson.Marshal(d)
+		if err != nil {
+			return err
+		}
+		err = bk.Put(k, v)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *boltBucket) delete(docs ...bson.M) error {
+	if len(docs) == 0 {
+		return nil
+	}
+	return b.db.Update(func(tx *bolt.Tx) error {
+		bk := tx.Bucket(b.name)
+		for _, d := range docs {
+			k, err := boltKey(d)
+			if err != nil {
+				return err
+			}
+			err = bk.Delete(k)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// boltIDGenerator is the idSource of the bolt backend, the counter is
+// incremented inside a write transaction
+type boltIDGenerator struct {
+	db *bolt.DB
+}
+
+func (g *boltIDGenerator) GenerateID() (uint64, error) {
+	return g.ReserveIDs(1)
+}
+
+func (g *boltIDGenerator) ReserveIDs(n uint64) (uint64, error) {
+	if n == 0 {
+		return 0, ErrInvalidIDCount
+	}
+	var last uint64
+	err := g.db.Update(func(tx *bolt.Tx) error {
+		bk, err := tx.CreateBucketIfNotExists(boltCounters)
+		if err != nil {
+			return err
+		}
+		if v := bk.Get(boltItemCounter); v != nil {
+			last = binary.BigEndian.Uint64(v)
+		}
+		last += n
+		return setCounter(bk, last)
+	})
+	return last - n + 1, err
+}
+
+func (g *boltIDGenerator) LastID() (uint64, error) {
+	var last uint64
+	err := g.db.View(func(tx *bolt.Tx) error {
+		if bk := tx.Bucket(boltCounters); bk != nil {
+			if v := bk.Get(boltItemCounter); v != nil {
+				last = binary.BigEndian.Uint64(v)
+			}
+		}
+		return nil
+	})
+	return last, err
+}
+
+func setCounter(bk *bolt.Bucket, id uint64) error {
+	v := make([]byte, 8)
+	binary.BigEndian.PutUint64(v, id)
+	return bk.Put(boltItemCounter, v)
+}
+
+func NewItemBoltProvider(b *BoltStore, img ImageProvider) (*ItemMemProvider, error) {
+	res := NewItemMemProvider(img)
+	var err error
+	res.c, err = b.collection("item")
+	if err != nil {
+		return nil, err
+	}
+	res.ch, err = b.collection("item_history")
+	if err != nil {
+		return nil, err
+	}
+	res.chain = &memChain{c: res.ch}
+	res.idgen = &boltIDGenerator{b.db}
+	return res, nil
+}
+
+func NewPolicyBoltProvider(b *BoltStore) (*PolicyMemProvider, error) {
+	res := NewPolicyMemProvider()
+	var err error
+	res.c, err = b.collection("policy")
+	if err != nil {
+		return nil, err
+	}
+	res.ch, err = b.collection("policy_history")
+	if err != nil {
+		return nil, err
+	}
+	res.chain = &memChain{c: res.ch}
+	return res, nil
+}
+
+func NewUserBoltProvider(b *BoltStore, i ItemProvider, p PolicyProvider) (*UserMemProvider, error) {
+	res := NewUserMemProvider(i, p)
+	var err error
+	res.c, err = b.collection("user")
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func NewLoanBoltProvider(b *BoltStore) (*LoanMemProvider, error) {
+	res := NewLoanMemProvider()
+	var err error
+	res.c, err = b.collection("loan")
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func NewReservationBoltProvider(b *BoltStore) (*ReservationMemProvider, error) {
+	res := NewReservationMemProvider()
+	var err error
+	res.c, err = b.collection("reservation")
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// NewTokenBoltProvider also drops expired tokens, which mongodb removes with
+// its TTL index
+func NewTokenBoltProvider(b *BoltStore) (*TokenMemProvider, error) {
+	res := NewTokenMemProvider()
+	var err error
+	res.c, err = b.collection("token")
+	if err != nil {
+		return nil, err
+	}
+	_, err = res.c.remove(bson.M{"expires": bson.M{"$lt": time.Now()}})
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// ImageBoltProvider stores images in the images bucket of a BoltStore
+type ImageBoltProvider struct {
+	db *bolt.DB
+}
+
+type boltImage struct {
+	ContentType string
+	Meta        ImageMetadata
+	Data        []byte
+}
+
+func NewImageBoltProvider(b *BoltStore) (*ImageBoltProvider, error) {
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(boltImages)
+		if err != nil {
+			return err
+		}
+		_, err = tx.CreateBucketIfNotExists(boltRenditions)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	res := new(ImageBoltProvider)
+	res.db = b.db
+	return res, nil
+}
+
+func putImage(bk *bolt.Bucket, id bson.ObjectId, img *boltImage) error {
+	v, err := bson.Marshal(img)
+	if err != nil {
+		return err
+	}
+	return bk.Put([]byte(id), v)
+}
+
+func (p *ImageBoltProvider) get(obj bson.ObjectId) (*boltImage, error) {
+	res := new(boltImage)
+	err := p.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(boltImages).Get([]byte(obj))
+		if v == nil {
+			return ErrNotFound
+		}
+		return bson.Unmarshal(v, res)
+	})
+	return res, err
+}
+
+func (p *ImageBoltProvider) Create(data io.Reader, user, contentType string, obj uint64) (bson.ObjectId, error) {
+	buf := new(bytes.Buffer)
+	_, err := buf.ReadFrom(data)
+	if err != nil {
+		return "", err
+	}
+	id := bson.NewObjectId()
+	img := &boltImage{contentType, *newImageMetadata(buf.Bytes(), user, obj), buf.Bytes()}
+	err = p.db.Update(func(tx *bolt.Tx) error {
+		return putImage(tx.Bucket(boltImages), id, img)
+	})
+	return id, err
+}
+
+// Remove deletes image obj and its renditions, which are keyed by the image
+// id followed by their size
+func (p *ImageBoltProvider) Remove(obj bson.ObjectId) error {
+	return p.db.Update(func(tx *bolt.Tx) error {
+		err := tx.Bucket(boltImages).Delete([]byte(obj))
+		if err != nil {
+			return err
+		}
+		bk := tx.Bucket(boltRenditions)
+		keys := make([][]byte, 0)
+		c := bk.Cursor()
+		for k, _ := c.Seek([]byte(obj)); k != nil && bytes.HasPrefix(k, []byte(obj)); k, _ = c.Next() {
+			keys = append(keys, k)
+		}
+		for _, k := range keys {
+			err = bk.Delete(k)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (p *ImageBoltProvider) GetRendition(obj bson.ObjectId, size string) (*bytes.Buffer, string, error) {
+	img := new(boltImage)
+	err := p.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(boltRenditions).Get([]byte(string(obj) + size))
+		if v == nil {
+			return ErrNotFound
+		}
+		return bson.Unmarshal(v, img)
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	return bytes.NewBuffer(img.Data), img.ContentType, nil
+}
+
+func (p *ImageBoltProvider) CreateRendition(data io.Reader, contentType string, obj bson.ObjectId, size string) error {
+	buf := new(bytes.Buffer)
+	_, err := buf.ReadFrom(data)
+	if err != nil {
+		return err
+	}
+	v, err := bson.Marshal(&boltImage{ContentType: contentType, Data: buf.Bytes()})
+	if err != nil {
+		return err
+	}
+	return p.db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket(boltImages).Get([]byte(obj)) == nil {
+			return ErrNotFound
+		}
+		return tx.Bucket(boltRenditions).Put([]byte(string(obj)+size), v)
+	})
+}
+
+func (p *ImageBoltProvider) GetImageById(obj bson.ObjectId) (*bytes.Buffer, string, error) {
+	img, err := p.get(obj)
+	if err != nil {
+		return nil, "", err
+	}
+	return bytes.NewBuffer(img.Data), img.ContentType, nil
+}
+
+func (p *ImageBoltProvider) OpenImage(obj bson.ObjectId) (ImageFile, error) {
+	img, err := p.get(obj)
+	if err != nil {
+		return nil, err
+	}
+	return newMemImageFile(img.Data, img.ContentType, obj), nil
+}
+
+func (p *ImageBoltProvider) GetImageMetadataById(obj bson.ObjectId) (*ImageMetadata, error) {
+	img, err := p.get(obj)
+	if err != nil {
+		return nil, err
+	}
+	return &img.Meta, nil
+}
+
+func (p *ImageBoltProvider) Delete(obj bson.ObjectId) error {
+	return p.Remove(obj)
+}
+
+func (p *ImageBoltProvider) ListImages() ([]FileRef, error) {
+	return listBoltFiles(p.db, boltImages)
+}
+
+// listBoltFiles returns the files in bucket name along with the item they
+// were uploaded for. Both images and attachments keep it in Meta.
+func listBoltFiles(db *bolt.DB, name []byte) ([]FileRef, error) {
+	res := make([]FileRef, 0)
+	err := db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(name).ForEach(func(k, v []byte) error {
+			var f struct {
+				Meta struct {
+					ItmRef uint64
+				}
+			}
+			err := bson.Unmarshal(v, &f)
+			if err != nil {
+				return err
+			}
+			res = append(res, FileRef{bson.ObjectId(k), f.Meta.ItmRef})
+			return nil
+		})
+	})
+	return res, err
+}
+
+// AttachmentBoltProvider stores attachments in the attachments bucket of a
+// BoltStore
+type AttachmentBoltProvider struct {
+	db *bolt.DB
+}
+
+type boltAttachment struct {
+	Meta Attachment
+	Data []byte
+}
+
+func NewAttachmentBoltProvider(b *BoltStore) (*AttachmentBoltProvider, error) {
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(boltAttachments)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	res := new(AttachmentBoltProvider)
+	res.db = b.db
+	return res, nil
+}
+
+func putAttachment(bk *bolt.Bucket, id bson.ObjectId, att *boltAttachment) error {
+	v, err := bson.Marshal(att)
+	if err != nil {
+		return err
+	}
+	return bk.Put([]byte(id), v)
+}
+
+func (p *AttachmentBoltProvider) get(obj bson.ObjectId) (*boltAttachment, error) {
+	res := new(boltAttachment)
+	err := p.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(boltAttachments).Get([]byte(obj))
+		if v == nil {
+			return ErrNotFound
+		}
+		return bson.Unmarshal(v, res)
+	})
+	res.Meta.ID = obj
+	return res, err
+}
+
+func (p *AttachmentBoltProvider) Create(data io.Reader, a *Attachment) error {
+	buf := new(bytes.Buffer)
+	_, err := buf.ReadFrom(data)
+	if err != nil {
+		return err
+	}
+	id := bson.NewObjectId()
+	setAttachmentData(a, buf.Bytes())
+	err = p.db.Update(func(tx *bolt.Tx) error {
+		return putAttachment(tx.Bucket(boltAttachments), id, &boltAttachment{*a, buf.Bytes()})
+	})
+	if err != nil {
+		return err
+	}
+	a.ID = id
+	return nil
+}
+
+func (p *AttachmentBoltProvider) GetAttachmentById(obj bson.ObjectId) (*Attachment, error) {
+	att, err := p.get(obj)
+	if err != nil {
+		return nil, err
+	}
+	return &att.Meta, nil
+}
+
+func (p *AttachmentBoltProvider) OpenAttachment(obj bson.ObjectId) (ImageFile, error) {
+	att, err := p.get(obj)
+	if err != nil {
+		return nil, err
+	}
+	return newMemImageFile(att.Data, att.Meta.ContentType, obj), nil
+}
+
+func (p *AttachmentBoltProvider) Remove(obj bson.ObjectId) error {
+	return p.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltAttachments).Delete([]byte(obj))
+	})
+}
+
+func (p *AttachmentBoltProvider) ListAttachments() ([]FileRef, error) {
+	return listBoltFiles(p.db, boltAttachments)
+}
@@ -0,0 +1,276 @@
+/*
+ *    Copyright (C) 2015 Stefan Luecke
+ *
+ *    This program is free software: you can redistribute it and/or modify
+ *    it under the terms of the GNU Affero General Public License as published
+ *    by the Free Software Foundation, either version 3 of the License, or
+ *    (at your option) any later version.
+ *
+ *    This program is distributed in the hope that it will be useful,
+ *    but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *    GNU Affero General Public License for more details.
+ *
+ *    You should have received a copy of the GNU Affero General Public License
+ *    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ *    Authors: Stefan Luecke <glaxx@glaxx.net>
+ */
+
+package database
+
+import (
+	log "github.com/Sirupsen/logrus"
+	"gopkg.in/mgo.v2/bson"
+	"strconv"
+	"time"
+)
+
+// Items refer to image and attachment files, their parent, users and
+// policies, none of which is enforced by the database. Fsck finds the
+// references which lead nowhere and the files nothing refers to.
+
+// FsckGracePeriod is the age below which unreferenced files are ignored.
+// Uploads store the file before the item refers to it.
+var FsckGracePeriod = time.Minute
+
+// FsckReport is the result of a consistency check
+type FsckReport struct {
+	Valid       bool   `description:"No problems were found"`
+	Items       int    `description:"Number of checked items"`
+	Images      int    `description:"Number of stored images"`
+	Attachments int    `description:"Number of stored attachments"`
+	Counter     uint64 `description:"Last allocated item id"`
+	MaxID       uint64 `description:"Highest id of an existing item"`
+	Problems    []FsckProblem
+}
+
+// FsckProblem describes an inconsistency and whether it was repaired
+type FsckProblem struct {
+	Problem  string
+	Item     uint64 `json:",omitempty"`
+	Field    string `json:",omitempty"`
+	Ref      string `json:",omitempty" description:"The reference which leads nowhere or the unreferenced file"`
+	Repaired bool
+}
+
+// Fsck checks the references between items, files, users and policies and
+// the item id counter. With repair, unreferenced files are removed,
+// references to missing entities are dropped from the items, which is
+// recorded in their history as done by user, and the counter is advanced.
+func Fsck(i ItemProvider, p PolicyProvider, u UserProvider, img ImageProvider, att AttachmentProvider,
+	repair bool, user string) (*FsckReport, error) {
+	res := new(FsckReport)
+	res.Problems = make([]FsckProblem, 0)
+
+	items, _, err := i.ListItem(nil)
+	if err != nil {
+		return nil, err
+	}
+	pols, _, err := p.ListPolicy(nil)
+	if err != nil {
+		return nil, err
+	}
+	usrs, _, err := u.ListUser(nil)
+	if err != nil {
+		return nil, err
+	}
+	imgs, err := img.ListImages()
+	if err != nil {
+		return nil, err
+	}
+	atts, err := att.ListAttachments()
+	if err != nil {
+		return nil, err
+	}
+	res.Items, res.Images, res.Attachments = len(items), len(imgs), len(atts)
+
+	eids := make(map[uint64]bool, len(items))
+	for _, itm := range items {
+		eids[itm.EID] = true
+		if itm.EID > res.MaxID {
+			res.MaxID = itm.EID
+		}
+	}
+	policies := make(map[string]bool, len(pols))
+	for _, pol := range pols {
+		policies[pol.Name] = true
+	}
+	users := make(map[string]bool, len(usrs))
+	for _, usr := range usrs {
+		users[usr.Name] = true
+	}
+	images := fileSet(imgs)
+	attachments := fileSet(atts)
+
+	referenced := make(map[bson.ObjectId]bool)
+	for k := range items {
+		itm := &items[k]
+		for _, ref := range itm.Images {
+			referenced[ref] = true
+		}
+		for _, ref := range itm.Attachments {
+			referenced[ref] = true
+		}
+		probs := checkItem(itm, eids, users, policies, images, attachments)
+		if len(probs) != 0 && repair {
+			err = repairItem(i, itm.EID, probs, user)
+			if err != nil {
+				return nil, err
+			}
+		}
+		res.Problems = append(res.Problems, probs...)
+	}
+
+	for _, files := range []struct {
+		refs    []FileRef
+		problem string
+		remove  func(bson.ObjectId) error
+	}{
+		{imgs, "Orphaned image", img.Remove},
+		{atts, "Orphaned attachment", att.Remove},
+	} {
+		for _, f := range files.refs {
+			if referenced[f.ID] || time.Since(f.ID.Time()) < FsckGracePeriod {
+				continue
+			}
+			prob := FsckProblem{Problem: files.problem, Item: f.ItmRef, Ref: f.ID.Hex()}
+			if repair {
+				err = files.remove(f.ID)
+				if err != nil {
+					return nil, err
+				}
+				prob.Repaired = true
+			}
+			res.Problems = append(res.Problems, prob)
+		}
+	}
+
+	res.Counter, err = i.LastID()
+	if err != nil {
+		return nil, err
+	}
+	if res.Counter < res.MaxID {
+		prob := FsckProblem{Problem: "Item id counter is behind the items", Ref: strconv.FormatUint(res.Counter, 10)}
+		if repair {
+			_, err = i.ReserveIDs(res.MaxID - res.Counter)
+			if err != nil {
+				return nil, err
+			}
+			res.Counter = res.MaxID
+			prob.Repaired = true
+		}
+		res.Problems = append(res.Problems, prob)
+	}
+
+	res.Valid = len(res.Problems) == 0
+	if !res.Valid {
+		log.WithFields(log.Fields{"Problems": len(res.Problems), "Repair": repair}).Warn("Fsck found problems")
+	}
+	return res, nil
+}
+
+func fileSet(refs []FileRef) map[bson.ObjectId]bool {
+	res := make(map[bson.ObjectId]bool, len(refs))
+	for _, f := range refs {
+		res[f.ID] = true
+	}
+	return res
+}
+
+// checkItem returns the references of itm which lead nowhere
+func checkItem(itm *Item, eids map[uint64]bool, users, policies map[string]bool,
+	images, attachments map[bson.ObjectId]bool) []FsckProblem {
+	res := make([]FsckProblem, 0)
+	add := func(problem, field, ref string) {
+		res = append(res, FsckProblem{Problem: problem, Item: itm.EID, Field: field, Ref: ref})
+	}
+	if itm.Parent != 0 && !eids[itm.Parent] {
+		add("Unknown parent", "parent", strconv.FormatUint(itm.Parent, 10))
+	}
+	if itm.Owner != "" && !users[itm.Owner] {
+		add("Unknown user", "owner", itm.Owner)
+	}
+	if itm.Maintainer != "" && !users[itm.Maintainer] {
+		add("Unknown user", "maintainer", itm.Maintainer)
+	}
+	if itm.Usage != "" && !policies[itm.Usage] {
+		add("Unknown policy", "usage", itm.Usage)
+	}
+	if itm.Discard != "" && !policies[itm.Discard] {
+		add("Unknown policy", "discard", itm.Discard)
+	}
+	for _, ref := range itm.Images {
+		if !images[ref] {
+			add("Missing image", "images", ref.Hex())
+		}
+	}
+	for _, ref := range itm.Attachments {
+		if !attachments[ref] {
+			add("Missing attachment", "attachments", ref.Hex())
+		}
+	}
+	return res
+}
+
+// repairItem drops the references probs found by checkItem from item id and
+// marks them repaired
+func repairItem(i ItemProvider, id uint64, probs []FsckProblem, user string) error {
+	for k := range probs {
+		var err error
+		switch probs[k].Field {
+		case "images":
+			_, err = i.RemoveImage(id, bson.ObjectIdHex(probs[k].Ref), user)
+		case "attachments":
+			_, err = i.RemoveAttachment(id, bson.ObjectIdHex(probs[k].Ref), user)
+		default:
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	// the references were removed above, so the item is read again
+	cur, err := i.GetItemById(id)
+	if err != nil {
+		return err
+	}
+	itm := cur
+	itm.ImageInfo = make(map[string]ImageInfo, len(cur.ImageInfo))
+	for ref, info := range cur.ImageInfo {
+		for _, img := range cur.Images {
+			if img.Hex() == ref {
+				itm.ImageInfo[ref] = info
+			}
+		}
+	}
+	if len(itm.ImageInfo) == 0 {
+		itm.ImageInfo = nil
+	}
+	for _, prob := range probs {
+		switch prob.Field {
+		case "parent":
+			itm.Parent = 0
+		case "owner":
+			itm.Owner = ""
+		case "maintainer":
+			itm.Maintainer = ""
+		case "usage":
+			itm.Usage = ""
+		case "discard":
+			itm.Discard = ""
+		}
+	}
+	h := cur.NewItemHistory(&itm, user)
+	if len(h.Item) > 1 {
+		err = i.UpdateItem(&itm, h)
+		if err != nil {
+			return err
+		}
+	}
+	for k := range probs {
+		probs[k].Repaired = true
+	}
+	return nil
+}
@@ -0,0 +1,143 @@
+/*
+ *    Copyright (C) 2015 Stefan Luecke
+ *
+ *    This program is free software: you can redistribute it and/or modify
+ *    it under the terms of the GNU Affero General Public License as published
+ *    by the Free Software Foundation, either version 3 of the License, or
+ *    (at your option) any later version.
+ *
+ *    This program is distributed in the hope that it will be useful,
+ *    but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *    GNU Affero General Public License for more details.
+ *
+ *    You should have received a copy of the GNU Affero General Public License
+ *    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ *    Authors: Stefan Luecke <glaxx@glaxx.net>
+ */
+
+package database
+
+import (
+	"errors"
+	"gopkg.in/mgo.v2/bson"
+)
+
+var (
+	ErrParentNotFound = errors.New("Parent item does not exist")
+	ErrParentCycle    = errors.New("An item can not be its own ancestor")
+	ErrHasChildren    = errors.New("Item still contains other items")
+)
+
+// ItemTree is an item together with all items it (recursively) contains
+type ItemTree struct {
+	Item
+	Children []ItemTree
+}
+
+// itemTree is what the hierarchy functions need to know about a backend
+type itemTree interface {
+	GetItemById(id uint64) (Item, error)
+	GetChildren(id uint64) ([]Item, error)
+}
+
+// CheckParent verifies that parent may become the parent of the item id:
+// the parent has to exist and id must not be one of its ancestors. A parent
+// of 0 means the item is not contained in another item.
+func (p *ItemDBProvider) CheckParent(id, parent uint64) error {
+	return checkParent(p, id, parent)
+}
+
+// GetChildren returns all items directly contained in the item id
+func (p *ItemDBProvider) GetChildren(id uint64) ([]Item, error) {
+	res := make([]Item, 0)
+	err := p.c.Find(bson.M{"parent": id}).Sort("name", "eid").All(&res)
+	return res, err
+}
+
+// GetAncestors returns the chain of items containing the item id, starting
+// with the outermost one. The item itself is not part of the result.
+func (p *ItemDBProvider) GetAncestors(id uint64) ([]Item, error) {
+	return getAncestors(p, id)
+}
+
+// GetItemTree returns the item id and everything it contains
+func (p *ItemDBProvider) GetItemTree(id uint64) (*ItemTree, error) {
+	return getItemTree(p, id)
+}
+
+func checkParent(p itemTree, id, parent uint64) error {
+	visited := make(map[uint64]bool)
+	for cur := parent; cur != 0; {
+		if cur == id || visited[cur] {
+			return ErrParentCycle
+		}
+		visited[cur] = true
+		itm, err := p.GetItemById(cur)
+		if err == ErrNotFound {
+			if cur == parent {
+				return ErrParentNotFound
+			}
+			// a dangling reference further up is not our business here
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		cur = itm.Parent
+	}
+	return nil
+}
+
+func getAncestors(p itemTree, id uint64) ([]Item, error) {
+	itm, err := p.GetItemById(id)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]Item, 0)
+	visited := map[uint64]bool{id: true}
+	for cur := itm.Parent; cur != 0 && !visited[cur]; {
+		visited[cur] = true
+		a, err := p.GetItemById(cur)
+		if err == ErrNotFound {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		res = append([]Item{a}, res...)
+		cur = a.Parent
+	}
+	return res, nil
+}
+
+func getItemTree(p itemTree, id uint64) (*ItemTree, error) {
+	itm, err := p.GetItemById(id)
+	if err != nil {
+		return nil, err
+	}
+	res := &ItemTree{Item: itm}
+	err = fillTree(p, res, map[uint64]bool{id: true})
+	return res, err
+}
+
+func fillTree(p itemTree, t *ItemTree, visited map[uint64]bool) error {
+	children, err := p.GetChildren(t.EID)
+	if err != nil {
+		return err
+	}
+	t.Children = make([]ItemTree, 0, len(children))
+	for i := 0; i != len(children); i++ {
+		if visited[children[i].EID] {
+			continue
+		}
+		visited[children[i].EID] = true
+		t.Children = append(t.Children, ItemTree{Item: children[i]})
+		err = fillTree(p, &t.Children[len(t.Children)-1], visited)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -21,39 +21,74 @@ package database
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	//	log "github.com/Sirupsen/logrus"
 	"gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
 	"io"
 )
 
 type ImageDBProvider struct {
 	c *mgo.GridFS
+	r *mgo.GridFS
 }
 
 func NewImageDBProvider(s *mgo.Session, dbname string) *ImageDBProvider {
 	res := new(ImageDBProvider)
 	res.c = s.DB(dbname).GridFS("images")
+	res.r = s.DB(dbname).GridFS("renditions")
 	return res
 }
 
+// renditionName names the rendition of image obj in the given size
+func renditionName(obj bson.ObjectId, size string) string {
+	return obj.Hex() + "/" + size
+}
+
 type ImageMetadata struct {
 	ItmRef uint64
 	User   string
+	Width  int    `bson:",omitempty" json:",omitempty"`
+	Height int    `bson:",omitempty" json:",omitempty"`
+	Size   int64  `bson:",omitempty" json:",omitempty" description:"Size of the image data in bytes"`
+	SHA256 string `bson:",omitempty" json:",omitempty" description:"Hex encoded SHA-256 of the image data"`
+}
+
+// newImageMetadata describes the image data uploaded by user for item obj.
+// Data which can not be decoded has no dimensions.
+func newImageMetadata(data []byte, user string, obj uint64) *ImageMetadata {
+	res := new(ImageMetadata)
+	res.ItmRef = obj
+	res.User = user
+	res.Size = int64(len(data))
+	sum := sha256.Sum256(data)
+	res.SHA256 = hex.EncodeToString(sum[:])
+	if cfg, _, err := image.DecodeConfig(bytes.NewReader(data)); err == nil {
+		res.Width = cfg.Width
+		res.Height = cfg.Height
+	}
+	return res
 }
 
 func (p *ImageDBProvider) Create(data io.Reader, user, contentType string, obj uint64) (bson.ObjectId, error) {
+	buf := new(bytes.Buffer)
+	_, err := buf.ReadFrom(data)
+	if err != nil {
+		return "", err
+	}
 	f, err := p.c.Create("")
 	if err != nil {
 		return "", err
 	}
 	f.SetContentType(contentType)
-	meta := new(ImageMetadata)
-	meta.ItmRef = obj
-	meta.User = user
-	f.SetMeta(meta)
+	f.SetMeta(newImageMetadata(buf.Bytes(), user, obj))
 
-	_, err = io.Copy(f, data)
+	_, err = io.Copy(f, buf)
 	if err != nil {
 		err2 := f.Close()
 		if err != nil {
@@ -66,8 +101,80 @@ func (p *ImageDBProvider) Create(data io.Reader, user, contentType string, obj u
 	return f.Id().(bson.ObjectId), err
 }
 
+// Remove deletes image obj and its renditions
 func (p *ImageDBProvider) Remove(obj bson.ObjectId) error {
-	return p.c.RemoveId(obj)
+	err := p.c.RemoveId(obj)
+	if err != nil {
+		return err
+	}
+	var f struct {
+		ID bson.ObjectId `bson:"_id"`
+	}
+	it := p.r.Find(bson.M{"filename": bson.RegEx{Pattern: "^" + renditionName(obj, "")}}).Select(bson.M{"_id": 1}).Iter()
+	for it.Next(&f) {
+		err = p.r.RemoveId(f.ID)
+		if err != nil {
+			it.Close()
+			return err
+		}
+	}
+	return it.Close()
+}
+
+func (p *ImageDBProvider) ListImages() ([]FileRef, error) {
+	return listFiles(p.c)
+}
+
+// listFiles returns the files in fs along with the item they were uploaded
+// for
+func listFiles(fs *mgo.GridFS) ([]FileRef, error) {
+	var f struct {
+		ID   bson.ObjectId `bson:"_id"`
+		Meta struct {
+			ItmRef uint64
+		} `bson:"metadata"`
+	}
+	res := make([]FileRef, 0)
+	it := fs.Find(nil).Select(bson.M{"_id": 1, "metadata.itmref": 1}).Iter()
+	for it.Next(&f) {
+		res = append(res, FileRef{f.ID, f.Meta.ItmRef})
+	}
+	return res, it.Close()
+}
+
+// GetRendition returns the stored rendition of image obj in the given size
+// and its content type
+func (p *ImageDBProvider) GetRendition(obj bson.ObjectId, size string) (*bytes.Buffer, string, error) {
+	// Open returns the newest file if a rendition was stored twice
+	f, err := p.r.Open(renditionName(obj, size))
+	if err != nil {
+		return nil, "", err
+	}
+	buf := new(bytes.Buffer)
+	_, err = buf.ReadFrom(f)
+	if err != nil {
+		f.Close()
+		return nil, "", err
+	}
+	ct := f.ContentType()
+	err = f.Close()
+	return buf, ct, err
+}
+
+// CreateRendition stores a rendition of image obj in the given size
+func (p *ImageDBProvider) CreateRendition(data io.Reader, contentType string, obj bson.ObjectId, size string) error {
+	f, err := p.r.Create(renditionName(obj, size))
+	if err != nil {
+		return err
+	}
+	f.SetContentType(contentType)
+	_, err = io.Copy(f, data)
+	if err != nil {
+		f.Abort()
+		f.Close()
+		return err
+	}
+	return f.Close()
 }
 
 func (p *ImageDBProvider) GetImageById(obj bson.ObjectId) (*bytes.Buffer, string, error) {
@@ -89,6 +196,14 @@ func (p *ImageDBProvider) GetImageById(obj bson.ObjectId) (*bytes.Buffer, string
 	return buf, ct, err
 }
 
+func (p *ImageDBProvider) OpenImage(obj bson.ObjectId) (ImageFile, error) {
+	f, err := p.c.OpenId(obj)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
 func (p *ImageDBProvider) GetImageMetadataById(obj bson.ObjectId) (*ImageMetadata, error) {
 	f, err := p.c.OpenId(obj)
 	if err != nil {
@@ -108,5 +223,5 @@ func (p *ImageDBProvider) GetImageMetadataById(obj bson.ObjectId) (*ImageMetadat
 }
 
 func (p *ImageDBProvider) Delete(obj bson.ObjectId) error {
-	return p.c.RemoveId(obj)
+	return p.Remove(obj)
 }
@@ -25,6 +25,8 @@ import (
 	dmp "github.com/sergi/go-diff/diffmatchpatch"
 	"gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
+	"reflect"
+	"sort"
 	"strconv"
 	"time"
 )
@@ -32,22 +34,36 @@ import (
 type ItemDBProvider struct {
 	c     *mgo.Collection
 	ch    *mgo.Collection
-	img   *ImageDBProvider
-	idgen *idgenerator
+	chain auditChain
+	img   ImageProvider
+	idgen idSource
 }
 
-func NewItemDBProvider(s *mgo.Session, dbname string, img *ImageDBProvider) *ItemDBProvider {
+func NewItemDBProvider(s *mgo.Session, dbname string, img ImageProvider) *ItemDBProvider {
 	res := new(ItemDBProvider)
 	res.c = s.DB(dbname).C("item")
 	res.ch = s.DB(dbname).C("item_history")
+	res.chain = newMongoChain(res.ch)
 	res.img = img
 	res.idgen = NewIDGenerator(s.DB(dbname).C("counters"))
+	err := ensureTextIndex(res.c, map[string]int{"name": 10, "description": 1})
+	if err != nil {
+		log.WithFields(log.Fields{"Err": err}).Warn("Could not create item search index")
+	}
+	err = res.c.EnsureIndexKey("parent")
+	if err != nil {
+		log.WithFields(log.Fields{"Err": err}).Warn("Could not create item parent index")
+	}
+	err = res.c.EnsureIndex(mgo.Index{Key: []string{"eid"}, Unique: true})
+	if err != nil {
+		log.WithFields(log.Fields{"Err": err}).Warn("Could not create unique item id index")
+	}
 	return res
 }
 
-func (p *ItemDBProvider) Stop() {
-	p.idgen.StopIDGenerator()
-}
+// Stop used to stop the id generator goroutine, ids are allocated by the
+// database now and there is nothing left to stop.
+func (p *ItemDBProvider) Stop() {}
 
 func (p *ItemDBProvider) GetItemById(id uint64) (Item, error) {
 	res := Item{}
@@ -57,7 +73,7 @@ func (p *ItemDBProvider) GetItemById(id uint64) (Item, error) {
 
 func (p *ItemDBProvider) GetItemLog(id uint64) ([]ItemHistory, error) {
 	res := make([]ItemHistory, 0)
-	err := p.ch.Find(bson.M{"item.eid": id}).All(&res)
+	err := p.ch.Find(bson.M{"item.eid": id}).Sort("_id").All(&res)
 	for i := 0; i != len(res); i++ {
 		res[i].Timestamp = res[i].ID.Time()
 	}
@@ -66,62 +82,173 @@ func (p *ItemDBProvider) GetItemLog(id uint64) ([]ItemHistory, error) {
 
 func (p *ItemDBProvider) GetItemLogByUsername(name string) (*[]ItemHistory, error) {
 	i := make([]ItemHistory, 0)
-	err := p.ch.Find(bson.M{"user": name}).All(&i)
+	err := p.ch.Find(bson.M{"user": name}).Sort("_id").All(&i)
+	for k := 0; k != len(i); k++ {
+		i[k].Timestamp = i[k].ID.Time()
+	}
 	return &i, err
 }
 
-func (p *ItemDBProvider) CreateItem(itm *Item) (uint64, error) {
-	itm.EID = p.idgen.GenerateID()
+// CreateItem stores itm under a new id and records its creation by user
+func (p *ItemDBProvider) CreateItem(itm *Item, user string) (uint64, error) {
+	id, err := p.idgen.GenerateID()
+	if err != nil {
+		return 0, err
+	}
+	itm.EID = id
+	itm.Revision = 1
 	log.WithFields(log.Fields{"ID": itm.EID}).Debug("Generated ID")
+	err = p.c.Insert(itm)
+	if err != nil {
+		return 0, err
+	}
+	return itm.EID, p.chain.append(itm.snapshot(user, historyCreated))
+}
+
+// ReserveIDs allocates n consecutive item ids for ImportItem and returns the
+// first one
+func (p *ItemDBProvider) ReserveIDs(n uint64) (uint64, error) {
+	return p.idgen.ReserveIDs(n)
+}
+
+// LastID returns the last allocated item id
+func (p *ItemDBProvider) LastID() (uint64, error) {
+	return p.idgen.LastID()
+}
+
+// ImportItem stores itm under its EID, which has to be reserved with
+// ReserveIDs first
+func (p *ItemDBProvider) ImportItem(itm *Item) error {
+	if itm.EID == 0 {
+		return ErrInvalidID
+	}
 	err := p.c.Insert(itm)
-	return itm.EID, err
+	if mgo.IsDup(err) {
+		return ErrDuplicateID
+	}
+	return err
 }
 
-func (p *ItemDBProvider) ListItem() ([]Item, error) {
+// RestoreItem stores the deleted item itm under its old id and records ih
+func (p *ItemDBProvider) RestoreItem(itm *Item, ih *ItemHistory) error {
+	err := p.ImportItem(itm)
+	if err != nil {
+		return err
+	}
+	return p.chain.append(ih)
+}
+
+// ListItem returns the items selected by q and the total number of items
+// matching its filter. A nil query lists all items.
+func (p *ItemDBProvider) ListItem(q *Query) ([]Item, int, error) {
 	itm := make([]Item, 0)
-	err := p.c.Find(nil).All(&itm)
-	return itm, err
+	res, total, err := q.find(p.c)
+	if err != nil {
+		return itm, 0, err
+	}
+	err = res.All(&itm)
+	return itm, total, err
 }
 
+// UpdateItem replaces the stored item if it is still at itm.Revision and
+// increments the revision. Otherwise it fails with ErrRevisionConflict.
 func (p *ItemDBProvider) UpdateItem(itm *Item, ih *ItemHistory) error {
-	err := p.ch.Insert(ih)
+	rev := itm.Revision
+	itm.Revision++
+	err := p.c.Update(bson.M{"eid": itm.EID, "revision": revisionQuery(rev)}, itm)
 	if err != nil {
+		itm.Revision = rev
+		if err == mgo.ErrNotFound && p.CheckItemExistance(itm) {
+			return ErrRevisionConflict
+		}
 		return err
 	}
-	return p.c.Update(bson.M{"eid": itm.EID}, itm)
+	return p.chain.append(ih)
+}
+
+func (p *ItemDBProvider) AddImage(id uint64, ref bson.ObjectId, user string) (*ItemHistory, error) {
+	return p.addRef(id, "images", ref, user)
+}
+
+func (p *ItemDBProvider) RemoveImage(id uint64, ref bson.ObjectId, user string) (*ItemHistory, error) {
+	return p.removeRef(id, "images", ref, user)
+}
+
+func (p *ItemDBProvider) AddAttachment(id uint64, ref bson.ObjectId, user string) (*ItemHistory, error) {
+	return p.addRef(id, "attachments", ref, user)
+}
+
+func (p *ItemDBProvider) RemoveAttachment(id uint64, ref bson.ObjectId, user string) (*ItemHistory, error) {
+	return p.removeRef(id, "attachments", ref, user)
 }
 
-func (p *ItemDBProvider) AddImage(id uint64, ref bson.ObjectId, user string) error {
+// addRef adds ref to the id list field of item id and records this in the
+// item history. Nothing is recorded and the returned history is nil if ref
+// is in the list already.
+func (p *ItemDBProvider) addRef(id uint64, field string, ref bson.ObjectId, user string) (*ItemHistory, error) {
+	err := p.c.Update(bson.M{"eid": id, field: bson.M{"$ne": ref}},
+		bson.M{"$push": bson.M{field: ref}, "$inc": bson.M{"revision": 1}})
+	return p.refChanged(id, field, ref, dmp.DiffInsert, user, err)
+}
+
+// removeRef removes ref from the id list field of item id, like addRef
+func (p *ItemDBProvider) removeRef(id uint64, field string, ref bson.ObjectId, user string) (*ItemHistory, error) {
+	err := p.c.Update(bson.M{"eid": id, field: ref},
+		bson.M{"$pull": bson.M{field: ref}, "$inc": bson.M{"revision": 1}})
+	return p.refChanged(id, field, ref, dmp.DiffDelete, user, err)
+}
+
+// refChanged appends the change of ref to the history once the update of
+// addRef or removeRef, which failed with err, went through. An update which
+// matched nothing left the list as it was, unless the item is missing.
+func (p *ItemDBProvider) refChanged(id uint64, field string, ref bson.ObjectId, op dmp.Operation, user string, err error) (*ItemHistory, error) {
+	if err == mgo.ErrNotFound {
+		if !p.CheckItemExistance(&Item{EID: id}) {
+			return nil, ErrNotFound
+		}
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
 	ih := new(ItemHistory)
 	ih.User = user
 	ih.Timestamp = time.Now()
 	ih.Item = make(map[string]interface{})
 	ih.Item["eid"] = id
-	ih.Item["images"] = bson.M{hex.EncodeToString([]byte(ref)): dmp.DiffInsert}
-
-	err := p.ch.Insert(ih)
-	if err != nil {
-		log.Debug(err)
-		return err
-	}
-
-	return p.c.Update(bson.M{"eid": id}, bson.M{"$addToSet": bson.M{"images": ref}})
+	ih.Item[field] = bson.M{hex.EncodeToString([]byte(ref)): op}
+	return ih, p.chain.append(ih)
 }
 
-func (p *ItemDBProvider) RemoveImage(id uint64, ref bson.ObjectId, user string) error {
+// SetBorrower lends the item id to borrower until due, or marks it as
+// returned if borrower is empty, and records this in the item history.
+// Lending an item which is already lent fails with ErrItemLent.
+func (p *ItemDBProvider) SetBorrower(id uint64, borrower string, due time.Time, user string) (*ItemHistory, error) {
 	ih := new(ItemHistory)
 	ih.User = user
 	ih.Timestamp = time.Now()
 	ih.Item = make(map[string]interface{})
 	ih.Item["eid"] = id
-	ih.Item["images"] = bson.M{hex.EncodeToString([]byte(ref)): dmp.DiffDelete}
+	ih.Item["borrower"] = borrower
+	if !due.IsZero() {
+		ih.Item["due"] = due
+	}
 
-	err := p.ch.Insert(ih)
+	var err error
+	if borrower == "" {
+		err = p.c.Update(bson.M{"eid": id},
+			bson.M{"$unset": bson.M{"borrower": ""}, "$inc": bson.M{"revision": 1}})
+	} else {
+		err = p.c.Update(bson.M{"eid": id, "borrower": bson.M{"$exists": false}},
+			bson.M{"$set": bson.M{"borrower": borrower}, "$inc": bson.M{"revision": 1}})
+		if err == mgo.ErrNotFound && p.CheckItemExistance(&Item{EID: id}) {
+			return nil, ErrItemLent
+		}
+	}
 	if err != nil {
-		log.Debug(err)
-		return err
+		return nil, err
 	}
-	return p.c.Update(bson.M{"eid": id}, bson.M{"$pull": bson.M{"images": ref}})
+	return ih, p.chain.append(ih)
 }
 
 func (p *ItemDBProvider) CheckItemExistance(itm *Item) bool {
@@ -139,40 +266,101 @@ func (p *ItemDBProvider) CheckItemExistance(itm *Item) bool {
 	return true
 }
 
+// DeleteItem removes itm and its images if it is still at itm.Revision.
+// Otherwise it fails with ErrRevisionConflict. Failing to remove an image
+// does not fail the deletion.
 func (p *ItemDBProvider) DeleteItem(itm *Item, ih *ItemHistory) error {
-	err := p.ch.Insert(ih)
+	err := p.c.Remove(bson.M{"eid": itm.EID, "revision": revisionQuery(itm.Revision)})
+	if err != nil {
+		if err == mgo.ErrNotFound && p.CheckItemExistance(itm) {
+			return ErrRevisionConflict
+		}
+		return err
+	}
+	err = p.chain.append(ih)
 	if err != nil {
 		return err
 	}
 
-	for i := 0; i != len(itm.Images); i++ {
-		err := p.img.Remove(itm.Images[i])
+	removeImages(p.img, itm.Images)
+	return nil
+}
+
+// removeImages removes the images refs of a deleted item. The item is gone
+// already, so failures are only logged and the files left behind are found
+// by Fsck.
+func removeImages(img ImageProvider, refs []bson.ObjectId) {
+	for _, ref := range refs {
+		err := img.Remove(ref)
 		if err != nil {
-			return err
+			log.WithFields(log.Fields{"Image": ref.Hex(), "Err": err}).Warn("Could not remove image")
 		}
 	}
+}
 
-	return p.c.Remove(bson.M{"eid": itm.EID})
+// VerifyLog checks the hash chain of the item log
+func (p *ItemDBProvider) VerifyLog() (*AuditReport, error) {
+	docs := make([]bson.M, 0)
+	err := p.ch.Find(nil).All(&docs)
+	if err != nil {
+		return nil, err
+	}
+	return verifyLog("item_history", docs), nil
 }
 
 type Item struct {
-	ID          bson.ObjectId   `bson:"_id,omitempty" json:"-"`
-	EID         uint64          `json:"Id"`
-	Name        string          `bson:",omitempty"`
-	Description string          `bson:",omitempty" description:"This string should be in Github Flavored Markdown"`
-	Parent      uint64          `bson:",omitempty"`
-	Owner       string          `bson:",omitempty"`
-	Maintainer  string          `bson:",omitempty"`
-	Usage       string          `bson:",omitempty"`
-	Discard     string          `bson:",omitempty"`
-	Images      []bson.ObjectId `bson:",omitempty"`
+	ID          bson.ObjectId        `bson:"_id,omitempty" json:"-"`
+	EID         uint64               `json:"Id"`
+	Name        string               `bson:",omitempty"`
+	Description string               `bson:",omitempty" description:"This string should be in Github Flavored Markdown"`
+	Parent      uint64               `bson:",omitempty"`
+	Owner       string               `bson:",omitempty"`
+	Maintainer  string               `bson:",omitempty"`
+	Usage       string               `bson:",omitempty"`
+	Discard     string               `bson:",omitempty"`
+	Images      []bson.ObjectId      `bson:",omitempty"`
+	Attachments []bson.ObjectId      `bson:",omitempty" description:"Managed under /items/{id}/attachments"`
+	ImageInfo   map[string]ImageInfo `bson:",omitempty" json:",omitempty" description:"Captions, order and cover of the images keyed by image id. Managed under /items/{id}/images"`
+	Borrower    string               `bson:",omitempty" description:"The user who currently borrows this item. Managed by checkout and checkin"`
+	Revision    uint64               `bson:",omitempty" description:"Incremented on every change, the ETag of the item"`
+}
+
+// ImageInfo tells how an image of an item is presented
+type ImageInfo struct {
+	Caption string `bson:",omitempty" json:",omitempty"`
+	Alt     string `bson:",omitempty" json:",omitempty" description:"Text replacing the image for those who can't see it"`
+	Order   int    `bson:",omitempty" json:",omitempty" description:"Position among the images starting at 1, unordered images follow the others"`
+	Cover   bool   `bson:",omitempty" json:",omitempty" description:"The image representing the item, at most one image is the cover"`
+}
+
+// ItemImage is an image of an item with its presentation and metadata
+type ItemImage struct {
+	ID bson.ObjectId `json:"Id"`
+	ImageInfo
+	ImageMetadata
+}
+
+// SortedImages returns the images of i in the order they are presented.
+// Images without an order follow the others in the order they were added.
+func (i *Item) SortedImages() []ItemImage {
+	res := make([]ItemImage, len(i.Images))
+	for k, ref := range i.Images {
+		res[k].ID = ref
+		res[k].ImageInfo = i.ImageInfo[ref.Hex()]
+	}
+	sort.SliceStable(res, func(a, b int) bool {
+		oa, ob := res[a].Order, res[b].Order
+		return oa != 0 && (ob == 0 || oa < ob)
+	})
+	return res
 }
 
 type ItemHistory struct {
-	ID        bson.ObjectId `bson:"_id,omitempty" json:"-"`
+	ID        bson.ObjectId `bson:"_id,omitempty" json:"Id,omitempty"`
 	Timestamp time.Time     `bson:"-" json:",omitempty"`
 	User      string
 	Item      map[string]interface{}
+	AuditLink `bson:",inline"`
 }
 
 func (i *Item) NewItemHistory(it *Item, user string) *ItemHistory {
@@ -183,8 +371,7 @@ func (i *Item) NewItemHistory(it *Item, user string) *ItemHistory {
 	res.Timestamp = time.Now()
 
 	if it == nil {
-		res.Item["deleted"] = true
-		return res
+		return i.snapshot(user, historyDeleted)
 	}
 	//res.Item["_id"] = i.ID
 	if i.Name != it.Name {
@@ -210,9 +397,42 @@ func (i *Item) NewItemHistory(it *Item, user string) *ItemHistory {
 	if i.Discard != it.Discard {
 		res.Item["discard"] = it.Discard
 	}
+	if (len(i.ImageInfo) != 0 || len(it.ImageInfo) != 0) && !reflect.DeepEqual(i.ImageInfo, it.ImageInfo) {
+		res.Item["imageinfo"] = it.ImageInfo
+	}
 	return res
 }
 
+// snapshot records every field of i in a history entry marked with event
+func (i *Item) snapshot(user, event string) *ItemHistory {
+	res := (&Item{EID: i.EID}).NewItemHistory(i, user)
+	if len(i.Images) != 0 {
+		imgs := bson.M{}
+		for _, ref := range i.Images {
+			imgs[hex.EncodeToString([]byte(ref))] = dmp.DiffInsert
+		}
+		res.Item["images"] = imgs
+	}
+	if len(i.Attachments) != 0 {
+		atts := bson.M{}
+		for _, ref := range i.Attachments {
+			atts[hex.EncodeToString([]byte(ref))] = dmp.DiffInsert
+		}
+		res.Item["attachments"] = atts
+	}
+	if i.Borrower != "" {
+		res.Item["borrower"] = i.Borrower
+	}
+	res.Item[event] = true
+	res.Item[historySnapshot] = true
+	return res
+}
+
+// NewCreatedHistory returns the history entry CreateItem records for i
+func (i *Item) NewCreatedHistory(user string) *ItemHistory {
+	return i.snapshot(user, historyCreated)
+}
+
 func uint64Diff(u1, u2 []uint64) map[string]dmp.Operation {
 	// mgo.bson does only support strings as keys
 	res := make(map[string]dmp.Operation)
@@ -20,18 +20,32 @@
 package database
 
 import (
+	"errors"
 	log "github.com/Sirupsen/logrus"
 	"gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
-	"sync"
-	"time"
 )
 
+var (
+	ErrInvalidIDCount = errors.New("At least one id has to be reserved")
+	ErrInvalidID      = errors.New("Imported items need a reserved id")
+	ErrDuplicateID    = errors.New("An item with this id already exists")
+)
+
+// idSource hands out increasing item ids
+type idSource interface {
+	GenerateID() (uint64, error)
+	// ReserveIDs allocates n consecutive ids and returns the first one
+	ReserveIDs(n uint64) (uint64, error)
+	// LastID returns the last allocated id without allocating one
+	LastID() (uint64, error)
+}
+
+// idgenerator allocates item ids from a counters collection. Every
+// allocation is a single findAndModify with $inc, so any number of
+// generators, also in different processes, can share the collection.
 type idgenerator struct {
-	status chan int         // status channel, 1 triggers an exit
-	getID  chan chan uint64 // result channel channel lol
-	wg     sync.WaitGroup
-	c      *mgo.Collection
+	c *mgo.Collection
 }
 
 type counter struct {
@@ -40,79 +54,56 @@ type counter struct {
 	Count uint64
 }
 
-// NewIDGenerator starts a new goroutine, which generates new autoincrementing
-// IDs. Do not generate multiple instances of this object!
 func NewIDGenerator(c *mgo.Collection) *idgenerator {
-	res := idgenerator{make(chan int), make(chan chan uint64), *new(sync.WaitGroup), c}
-	go res.generateID()
-	res.wg.Add(1)
-	return &res
-}
-
-func (i *idgenerator) StopIDGenerator() {
-	i.status <- 1
-	i.wg.Wait()
+	res := new(idgenerator)
+	res.c = c
+	// two concurrent upserts on an empty collection must not create two
+	// counters
+	err := c.EnsureIndex(mgo.Index{Key: []string{"type_"}, Unique: true})
+	if err != nil {
+		log.WithFields(log.Fields{"Err": err}).Warn("Could not create counter index")
+	}
+	return res
 }
 
-func (i *idgenerator) ResetCounter() {
+func (i *idgenerator) ResetCounter() error {
 	err := i.c.DropCollection()
 	if err != nil && err.Error() != "ns not found" {
-		log.Panic(err.Error())
+		return err
 	}
+	return nil
 }
 
-// GenerateID is a blocking function to get a incrementing id
-func (i *idgenerator) GenerateID() uint64 {
-	res := make(chan uint64)
-	i.getID <- res
-	return <-res
+func (i *idgenerator) GenerateID() (uint64, error) {
+	return i.ReserveIDs(1)
 }
 
-func (i *idgenerator) generateID() {
-	defer i.wg.Done()
-	var x counter
-	//check if document exist
-	err := i.c.Find(bson.M{"type_": "item"}).One(&x)
+func (i *idgenerator) ReserveIDs(n uint64) (uint64, error) {
+	if n == 0 {
+		return 0, ErrInvalidIDCount
+	}
+	change := mgo.Change{
+		Update:    bson.M{"$inc": bson.M{"count": n}},
+		Upsert:    true,
+		ReturnNew: true,
+	}
+	var cnt counter
+	_, err := i.c.Find(bson.M{"type_": "item"}).Apply(change, &cnt)
+	if mgo.IsDup(err) {
+		// lost the race to create the counter, it exists now
+		_, err = i.c.Find(bson.M{"type_": "item"}).Apply(change, &cnt)
+	}
 	if err != nil {
-		if err.Error() != "not found" {
-			log.Panic(err)
-		} else {
-			log.Info("Empty Database found.")
-			i.c.Insert(&counter{"", "item", 0})
-		}
+		return 0, err
 	}
+	return cnt.Count - n + 1, nil
+}
 
-	hit := false
-
-	for {
-		select {
-		case _ = <-i.status:
-			return
-		default:
-			select {
-			case ret := <-i.getID:
-				hit = true
-				var temp counter
-				err := i.c.Find(bson.M{"type_": "item"}).One(&temp)
-				if err != nil {
-					log.Panic(err)
-				}
-				temp.Count++
-				err = i.c.Update(bson.M{"type_": "item"}, &temp)
-				if err != nil {
-					log.Panic(err)
-				}
-				ret <- temp.Count
-
-			default:
-			}
-
-		}
-		if !hit { // Process all request every 75 Millisecond to save CPU time
-			time.Sleep(75 * time.Millisecond)
-		} else {
-			hit = false
-		}
-
+func (i *idgenerator) LastID() (uint64, error) {
+	var cnt counter
+	err := i.c.Find(bson.M{"type_": "item"}).One(&cnt)
+	if err == mgo.ErrNotFound {
+		return 0, nil
 	}
+	return cnt.Count, err
 }
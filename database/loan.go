@@ -0,0 +1,119 @@
+/*
+ *    Copyright (C) 2015 Stefan Luecke
+ *
+ *    This program is free software: you can redistribute it and/or modify
+ *    it under the terms of the GNU Affero General Public License as published
+ *    by the Free Software Foundation, either version 3 of the License, or
+ *    (at your option) any later version.
+ *
+ *    This program is distributed in the hope that it will be useful,
+ *    but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *    GNU Affero General Public License for more details.
+ *
+ *    You should have received a copy of the GNU Affero General Public License
+ *    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ *    Authors: Stefan Luecke <glaxx@glaxx.net>
+ */
+
+package database
+
+import (
+	"errors"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"time"
+)
+
+const (
+	LoanRequested = "requested"
+	LoanActive    = "active"
+	LoanReturned  = "returned"
+	LoanRejected  = "rejected"
+)
+
+var ErrItemLent = errors.New("Item is already lent")
+
+type LoanDBProvider struct {
+	c *mgo.Collection
+}
+
+func NewLoanDBProvider(s *mgo.Session, dbname string) *LoanDBProvider {
+	res := new(LoanDBProvider)
+	res.c = s.DB(dbname).C("loan")
+	return res
+}
+
+// Loan records the lending of an item to a user. Loans of items whose usage
+// policy requires approval start in state requested, all others are active
+// right away.
+type Loan struct {
+	ID         bson.ObjectId `bson:"_id,omitempty" json:"Id"`
+	Item       uint64
+	Borrower   string
+	State      string
+	ApprovedBy string    `bson:",omitempty" json:",omitempty"`
+	Requested  time.Time `description:"Time the checkout was requested"`
+	Out        time.Time `bson:",omitempty" description:"Time the item left"`
+	Due        time.Time `bson:",omitempty" description:"Time the item has to be returned, if any"`
+	Returned   time.Time `bson:",omitempty"`
+}
+
+// overdueQuery restricts q to active loans past their due date
+func overdueQuery(q *Query) *Query {
+	o := Query{Filter: make(map[string]interface{})}
+	if q != nil {
+		o = *q
+		o.Filter = make(map[string]interface{})
+		for k, v := range q.Filter {
+			o.Filter[k] = v
+		}
+	}
+	o.Filter["state"] = LoanActive
+	o.Filter["due"] = bson.M{"$lt": time.Now(), "$gt": time.Time{}}
+	return &o
+}
+
+// Overdue reports whether l is active and past its due date
+func (l *Loan) Overdue(now time.Time) bool {
+	return l.State == LoanActive && !l.Due.IsZero() && l.Due.Before(now)
+}
+
+func (p *LoanDBProvider) CreateLoan(l *Loan) error {
+	l.ID = bson.NewObjectId()
+	return p.c.Insert(l)
+}
+
+func (p *LoanDBProvider) UpdateLoan(l *Loan) error {
+	return p.c.UpdateId(l.ID, l)
+}
+
+func (p *LoanDBProvider) GetLoanById(id bson.ObjectId) (Loan, error) {
+	res := Loan{}
+	err := p.c.FindId(id).One(&res)
+	return res, err
+}
+
+// GetCurrentLoan returns the active loan of the item id
+func (p *LoanDBProvider) GetCurrentLoan(id uint64) (Loan, error) {
+	res := Loan{}
+	err := p.c.Find(bson.M{"item": id, "state": LoanActive}).One(&res)
+	return res, err
+}
+
+// ListLoans returns the loans selected by q and the total number of loans
+// matching its filter. If overdue is set, only active loans past their due
+// date are considered.
+func (p *LoanDBProvider) ListLoans(q *Query, overdue bool) ([]Loan, int, error) {
+	l := make([]Loan, 0)
+	if overdue {
+		q = overdueQuery(q)
+	}
+	res, total, err := q.find(p.c)
+	if err != nil {
+		return l, 0, err
+	}
+	err = res.All(&l)
+	return l, total, err
+}
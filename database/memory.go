@@ -0,0 +1,593 @@
+/*
+ *    Copyright (C) 2015 Stefan Luecke
+ *
+ *    This program is free software: you can redistribute it and/or modify
+ *    it under the terms of the GNU Affero General Public License as published
+ *    by the Free Software Foundation, either version 3 of the License, or
+ *    (at your option) any later version.
+ *
+ *    This program is distributed in the hope that it will be useful,
+ *    but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *    GNU Affero General Public License for more details.
+ *
+ *    You should have received a copy of the GNU Affero General Public License
+ *    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ *    Authors: Stefan Luecke <glaxx@glaxx.net>
+ */
+
+package database
+
+import (
+	"bytes"
+	"fmt"
+	"gopkg.in/mgo.v2/bson"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// memCollection is the in-memory stand-in for a mongodb collection. The
+// documents are kept in their bson form, so queries see the same field names
+// and values as they would on a server. It supports the subset of the query
+// language the providers use: equality, $in, $ne, $lt, $lte, $gt, $gte,
+// $exists, $regex, $or and $and.
+type memCollection struct {
+	mu    sync.RWMutex
+	docs  []bson.M
+	store docStore // optional, receives every change before it is applied
+}
+
+// docStore persists the documents of a memCollection
+type docStore interface {
+	put(docs ...bson.M) error
+	delete(docs ...bson.M) error
+}
+
+// toDoc converts v to its bson document form
+func toDoc(v interface{}) (bson.M, error) {
+	data, err := bson.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	doc := bson.M{}
+	err = bson.Unmarshal(data, &doc)
+	return doc, err
+}
+
+// fromDoc stores doc in res, which has to be a pointer to a struct
+func fromDoc(doc bson.M, res interface{}) error {
+	data, err := bson.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	return bson.Unmarshal(data, res)
+}
+
+func (c *memCollection) insert(v interface{}) error {
+	doc, err := toDoc(v)
+	if err != nil {
+		return err
+	}
+	if _, ok := doc["_id"]; !ok {
+		doc["_id"] = bson.NewObjectId()
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.store != nil {
+		err = c.store.put(doc)
+		if err != nil {
+			return err
+		}
+	}
+	c.docs = append(c.docs, doc)
+	return nil
+}
+
+// find returns the documents matching filter in insertion order
+func (c *memCollection) find(filter bson.M) ([]bson.M, error) {
+	f, err := toDoc(filter)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	res := make([]bson.M, 0)
+	for _, d := range c.docs {
+		if memMatch(d, f) {
+			res = append(res, d)
+		}
+	}
+	return res, nil
+}
+
+func (c *memCollection) one(filter bson.M, res interface{}) error {
+	docs, err := c.find(filter)
+	if err != nil {
+		return err
+	}
+	if len(docs) == 0 {
+		return ErrNotFound
+	}
+	return fromDoc(docs[0], res)
+}
+
+// all stores the documents matching filter in res, which has to be a pointer
+// to a slice of structs. The documents are ordered by the sort keys.
+func (c *memCollection) all(filter bson.M, res interface{}, sortKeys ...string) error {
+	docs, err := c.find(filter)
+	if err != nil {
+		return err
+	}
+	memSort(docs, sortKeys)
+	return allDocs(docs, res)
+}
+
+// query is the in-memory counterpart of Query.find: it stores the page of
+// documents selected by q in res and returns the number of matching
+// documents.
+func (c *memCollection) query(q *Query, res interface{}) (int, error) {
+	if q == nil {
+		q = new(Query)
+	}
+	filter := bson.M{}
+	for k, v := range q.Filter {
+		filter[k] = v
+	}
+	docs, err := c.find(filter)
+	if err != nil {
+		return 0, err
+	}
+	total := len(docs)
+	memSort(docs, append(append([]string{}, q.Sort...), "_id"))
+	if q.Offset > 0 {
+		if q.Offset > len(docs) {
+			q.Offset = len(docs)
+		}
+		docs = docs[q.Offset:]
+	}
+	if q.Limit > 0 && q.Limit < len(docs) {
+		docs = docs[:q.Limit]
+	}
+	return total, allDocs(docs, res)
+}
+
+func allDocs(docs []bson.M, res interface{}) error {
+	sl := reflect.ValueOf(res).Elem()
+	sl.Set(reflect.MakeSlice(sl.Type(), 0, len(docs)))
+	for _, d := range docs {
+		e := reflect.New(sl.Type().Elem())
+		err := fromDoc(d, e.Interface())
+		if err != nil {
+			return err
+		}
+		sl.Set(reflect.Append(sl, e.Elem()))
+	}
+	return nil
+}
+
+// replace replaces the first document matching filter with v. Like mongodb
+// it keeps the _id of the document if v has none.
+func (c *memCollection) replace(filter bson.M, v interface{}) error {
+	f, err := toDoc(filter)
+	if err != nil {
+		return err
+	}
+	doc, err := toDoc(v)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, d := range c.docs {
+		if memMatch(d, f) {
+			if _, ok := doc["_id"]; !ok {
+				doc["_id"] = d["_id"]
+			}
+			if c.store != nil {
+				err = c.store.put(doc)
+				if err != nil {
+					return err
+				}
+			}
+			c.docs[i] = doc
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+// remove deletes the documents matching filter and returns how many there
+// were
+func (c *memCollection) remove(filter bson.M) (int, error) {
+	f, err := toDoc(filter)
+	if err != nil {
+		return 0, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.store != nil {
+		gone := make([]bson.M, 0)
+		for _, d := range c.docs {
+			if memMatch(d, f) {
+				gone = append(gone, d)
+			}
+		}
+		err = c.store.delete(gone...)
+		if err != nil {
+			return 0, err
+		}
+	}
+	kept := c.docs[:0]
+	for _, d := range c.docs {
+		if !memMatch(d, f) {
+			kept = append(kept, d)
+		}
+	}
+	n := len(c.docs) - len(kept)
+	for i := len(kept); i != len(c.docs); i++ {
+		c.docs[i] = nil
+	}
+	c.docs = kept
+	return n, nil
+}
+
+// removeOne is remove for a single document, reporting ErrNotFound if there
+// was none
+func (c *memCollection) removeOne(filter bson.M) error {
+	n, err := c.remove(filter)
+	if err == nil && n == 0 {
+		return ErrNotFound
+	}
+	return err
+}
+
+// memLookup returns the value of the dotted path key in doc
+func memLookup(doc bson.M, key string) (interface{}, bool) {
+	var cur interface{} = doc
+	for _, k := range strings.Split(key, ".") {
+		m, ok := cur.(bson.M)
+		if !ok {
+			return nil, false
+		}
+		cur, ok = m[k]
+		if !ok {
+			return nil, false
+		}
+	}
+	return cur, true
+}
+
+func memMatch(doc bson.M, filter bson.M) bool {
+	for k, cond := range filter {
+		switch k {
+		case "$or", "$and":
+			sub, _ := cond.([]interface{})
+			matched := false
+			for _, s := range sub {
+				m, _ := s.(bson.M)
+				ok := memMatch(doc, m)
+				if ok && k == "$or" {
+					matched = true
+					break
+				}
+				if !ok && k == "$and" {
+					return false
+				}
+			}
+			if k == "$or" && !matched {
+				return false
+			}
+		default:
+			v, exists := memLookup(doc, k)
+			if !memMatchValue(v, exists, cond) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func isOperatorDoc(m bson.M) bool {
+	for k := range m {
+		if !strings.HasPrefix(k, "$") {
+			return false
+		}
+	}
+	return len(m) != 0
+}
+
+func memMatchValue(v interface{}, exists bool, cond interface{}) bool {
+	ops, ok := cond.(bson.M)
+	if !ok || !isOperatorDoc(ops) {
+		return exists && memEqual(v, cond)
+	}
+	for op, arg := range ops {
+		switch op {
+		case "$exists":
+			if b, _ := arg.(bool); b != exists {
+				return false
+			}
+		case "$ne":
+			if exists && memEqual(v, arg) {
+				return false
+			}
+		case "$in":
+			args, _ := arg.([]interface{})
+			found := false
+			for _, a := range args {
+				if exists && memEqual(v, a) {
+					found = true
+					break
+				}
+			}
+			if !found {
+				return false
+			}
+		case "$lt", "$lte", "$gt", "$gte":
+			if !exists || !memComparable(v, arg) {
+				return false
+			}
+			c := memCompare(v, arg)
+			if (op == "$lt" && c >= 0) || (op == "$lte" && c > 0) ||
+				(op == "$gt" && c <= 0) || (op == "$gte" && c < 0) {
+				return false
+			}
+		case "$regex":
+			s, ok := v.(string)
+			if !exists || !ok {
+				return false
+			}
+			expr, _ := arg.(string)
+			if o, _ := ops["$options"].(string); strings.Contains(o, "i") {
+				expr = "(?i)" + expr
+			}
+			re, err := regexp.Compile(expr)
+			if err != nil || !re.MatchString(s) {
+				return false
+			}
+		case "$options":
+		default:
+			panic("memory backend: unsupported query operator " + op)
+		}
+	}
+	return true
+}
+
+// memEqual compares a document value with a query value. Like in mongodb a
+// query value matches an array if it matches one of its elements.
+func memEqual(v, q interface{}) bool {
+	if arr, ok := v.([]interface{}); ok {
+		if _, qarr := q.([]interface{}); !qarr {
+			for _, e := range arr {
+				if memEqual(e, q) {
+					return true
+				}
+			}
+			return false
+		}
+	}
+	if memComparable(v, q) {
+		return memCompare(v, q) == 0
+	}
+	return reflect.DeepEqual(v, q)
+}
+
+// memRank orders bson types the way mongodb sorts them
+func memRank(v interface{}) int {
+	switch v.(type) {
+	case nil:
+		return 1
+	case int, int32, int64, float64:
+		return 2
+	case string:
+		return 3
+	case bson.M:
+		return 4
+	case []interface{}:
+		return 5
+	case []byte:
+		return 6
+	case bson.ObjectId:
+		return 7
+	case bool:
+		return 8
+	case time.Time:
+		return 9
+	}
+	return 10
+}
+
+func memComparable(a, b interface{}) bool {
+	ra := memRank(a)
+	return ra == memRank(b) && ra != 4 && ra != 5 && ra != 10
+}
+
+func memFloat(v interface{}) float64 {
+	switch n := v.(type) {
+	case int:
+		return float64(n)
+	case int32:
+		return float64(n)
+	case int64:
+		return float64(n)
+	case float64:
+		return n
+	}
+	return 0
+}
+
+// memCompare returns -1, 0 or 1 if a is less than, equal to or greater than
+// b in mongodb sort order
+func memCompare(a, b interface{}) int {
+	ra, rb := memRank(a), memRank(b)
+	if ra != rb {
+		if ra < rb {
+			return -1
+		}
+		return 1
+	}
+	switch x := a.(type) {
+	case int, int32, int64, float64:
+		fa, fb := memFloat(a), memFloat(b)
+		if fa < fb {
+			return -1
+		} else if fa > fb {
+			return 1
+		}
+		return 0
+	case string:
+		return strings.Compare(x, b.(string))
+	case []byte:
+		return bytes.Compare(x, b.([]byte))
+	case bson.ObjectId:
+		return strings.Compare(string(x), string(b.(bson.ObjectId)))
+	case bool:
+		if x == b.(bool) {
+			return 0
+		} else if !x {
+			return -1
+		}
+		return 1
+	case time.Time:
+		y := b.(time.Time)
+		if x.Before(y) {
+			return -1
+		} else if x.After(y) {
+			return 1
+		}
+		return 0
+	case nil:
+		return 0
+	}
+	return strings.Compare(fmt.Sprint(a), fmt.Sprint(b))
+}
+
+// memSort orders docs by keys, which are field names optionally prefixed
+// with - for descending order. Missing fields sort first.
+func memSort(docs []bson.M, keys []string) {
+	sort.SliceStable(docs, func(i, j int) bool {
+		for _, k := range keys {
+			desc := strings.HasPrefix(k, "-")
+			k = strings.TrimPrefix(k, "-")
+			a, _ := memLookup(docs[i], k)
+			b, _ := memLookup(docs[j], k)
+			c := memCompare(a, b)
+			if c == 0 {
+				continue
+			}
+			return (c < 0) != desc
+		}
+		return false
+	})
+}
+
+// memTextSearch scores docs against a text search term the way a mongodb
+// text index with the given field weights and language none would: a
+// document matches if it contains one of the words (and all quoted phrases
+// and none of the negated words) and scores the weighted number of matching
+// words. It returns the indices of the matching documents, best first, and
+// their scores.
+func memTextSearch(docs []bson.M, term string, weights map[string]int) ([]int, []float64) {
+	words, phrases, negated := parseTextSearch(term)
+	idx := make([]int, 0)
+	scores := make(map[int]float64)
+	for i, d := range docs {
+		text := ""
+		score := 0.0
+		for f, w := range weights {
+			s, _ := memLookup(d, f)
+			t, _ := s.(string)
+			text += " " + t
+			for _, tw := range textWords(t) {
+				for _, q := range words {
+					if tw == q {
+						score += float64(w)
+					}
+				}
+			}
+		}
+		lower := strings.ToLower(text)
+		ok := score > 0
+		for _, p := range phrases {
+			ok = ok && strings.Contains(lower, p)
+		}
+		for _, tw := range textWords(text) {
+			for _, n := range negated {
+				if tw == n {
+					ok = false
+				}
+			}
+		}
+		if ok {
+			idx = append(idx, i)
+			scores[i] = score
+		}
+	}
+	sort.SliceStable(idx, func(a, b int) bool { return scores[idx[a]] > scores[idx[b]] })
+	res := make([]float64, len(idx))
+	for i := range idx {
+		res[i] = scores[idx[i]]
+	}
+	return idx, res
+}
+
+// parseTextSearch splits a text search string into lower case words,
+// quoted phrases and negated words. The words of phrases count as words.
+func parseTextSearch(term string) (words, phrases, negated []string) {
+	parts := strings.Split(strings.ToLower(term), "\"")
+	for i, p := range parts {
+		if i%2 == 1 {
+			if p = strings.TrimSpace(p); p != "" {
+				phrases = append(phrases, p)
+				words = append(words, textWords(p)...)
+			}
+			continue
+		}
+		for _, w := range strings.Fields(p) {
+			if strings.HasPrefix(w, "-") {
+				negated = append(negated, textWords(w)...)
+			} else {
+				words = append(words, textWords(w)...)
+			}
+		}
+	}
+	return words, phrases, negated
+}
+
+func textWords(t string) []string {
+	return strings.FieldsFunc(strings.ToLower(t), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
+
+// memIDGenerator is the idSource of the in-memory backend
+type memIDGenerator struct {
+	mu   sync.Mutex
+	last uint64
+}
+
+func (g *memIDGenerator) GenerateID() (uint64, error) {
+	return g.ReserveIDs(1)
+}
+
+func (g *memIDGenerator) ReserveIDs(n uint64) (uint64, error) {
+	if n == 0 {
+		return 0, ErrInvalidIDCount
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.last += n
+	return g.last - n + 1, nil
+}
+
+func (g *memIDGenerator) LastID() (uint64, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.last, nil
+}
@@ -0,0 +1,560 @@
+/*
+ *    Copyright (C) 2015 Stefan Luecke
+ *
+ *    This program is free software: you can redistribute it and/or modify
+ *    it under the terms of the GNU Affero General Public License as published
+ *    by the Free Software Foundation, either version 3 of the License, or
+ *    (at your option) any later version.
+ *
+ *    This program is distributed in the hope that it will be useful,
+ *    but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *    GNU Affero General Public License for more details.
+ *
+ *    You should have received a copy of the GNU Affero General Public License
+ *    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ *    Authors: Stefan Luecke <glaxx@glaxx.net>
+ */
+
+package database
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	dmp "github.com/sergi/go-diff/diffmatchpatch"
+	"gopkg.in/mgo.v2/bson"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ItemMemProvider is the in-memory implementation of ItemProvider
+type ItemMemProvider struct {
+	c     *memCollection
+	ch    *memCollection
+	chain *memChain
+	img   ImageProvider
+	idgen idSource
+	mu    sync.Mutex // serializes writes
+}
+
+func NewItemMemProvider(img ImageProvider) *ItemMemProvider {
+	res := new(ItemMemProvider)
+	res.c = new(memCollection)
+	res.ch = new(memCollection)
+	res.chain = &memChain{c: res.ch}
+	res.img = img
+	res.idgen = new(memIDGenerator)
+	return res
+}
+
+func (p *ItemMemProvider) Stop() {}
+
+func (p *ItemMemProvider) GetItemById(id uint64) (Item, error) {
+	res := Item{}
+	err := p.c.one(bson.M{"eid": id}, &res)
+	return res, err
+}
+
+func (p *ItemMemProvider) GetItemLog(id uint64) ([]ItemHistory, error) {
+	res := make([]ItemHistory, 0)
+	err := p.ch.all(bson.M{"item.eid": id}, &res)
+	for i := 0; i != len(res); i++ {
+		res[i].Timestamp = res[i].ID.Time()
+	}
+	return res, err
+}
+
+func (p *ItemMemProvider) GetItemLogByUsername(name string) (*[]ItemHistory, error) {
+	i := make([]ItemHistory, 0)
+	err := p.ch.all(bson.M{"user": name}, &i)
+	for k := 0; k != len(i); k++ {
+		i[k].Timestamp = i[k].ID.Time()
+	}
+	return &i, err
+}
+
+func (p *ItemMemProvider) CreateItem(itm *Item, user string) (uint64, error) {
+	id, err := p.idgen.GenerateID()
+	if err != nil {
+		return 0, err
+	}
+	itm.EID = id
+	itm.Revision = 1
+	err = p.c.insert(itm)
+	if err != nil {
+		return 0, err
+	}
+	return itm.EID, p.chain.append(itm.snapshot(user, historyCreated))
+}
+
+func (p *ItemMemProvider) ReserveIDs(n uint64) (uint64, error) {
+	return p.idgen.ReserveIDs(n)
+}
+
+func (p *ItemMemProvider) LastID() (uint64, error) {
+	return p.idgen.LastID()
+}
+
+func (p *ItemMemProvider) ImportItem(itm *Item) error {
+	if itm.EID == 0 {
+		return ErrInvalidID
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.CheckItemExistance(itm) {
+		return ErrDuplicateID
+	}
+	return p.c.insert(itm)
+}
+
+func (p *ItemMemProvider) RestoreItem(itm *Item, ih *ItemHistory) error {
+	err := p.ImportItem(itm)
+	if err != nil {
+		return err
+	}
+	return p.chain.append(ih)
+}
+
+func (p *ItemMemProvider) VerifyLog() (*AuditReport, error) {
+	docs, err := p.ch.find(bson.M{})
+	if err != nil {
+		return nil, err
+	}
+	return verifyLog("item_history", docs), nil
+}
+
+func (p *ItemMemProvider) ListItem(q *Query) ([]Item, int, error) {
+	itm := make([]Item, 0)
+	total, err := p.c.query(q, &itm)
+	return itm, total, err
+}
+
+func (p *ItemMemProvider) UpdateItem(itm *Item, ih *ItemHistory) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	cur, err := p.GetItemById(itm.EID)
+	if err != nil {
+		return err
+	}
+	if cur.Revision != itm.Revision {
+		return ErrRevisionConflict
+	}
+	itm.Revision++
+	err = p.c.replace(bson.M{"eid": itm.EID}, itm)
+	if err != nil {
+		itm.Revision--
+		return err
+	}
+	return p.chain.append(ih)
+}
+
+// modify applies f to the stored item id
+func (p *ItemMemProvider) modify(id uint64, f func(itm *Item) error) error {
+	itm := Item{}
+	err := p.c.one(bson.M{"eid": id}, &itm)
+	if err != nil {
+		return err
+	}
+	err = f(&itm)
+	if err != nil {
+		return err
+	}
+	itm.Revision++
+	return p.c.replace(bson.M{"eid": id}, &itm)
+}
+
+func (p *ItemMemProvider) AddImage(id uint64, ref bson.ObjectId, user string) (*ItemHistory, error) {
+	return p.addRef(id, "images", ref, user, func(itm *Item) *[]bson.ObjectId { return &itm.Images })
+}
+
+func (p *ItemMemProvider) RemoveImage(id uint64, ref bson.ObjectId, user string) (*ItemHistory, error) {
+	return p.removeRef(id, "images", ref, user, func(itm *Item) *[]bson.ObjectId { return &itm.Images })
+}
+
+func (p *ItemMemProvider) AddAttachment(id uint64, ref bson.ObjectId, user string) (*ItemHistory, error) {
+	return p.addRef(id, "attachments", ref, user, func(itm *Item) *[]bson.ObjectId { return &itm.Attachments })
+}
+
+func (p *ItemMemProvider) RemoveAttachment(id uint64, ref bson.ObjectId, user string) (*ItemHistory, error) {
+	return p.removeRef(id, "attachments", ref, user, func(itm *Item) *[]bson.ObjectId { return &itm.Attachments })
+}
+
+// errUnchanged stops modify if the item would stay as it is
+var errUnchanged = errors.New("unchanged")
+
+// addRef adds ref to the id list field of item id, which refs returns, and
+// records this in the item history. Nothing is recorded and the returned
+// history is nil if ref is in the list already.
+func (p *ItemMemProvider) addRef(id uint64, field string, ref bson.ObjectId, user string, refs func(*Item) *[]bson.ObjectId) (*ItemHistory, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	err := p.modify(id, func(itm *Item) error {
+		l := refs(itm)
+		for _, i := range *l {
+			if i == ref {
+				return errUnchanged
+			}
+		}
+		*l = append(*l, ref)
+		return nil
+	})
+	return p.refChanged(id, field, ref, dmp.DiffInsert, user, err)
+}
+
+// removeRef removes ref from the id list field of item id, like addRef
+func (p *ItemMemProvider) removeRef(id uint64, field string, ref bson.ObjectId, user string, refs func(*Item) *[]bson.ObjectId) (*ItemHistory, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	err := p.modify(id, func(itm *Item) error {
+		l := refs(itm)
+		kept := (*l)[:0]
+		for _, i := range *l {
+			if i != ref {
+				kept = append(kept, i)
+			}
+		}
+		if len(kept) == len(*l) {
+			return errUnchanged
+		}
+		*l = kept
+		return nil
+	})
+	return p.refChanged(id, field, ref, dmp.DiffDelete, user, err)
+}
+
+// refChanged appends the change of ref to the history once the modification
+// of addRef or removeRef, which failed with err, went through
+func (p *ItemMemProvider) refChanged(id uint64, field string, ref bson.ObjectId, op dmp.Operation, user string, err error) (*ItemHistory, error) {
+	if err == errUnchanged {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	ih := &ItemHistory{User: user, Timestamp: time.Now(), Item: map[string]interface{}{
+		"eid": id,
+		field: bson.M{hex.EncodeToString([]byte(ref)): op},
+	}}
+	return ih, p.chain.append(ih)
+}
+
+func (p *ItemMemProvider) SetBorrower(id uint64, borrower string, due time.Time, user string) (*ItemHistory, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	ih := &ItemHistory{User: user, Timestamp: time.Now(), Item: map[string]interface{}{
+		"eid":      id,
+		"borrower": borrower,
+	}}
+	if !due.IsZero() {
+		ih.Item["due"] = due
+	}
+	err := p.modify(id, func(itm *Item) error {
+		if borrower != "" && itm.Borrower != "" {
+			return ErrItemLent
+		}
+		itm.Borrower = borrower
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ih, p.chain.append(ih)
+}
+
+func (p *ItemMemProvider) CheckItemExistance(itm *Item) bool {
+	_, err := p.GetItemById(itm.EID)
+	return err == nil
+}
+
+func (p *ItemMemProvider) DeleteItem(itm *Item, ih *ItemHistory) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	cur, err := p.GetItemById(itm.EID)
+	if err != nil {
+		return err
+	}
+	if cur.Revision != itm.Revision {
+		return ErrRevisionConflict
+	}
+	err = p.c.removeOne(bson.M{"eid": itm.EID})
+	if err != nil {
+		return err
+	}
+	err = p.chain.append(ih)
+	if err != nil {
+		return err
+	}
+	removeImages(p.img, itm.Images)
+	return nil
+}
+
+func (p *ItemMemProvider) CheckParent(id, parent uint64) error {
+	return checkParent(p, id, parent)
+}
+
+func (p *ItemMemProvider) GetChildren(id uint64) ([]Item, error) {
+	res := make([]Item, 0)
+	err := p.c.all(bson.M{"parent": id}, &res, "name", "eid")
+	return res, err
+}
+
+func (p *ItemMemProvider) GetAncestors(id uint64) ([]Item, error) {
+	return getAncestors(p, id)
+}
+
+func (p *ItemMemProvider) GetItemTree(id uint64) (*ItemTree, error) {
+	return getItemTree(p, id)
+}
+
+func (p *ItemMemProvider) Search(term string, limit int) ([]SearchResult, int, error) {
+	docs, err := p.c.find(bson.M{})
+	if err != nil {
+		return nil, 0, err
+	}
+	idx, scores := memTextSearch(docs, term, map[string]int{"name": 10, "description": 1})
+	res := make([]SearchResult, 0, len(idx))
+	for i := 0; i != len(idx) && (limit <= 0 || i < limit); i++ {
+		itm := Item{}
+		err = fromDoc(docs[idx[i]], &itm)
+		if err != nil {
+			return nil, 0, err
+		}
+		res = append(res, itemResult(term, &itm, scores[i]))
+	}
+	return res, len(idx), nil
+}
+
+// ImageMemProvider is the in-memory implementation of ImageProvider
+type ImageMemProvider struct {
+	mu         sync.RWMutex
+	images     map[bson.ObjectId]memImage
+	renditions map[string]memImage
+}
+
+type memImage struct {
+	data        []byte
+	contentType string
+	meta        ImageMetadata
+}
+
+func NewImageMemProvider() *ImageMemProvider {
+	res := new(ImageMemProvider)
+	res.images = make(map[bson.ObjectId]memImage)
+	res.renditions = make(map[string]memImage)
+	return res
+}
+
+func (p *ImageMemProvider) Create(data io.Reader, user, contentType string, obj uint64) (bson.ObjectId, error) {
+	buf := new(bytes.Buffer)
+	_, err := buf.ReadFrom(data)
+	if err != nil {
+		return "", err
+	}
+	id := bson.NewObjectId()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.images[id] = memImage{buf.Bytes(), contentType, *newImageMetadata(buf.Bytes(), user, obj)}
+	return id, nil
+}
+
+func (p *ImageMemProvider) Remove(obj bson.ObjectId) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	// like GridFS, removing a missing file is no error
+	delete(p.images, obj)
+	for name := range p.renditions {
+		if strings.HasPrefix(name, renditionName(obj, "")) {
+			delete(p.renditions, name)
+		}
+	}
+	return nil
+}
+
+func (p *ImageMemProvider) GetRendition(obj bson.ObjectId, size string) (*bytes.Buffer, string, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	img, ok := p.renditions[renditionName(obj, size)]
+	if !ok {
+		return nil, "", ErrNotFound
+	}
+	return bytes.NewBuffer(append([]byte{}, img.data...)), img.contentType, nil
+}
+
+func (p *ImageMemProvider) CreateRendition(data io.Reader, contentType string, obj bson.ObjectId, size string) error {
+	buf := new(bytes.Buffer)
+	_, err := buf.ReadFrom(data)
+	if err != nil {
+		return err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.images[obj]; !ok {
+		return ErrNotFound
+	}
+	p.renditions[renditionName(obj, size)] = memImage{buf.Bytes(), contentType, ImageMetadata{}}
+	return nil
+}
+
+func (p *ImageMemProvider) GetImageById(obj bson.ObjectId) (*bytes.Buffer, string, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	img, ok := p.images[obj]
+	if !ok {
+		return nil, "", ErrNotFound
+	}
+	return bytes.NewBuffer(append([]byte{}, img.data...)), img.contentType, nil
+}
+
+func (p *ImageMemProvider) OpenImage(obj bson.ObjectId) (ImageFile, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	img, ok := p.images[obj]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	// stored images are never changed, so the data can be shared
+	return newMemImageFile(img.data, img.contentType, obj), nil
+}
+
+// memImageFile is an ImageFile of data held in memory
+type memImageFile struct {
+	*bytes.Reader
+	contentType string
+	uploadDate  time.Time
+	md5         string
+}
+
+func newMemImageFile(data []byte, contentType string, obj bson.ObjectId) *memImageFile {
+	res := new(memImageFile)
+	res.Reader = bytes.NewReader(data)
+	res.contentType = contentType
+	res.uploadDate = obj.Time()
+	sum := md5.Sum(data)
+	res.md5 = hex.EncodeToString(sum[:])
+	return res
+}
+
+func (f *memImageFile) ContentType() string {
+	return f.contentType
+}
+
+func (f *memImageFile) UploadDate() time.Time {
+	return f.uploadDate
+}
+
+func (f *memImageFile) MD5() string {
+	return f.md5
+}
+
+func (f *memImageFile) Close() error {
+	return nil
+}
+
+func (p *ImageMemProvider) GetImageMetadataById(obj bson.ObjectId) (*ImageMetadata, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	img, ok := p.images[obj]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	meta := img.meta
+	return &meta, nil
+}
+
+func (p *ImageMemProvider) Delete(obj bson.ObjectId) error {
+	return p.Remove(obj)
+}
+
+func (p *ImageMemProvider) ListImages() ([]FileRef, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	res := make([]FileRef, 0, len(p.images))
+	for id, img := range p.images {
+		res = append(res, FileRef{id, img.meta.ItmRef})
+	}
+	return res, nil
+}
+
+// AttachmentMemProvider is the in-memory implementation of
+// AttachmentProvider
+type AttachmentMemProvider struct {
+	mu          sync.RWMutex
+	attachments map[bson.ObjectId]memAttachment
+}
+
+type memAttachment struct {
+	data []byte
+	meta Attachment
+}
+
+func NewAttachmentMemProvider() *AttachmentMemProvider {
+	res := new(AttachmentMemProvider)
+	res.attachments = make(map[bson.ObjectId]memAttachment)
+	return res
+}
+
+func (p *AttachmentMemProvider) Create(data io.Reader, a *Attachment) error {
+	buf := new(bytes.Buffer)
+	_, err := buf.ReadFrom(data)
+	if err != nil {
+		return err
+	}
+	a.ID = bson.NewObjectId()
+	setAttachmentData(a, buf.Bytes())
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.attachments[a.ID] = memAttachment{buf.Bytes(), *a}
+	return nil
+}
+
+// setAttachmentData sets the fields of a describing its data
+func setAttachmentData(a *Attachment, data []byte) {
+	a.Size = int64(len(data))
+	sum := sha256.Sum256(data)
+	a.SHA256 = hex.EncodeToString(sum[:])
+	a.Uploaded = time.Now()
+}
+
+func (p *AttachmentMemProvider) GetAttachmentById(obj bson.ObjectId) (*Attachment, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	att, ok := p.attachments[obj]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	meta := att.meta
+	return &meta, nil
+}
+
+func (p *AttachmentMemProvider) OpenAttachment(obj bson.ObjectId) (ImageFile, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	att, ok := p.attachments[obj]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return newMemImageFile(att.data, att.meta.ContentType, obj), nil
+}
+
+func (p *AttachmentMemProvider) Remove(obj bson.ObjectId) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.attachments, obj)
+	return nil
+}
+
+func (p *AttachmentMemProvider) ListAttachments() ([]FileRef, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	res := make([]FileRef, 0, len(p.attachments))
+	for id, att := range p.attachments {
+		res = append(res, FileRef{id, att.meta.ItmRef})
+	}
+	return res, nil
+}
@@ -0,0 +1,131 @@
+/*
+ *    Copyright (C) 2015 Stefan Luecke
+ *
+ *    This program is free software: you can redistribute it and/or modify
+ *    it under the terms of the GNU Affero General Public License as published
+ *    by the Free Software Foundation, either version 3 of the License, or
+ *    (at your option) any later version.
+ *
+ *    This program is distributed in the hope that it will be useful,
+ *    but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *    GNU Affero General Public License for more details.
+ *
+ *    You should have received a copy of the GNU Affero General Public License
+ *    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ *    Authors: Stefan Luecke <glaxx@glaxx.net>
+ */
+
+package database
+
+import (
+	"gopkg.in/mgo.v2/bson"
+	"sync"
+	"time"
+)
+
+// LoanMemProvider is the in-memory implementation of LoanProvider
+type LoanMemProvider struct {
+	c *memCollection
+}
+
+func NewLoanMemProvider() *LoanMemProvider {
+	res := new(LoanMemProvider)
+	res.c = new(memCollection)
+	return res
+}
+
+func (p *LoanMemProvider) CreateLoan(l *Loan) error {
+	l.ID = bson.NewObjectId()
+	return p.c.insert(l)
+}
+
+func (p *LoanMemProvider) UpdateLoan(l *Loan) error {
+	return p.c.replace(bson.M{"_id": l.ID}, l)
+}
+
+func (p *LoanMemProvider) GetLoanById(id bson.ObjectId) (Loan, error) {
+	res := Loan{}
+	err := p.c.one(bson.M{"_id": id}, &res)
+	return res, err
+}
+
+func (p *LoanMemProvider) GetCurrentLoan(id uint64) (Loan, error) {
+	res := Loan{}
+	err := p.c.one(bson.M{"item": id, "state": LoanActive}, &res)
+	return res, err
+}
+
+func (p *LoanMemProvider) ListLoans(q *Query, overdue bool) ([]Loan, int, error) {
+	l := make([]Loan, 0)
+	if overdue {
+		q = overdueQuery(q)
+	}
+	total, err := p.c.query(q, &l)
+	return l, total, err
+}
+
+// ReservationMemProvider is the in-memory implementation of
+// ReservationProvider
+type ReservationMemProvider struct {
+	c  *memCollection
+	mu sync.Mutex // makes conflict checks and writes atomic
+}
+
+func NewReservationMemProvider() *ReservationMemProvider {
+	res := new(ReservationMemProvider)
+	res.c = new(memCollection)
+	return res
+}
+
+func (p *ReservationMemProvider) checkConflict(r *Reservation) error {
+	if !r.End.After(r.Start) {
+		return ErrReservationInvalid
+	}
+	c, err := p.c.find(conflictQuery(r))
+	if err != nil {
+		return err
+	}
+	if len(c) != 0 {
+		return ErrReservationConflict
+	}
+	return nil
+}
+
+func (p *ReservationMemProvider) CreateReservation(r *Reservation) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	err := p.checkConflict(r)
+	if err != nil {
+		return err
+	}
+	r.ID = bson.NewObjectId()
+	return p.c.insert(r)
+}
+
+func (p *ReservationMemProvider) UpdateReservation(r *Reservation) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	err := p.checkConflict(r)
+	if err != nil {
+		return err
+	}
+	return p.c.replace(bson.M{"_id": r.ID}, r)
+}
+
+func (p *ReservationMemProvider) DeleteReservation(id bson.ObjectId) error {
+	return p.c.removeOne(bson.M{"_id": id})
+}
+
+func (p *ReservationMemProvider) GetReservationById(id bson.ObjectId) (Reservation, error) {
+	res := Reservation{}
+	err := p.c.one(bson.M{"_id": id}, &res)
+	return res, err
+}
+
+func (p *ReservationMemProvider) GetReservations(item uint64, user string, from, to time.Time) ([]Reservation, error) {
+	res := make([]Reservation, 0)
+	err := p.c.all(reservationQuery(item, user, from, to), &res, "start")
+	return res, err
+}
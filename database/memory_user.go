@@ -0,0 +1,330 @@
+/*
+ *    Copyright (C) 2015 Stefan Luecke
+ *
+ *    This program is free software: you can redistribute it and/or modify
+ *    it under the terms of the GNU Affero General Public License as published
+ *    by the Free Software Foundation, either version 3 of the License, or
+ *    (at your option) any later version.
+ *
+ *    This program is distributed in the hope that it will be useful,
+ *    but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *    GNU Affero General Public License for more details.
+ *
+ *    You should have received a copy of the GNU Affero General Public License
+ *    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ *    Authors: Stefan Luecke <glaxx@glaxx.net>
+ */
+
+package database
+
+import (
+	"gopkg.in/mgo.v2/bson"
+	"sync"
+	"time"
+)
+
+// PolicyMemProvider is the in-memory implementation of PolicyProvider
+type PolicyMemProvider struct {
+	c     *memCollection
+	ch    *memCollection
+	chain *memChain
+	mu    sync.Mutex // serializes writes
+}
+
+func NewPolicyMemProvider() *PolicyMemProvider {
+	res := new(PolicyMemProvider)
+	res.c = new(memCollection)
+	res.ch = new(memCollection)
+	res.chain = &memChain{c: res.ch}
+	return res
+}
+
+func (p *PolicyMemProvider) GetPolicyByName(name string) (Policy, error) {
+	res := Policy{}
+	err := p.c.one(bson.M{"name": name}, &res)
+	return res, err
+}
+
+func (p *PolicyMemProvider) GetPolicyLog(name string) ([]PolicyHistory, error) {
+	res := make([]PolicyHistory, 0)
+	err := p.ch.all(bson.M{"policy.name": name}, &res)
+	for i := 0; i != len(res); i++ {
+		res[i].Timestamp = res[i].ID.Time()
+	}
+	return res, err
+}
+
+func (p *PolicyMemProvider) GetPolicyLogByUsername(name string) (*[]PolicyHistory, error) {
+	ph := make([]PolicyHistory, 0)
+	err := p.ch.all(bson.M{"user": name}, &ph)
+	for i := 0; i != len(ph); i++ {
+		ph[i].Timestamp = ph[i].ID.Time()
+	}
+	return &ph, err
+}
+
+func (p *PolicyMemProvider) ListPolicy(q *Query) ([]Policy, int, error) {
+	pol := make([]Policy, 0)
+	total, err := p.c.query(q, &pol)
+	return pol, total, err
+}
+
+func (p *PolicyMemProvider) UpdatePolicy(pol *Policy, ph *PolicyHistory) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	cur, err := p.GetPolicyByName(pol.Name)
+	if err != nil {
+		return err
+	}
+	if cur.Revision != pol.Revision {
+		return ErrRevisionConflict
+	}
+	pol.Revision++
+	err = p.c.replace(bson.M{"name": pol.Name}, pol)
+	if err != nil {
+		pol.Revision--
+		return err
+	}
+	return p.chain.append(ph)
+}
+
+func (p *PolicyMemProvider) CheckPolicyExistance(pol *Policy) bool {
+	_, err := p.GetPolicyByName(pol.Name)
+	return err == nil
+}
+
+func (p *PolicyMemProvider) CreatePolicy(pol *Policy, user string) error {
+	pol.Revision = 1
+	err := p.c.insert(pol)
+	if err != nil {
+		return err
+	}
+	return p.chain.append(pol.snapshot(user, historyCreated))
+}
+
+func (p *PolicyMemProvider) RestorePolicy(pol *Policy, ph *PolicyHistory) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.CheckPolicyExistance(pol) {
+		return ErrRevertConflict
+	}
+	err := p.c.insert(pol)
+	if err != nil {
+		return err
+	}
+	return p.chain.append(ph)
+}
+
+func (p *PolicyMemProvider) DeletePolicy(pol *Policy, ph *PolicyHistory) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	cur, err := p.GetPolicyByName(pol.Name)
+	if err != nil {
+		return err
+	}
+	if cur.Revision != pol.Revision {
+		return ErrRevisionConflict
+	}
+	err = p.c.removeOne(bson.M{"name": pol.Name})
+	if err != nil {
+		return err
+	}
+	return p.chain.append(ph)
+}
+
+func (p *PolicyMemProvider) VerifyLog() (*AuditReport, error) {
+	docs, err := p.ch.find(bson.M{})
+	if err != nil {
+		return nil, err
+	}
+	return verifyLog("policy_history", docs), nil
+}
+
+func (p *PolicyMemProvider) Search(term string, limit int) ([]SearchResult, int, error) {
+	docs, err := p.c.find(bson.M{})
+	if err != nil {
+		return nil, 0, err
+	}
+	idx, scores := memTextSearch(docs, term, map[string]int{"name": 10, "description": 1})
+	res := make([]SearchResult, 0, len(idx))
+	for i := 0; i != len(idx) && (limit <= 0 || i < limit); i++ {
+		pol := Policy{}
+		err = fromDoc(docs[idx[i]], &pol)
+		if err != nil {
+			return nil, 0, err
+		}
+		res = append(res, policyResult(term, &pol, scores[i]))
+	}
+	return res, len(idx), nil
+}
+
+// UserMemProvider is the in-memory implementation of UserProvider
+type UserMemProvider struct {
+	c  *memCollection
+	i  ItemProvider
+	p  PolicyProvider
+	mu sync.Mutex // serializes writes
+}
+
+func NewUserMemProvider(i ItemProvider, p PolicyProvider) *UserMemProvider {
+	res := new(UserMemProvider)
+	res.c = new(memCollection)
+	res.i = i
+	res.p = p
+	return res
+}
+
+func (p *UserMemProvider) GetUserByName(name string) (User, error) {
+	res := User{}
+	err := p.c.one(bson.M{"name": name}, &res)
+	return res, err
+}
+
+func (p *UserMemProvider) GetUserLogByName(name string) (*UserActionHistory, error) {
+	ih, err := p.i.GetItemLogByUsername(name)
+	if err != nil {
+		return nil, err
+	}
+	ph, err := p.p.GetPolicyLogByUsername(name)
+	if err != nil {
+		return nil, err
+	}
+	return &UserActionHistory{ItemChanges: *ih, PolicyChanges: *ph}, nil
+}
+
+func (p *UserMemProvider) ListUser(q *Query) ([]User, int, error) {
+	usr := make([]User, 0)
+	total, err := p.c.query(q, &usr)
+	return usr, total, err
+}
+
+func (p *UserMemProvider) UpdateUser(usr *User) error {
+	return p.c.replace(bson.M{"name": usr.Name}, usr)
+}
+
+// modify applies f to the stored user name
+func (p *UserMemProvider) modify(name string, f func(usr *User)) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	usr, err := p.GetUserByName(name)
+	if err != nil {
+		return err
+	}
+	f(&usr)
+	return p.c.replace(bson.M{"name": name}, &usr)
+}
+
+func (p *UserMemProvider) SetRole(name, role string) error {
+	return p.modify(name, func(usr *User) { usr.Role = role })
+}
+
+func (p *UserMemProvider) SetSecret(name string, sec Secret) error {
+	return p.modify(name, func(usr *User) { usr.Secret = sec })
+}
+
+func (p *UserMemProvider) SetVerified(name string) error {
+	return p.modify(name, func(usr *User) {
+		usr.Unverified = false
+		if usr.Role == RoleGuest {
+			usr.Role = RoleMember
+		}
+	})
+}
+
+func (p *UserMemProvider) CreateUser(usr *User) error {
+	return p.c.insert(usr)
+}
+
+func (p *UserMemProvider) CheckUserExistance(usr *User) bool {
+	_, err := p.GetUserByName(usr.Name)
+	return err == nil
+}
+
+func (p *UserMemProvider) DeleteUser(name string) error {
+	return p.c.removeOne(bson.M{"name": name})
+}
+
+func (p *UserMemProvider) Search(term string, limit int) ([]SearchResult, int, error) {
+	docs, err := p.c.find(bson.M{})
+	if err != nil {
+		return nil, 0, err
+	}
+	idx, scores := memTextSearch(docs, term, map[string]int{"name": 1})
+	res := make([]SearchResult, 0, len(idx))
+	for i := 0; i != len(idx) && (limit <= 0 || i < limit); i++ {
+		usr := User{}
+		err = fromDoc(docs[idx[i]], &usr)
+		if err != nil {
+			return nil, 0, err
+		}
+		res = append(res, userResult(term, &usr, scores[i]))
+	}
+	return res, len(idx), nil
+}
+
+// TokenMemProvider is the in-memory implementation of TokenProvider
+type TokenMemProvider struct {
+	c  *memCollection
+	mu sync.Mutex // serializes writes
+}
+
+func NewTokenMemProvider() *TokenMemProvider {
+	res := new(TokenMemProvider)
+	res.c = new(memCollection)
+	return res
+}
+
+func (p *TokenMemProvider) CreateToken(user, name, kind string, expires time.Time) (*Token, string, error) {
+	t, secret, err := newToken(user, name, kind, expires)
+	if err != nil {
+		return nil, "", err
+	}
+	return t, secret, p.c.insert(t)
+}
+
+func (p *TokenMemProvider) GetTokenBySecret(secret string) (Token, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	res := Token{}
+	err := p.c.one(validToken(secret, TokenSession, TokenAPI), &res)
+	if err != nil {
+		return res, err
+	}
+	if res.Kind == TokenAPI {
+		res.LastUsed = time.Now()
+		err = p.c.replace(bson.M{"_id": res.ID}, &res)
+	}
+	return res, err
+}
+
+func (p *TokenMemProvider) ConsumeToken(secret, kind string) (Token, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	res := Token{}
+	err := p.c.one(validToken(secret, kind), &res)
+	if err != nil {
+		return res, err
+	}
+	return res, p.c.removeOne(bson.M{"_id": res.ID})
+}
+
+func (p *TokenMemProvider) ListTokens(user, kind string) ([]Token, error) {
+	res := make([]Token, 0)
+	err := p.c.all(bson.M{"user": user, "kind": kind}, &res, "created")
+	return res, err
+}
+
+func (p *TokenMemProvider) DeleteToken(user string, id bson.ObjectId) error {
+	return p.c.removeOne(bson.M{"_id": id, "user": user})
+}
+
+func (p *TokenMemProvider) DeleteUserTokens(user string, kinds ...string) error {
+	sel := bson.M{"user": user}
+	if len(kinds) != 0 {
+		sel["kind"] = bson.M{"$in": kinds}
+	}
+	_, err := p.c.remove(sel)
+	return err
+}
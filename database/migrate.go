@@ -0,0 +1,206 @@
+/*
+ *    Copyright (C) 2015 Stefan Luecke
+ *
+ *    This program is free software: you can redistribute it and/or modify
+ *    it under the terms of the GNU Affero General Public License as published
+ *    by the Free Software Foundation, either version 3 of the License, or
+ *    (at your option) any later version.
+ *
+ *    This program is distributed in the hope that it will be useful,
+ *    but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *    GNU Affero General Public License for more details.
+ *
+ *    You should have received a copy of the GNU Affero General Public License
+ *    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ *    Authors: Stefan Luecke <glaxx@glaxx.net>
+ */
+
+package database
+
+import (
+	log "github.com/Sirupsen/logrus"
+	bolt "go.etcd.io/bbolt"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"io"
+)
+
+// migratedCollections are the mongodb collections MigrateMongoToBolt copies
+// as they are. The item counter and the GridFS images and attachments are
+// copied separately.
+var migratedCollections = []string{
+	"item", "item_history",
+	"policy", "policy_history",
+	"user", "loan", "reservation", "token",
+}
+
+// migrateBatch is the number of documents written per transaction
+const migrateBatch = 1000
+
+// MigrateMongoToBolt copies the database dbname into b, which has to be
+// empty. Documents keep their ids, so references between them stay intact.
+func MigrateMongoToBolt(s *mgo.Session, dbname string, b *BoltStore) error {
+	empty, err := b.empty()
+	if err != nil {
+		return err
+	}
+	if !empty {
+		return ErrBoltNotEmpty
+	}
+	d := s.DB(dbname)
+	for _, name := range migratedCollections {
+		n, err := migrateCollection(d.C(name), b, name)
+		if err != nil {
+			return err
+		}
+		log.WithFields(log.Fields{"Collection": name, "Documents": n}).Info("Collection migrated")
+	}
+
+	var cnt counter
+	err = d.C("counters").Find(bson.M{"type_": "item"}).One(&cnt)
+	if err != nil && err != mgo.ErrNotFound {
+		return err
+	}
+	err = b.db.Update(func(tx *bolt.Tx) error {
+		bk, err := tx.CreateBucketIfNotExists(boltCounters)
+		if err != nil {
+			return err
+		}
+		return setCounter(bk, cnt.Count)
+	})
+	if err != nil {
+		return err
+	}
+	log.WithFields(log.Fields{"Count": cnt.Count}).Info("Item counter migrated")
+
+	n, err := migrateImages(d.GridFS("images"), b)
+	if err != nil {
+		return err
+	}
+	log.WithFields(log.Fields{"Images": n}).Info("Images migrated")
+
+	n, err = migrateAttachments(d.GridFS("attachments"), b)
+	if err != nil {
+		return err
+	}
+	log.WithFields(log.Fields{"Attachments": n}).Info("Attachments migrated")
+	return nil
+}
+
+func migrateCollection(c *mgo.Collection, b *BoltStore, name string) (int, error) {
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists([]byte(name))
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	batch := make([]bson.M, 0, migrateBatch)
+	flush := func() error {
+		err := b.db.Update(func(tx *bolt.Tx) error {
+			return putDocs(tx.Bucket([]byte(name)), batch)
+		})
+		n += len(batch)
+		batch = batch[:0]
+		return err
+	}
+	it := c.Find(nil).Iter()
+	doc := bson.M{}
+	for it.Next(&doc) {
+		batch = append(batch, doc)
+		doc = bson.M{}
+		if len(batch) == migrateBatch {
+			err = flush()
+			if err != nil {
+				it.Close()
+				return n, err
+			}
+		}
+	}
+	err = it.Close()
+	if err != nil {
+		return n, err
+	}
+	return n, flush()
+}
+
+func migrateImages(fs *mgo.GridFS, b *BoltStore) (int, error) {
+	_, err := NewImageBoltProvider(b)
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	var f *mgo.GridFile
+	it := fs.Find(nil).Iter()
+	for fs.OpenNext(it, &f) {
+		img := new(boltImage)
+		img.ContentType = f.ContentType()
+		err = f.GetMeta(&img.Meta)
+		if err != nil {
+			break
+		}
+		img.Data = make([]byte, f.Size())
+		_, err = io.ReadFull(f, img.Data)
+		if err != nil {
+			break
+		}
+		id, _ := f.Id().(bson.ObjectId)
+		err = b.db.Update(func(tx *bolt.Tx) error {
+			return putImage(tx.Bucket(boltImages), id, img)
+		})
+		if err != nil {
+			break
+		}
+		n++
+	}
+	// OpenNext only closes the files it iterated past
+	if f != nil {
+		f.Close()
+	}
+	if err != nil {
+		it.Close()
+		return n, err
+	}
+	return n, it.Close()
+}
+
+func migrateAttachments(fs *mgo.GridFS, b *BoltStore) (int, error) {
+	_, err := NewAttachmentBoltProvider(b)
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	var f *mgo.GridFile
+	it := fs.Find(nil).Iter()
+	for fs.OpenNext(it, &f) {
+		att := new(boltAttachment)
+		err = f.GetMeta(&att.Meta)
+		if err != nil {
+			break
+		}
+		att.Data = make([]byte, f.Size())
+		_, err = io.ReadFull(f, att.Data)
+		if err != nil {
+			break
+		}
+		id, _ := f.Id().(bson.ObjectId)
+		err = b.db.Update(func(tx *bolt.Tx) error {
+			return putAttachment(tx.Bucket(boltAttachments), id, att)
+		})
+		if err != nil {
+			break
+		}
+		n++
+	}
+	if f != nil {
+		f.Close()
+	}
+	if err != nil {
+		it.Close()
+		return n, err
+	}
+	return n, it.Close()
+}
@@ -20,10 +20,16 @@
 package database
 
 import (
+	"crypto/hmac"
 	"crypto/rand"
+	"crypto/sha256"
 	"crypto/sha512"
+	"crypto/subtle"
 	"errors"
 	log "github.com/Sirupsen/logrus"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/scrypt"
 	"os"
 )
 
@@ -85,19 +91,139 @@ func createPepper(path string) []byte {
 	return res
 }
 
+const (
+	AlgorithmSHA512   = "" // legacy records, never used for new passwords
+	AlgorithmBcrypt   = "bcrypt"
+	AlgorithmScrypt   = "scrypt"
+	AlgorithmArgon2id = "argon2id"
+)
+
+// KDFParams are the work factors of a password hash. Their meaning depends
+// on the algorithm:
+//
+//	bcrypt:   Cost is the bcrypt cost
+//	scrypt:   N = 2^Cost, r = Memory, p = Parallelism
+//	argon2id: Cost iterations over Memory KiB with Parallelism threads
+type KDFParams struct {
+	Cost        uint32
+	Memory      uint32 `bson:",omitempty"`
+	Parallelism uint8  `bson:",omitempty"`
+}
+
+// Hasher is a password hashing algorithm. The password handed to it is
+// already combined with the pepper.
+type Hasher interface {
+	Hash(pw, salt []byte, p KDFParams) ([]byte, error)
+	Verify(pw, salt []byte, p KDFParams, hash []byte) bool
+	DefaultParams() KDFParams
+}
+
+var hashers = map[string]Hasher{
+	AlgorithmBcrypt:   bcryptHasher{},
+	AlgorithmScrypt:   scryptHasher{},
+	AlgorithmArgon2id: argon2idHasher{},
+}
+
+var (
+	defaultAlgorithm = AlgorithmArgon2id
+	defaultParams    = argon2idHasher{}.DefaultParams()
+)
+
+// SetPasswordHasher selects the algorithm used for new and upgraded
+// passwords. If params is nil, the defaults of the algorithm are used.
+func SetPasswordHasher(algorithm string, params *KDFParams) error {
+	h, ok := hashers[algorithm]
+	if !ok {
+		return errors.New("Unknown password hash algorithm " + algorithm)
+	}
+	defaultAlgorithm = algorithm
+	defaultParams = h.DefaultParams()
+	if params != nil {
+		defaultParams = *params
+	}
+	return nil
+}
+
+type bcryptHasher struct{}
+
+func (bcryptHasher) Hash(pw, salt []byte, p KDFParams) ([]byte, error) {
+	// bcrypt salts on its own
+	return bcrypt.GenerateFromPassword(pw, int(p.Cost))
+}
+
+func (bcryptHasher) Verify(pw, salt []byte, p KDFParams, hash []byte) bool {
+	return bcrypt.CompareHashAndPassword(hash, pw) == nil
+}
+
+func (bcryptHasher) DefaultParams() KDFParams {
+	return KDFParams{Cost: 12}
+}
+
+type scryptHasher struct{}
+
+func (scryptHasher) Hash(pw, salt []byte, p KDFParams) ([]byte, error) {
+	return scrypt.Key(pw, salt, 1<<p.Cost, int(p.Memory), int(p.Parallelism), 32)
+}
+
+func (h scryptHasher) Verify(pw, salt []byte, p KDFParams, hash []byte) bool {
+	k, err := h.Hash(pw, salt, p)
+	return err == nil && subtle.ConstantTimeCompare(k, hash) == 1
+}
+
+func (scryptHasher) DefaultParams() KDFParams {
+	return KDFParams{Cost: 15, Memory: 8, Parallelism: 1}
+}
+
+type argon2idHasher struct{}
+
+func (argon2idHasher) Hash(pw, salt []byte, p KDFParams) ([]byte, error) {
+	if p.Cost == 0 || p.Parallelism == 0 {
+		return nil, errors.New("Invalid argon2id parameters")
+	}
+	return argon2.IDKey(pw, salt, p.Cost, p.Memory, p.Parallelism, 32), nil
+}
+
+func (h argon2idHasher) Verify(pw, salt []byte, p KDFParams, hash []byte) bool {
+	k, err := h.Hash(pw, salt, p)
+	return err == nil && subtle.ConstantTimeCompare(k, hash) == 1
+}
+
+func (argon2idHasher) DefaultParams() KDFParams {
+	return KDFParams{Cost: 3, Memory: 64 * 1024, Parallelism: 4}
+}
+
+// Secret holds a password hash. Records created before the switch to key
+// derivation functions have no Algorithm and store sha512(pw || salt ||
+// pepper) in Password; they are upgraded on the next successful login.
 type Secret struct {
-	Password [sha512.Size]byte `json:"-"`
-	Salt     [64]byte          `json:"-"`
+	Algorithm string            `bson:",omitempty" json:"-"`
+	Params    KDFParams         `json:"-"`
+	Hash      []byte            `bson:",omitempty" json:"-"`
+	Password  [sha512.Size]byte `json:"-"`
+	Salt      [64]byte          `json:"-"`
 }
 
 func (s *Secret) VerifyPassword(pw string) bool {
-	input := s.assemblePassword(pw)
-	for i := 0; i != len(s.Password); i++ {
-		if s.Password[i] != input[i] {
-			return false
-		}
+	if s.Algorithm == AlgorithmSHA512 {
+		input := s.assemblePassword(pw, pepper)
+		// earlier versions of lsmsd never read the pepper file, so legacy
+		// records may have been hashed without one
+		unpeppered := s.assemblePassword(pw, nil)
+		return subtle.ConstantTimeCompare(input[:], s.Password[:])|
+			subtle.ConstantTimeCompare(unpeppered[:], s.Password[:]) == 1
 	}
-	return true
+	h, ok := hashers[s.Algorithm]
+	if !ok {
+		log.WithFields(log.Fields{"Algorithm": s.Algorithm}).Warn("Unknown password hash algorithm")
+		return false
+	}
+	return h.Verify(pepperPassword(pw), s.Salt[:], s.Params, s.Hash)
+}
+
+// NeedsUpgrade reports whether s was hashed with another algorithm or other
+// parameters than the ones currently configured
+func (s *Secret) NeedsUpgrade() bool {
+	return s.Algorithm != defaultAlgorithm || s.Params != defaultParams
 }
 
 func (s *Secret) SetPassword(pw string) error {
@@ -105,12 +231,26 @@ func (s *Secret) SetPassword(pw string) error {
 	if err != nil {
 		return err
 	}
-
-	s.Password = s.assemblePassword(pw)
+	hash, err := hashers[defaultAlgorithm].Hash(pepperPassword(pw), s.Salt[:], defaultParams)
+	if err != nil {
+		return err
+	}
+	s.Algorithm = defaultAlgorithm
+	s.Params = defaultParams
+	s.Hash = hash
+	s.Password = [sha512.Size]byte{}
 	return nil
 }
 
-func (s *Secret) assemblePassword(pw string) [sha512.Size]byte {
+// pepperPassword mixes the pepper into pw. The result has a fixed length,
+// which keeps long passwords within the 72 byte limit of bcrypt.
+func pepperPassword(pw string) []byte {
+	mac := hmac.New(sha256.New, pepper)
+	mac.Write([]byte(pw))
+	return mac.Sum(nil)
+}
+
+func (s *Secret) assemblePassword(pw string, pepper []byte) [sha512.Size]byte {
 	temp := make([]byte, len(pw)+len(s.Salt)+len(pepper))
 	for i := 0; i != len(pw); i++ {
 		temp[i] = pw[i]
@@ -28,28 +28,60 @@ import (
 )
 
 type PolicyDBProvider struct {
-	c  *mgo.Collection
-	ch *mgo.Collection
+	c     *mgo.Collection
+	ch    *mgo.Collection
+	chain auditChain
 }
 
 func NewPolicyDBProvider(s *mgo.Session, dbname string) *PolicyDBProvider {
 	res := new(PolicyDBProvider)
 	res.c = s.DB(dbname).C("policy")
 	res.ch = s.DB(dbname).C("policy_history")
+	res.chain = newMongoChain(res.ch)
+	err := ensureTextIndex(res.c, map[string]int{"name": 10, "description": 1})
+	if err != nil {
+		log.WithFields(log.Fields{"Err": err}).Warn("Could not create policy search index")
+	}
 	return res
 }
 
+const (
+	CheckoutAllowed   = "allowed"
+	CheckoutApproval  = "approval"
+	CheckoutForbidden = "forbidden"
+)
+
 type Policy struct {
 	ID          bson.ObjectId `bson:"_id,omitempty" json:"-"`
 	Name        string
 	Description string
+	Checkout    string `bson:",omitempty" description:"Lending rule for items using this policy: allowed (default), approval (owner or maintainer have to approve each checkout) or forbidden"`
+	Revision    uint64 `bson:",omitempty" description:"Incremented on every change, the ETag of the policy"`
+}
+
+// CheckoutRule returns the lending rule of p, an unset rule allows lending
+func (p *Policy) CheckoutRule() string {
+	if p.Checkout == "" {
+		return CheckoutAllowed
+	}
+	return p.Checkout
+}
+
+// ValidCheckoutRule reports whether p.Checkout is one of the known rules
+func (p *Policy) ValidCheckoutRule() bool {
+	switch p.CheckoutRule() {
+	case CheckoutAllowed, CheckoutApproval, CheckoutForbidden:
+		return true
+	}
+	return false
 }
 
 type PolicyHistory struct {
-	ID        bson.ObjectId `bson:"_id,omitempty" json:"-"`
+	ID        bson.ObjectId `bson:"_id,omitempty" json:"Id,omitempty"`
 	Timestamp time.Time     `bson:"-" json:",omitempty"`
 	User      string
 	Policy    map[string]interface{}
+	AuditLink `bson:",inline"`
 }
 
 func (p *Policy) NewPolicyHistory(po *Policy, user string) *PolicyHistory {
@@ -60,17 +92,32 @@ func (p *Policy) NewPolicyHistory(po *Policy, user string) *PolicyHistory {
 	res.Timestamp = time.Now()
 
 	if po == nil {
-		res.Policy["deleted"] = true
-		return res
+		return p.snapshot(user, historyDeleted)
 	}
 	if p.Description != po.Description {
 		d := dmp.New()
 		d.DiffTimeout = 200 * time.Millisecond
 		res.Policy["description"] = d.DiffMain(p.Description, po.Description, true)
 	}
+	if p.Checkout != po.Checkout {
+		res.Policy["checkout"] = po.Checkout
+	}
+	return res
+}
+
+// snapshot records every field of p in a history entry marked with event
+func (p *Policy) snapshot(user, event string) *PolicyHistory {
+	res := (&Policy{Name: p.Name}).NewPolicyHistory(p, user)
+	res.Policy[event] = true
+	res.Policy[historySnapshot] = true
 	return res
 }
 
+// NewCreatedHistory returns the history entry CreatePolicy records for p
+func (p *Policy) NewCreatedHistory(user string) *PolicyHistory {
+	return p.snapshot(user, historyCreated)
+}
+
 func (p *PolicyDBProvider) GetPolicyByName(name string) (Policy, error) {
 	res := Policy{}
 	err := p.c.Find(bson.M{"name": name}).One(&res)
@@ -79,7 +126,7 @@ func (p *PolicyDBProvider) GetPolicyByName(name string) (Policy, error) {
 
 func (p *PolicyDBProvider) GetPolicyLog(name string) ([]PolicyHistory, error) {
 	res := make([]PolicyHistory, 0)
-	err := p.ch.Find(bson.M{"policy.name": name}).All(&res)
+	err := p.ch.Find(bson.M{"policy.name": name}).Sort("_id").All(&res)
 	for i := 0; i != len(res); i++ {
 		res[i].Timestamp = res[i].ID.Time()
 	}
@@ -88,22 +135,39 @@ func (p *PolicyDBProvider) GetPolicyLog(name string) ([]PolicyHistory, error) {
 
 func (p *PolicyDBProvider) GetPolicyLogByUsername(name string) (*[]PolicyHistory, error) {
 	ph := make([]PolicyHistory, 0)
-	err := p.ch.Find(bson.M{"user": name}).All(&ph)
+	err := p.ch.Find(bson.M{"user": name}).Sort("_id").All(&ph)
+	for i := 0; i != len(ph); i++ {
+		ph[i].Timestamp = ph[i].ID.Time()
+	}
 	return &ph, err
 }
 
-func (p *PolicyDBProvider) ListPolicy() ([]Policy, error) {
+// ListPolicy returns the policies selected by q and the total number of
+// policies matching its filter. A nil query lists all policies.
+func (p *PolicyDBProvider) ListPolicy(q *Query) ([]Policy, int, error) {
 	pol := make([]Policy, 0)
-	err := p.c.Find(nil).All(&pol)
-	return pol, err
+	res, total, err := q.find(p.c)
+	if err != nil {
+		return pol, 0, err
+	}
+	err = res.All(&pol)
+	return pol, total, err
 }
 
+// UpdatePolicy replaces the stored policy if it is still at pol.Revision and
+// increments the revision. Otherwise it fails with ErrRevisionConflict.
 func (p *PolicyDBProvider) UpdatePolicy(pol *Policy, ph *PolicyHistory) error {
-	err := p.ch.Insert(ph)
+	rev := pol.Revision
+	pol.Revision++
+	err := p.c.Update(bson.M{"name": pol.Name, "revision": revisionQuery(rev)}, pol)
 	if err != nil {
+		pol.Revision = rev
+		if err == mgo.ErrNotFound && p.CheckPolicyExistance(pol) {
+			return ErrRevisionConflict
+		}
 		return err
 	}
-	return p.c.Update(bson.M{"name": pol.Name}, pol)
+	return p.chain.append(ph)
 }
 
 func (p *PolicyDBProvider) CheckPolicyExistance(pol *Policy) bool {
@@ -121,14 +185,47 @@ func (p *PolicyDBProvider) CheckPolicyExistance(pol *Policy) bool {
 	return true
 }
 
-func (p *PolicyDBProvider) CreatePolicy(pol *Policy) error {
-	return p.c.Insert(pol)
+// CreatePolicy stores pol and records its creation by user
+func (p *PolicyDBProvider) CreatePolicy(pol *Policy, user string) error {
+	pol.Revision = 1
+	err := p.c.Insert(pol)
+	if err != nil {
+		return err
+	}
+	return p.chain.append(pol.snapshot(user, historyCreated))
 }
 
+// RestorePolicy stores the deleted policy pol again and records ph
+func (p *PolicyDBProvider) RestorePolicy(pol *Policy, ph *PolicyHistory) error {
+	if p.CheckPolicyExistance(pol) {
+		return ErrRevertConflict
+	}
+	err := p.c.Insert(pol)
+	if err != nil {
+		return err
+	}
+	return p.chain.append(ph)
+}
+
+// DeletePolicy removes pol if it is still at pol.Revision. Otherwise it fails
+// with ErrRevisionConflict.
 func (p *PolicyDBProvider) DeletePolicy(pol *Policy, ph *PolicyHistory) error {
-	err := p.ch.Insert(ph)
+	err := p.c.Remove(bson.M{"name": pol.Name, "revision": revisionQuery(pol.Revision)})
 	if err != nil {
+		if err == mgo.ErrNotFound && p.CheckPolicyExistance(pol) {
+			return ErrRevisionConflict
+		}
 		return err
 	}
-	return p.c.Remove(bson.M{"name": pol.Name})
+	return p.chain.append(ph)
+}
+
+// VerifyLog checks the hash chain of the policy log
+func (p *PolicyDBProvider) VerifyLog() (*AuditReport, error) {
+	docs := make([]bson.M, 0)
+	err := p.ch.Find(nil).All(&docs)
+	if err != nil {
+		return nil, err
+	}
+	return verifyLog("policy_history", docs), nil
 }
@@ -0,0 +1,188 @@
+/*
+ *    Copyright (C) 2015 Stefan Luecke
+ *
+ *    This program is free software: you can redistribute it and/or modify
+ *    it under the terms of the GNU Affero General Public License as published
+ *    by the Free Software Foundation, either version 3 of the License, or
+ *    (at your option) any later version.
+ *
+ *    This program is distributed in the hope that it will be useful,
+ *    but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *    GNU Affero General Public License for more details.
+ *
+ *    You should have received a copy of the GNU Affero General Public License
+ *    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ *    Authors: Stefan Luecke <glaxx@glaxx.net>
+ */
+
+package database
+
+import (
+	"bytes"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"io"
+	"time"
+)
+
+// ErrNotFound is returned by all providers if the requested object does not
+// exist.
+var ErrNotFound = mgo.ErrNotFound
+
+// The provider interfaces below are implemented by the mongodb backend
+// (the *DBProviders) and the in-memory backend (the *MemProviders), which
+// the bolt backend reuses with an ImageBoltProvider. The webservices
+// only depend on these interfaces.
+
+type ItemProvider interface {
+	GetItemById(id uint64) (Item, error)
+	GetItemLog(id uint64) ([]ItemHistory, error)
+	GetItemLogByUsername(name string) (*[]ItemHistory, error)
+	CreateItem(itm *Item, user string) (uint64, error)
+	ReserveIDs(n uint64) (uint64, error)
+	LastID() (uint64, error)
+	ImportItem(itm *Item) error
+	RestoreItem(itm *Item, ih *ItemHistory) error
+	ListItem(q *Query) ([]Item, int, error)
+	UpdateItem(itm *Item, ih *ItemHistory) error
+	AddImage(id uint64, ref bson.ObjectId, user string) (*ItemHistory, error)
+	RemoveImage(id uint64, ref bson.ObjectId, user string) (*ItemHistory, error)
+	AddAttachment(id uint64, ref bson.ObjectId, user string) (*ItemHistory, error)
+	RemoveAttachment(id uint64, ref bson.ObjectId, user string) (*ItemHistory, error)
+	SetBorrower(id uint64, borrower string, due time.Time, user string) (*ItemHistory, error)
+	CheckItemExistance(itm *Item) bool
+	DeleteItem(itm *Item, ih *ItemHistory) error
+	VerifyLog() (*AuditReport, error)
+
+	CheckParent(id, parent uint64) error
+	GetChildren(id uint64) ([]Item, error)
+	GetAncestors(id uint64) ([]Item, error)
+	GetItemTree(id uint64) (*ItemTree, error)
+
+	Search(term string, limit int) ([]SearchResult, int, error)
+	Stop()
+}
+
+type PolicyProvider interface {
+	GetPolicyByName(name string) (Policy, error)
+	GetPolicyLog(name string) ([]PolicyHistory, error)
+	GetPolicyLogByUsername(name string) (*[]PolicyHistory, error)
+	ListPolicy(q *Query) ([]Policy, int, error)
+	UpdatePolicy(pol *Policy, ph *PolicyHistory) error
+	CheckPolicyExistance(pol *Policy) bool
+	CreatePolicy(pol *Policy, user string) error
+	RestorePolicy(pol *Policy, ph *PolicyHistory) error
+	DeletePolicy(pol *Policy, ph *PolicyHistory) error
+	VerifyLog() (*AuditReport, error)
+
+	Search(term string, limit int) ([]SearchResult, int, error)
+}
+
+type UserProvider interface {
+	GetUserByName(name string) (User, error)
+	GetUserLogByName(name string) (*UserActionHistory, error)
+	ListUser(q *Query) ([]User, int, error)
+	UpdateUser(usr *User) error
+	SetRole(name, role string) error
+	SetSecret(name string, sec Secret) error
+	SetVerified(name string) error
+	CreateUser(usr *User) error
+	CheckUserExistance(usr *User) bool
+	DeleteUser(name string) error
+
+	Search(term string, limit int) ([]SearchResult, int, error)
+}
+
+// ImageFile streams a stored image or attachment. *mgo.GridFile is one.
+type ImageFile interface {
+	io.ReadSeeker
+	io.Closer
+	ContentType() string
+	UploadDate() time.Time
+	Size() int64
+	// MD5 returns the hex encoded MD5 of the data
+	MD5() string
+}
+
+type ImageProvider interface {
+	Create(data io.Reader, user, contentType string, obj uint64) (bson.ObjectId, error)
+	Remove(obj bson.ObjectId) error
+	GetImageById(obj bson.ObjectId) (*bytes.Buffer, string, error)
+	// OpenImage returns image obj for reading, it has to be closed
+	OpenImage(obj bson.ObjectId) (ImageFile, error)
+	GetImageMetadataById(obj bson.ObjectId) (*ImageMetadata, error)
+	Delete(obj bson.ObjectId) error
+	// ListImages returns every stored image
+	ListImages() ([]FileRef, error)
+
+	// Renditions are resized copies of an image, removed along with it
+	GetRendition(obj bson.ObjectId, size string) (*bytes.Buffer, string, error)
+	CreateRendition(data io.Reader, contentType string, obj bson.ObjectId, size string) error
+}
+
+type AttachmentProvider interface {
+	Create(data io.Reader, a *Attachment) error
+	GetAttachmentById(obj bson.ObjectId) (*Attachment, error)
+	// OpenAttachment returns the file of attachment obj, it has to be closed
+	OpenAttachment(obj bson.ObjectId) (ImageFile, error)
+	Remove(obj bson.ObjectId) error
+	// ListAttachments returns every stored attachment
+	ListAttachments() ([]FileRef, error)
+}
+
+// FileRef names a stored image or attachment and the item it was uploaded
+// for
+type FileRef struct {
+	ID     bson.ObjectId
+	ItmRef uint64
+}
+
+type LoanProvider interface {
+	CreateLoan(l *Loan) error
+	UpdateLoan(l *Loan) error
+	GetLoanById(id bson.ObjectId) (Loan, error)
+	GetCurrentLoan(id uint64) (Loan, error)
+	ListLoans(q *Query, overdue bool) ([]Loan, int, error)
+}
+
+type ReservationProvider interface {
+	CreateReservation(r *Reservation) error
+	UpdateReservation(r *Reservation) error
+	DeleteReservation(id bson.ObjectId) error
+	GetReservationById(id bson.ObjectId) (Reservation, error)
+	GetReservations(item uint64, user string, from, to time.Time) ([]Reservation, error)
+}
+
+type TokenProvider interface {
+	CreateToken(user, name, kind string, expires time.Time) (*Token, string, error)
+	GetTokenBySecret(secret string) (Token, error)
+	ConsumeToken(secret, kind string) (Token, error)
+	ListTokens(user, kind string) ([]Token, error)
+	DeleteToken(user string, id bson.ObjectId) error
+	DeleteUserTokens(user string, kinds ...string) error
+}
+
+var (
+	_ ItemProvider        = (*ItemDBProvider)(nil)
+	_ PolicyProvider      = (*PolicyDBProvider)(nil)
+	_ UserProvider        = (*UserDBProvider)(nil)
+	_ ImageProvider       = (*ImageDBProvider)(nil)
+	_ AttachmentProvider  = (*AttachmentDBProvider)(nil)
+	_ LoanProvider        = (*LoanDBProvider)(nil)
+	_ ReservationProvider = (*ReservationDBProvider)(nil)
+	_ TokenProvider       = (*TokenDBProvider)(nil)
+
+	_ ItemProvider        = (*ItemMemProvider)(nil)
+	_ PolicyProvider      = (*PolicyMemProvider)(nil)
+	_ UserProvider        = (*UserMemProvider)(nil)
+	_ ImageProvider       = (*ImageMemProvider)(nil)
+	_ AttachmentProvider  = (*AttachmentMemProvider)(nil)
+	_ LoanProvider        = (*LoanMemProvider)(nil)
+	_ ReservationProvider = (*ReservationMemProvider)(nil)
+	_ TokenProvider       = (*TokenMemProvider)(nil)
+
+	_ ImageProvider      = (*ImageBoltProvider)(nil)
+	_ AttachmentProvider = (*AttachmentBoltProvider)(nil)
+)
@@ -0,0 +1,62 @@
+/*
+ *    Copyright (C) 2015 Stefan Luecke
+ *
+ *    This program is free software: you can redistribute it and/or modify
+ *    it under the terms of the GNU Affero General Public License as published
+ *    by the Free Software Foundation, either version 3 of the License, or
+ *    (at your option) any later version.
+ *
+ *    This program is distributed in the hope that it will be useful,
+ *    but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *    GNU Affero General Public License for more details.
+ *
+ *    You should have received a copy of the GNU Affero General Public License
+ *    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ *    Authors: Stefan Luecke <glaxx@glaxx.net>
+ */
+
+package database
+
+import (
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Query describes a paginated, filtered and sorted listing. Filter maps
+// database field names to the value they have to match, Sort takes mgo style
+// field names ("-name" sorts descending). A Limit of zero means no limit.
+type Query struct {
+	Offset int
+	Limit  int
+	Sort   []string
+	Filter map[string]interface{}
+}
+
+// find applies q to the collection and returns the resulting mgo query
+// together with the total number of matching documents, ignoring pagination.
+func (q *Query) find(c *mgo.Collection) (*mgo.Query, int, error) {
+	if q == nil {
+		q = new(Query)
+	}
+	filter := bson.M{}
+	for k, v := range q.Filter {
+		filter[k] = v
+	}
+	res := c.Find(filter)
+	total, err := res.Count()
+	if err != nil {
+		return nil, 0, err
+	}
+	// _id as last sort key keeps the order stable between pages
+	sort := append(append([]string{}, q.Sort...), "_id")
+	res = res.Sort(sort...)
+	if q.Offset > 0 {
+		res = res.Skip(q.Offset)
+	}
+	if q.Limit > 0 {
+		res = res.Limit(q.Limit)
+	}
+	return res, total, nil
+}
@@ -0,0 +1,377 @@
+/*
+ *    Copyright (C) 2015 Stefan Luecke
+ *
+ *    This program is free software: you can redistribute it and/or modify
+ *    it under the terms of the GNU Affero General Public License as published
+ *    by the Free Software Foundation, either version 3 of the License, or
+ *    (at your option) any later version.
+ *
+ *    This program is distributed in the hope that it will be useful,
+ *    but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *    GNU Affero General Public License for more details.
+ *
+ *    You should have received a copy of the GNU Affero General Public License
+ *    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ *    Authors: Stefan Luecke <glaxx@glaxx.net>
+ */
+
+package database
+
+import (
+	"bytes"
+	"encoding/hex"
+	dmp "github.com/sergi/go-diff/diffmatchpatch"
+	"gopkg.in/mgo.v2/bson"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// diffContext is the number of unchanged lines around each hunk of a
+// rendered text diff
+const diffContext = 3
+
+// RenderedHistory is a log entry in readable form
+type RenderedHistory struct {
+	ID        bson.ObjectId `json:"Id"`
+	Timestamp time.Time
+	User      string
+	Event     string `json:",omitempty" description:"created, deleted or restored, empty for other changes"`
+	Revert    string `json:",omitempty" description:"Id of the log entry this change reverted"`
+	Changes   []FieldChange
+}
+
+// FieldChange describes how a log entry changed a field
+type FieldChange struct {
+	Field   string
+	Before  interface{}     `json:",omitempty" description:"Missing if the field was empty or is not known from the log"`
+	After   interface{}     `json:",omitempty" description:"Missing if the field is empty now"`
+	Diff    string          `json:",omitempty" description:"Unified diff of text fields"`
+	Added   []bson.ObjectId `json:",omitempty" description:"Ids added to a list field"`
+	Removed []bson.ObjectId `json:",omitempty" description:"Ids removed from a list field"`
+}
+
+// FieldBlame tells who last changed a field
+type FieldBlame struct {
+	Field     string
+	Value     interface{}   `json:",omitempty"`
+	ID        bson.ObjectId `json:"Id" description:"Id of the log entry"`
+	Timestamp time.Time
+	User      string
+}
+
+// RenderItemLog renders the log of an item. cur is the stored item, nil if
+// it was deleted.
+func RenderItemLog(log []ItemHistory, cur *Item) ([]RenderedHistory, error) {
+	entries, _, err := itemEntries(log, time.Time{})
+	if err != nil {
+		return nil, err
+	}
+	doc, err := optDoc(cur != nil, cur)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]RenderedHistory, len(log))
+	for i := 0; i != len(log); i++ {
+		res[i] = RenderedHistory{ID: log[i].ID, Timestamp: log[i].Timestamp, User: log[i].User}
+		res[i].Event, res[i].Revert, res[i].Changes, err = render(entries, i, doc, itemFields)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
+
+// RenderPolicyLog renders the log of a policy, like RenderItemLog
+func RenderPolicyLog(log []PolicyHistory, cur *Policy) ([]RenderedHistory, error) {
+	entries, _, err := policyEntries(log, time.Time{})
+	if err != nil {
+		return nil, err
+	}
+	doc, err := optDoc(cur != nil, cur)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]RenderedHistory, len(log))
+	for i := 0; i != len(log); i++ {
+		res[i] = RenderedHistory{ID: log[i].ID, Timestamp: log[i].Timestamp, User: log[i].User}
+		res[i].Event, res[i].Revert, res[i].Changes, err = render(entries, i, doc, policyFields)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
+
+// BlameItem returns who last changed each field of cur. Fields which were
+// not changed since the log begins are missing.
+func BlameItem(log []ItemHistory, cur *Item) ([]FieldBlame, error) {
+	entries, _, err := itemEntries(log, time.Time{})
+	if err != nil {
+		return nil, err
+	}
+	doc, err := toDoc(cur)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]FieldBlame, 0, len(itemFields))
+	for _, f := range sortedFields(itemFields) {
+		for i := len(entries) - 1; i >= 0; i-- {
+			if _, ok := entries[i][f]; ok || entries[i][historySnapshot] == true {
+				res = append(res, FieldBlame{Field: fieldName(f), Value: doc[f],
+					ID: log[i].ID, Timestamp: log[i].Timestamp, User: log[i].User})
+				break
+			}
+		}
+	}
+	return res, nil
+}
+
+// render describes entry k of log
+func render(log []bson.M, k int, cur bson.M, fields map[string]fieldKind) (string, string, []FieldChange, error) {
+	e := log[k]
+	event := ""
+	switch {
+	case e[historyDeleted] == true:
+		event = historyDeleted
+	case e[historyCreated] == true && e[historyRevert] != nil:
+		event = "restored"
+	case e[historyCreated] == true:
+		event = historyCreated
+	}
+	revert, _ := e[historyRevert].(string)
+
+	changes := make([]FieldChange, 0)
+	for _, f := range sortedFields(fields) {
+		v, ok := e[f]
+		if !ok {
+			continue
+		}
+		c := FieldChange{Field: fieldName(f)}
+		switch fields[f] {
+		case textField:
+			d, err := historyDiff(v)
+			if err != nil {
+				return "", "", nil, err
+			}
+			before, after := dmp.New().DiffText1(d), dmp.New().DiffText2(d)
+			if event == historyDeleted {
+				// snapshots record the text as insertion
+				before, after = after, ""
+			}
+			c.Before, c.After, c.Diff = optString(before), optString(after), unifiedDiff(before, after)
+		case setField:
+			m, _ := v.(bson.M)
+			for _, k := range sortedKeys(m) {
+				b, err := hex.DecodeString(k)
+				if err != nil {
+					continue
+				}
+				if memFloat(m[k]) == float64(dmp.DiffInsert) && event != historyDeleted {
+					c.Added = append(c.Added, bson.ObjectId(b))
+				} else {
+					c.Removed = append(c.Removed, bson.ObjectId(b))
+				}
+			}
+		default:
+			if event == historyDeleted {
+				c.Before = v
+				break
+			}
+			if event == "" {
+				// older entries do not always tell the previous value
+				before, err := fieldAt(log, k, cur, f, fields[f])
+				if err != nil && err != ErrHistoryIncomplete {
+					return "", "", nil, err
+				}
+				if !isZero(before) {
+					c.Before = before
+				}
+			}
+			if !isZero(v) {
+				c.After = v
+			}
+		}
+		changes = append(changes, c)
+	}
+	return event, revert, changes, nil
+}
+
+// apiFieldNames lists the stored fields whose API name is more than the
+// capitalized stored name
+var apiFieldNames = map[string]string{"imageinfo": "ImageInfo"}
+
+// fieldName returns the name of a stored field in the API
+func fieldName(f string) string {
+	if n, ok := apiFieldNames[f]; ok {
+		return n
+	}
+	return strings.ToUpper(f[:1]) + f[1:]
+}
+
+func sortedFields(fields map[string]fieldKind) []string {
+	res := make([]string, 0, len(fields))
+	for f := range fields {
+		res = append(res, f)
+	}
+	sort.Strings(res)
+	return res
+}
+
+func sortedKeys(m bson.M) []string {
+	res := make([]string, 0, len(m))
+	for k := range m {
+		res = append(res, k)
+	}
+	sort.Strings(res)
+	return res
+}
+
+func optString(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+// diffLine is a line of a text diff with its operation
+type diffLine struct {
+	op   dmp.Operation
+	text string
+}
+
+// unifiedDiff renders the change from a to b as unified diff without file
+// headers. It is empty if a equals b.
+func unifiedDiff(a, b string) string {
+	// diff the texts line by line with each distinct line encoded as rune.
+	// DiffLinesToChars of go-diff garbles texts with more than ten lines.
+	lines := make([]string, 0)
+	index := make(map[string]rune)
+	encode := func(text string) []rune {
+		res := make([]rune, 0)
+		for _, line := range splitLines(text) {
+			r, ok := index[line]
+			if !ok {
+				r = rune(len(lines))
+				if r >= 0xd800 {
+					// skip the surrogates, which are no valid runes
+					r += 0x800
+				}
+				index[line] = r
+				lines = append(lines, line)
+			}
+			res = append(res, r)
+		}
+		return res
+	}
+	ra, rb := encode(a), encode(b)
+	var l []diffLine
+	for _, diff := range dmp.New().DiffMainRunes(ra, rb, false) {
+		for _, r := range diff.Text {
+			if r >= 0xe000 {
+				r -= 0x800
+			}
+			l = append(l, diffLine{diff.Type, lines[r]})
+		}
+	}
+
+	buf := new(bytes.Buffer)
+	for start := 0; start != len(l); {
+		// find the next change and extend the hunk over changes which are
+		// at most two contexts apart
+		first := start
+		for first != len(l) && l[first].op == dmp.DiffEqual {
+			first++
+		}
+		if first == len(l) {
+			break
+		}
+		end, equal := first, 0
+		for end != len(l) && equal <= 2*diffContext {
+			if l[end].op == dmp.DiffEqual {
+				equal++
+			} else {
+				equal = 0
+			}
+			end++
+		}
+		if equal > diffContext {
+			end -= equal - diffContext
+		}
+		begin := first - diffContext
+		if begin < start {
+			begin = start
+		}
+		writeHunk(buf, l, begin, end)
+		start = end
+	}
+	return buf.String()
+}
+
+// writeHunk writes the lines from begin to end of l as hunk
+func writeHunk(buf *bytes.Buffer, l []diffLine, begin, end int) {
+	oldStart, newStart := 1, 1
+	for i := 0; i != begin; i++ {
+		if l[i].op != dmp.DiffInsert {
+			oldStart++
+		}
+		if l[i].op != dmp.DiffDelete {
+			newStart++
+		}
+	}
+	oldLen, newLen := 0, 0
+	for i := begin; i != end; i++ {
+		if l[i].op != dmp.DiffInsert {
+			oldLen++
+		}
+		if l[i].op != dmp.DiffDelete {
+			newLen++
+		}
+	}
+	// empty ranges start at the line before them
+	if oldLen == 0 {
+		oldStart--
+	}
+	if newLen == 0 {
+		newStart--
+	}
+	buf.WriteString("@@ -" + hunkRange(oldStart, oldLen) + " +" + hunkRange(newStart, newLen) + " @@\n")
+	for i := begin; i != end; i++ {
+		switch l[i].op {
+		case dmp.DiffEqual:
+			buf.WriteByte(' ')
+		case dmp.DiffDelete:
+			buf.WriteByte('-')
+		case dmp.DiffInsert:
+			buf.WriteByte('+')
+		}
+		buf.WriteString(l[i].text)
+		if !strings.HasSuffix(l[i].text, "\n") {
+			buf.WriteString("\n\\ No newline at end of text\n")
+		}
+	}
+}
+
+// splitLines splits text after each newline
+func splitLines(text string) []string {
+	res := make([]string, 0)
+	for text != "" {
+		i := strings.IndexByte(text, '\n') + 1
+		if i == 0 {
+			i = len(text)
+		}
+		res = append(res, text[:i])
+		text = text[i:]
+	}
+	return res
+}
+
+func hunkRange(start, n int) string {
+	if n == 1 {
+		return strconv.Itoa(start)
+	}
+	return strconv.Itoa(start) + "," + strconv.Itoa(n)
+}
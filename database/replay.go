@@ -0,0 +1,488 @@
+/*
+ *    Copyright (C) 2015 Stefan Luecke
+ *
+ *    This program is free software: you can redistribute it and/or modify
+ *    it under the terms of the GNU Affero General Public License as published
+ *    by the Free Software Foundation, either version 3 of the License, or
+ *    (at your option) any later version.
+ *
+ *    This program is distributed in the hope that it will be useful,
+ *    but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *    GNU Affero General Public License for more details.
+ *
+ *    You should have received a copy of the GNU Affero General Public License
+ *    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ *    Authors: Stefan Luecke <glaxx@glaxx.net>
+ */
+
+package database
+
+import (
+	"encoding/hex"
+	"errors"
+	dmp "github.com/sergi/go-diff/diffmatchpatch"
+	"gopkg.in/mgo.v2/bson"
+	"sort"
+	"time"
+)
+
+var (
+	ErrHistoryIncomplete = errors.New("The history does not reach back far enough")
+	ErrNotRevertable     = errors.New("This change can not be reverted")
+	ErrRevertConflict    = errors.New("The change was overwritten in the meantime")
+)
+
+// Keys marking history entries which are not field changes. Creations and
+// deletions record every field as snapshot, replaying a log starts from them.
+const (
+	historyCreated  = "created"
+	historyDeleted  = "deleted"
+	historySnapshot = "snapshot"
+	historyRevert   = "revert"
+)
+
+// fieldKind tells how a field is recorded in the history
+type fieldKind int
+
+const (
+	scalarField  fieldKind = iota // the new value
+	textField                     // a diff-match-patch diff
+	setField                      // hex encoded ids mapped to insert or delete
+	managedField                  // like scalarField, but changed by its own endpoints only
+)
+
+var itemFields = map[string]fieldKind{
+	"name":        scalarField,
+	"description": textField,
+	"parent":      scalarField,
+	"owner":       scalarField,
+	"maintainer":  scalarField,
+	"usage":       scalarField,
+	"discard":     scalarField,
+	"images":      setField,
+	"attachments": setField,
+	"imageinfo":   managedField,
+	"borrower":    managedField,
+}
+
+var policyFields = map[string]fieldKind{
+	"description": textField,
+	"checkout":    scalarField,
+}
+
+// ItemAt rebuilds item id as it was at t from its log and the stored item
+// cur, which is nil if the item was deleted. Log timestamps are precise to
+// the second. The result is nil if the item did not exist at t.
+func ItemAt(id uint64, log []ItemHistory, cur *Item, t time.Time) (*Item, error) {
+	entries, n, err := itemEntries(log, t)
+	if err != nil {
+		return nil, err
+	}
+	doc, err := optDoc(cur != nil, cur)
+	if err != nil {
+		return nil, err
+	}
+	state, exists, err := replay(entries, n, doc, itemFields)
+	if err != nil || !exists {
+		return nil, err
+	}
+	res := new(Item)
+	err = fromDoc(state, res)
+	res.EID = id
+	return res, err
+}
+
+// RevertItem returns the item cur becomes if the log entry ref is undone.
+// Reverting a deletion restores the item without its images and
+// attachments, which are gone, and without a borrower; cur has to be nil
+// then. Other changes fail with ErrRevertConflict if a later change touched
+// the same fields.
+func RevertItem(id uint64, log []ItemHistory, cur *Item, ref bson.ObjectId) (*Item, error) {
+	k := -1
+	for i := 0; i != len(log); i++ {
+		if log[i].ID == ref {
+			k = i
+		}
+	}
+	if k == -1 {
+		return nil, ErrNotFound
+	}
+	entries, _, err := itemEntries(log, time.Time{})
+	if err != nil {
+		return nil, err
+	}
+	doc, err := optDoc(cur != nil, cur)
+	if err != nil {
+		return nil, err
+	}
+	state, err := revert(entries, k, doc, itemFields)
+	if err != nil {
+		return nil, err
+	}
+	res := new(Item)
+	err = fromDoc(state, res)
+	if cur == nil {
+		res.EID = id
+		res.Images = nil
+		res.Attachments = nil
+		res.ImageInfo = nil
+		res.Borrower = ""
+		// every write since the creation left an entry, so this is higher
+		// than any revision the item had before
+		res.Revision = uint64(len(log)) + 1
+	}
+	return res, err
+}
+
+// NewItemRevertHistory records that it replaces i by undoing the log entry
+// ref. i is nil if it restores a deleted item.
+func NewItemRevertHistory(i, it *Item, ref bson.ObjectId, user string) *ItemHistory {
+	var res *ItemHistory
+	if i == nil {
+		res = it.snapshot(user, historyCreated)
+	} else {
+		res = i.NewItemHistory(it, user)
+	}
+	res.Item[historyRevert] = ref.Hex()
+	return res
+}
+
+// PolicyAt rebuilds policy name as it was at t, like ItemAt
+func PolicyAt(name string, log []PolicyHistory, cur *Policy, t time.Time) (*Policy, error) {
+	entries, n, err := policyEntries(log, t)
+	if err != nil {
+		return nil, err
+	}
+	doc, err := optDoc(cur != nil, cur)
+	if err != nil {
+		return nil, err
+	}
+	state, exists, err := replay(entries, n, doc, policyFields)
+	if err != nil || !exists {
+		return nil, err
+	}
+	res := new(Policy)
+	err = fromDoc(state, res)
+	res.Name = name
+	return res, err
+}
+
+// RevertPolicy returns the policy cur becomes if the log entry ref is
+// undone, like RevertItem
+func RevertPolicy(name string, log []PolicyHistory, cur *Policy, ref bson.ObjectId) (*Policy, error) {
+	k := -1
+	for i := 0; i != len(log); i++ {
+		if log[i].ID == ref {
+			k = i
+		}
+	}
+	if k == -1 {
+		return nil, ErrNotFound
+	}
+	entries, _, err := policyEntries(log, time.Time{})
+	if err != nil {
+		return nil, err
+	}
+	doc, err := optDoc(cur != nil, cur)
+	if err != nil {
+		return nil, err
+	}
+	state, err := revert(entries, k, doc, policyFields)
+	if err != nil {
+		return nil, err
+	}
+	res := new(Policy)
+	err = fromDoc(state, res)
+	res.Name = name
+	if cur == nil {
+		res.Revision = uint64(len(log)) + 1
+	}
+	return res, err
+}
+
+// NewPolicyRevertHistory records that po replaces p by undoing the log entry
+// ref. p is nil if po restores a deleted policy.
+func NewPolicyRevertHistory(p, po *Policy, ref bson.ObjectId, user string) *PolicyHistory {
+	var res *PolicyHistory
+	if p == nil {
+		res = po.snapshot(user, historyCreated)
+	} else {
+		res = p.NewPolicyHistory(po, user)
+	}
+	res.Policy[historyRevert] = ref.Hex()
+	return res
+}
+
+// itemEntries returns the fields of the log entries in their stored form
+// and how many of them were made at or before t
+func itemEntries(log []ItemHistory, t time.Time) ([]bson.M, int, error) {
+	res := make([]bson.M, len(log))
+	n := 0
+	for i := 0; i != len(log); i++ {
+		doc, err := toDoc(log[i].Item)
+		if err != nil {
+			return nil, 0, err
+		}
+		res[i] = doc
+		if !log[i].Timestamp.After(t) {
+			n = i + 1
+		}
+	}
+	return res, n, nil
+}
+
+func policyEntries(log []PolicyHistory, t time.Time) ([]bson.M, int, error) {
+	res := make([]bson.M, len(log))
+	n := 0
+	for i := 0; i != len(log); i++ {
+		doc, err := toDoc(log[i].Policy)
+		if err != nil {
+			return nil, 0, err
+		}
+		res[i] = doc
+		if !log[i].Timestamp.After(t) {
+			n = i + 1
+		}
+	}
+	return res, n, nil
+}
+
+// optDoc returns the document form of v, or nil if ok is false
+func optDoc(ok bool, v interface{}) (bson.M, error) {
+	if !ok {
+		return nil, nil
+	}
+	return toDoc(v)
+}
+
+// replay rebuilds the document described by the first n entries of log. cur
+// is the stored document, nil if there is none. It also reports whether the
+// document existed at that point.
+func replay(log []bson.M, n int, cur bson.M, fields map[string]fieldKind) (bson.M, bool, error) {
+	res := bson.M{}
+	for f, kind := range fields {
+		v, err := fieldAt(log, n, cur, f, kind)
+		if err != nil {
+			return nil, false, err
+		}
+		if v != nil {
+			res[f] = v
+		}
+	}
+	switch {
+	case n != 0:
+		return res, log[n-1][historyDeleted] != true, nil
+	case len(log) != 0:
+		return res, log[0][historyCreated] != true, nil
+	}
+	return res, cur != nil, nil
+}
+
+// fieldAt returns field f after the first n entries of log. It is taken from
+// the last entry before n which set it. If there is none, the next snapshot,
+// the old text of the next diff or cur tell what it was.
+func fieldAt(log []bson.M, n int, cur bson.M, f string, kind fieldKind) (interface{}, error) {
+	if kind == setField {
+		return setAt(log, n, cur, f)
+	}
+	for i := n - 1; i >= 0; i-- {
+		if v, ok := log[i][f]; ok {
+			return valueAfter(v, kind)
+		}
+		if log[i][historySnapshot] == true {
+			return nil, nil
+		}
+	}
+	for i := n; i != len(log); i++ {
+		v, ok := log[i][f]
+		switch {
+		case log[i][historyCreated] == true:
+			return nil, nil
+		case log[i][historySnapshot] == true && ok:
+			return valueAfter(v, kind)
+		case log[i][historySnapshot] == true:
+			return nil, nil
+		case ok && kind == textField:
+			d, err := historyDiff(v)
+			if err != nil {
+				return nil, err
+			}
+			return dmp.New().DiffText1(d), nil
+		case ok:
+			return nil, ErrHistoryIncomplete
+		}
+	}
+	if cur == nil {
+		return nil, ErrHistoryIncomplete
+	}
+	return cur[f], nil
+}
+
+// setAt returns the set field f after the first n entries of log. Set
+// changes can be undone, so it is replayed forwards from the last snapshot
+// before n or backwards from the next snapshot or cur.
+func setAt(log []bson.M, n int, cur bson.M, f string) (interface{}, error) {
+	for s := n - 1; s >= 0; s-- {
+		if log[s][historySnapshot] == true {
+			set := applySetChange(nil, log[s][f], false)
+			for i := s + 1; i != n; i++ {
+				set = applySetChange(set, log[i][f], false)
+			}
+			return set, nil
+		}
+	}
+	end := n
+	for end != len(log) && log[end][historySnapshot] != true {
+		end++
+	}
+	var set []bson.ObjectId
+	switch {
+	case end != len(log) && log[end][historyCreated] == true:
+		return nil, nil
+	case end != len(log):
+		set = applySetChange(nil, log[end][f], false)
+	case cur == nil:
+		return nil, ErrHistoryIncomplete
+	default:
+		if l, ok := cur[f].([]interface{}); ok {
+			for _, v := range l {
+				if id, ok := v.(bson.ObjectId); ok {
+					set = append(set, id)
+				}
+			}
+		}
+	}
+	for i := end - 1; i >= n; i-- {
+		set = applySetChange(set, log[i][f], true)
+	}
+	return set, nil
+}
+
+// applySetChange applies the recorded set change v to set, or undoes it
+func applySetChange(set []bson.ObjectId, v interface{}, undo bool) []bson.ObjectId {
+	m, ok := v.(bson.M)
+	if !ok {
+		return set
+	}
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		b, err := hex.DecodeString(k)
+		if err != nil {
+			continue
+		}
+		id := bson.ObjectId(b)
+		insert := memFloat(m[k]) == float64(dmp.DiffInsert)
+		pos := -1
+		for i := 0; i != len(set); i++ {
+			if set[i] == id {
+				pos = i
+			}
+		}
+		switch {
+		case insert != undo && pos == -1:
+			set = append(set, id)
+		case insert == undo && pos != -1:
+			set = append(set[:pos], set[pos+1:]...)
+		}
+	}
+	return set
+}
+
+// valueAfter returns the value a field has after an entry recorded v
+func valueAfter(v interface{}, kind fieldKind) (interface{}, error) {
+	if kind != textField {
+		return v, nil
+	}
+	d, err := historyDiff(v)
+	if err != nil {
+		return nil, err
+	}
+	return dmp.New().DiffText2(d), nil
+}
+
+// historyDiff decodes a diff read from the history
+func historyDiff(v interface{}) ([]dmp.Diff, error) {
+	var res struct {
+		D []dmp.Diff
+	}
+	err := fromDoc(bson.M{"d": v}, &res)
+	return res.D, err
+}
+
+// revert returns the document cur becomes if entry k of log is undone
+func revert(log []bson.M, k int, cur bson.M, fields map[string]fieldKind) (bson.M, error) {
+	e := log[k]
+	if e[historyCreated] == true {
+		return nil, ErrNotRevertable
+	}
+	if e[historyDeleted] == true {
+		if cur != nil || k != len(log)-1 {
+			return nil, ErrRevertConflict
+		}
+		res, _, err := replay(log, k, nil, fields)
+		return res, err
+	}
+	if cur == nil {
+		return nil, ErrRevertConflict
+	}
+	res := bson.M{}
+	for f, v := range cur {
+		res[f] = v
+	}
+	for f, kind := range fields {
+		if _, ok := e[f]; !ok {
+			continue
+		}
+		if kind == setField || kind == managedField {
+			return nil, ErrNotRevertable
+		}
+		before, err := fieldAt(log, k, cur, f, kind)
+		if err != nil {
+			return nil, err
+		}
+		after, err := fieldAt(log, k+1, cur, f, kind)
+		if err != nil {
+			return nil, err
+		}
+		v := before
+		if kind == textField {
+			d := dmp.New()
+			text, _ := cur[f].(string)
+			old, _ := before.(string)
+			changed, _ := after.(string)
+			var applied []bool
+			v, applied = d.PatchApply(d.PatchMake(changed, old), text)
+			for _, ok := range applied {
+				if !ok {
+					return nil, ErrRevertConflict
+				}
+			}
+		} else if !sameValue(cur[f], after) {
+			return nil, ErrRevertConflict
+		}
+		if isZero(v) {
+			delete(res, f)
+		} else {
+			res[f] = v
+		}
+	}
+	return res, nil
+}
+
+func isZero(v interface{}) bool {
+	return v == nil || v == "" || (memRank(v) == 2 && memFloat(v) == 0)
+}
+
+// sameValue compares field values, a missing field equals its zero value
+func sameValue(a, b interface{}) bool {
+	if isZero(a) || isZero(b) {
+		return isZero(a) && isZero(b)
+	}
+	return memEqual(a, b)
+}
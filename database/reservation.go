@@ -0,0 +1,206 @@
+/*
+ *    Copyright (C) 2015 Stefan Luecke
+ *
+ *    This program is free software: you can redistribute it and/or modify
+ *    it under the terms of the GNU Affero General Public License as published
+ *    by the Free Software Foundation, either version 3 of the License, or
+ *    (at your option) any later version.
+ *
+ *    This program is distributed in the hope that it will be useful,
+ *    but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *    GNU Affero General Public License for more details.
+ *
+ *    You should have received a copy of the GNU Affero General Public License
+ *    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ *    Authors: Stefan Luecke <glaxx@glaxx.net>
+ */
+
+package database
+
+import (
+	"errors"
+	log "github.com/Sirupsen/logrus"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"time"
+)
+
+var (
+	ErrReservationConflict = errors.New("The item is already reserved for this time")
+	ErrReservationInvalid  = errors.New("A reservation has to end after it starts")
+	ErrReservationBusy     = errors.New("The reservations of the item are being changed, try again")
+)
+
+// reservationLockTimeout is the age after which the reservation lock of an
+// item is broken, its holder is assumed to be dead
+const reservationLockTimeout = 10 * time.Second
+
+// reservationLockWait is the time a writer waits for the reservation lock of
+// an item before it gives up
+const reservationLockWait = 5 * time.Second
+
+type ReservationDBProvider struct {
+	c *mgo.Collection
+	l *mgo.Collection // one lock document with a version per item
+}
+
+func NewReservationDBProvider(s *mgo.Session, dbname string) *ReservationDBProvider {
+	res := new(ReservationDBProvider)
+	res.c = s.DB(dbname).C("reservation")
+	res.l = s.DB(dbname).C("reservation_lock")
+	err := res.c.EnsureIndexKey("item", "start")
+	if err != nil {
+		log.WithFields(log.Fields{"Err": err}).Warn("Could not create reservation index")
+	}
+	return res
+}
+
+// Reservation books an item for the time between Start and End. Deleted is
+// only set on the copy which is broadcast when a reservation is removed.
+type Reservation struct {
+	ID      bson.ObjectId `bson:"_id,omitempty" json:"Id"`
+	Item    uint64
+	User    string
+	Start   time.Time
+	End     time.Time
+	Comment string `bson:",omitempty"`
+	Deleted bool   `bson:"-" json:",omitempty"`
+}
+
+// conflictQuery selects the reservations of the item of r which overlap r
+func conflictQuery(r *Reservation) bson.M {
+	q := bson.M{
+		"item":  r.Item,
+		"start": bson.M{"$lt": r.End},
+		"end":   bson.M{"$gt": r.Start},
+	}
+	if r.ID != "" {
+		q["_id"] = bson.M{"$ne": r.ID}
+	}
+	return q
+}
+
+// reservationQuery selects the reservations returned by GetReservations
+func reservationQuery(item uint64, user string, from, to time.Time) bson.M {
+	q := bson.M{}
+	if item != 0 {
+		q["item"] = item
+	}
+	if user != "" {
+		q["user"] = user
+	}
+	if !from.IsZero() {
+		q["end"] = bson.M{"$gt": from}
+	}
+	if !to.IsZero() {
+		q["start"] = bson.M{"$lt": to}
+	}
+	return q
+}
+
+// checkConflict verifies that r is valid and does not overlap any other
+// reservation of the same item.
+func (p *ReservationDBProvider) checkConflict(r *Reservation) error {
+	if !r.End.After(r.Start) {
+		return ErrReservationInvalid
+	}
+	n, err := p.c.Find(conflictQuery(r)).Count()
+	if err != nil {
+		return err
+	}
+	if n != 0 {
+		return ErrReservationConflict
+	}
+	return nil
+}
+
+// lock serializes the writers of the reservations of item, which may be
+// other lsmsd processes, so no two of them pass checkConflict for
+// overlapping reservations. The lock is a per-item document which is taken
+// with a single findAndModify, bumping its version, and it is given up after
+// reservationLockWait. The returned function releases the lock.
+func (p *ReservationDBProvider) lock(item uint64) (func(), error) {
+	var l struct {
+		Version uint64
+	}
+	deadline := time.Now().Add(reservationLockWait)
+	for {
+		now := time.Now()
+		_, err := p.l.Find(bson.M{
+			"_id": item,
+			"$or": []bson.M{{"holder": false}, {"expires": bson.M{"$lt": now}}},
+		}).Apply(mgo.Change{
+			Update: bson.M{
+				"$set": bson.M{"holder": true, "expires": now.Add(reservationLockTimeout)},
+				"$inc": bson.M{"version": 1},
+			},
+			Upsert:    true,
+			ReturnNew: true,
+		}, &l)
+		if err == nil {
+			break
+		}
+		// the document exists but is held by someone else
+		if !mgo.IsDup(err) {
+			return nil, err
+		}
+		if now.After(deadline) {
+			return nil, ErrReservationBusy
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return func() {
+		err := p.l.Update(bson.M{"_id": item, "version": l.Version}, bson.M{"$set": bson.M{"holder": false}})
+		if err != nil {
+			log.WithFields(log.Fields{"Item": item, "Err": err}).Warn("Could not release reservation lock")
+		}
+	}, nil
+}
+
+func (p *ReservationDBProvider) CreateReservation(r *Reservation) error {
+	unlock, err := p.lock(r.Item)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	err = p.checkConflict(r)
+	if err != nil {
+		return err
+	}
+	r.ID = bson.NewObjectId()
+	return p.c.Insert(r)
+}
+
+func (p *ReservationDBProvider) UpdateReservation(r *Reservation) error {
+	unlock, err := p.lock(r.Item)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	err = p.checkConflict(r)
+	if err != nil {
+		return err
+	}
+	return p.c.UpdateId(r.ID, r)
+}
+
+func (p *ReservationDBProvider) DeleteReservation(id bson.ObjectId) error {
+	return p.c.RemoveId(id)
+}
+
+func (p *ReservationDBProvider) GetReservationById(id bson.ObjectId) (Reservation, error) {
+	res := Reservation{}
+	err := p.c.FindId(id).One(&res)
+	return res, err
+}
+
+// GetReservations returns the reservations of an item (if item is not 0) or
+// of a user (if user is not empty) which overlap the time between from and
+// to, ordered by their start. A zero from or to leaves the interval open.
+func (p *ReservationDBProvider) GetReservations(item uint64, user string, from, to time.Time) ([]Reservation, error) {
+	res := make([]Reservation, 0)
+	err := p.c.Find(reservationQuery(item, user, from, to)).Sort("start").All(&res)
+	return res, err
+}
@@ -0,0 +1,38 @@
+/*
+ *    Copyright (C) 2015 Stefan Luecke
+ *
+ *    This program is free software: you can redistribute it and/or modify
+ *    it under the terms of the GNU Affero General Public License as published
+ *    by the Free Software Foundation, either version 3 of the License, or
+ *    (at your option) any later version.
+ *
+ *    This program is distributed in the hope that it will be useful,
+ *    but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *    GNU Affero General Public License for more details.
+ *
+ *    You should have received a copy of the GNU Affero General Public License
+ *    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ *    Authors: Stefan Luecke <glaxx@glaxx.net>
+ */
+
+package database
+
+import (
+	"errors"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// ErrRevisionConflict is returned by updates and deletes if the stored object
+// is no longer at the revision the caller based its change on.
+var ErrRevisionConflict = errors.New("The object was changed in the meantime")
+
+// revisionQuery selects documents at revision rev. Documents stored before
+// revisions were introduced have none and count as revision 0.
+func revisionQuery(rev uint64) interface{} {
+	if rev == 0 {
+		return bson.M{"$exists": false}
+	}
+	return rev
+}
@@ -0,0 +1,262 @@
+/*
+ *    Copyright (C) 2015 Stefan Luecke
+ *
+ *    This program is free software: you can redistribute it and/or modify
+ *    it under the terms of the GNU Affero General Public License as published
+ *    by the Free Software Foundation, either version 3 of the License, or
+ *    (at your option) any later version.
+ *
+ *    This program is distributed in the hope that it will be useful,
+ *    but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *    GNU Affero General Public License for more details.
+ *
+ *    You should have received a copy of the GNU Affero General Public License
+ *    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ *    Authors: Stefan Luecke <glaxx@glaxx.net>
+ */
+
+package database
+
+import (
+	"bytes"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"html"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	SearchTypeItem   = "item"
+	SearchTypePolicy = "policy"
+	SearchTypeUser   = "user"
+
+	snippetRadius = 60
+)
+
+// SearchResult is a single hit of a full text search. Id is the EID of an
+// item or the name of a policy or user. Snippet is HTML escaped text with
+// the matches enclosed in <em> tags.
+type SearchResult struct {
+	Type    string
+	Id      string
+	Name    string
+	Score   float64
+	Snippet string
+}
+
+// ensureTextIndex creates the text index used by the Search methods. The
+// language is set to none, so words are neither stemmed nor dropped as stop
+// words; our descriptions are a wild mix of german and english anyway.
+func ensureTextIndex(c *mgo.Collection, weights map[string]int) error {
+	idx := mgo.Index{
+		Key:             make([]string, 0, len(weights)),
+		Weights:         weights,
+		DefaultLanguage: "none",
+		Name:            "search",
+	}
+	for f := range weights {
+		idx.Key = append(idx.Key, "$text:"+f)
+	}
+	return c.EnsureIndex(idx)
+}
+
+// textSearch runs a text search for term on c and stores the limit best
+// matches in res, which has to be a pointer to a slice of structs with a
+// Score field. It returns the total number of matches.
+func textSearch(c *mgo.Collection, term string, limit int, res interface{}) (int, error) {
+	q := c.Find(bson.M{"$text": bson.M{"$search": term}})
+	total, err := q.Count()
+	if err != nil {
+		return 0, err
+	}
+	q = q.Select(bson.M{"score": bson.M{"$meta": "textScore"}}).Sort("$textScore:score")
+	if limit > 0 {
+		q = q.Limit(limit)
+	}
+	return total, q.All(res)
+}
+
+// Search returns the limit best matching items for term together with the
+// total number of matches. Name and Description are searched.
+func (p *ItemDBProvider) Search(term string, limit int) ([]SearchResult, int, error) {
+	hits := make([]struct {
+		Item  `bson:",inline"`
+		Score float64 `bson:"score"`
+	}, 0)
+	total, err := textSearch(p.c, term, limit, &hits)
+	if err != nil {
+		return nil, 0, err
+	}
+	res := make([]SearchResult, len(hits))
+	for i, h := range hits {
+		res[i] = itemResult(term, &h.Item, h.Score)
+	}
+	return res, total, nil
+}
+
+func itemResult(term string, itm *Item, score float64) SearchResult {
+	return SearchResult{
+		Type:    SearchTypeItem,
+		Id:      strconv.FormatUint(itm.EID, 10),
+		Name:    itm.Name,
+		Score:   score,
+		Snippet: Snippet(term, itm.Description, itm.Name),
+	}
+}
+
+// Search returns the limit best matching policies for term together with
+// the total number of matches. Name and Description are searched.
+func (p *PolicyDBProvider) Search(term string, limit int) ([]SearchResult, int, error) {
+	hits := make([]struct {
+		Policy `bson:",inline"`
+		Score  float64 `bson:"score"`
+	}, 0)
+	total, err := textSearch(p.c, term, limit, &hits)
+	if err != nil {
+		return nil, 0, err
+	}
+	res := make([]SearchResult, len(hits))
+	for i, h := range hits {
+		res[i] = policyResult(term, &h.Policy, h.Score)
+	}
+	return res, total, nil
+}
+
+func policyResult(term string, pol *Policy, score float64) SearchResult {
+	return SearchResult{
+		Type:    SearchTypePolicy,
+		Id:      pol.Name,
+		Name:    pol.Name,
+		Score:   score,
+		Snippet: Snippet(term, pol.Description, pol.Name),
+	}
+}
+
+// Search returns the limit best matching users for term together with the
+// total number of matches. Only user names are searched.
+func (p *UserDBProvider) Search(term string, limit int) ([]SearchResult, int, error) {
+	hits := make([]struct {
+		User  `bson:",inline"`
+		Score float64 `bson:"score"`
+	}, 0)
+	total, err := textSearch(p.c, term, limit, &hits)
+	if err != nil {
+		return nil, 0, err
+	}
+	res := make([]SearchResult, len(hits))
+	for i, h := range hits {
+		res[i] = userResult(term, &h.User, h.Score)
+	}
+	return res, total, nil
+}
+
+func userResult(term string, usr *User, score float64) SearchResult {
+	return SearchResult{
+		Type:    SearchTypeUser,
+		Id:      usr.Name,
+		Name:    usr.Name,
+		Score:   score,
+		Snippet: Snippet(term, usr.Name),
+	}
+}
+
+// Snippet returns an excerpt of the first text containing one of the words
+// of term as HTML. All occurences of those words are enclosed in <em> tags.
+// If no text matches, the beginning of the first non empty text is returned.
+func Snippet(term string, texts ...string) string {
+	words := searchWords(term)
+	for _, t := range texts {
+		for _, w := range words {
+			if i := indexFold(t, w); i >= 0 {
+				return highlight(excerpt(t, i, i+len(w)), words)
+			}
+		}
+	}
+	for _, t := range texts {
+		if t != "" {
+			return html.EscapeString(excerpt(t, 0, 0))
+		}
+	}
+	return ""
+}
+
+// searchWords splits a text search string into lower case words, dropping
+// negations and quotes.
+func searchWords(term string) []string {
+	res := make([]string, 0)
+	for _, w := range strings.Fields(strings.ToLower(term)) {
+		w = strings.Trim(w, "\"")
+		if w == "" || strings.HasPrefix(w, "-") {
+			continue
+		}
+		res = append(res, w)
+	}
+	return res
+}
+
+// excerpt cuts about snippetRadius bytes around t[start:end] out of t,
+// without splitting words or runes.
+func excerpt(t string, start, end int) string {
+	from := start - snippetRadius
+	prefix := "…"
+	if from <= 0 {
+		from = 0
+		prefix = ""
+	} else if i := strings.IndexAny(t[from:start], " \n\t"); i >= 0 {
+		from += i + 1
+	}
+	to := end + snippetRadius
+	suffix := "…"
+	if to >= len(t) {
+		to = len(t)
+		suffix = ""
+	} else if i := strings.LastIndexAny(t[end:to], " \n\t"); i >= 0 {
+		to = end + i
+	}
+	for from < len(t) && !utf8.RuneStart(t[from]) {
+		from++
+	}
+	for to < len(t) && !utf8.RuneStart(t[to]) {
+		to++
+	}
+	return prefix + strings.TrimSpace(t[from:to]) + suffix
+}
+
+// highlight encloses the occurences of words in t in <em> tags. The text
+// itself is HTML escaped, so the result can be used as markup.
+func highlight(t string, words []string) string {
+	res := new(bytes.Buffer)
+	plain := 0
+	for i := 0; i < len(t); {
+		matched := 0
+		for _, w := range words {
+			if len(w) > matched && i+len(w) <= len(t) && strings.EqualFold(t[i:i+len(w)], w) {
+				matched = len(w)
+			}
+		}
+		if matched == 0 {
+			i++
+			continue
+		}
+		res.WriteString(html.EscapeString(t[plain:i]))
+		res.WriteString("<em>" + html.EscapeString(t[i:i+matched]) + "</em>")
+		i += matched
+		plain = i
+	}
+	res.WriteString(html.EscapeString(t[plain:]))
+	return res.String()
+}
+
+// indexFold is a case insensitive strings.Index
+func indexFold(s, substr string) int {
+	for i := 0; i+len(substr) <= len(s); i++ {
+		if strings.EqualFold(s[i:i+len(substr)], substr) {
+			return i
+		}
+	}
+	return -1
+}
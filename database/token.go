@@ -0,0 +1,171 @@
+/*
+ *    Copyright (C) 2015 Stefan Luecke
+ *
+ *    This program is free software: you can redistribute it and/or modify
+ *    it under the terms of the GNU Affero General Public License as published
+ *    by the Free Software Foundation, either version 3 of the License, or
+ *    (at your option) any later version.
+ *
+ *    This program is distributed in the hope that it will be useful,
+ *    but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *    GNU Affero General Public License for more details.
+ *
+ *    You should have received a copy of the GNU Affero General Public License
+ *    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ *    Authors: Stefan Luecke <glaxx@glaxx.net>
+ */
+
+package database
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	log "github.com/Sirupsen/logrus"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"time"
+)
+
+const (
+	TokenSession       = "session"
+	TokenAPI           = "api"
+	TokenPasswordReset = "reset"
+	TokenVerifyEMail   = "verify"
+
+	SessionLifetime       = 24 * time.Hour
+	PasswordResetLifetime = time.Hour
+	VerifyEMailLifetime   = 7 * 24 * time.Hour
+	tokenSize             = 32
+)
+
+type TokenDBProvider struct {
+	c *mgo.Collection
+}
+
+func NewTokenDBProvider(s *mgo.Session, dbname string) *TokenDBProvider {
+	res := new(TokenDBProvider)
+	res.c = s.DB(dbname).C("token")
+	err := res.c.EnsureIndex(mgo.Index{Key: []string{"hash"}, Unique: true})
+	if err != nil {
+		log.WithFields(log.Fields{"Err": err}).Warn("Could not create token index")
+	}
+	// let mongodb clean up expired sessions; tokens without expiry are kept
+	err = res.c.EnsureIndex(mgo.Index{Key: []string{"expires"}, ExpireAfter: time.Second})
+	if err != nil {
+		log.WithFields(log.Fields{"Err": err}).Warn("Could not create token expiry index")
+	}
+	return res
+}
+
+// Token is a credential which can be used instead of the password of User.
+// Only a hash of the secret is stored, the secret itself is handed out once
+// on creation.
+type Token struct {
+	ID       bson.ObjectId `bson:"_id,omitempty" json:"Id"`
+	Name     string        `description:"Name of the token, e.g. the script using it"`
+	User     string
+	Kind     string `description:"session or api"`
+	Hash     string `json:"-"`
+	Created  time.Time
+	Expires  time.Time `bson:",omitempty" json:",omitempty" description:"Time the token stops working, if any"`
+	LastUsed time.Time `bson:",omitempty" json:",omitempty"`
+}
+
+func hashToken(secret string) string {
+	h := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(h[:])
+}
+
+// newToken generates a token and its secret
+func newToken(user, name, kind string, expires time.Time) (*Token, string, error) {
+	b := make([]byte, tokenSize)
+	_, err := rand.Read(b)
+	if err != nil {
+		return nil, "", err
+	}
+	secret := hex.EncodeToString(b)
+	t := &Token{
+		ID:      bson.NewObjectId(),
+		Name:    name,
+		User:    user,
+		Kind:    kind,
+		Hash:    hashToken(secret),
+		Created: time.Now(),
+		Expires: expires,
+	}
+	return t, secret, nil
+}
+
+// CreateToken stores a new token for user and returns it together with its
+// secret. A zero expires creates a token which is valid until revoked.
+func (p *TokenDBProvider) CreateToken(user, name, kind string, expires time.Time) (*Token, string, error) {
+	t, secret, err := newToken(user, name, kind, expires)
+	if err != nil {
+		return nil, "", err
+	}
+	err = p.c.Insert(t)
+	if err != nil {
+		return nil, "", err
+	}
+	return t, secret, nil
+}
+
+func validToken(secret string, kinds ...string) bson.M {
+	return bson.M{
+		"hash": hashToken(secret),
+		"kind": bson.M{"$in": kinds},
+		"$or": []bson.M{
+			{"expires": bson.M{"$exists": false}},
+			{"expires": bson.M{"$gt": time.Now()}},
+		},
+	}
+}
+
+// GetTokenBySecret returns the session or API token belonging to secret
+// unless it has expired. API tokens are stamped with the time of their last
+// use.
+func (p *TokenDBProvider) GetTokenBySecret(secret string) (Token, error) {
+	res := Token{}
+	now := time.Now()
+	err := p.c.Find(validToken(secret, TokenSession, TokenAPI)).One(&res)
+	if err != nil {
+		return res, err
+	}
+	if res.Kind == TokenAPI {
+		res.LastUsed = now
+		err = p.c.UpdateId(res.ID, bson.M{"$set": bson.M{"lastused": now}})
+	}
+	return res, err
+}
+
+// ConsumeToken removes the token of the given kind belonging to secret and
+// returns it. Single use tokens like password resets are redeemed this way.
+func (p *TokenDBProvider) ConsumeToken(secret, kind string) (Token, error) {
+	res := Token{}
+	_, err := p.c.Find(validToken(secret, kind)).Apply(mgo.Change{Remove: true}, &res)
+	return res, err
+}
+
+func (p *TokenDBProvider) ListTokens(user, kind string) ([]Token, error) {
+	res := make([]Token, 0)
+	err := p.c.Find(bson.M{"user": user, "kind": kind}).Sort("created").All(&res)
+	return res, err
+}
+
+func (p *TokenDBProvider) DeleteToken(user string, id bson.ObjectId) error {
+	return p.c.Remove(bson.M{"_id": id, "user": user})
+}
+
+// DeleteUserTokens revokes the tokens of user. If kinds are given, only
+// tokens of these kinds are revoked.
+func (p *TokenDBProvider) DeleteUserTokens(user string, kinds ...string) error {
+	sel := bson.M{"user": user}
+	if len(kinds) != 0 {
+		sel["kind"] = bson.M{"$in": kinds}
+	}
+	_, err := p.c.RemoveAll(sel)
+	return err
+}
@@ -27,27 +27,84 @@ import (
 
 type UserDBProvider struct {
 	c *mgo.Collection
-	i *ItemDBProvider
-	p *PolicyDBProvider
+	i ItemProvider
+	p PolicyProvider
 }
 
-func NewUserDBProvider(s *mgo.Session, i *ItemDBProvider, p *PolicyDBProvider, dbname string) *UserDBProvider {
+func NewUserDBProvider(s *mgo.Session, i ItemProvider, p PolicyProvider, dbname string) *UserDBProvider {
 	res := new(UserDBProvider)
 	res.c = s.DB(dbname).C("user")
 	res.i = i
 	res.p = p
+	err := ensureTextIndex(res.c, map[string]int{"name": 1})
+	if err != nil {
+		log.WithFields(log.Fields{"Err": err}).Warn("Could not create user search index")
+	}
 	return res
 }
 
+const (
+	RoleAdmin      = "admin"
+	RoleMaintainer = "maintainer"
+	RoleMember     = "member"
+	RoleGuest      = "guest"
+)
+
 type User struct {
-	ID       bson.ObjectId `bson:"_id,omitempty" json:"-"`
-	Name     string        `description:"The unique identifier of a user. Let your user know that they should choose it wisely"`
-	EMail    string
-	Password string `bson:"-" json:",omitempty" description:"Use this field to set a new password. This field will never occour in responses."`
+	ID         bson.ObjectId `bson:"_id,omitempty" json:"-"`
+	Name       string        `description:"The unique identifier of a user. Let your user know that they should choose it wisely"`
+	EMail      string
+	Password   string   `bson:"-" json:",omitempty" description:"Use this field to set a new password. This field will never occour in responses."`
+	Role       string   `bson:",omitempty" description:"One of admin, maintainer, member or guest. Can only be changed by admins"`
+	Unverified bool     `bson:",omitempty" json:",omitempty" description:"Set until the user confirmed their email address"`
+	MuteMail   []string `bson:",omitempty" json:",omitempty" description:"Event types (ItemHistory, PolicyHistory) the user does not want to receive emails for"`
 
 	Secret Secret `json:"-"`
 }
 
+// EffectiveRole returns the role of u. Users registered before roles were
+// introduced have none and are treated as members, users who did not verify
+// their email address yet are guests.
+func (u *User) EffectiveRole() string {
+	if u.Unverified {
+		return RoleGuest
+	}
+	if u.Role == "" {
+		return RoleMember
+	}
+	return u.Role
+}
+
+// ValidRole reports whether role is one of the known roles
+func ValidRole(role string) bool {
+	switch role {
+	case RoleAdmin, RoleMaintainer, RoleMember, RoleGuest:
+		return true
+	}
+	return false
+}
+
+const (
+	MailEventItem   = "ItemHistory"
+	MailEventPolicy = "PolicyHistory"
+)
+
+// ValidMailEvent reports whether event is a type of change users can
+// receive emails about
+func ValidMailEvent(event string) bool {
+	return event == MailEventItem || event == MailEventPolicy
+}
+
+// WantsMail reports whether u has not opted out of emails about event
+func (u *User) WantsMail(event string) bool {
+	for _, m := range u.MuteMail {
+		if m == event {
+			return false
+		}
+	}
+	return true
+}
+
 type UserActionHistory struct {
 	ItemChanges   []ItemHistory
 	PolicyChanges []PolicyHistory
@@ -74,16 +131,45 @@ func (p *UserDBProvider) GetUserLogByName(name string) (*UserActionHistory, erro
 	return ul, nil
 }
 
-func (p *UserDBProvider) ListUser() ([]User, error) {
+// ListUser returns the users selected by q and the total number of users
+// matching its filter. A nil query lists all users.
+func (p *UserDBProvider) ListUser(q *Query) ([]User, int, error) {
 	usr := make([]User, 0)
-	err := p.c.Find(nil).All(&usr)
-	return usr, err
+	res, total, err := q.find(p.c)
+	if err != nil {
+		return usr, 0, err
+	}
+	err = res.All(&usr)
+	return usr, total, err
 }
 
 func (p *UserDBProvider) UpdateUser(usr *User) error {
 	return p.c.Update(bson.M{"name": usr.Name}, usr)
 }
 
+func (p *UserDBProvider) SetRole(name, role string) error {
+	return p.c.Update(bson.M{"name": name}, bson.M{"$set": bson.M{"role": role}})
+}
+
+// SetSecret replaces the password hash of user name
+func (p *UserDBProvider) SetSecret(name string, sec Secret) error {
+	return p.c.Update(bson.M{"name": name}, bson.M{"$set": bson.M{"secret": sec}})
+}
+
+// SetVerified marks the email address of user name as confirmed and
+// promotes the user to a member if they are a guest
+func (p *UserDBProvider) SetVerified(name string) error {
+	err := p.c.Update(bson.M{"name": name}, bson.M{"$unset": bson.M{"unverified": ""}})
+	if err != nil {
+		return err
+	}
+	err = p.c.Update(bson.M{"name": name, "role": RoleGuest}, bson.M{"$set": bson.M{"role": RoleMember}})
+	if err == mgo.ErrNotFound {
+		return nil
+	}
+	return err
+}
+
 func (p *UserDBProvider) CreateUser(usr *User) error {
 	return p.c.Insert(usr)
 }
@@ -0,0 +1,116 @@
+/*
+ *    Copyright (C) 2015 Stefan Luecke
+ *
+ *    This program is free software: you can redistribute it and/or modify
+ *    it under the terms of the GNU Affero General Public License as published
+ *    by the Free Software Foundation, either version 3 of the License, or
+ *    (at your option) any later version.
+ *
+ *    This program is distributed in the hope that it will be useful,
+ *    but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *    GNU Affero General Public License for more details.
+ *
+ *    You should have received a copy of the GNU Affero General Public License
+ *    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ *    Authors: Stefan Luecke <glaxx@glaxx.net>
+ */
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	db "github.com/openlab-aux/lsmsd/database"
+	"gopkg.in/mgo.v2"
+	"os"
+)
+
+// fsck implements "lsmsd fsck", which checks the references between items,
+// files, users and policies and the item id counter. It exits with status 1
+// if problems were found and not repaired. A bolt database file can not be
+// checked while lsmsd is running, use GET /audit/fsck then.
+func fsck(args []string) {
+	fs := flag.NewFlagSet("fsck", flag.ExitOnError)
+	var repair = fs.Bool("repair", false, "remove unreferenced files and references to missing entities")
+	var user = fs.String("user", "fsck", "user recorded in the item history for repairs")
+	cfg := toolConfig(fs, args)
+
+	var (
+		itemp db.ItemProvider
+		polp  db.PolicyProvider
+		userp db.UserProvider
+		imgp  db.ImageProvider
+		attp  db.AttachmentProvider
+	)
+	switch cfg.Database.Backend {
+	case "", "mongodb":
+		s, err := mgo.Dial(cfg.Database.Server)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer s.Close()
+		imgp = db.NewImageDBProvider(s, cfg.Database.DB)
+		attp = db.NewAttachmentDBProvider(s, cfg.Database.DB)
+		itemp = db.NewItemDBProvider(s, cfg.Database.DB, imgp)
+		polp = db.NewPolicyDBProvider(s, cfg.Database.DB)
+		userp = db.NewUserDBProvider(s, itemp, polp, cfg.Database.DB)
+	case "bolt":
+		b, err := db.OpenBoltStore(cfg.Database.File)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer b.Close()
+		imgp, err = db.NewImageBoltProvider(b)
+		if err != nil {
+			log.Fatal(err)
+		}
+		attp, err = db.NewAttachmentBoltProvider(b)
+		if err != nil {
+			log.Fatal(err)
+		}
+		itemp, err = db.NewItemBoltProvider(b, imgp)
+		if err != nil {
+			log.Fatal(err)
+		}
+		polp, err = db.NewPolicyBoltProvider(b)
+		if err != nil {
+			log.Fatal(err)
+		}
+		userp, err = db.NewUserBoltProvider(b, itemp, polp)
+		if err != nil {
+			log.Fatal(err)
+		}
+	default:
+		log.WithFields(log.Fields{"Backend": cfg.Database.Backend}).Fatal("Backend is not persistent")
+	}
+
+	r, err := db.Fsck(itemp, polp, userp, imgp, attp, *repair, *user)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("%v items, %v images, %v attachments, item id counter at %v, highest item id %v\n",
+		r.Items, r.Images, r.Attachments, r.Counter, r.MaxID)
+	clean := true
+	for _, p := range r.Problems {
+		fmt.Printf("  %v", p.Problem)
+		if p.Item != 0 {
+			fmt.Printf(" (item %v", p.Item)
+			if p.Field != "" {
+				fmt.Printf(", %v", p.Field)
+			}
+			fmt.Print(")")
+		}
+		fmt.Printf(": %v", p.Ref)
+		if p.Repaired {
+			fmt.Print(", repaired")
+		}
+		fmt.Println()
+		clean = clean && p.Repaired
+	}
+	if !clean {
+		os.Exit(1)
+	}
+}
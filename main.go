@@ -29,6 +29,10 @@ import (
 	"github.com/openlab-aux/lsmsd/webservice"
 
 	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"syscall"
 	//	"time"
 	"github.com/emicklei/go-restful-swagger12"
 	"gopkg.in/gcfg.v1"
@@ -38,16 +42,35 @@ import (
 type Config struct {
 	Network struct {
 		ListenTo string
+		// address under which clients reach the api, used in emails
+		PublicURL string
 	}
 	Crypto struct {
 		Enabled     bool
 		Certificate string
 		KeyFile     string
 		Pepperfile  string
+		// one of argon2id, scrypt or bcrypt
+		PasswordHash string
 	}
 	Database struct {
-		Server string
-		DB     string
+		// mongodb, bolt or memory. bolt stores everything in File,
+		// memory keeps everything in RAM and forgets it on exit
+		Backend string
+		Server  string
+		DB      string
+		File    string
+	}
+	Images struct {
+		// largest accepted upload in bytes
+		MaxUploadSize int64
+	}
+	Attachments struct {
+		// largest accepted upload in bytes
+		MaxUploadSize int64
+	}
+	Auth struct {
+		Admin []string
 	}
 	Mail    notification.Mailconfig
 	Logging struct {
@@ -62,8 +85,10 @@ const (
 	defaultCrypto            = false
 	defaultCertificate       = "./cert.pem"
 	defaultKeyfile           = "keyfile.key"
+	defaultDatabaseBackend   = "mongodb"
 	defaultDatabaseServer    = "localhost"
 	defaultDatabase          = "lsmsd"
+	defaultDatabaseFile      = "./lsmsd.db"
 	defaultPepperfile        = "./.pepper"
 	defaultMailEnabled       = false
 	defaultMailStartTLS      = true
@@ -74,6 +99,18 @@ const (
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		migrate(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "audit" {
+		audit(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "fsck" {
+		fsck(os.Args[2:])
+		return
+	}
 	log.WithFields(log.Fields{"Version": "0.1"}).Info("lsmsd starting")
 	var cfg Config
 	var configpath = flag.String("cfgpath", defaultConfigPath, "path to your config file")
@@ -85,8 +122,10 @@ func main() {
 	var pepper = flag.String("pepper", defaultPepperfile, "path to your pepperfile")
 	var keyfile = flag.String("keyfile", defaultKeyfile, "private key path")
 
+	var dbbackend = flag.String("dbbackend", defaultDatabaseBackend, "storage backend, mongodb, bolt or memory")
 	var dbserver = flag.String("dbserver", defaultDatabaseServer, "address of your mongo db server")
 	var dbdb = flag.String("dbdb", defaultDatabase, "default database name")
+	var dbfile = flag.String("dbfile", defaultDatabaseFile, "database file of the bolt backend")
 
 	var mailenabled = flag.Bool("enablemail", defaultMailEnabled, "enable email notifications")
 	var mailstarttls = flag.Bool("mailtls", defaultMailStartTLS, "use TLS when sending emails")
@@ -116,12 +155,18 @@ func main() {
 	if *keyfile != defaultKeyfile {
 		cfg.Crypto.KeyFile = *keyfile
 	}
+	if *dbbackend != defaultDatabaseBackend {
+		cfg.Database.Backend = *dbbackend
+	}
 	if *dbserver != defaultDatabaseServer {
 		cfg.Database.Server = *dbserver
 	}
 	if *dbdb != defaultDatabase {
 		cfg.Database.DB = *dbdb
 	}
+	if *dbfile != defaultDatabaseFile {
+		cfg.Database.File = *dbfile
+	}
 	if *pepper != defaultPepperfile {
 		cfg.Crypto.Pepperfile = *pepper
 	}
@@ -152,31 +197,159 @@ func main() {
 		restful.EnableTracing(true)
 	}
 
-	// Test DB Connection
-	log.Info("Test database connection …")
-	s, err := mgo.Dial(cfg.Database.Server)
-	if err != nil {
-		log.Fatal(err)
+	if cfg.Crypto.Pepperfile == "" {
+		cfg.Crypto.Pepperfile = defaultPepperfile
 	}
-	log.Info("Connection successful")
-	defer s.Close()
+	db.ReadPepper(cfg.Crypto.Pepperfile)
+	if cfg.Crypto.PasswordHash != "" {
+		err = db.SetPasswordHasher(cfg.Crypto.PasswordHash, nil)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	var (
+		imgp     db.ImageProvider
+		attp     db.AttachmentProvider
+		itemp    db.ItemProvider
+		polp     db.PolicyProvider
+		userp    db.UserProvider
+		loanp    db.LoanProvider
+		resp     db.ReservationProvider
+		tokp     db.TokenProvider
+		deferred *mgo.Collection
+	)
+	switch cfg.Database.Backend {
+	case "", "mongodb":
+		// Test DB Connection
+		log.Info("Test database connection …")
+		s, err := mgo.Dial(cfg.Database.Server)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Info("Connection successful")
+		defer s.Close()
 
-	imgp := db.NewImageDBProvider(s, cfg.Database.DB)
-	itemp := db.NewItemDBProvider(s, cfg.Database.DB, imgp)
-	polp := db.NewPolicyDBProvider(s, cfg.Database.DB)
-	userp := db.NewUserDBProvider(s, itemp, polp, cfg.Database.DB)
-	us := webservice.NewUpdateService()
-	auth := webservice.NewBasicAuthService(userp)
-	iws := webservice.NewItemWebService(itemp, imgp, auth, us)
+		imgp = db.NewImageDBProvider(s, cfg.Database.DB)
+		attp = db.NewAttachmentDBProvider(s, cfg.Database.DB)
+		itemp = db.NewItemDBProvider(s, cfg.Database.DB, imgp)
+		polp = db.NewPolicyDBProvider(s, cfg.Database.DB)
+		userp = db.NewUserDBProvider(s, itemp, polp, cfg.Database.DB)
+		loanp = db.NewLoanDBProvider(s, cfg.Database.DB)
+		resp = db.NewReservationDBProvider(s, cfg.Database.DB)
+		tokp = db.NewTokenDBProvider(s, cfg.Database.DB)
+		deferred = s.DB(cfg.Database.DB).C("mail_deferred")
+	case "bolt":
+		if cfg.Database.File == "" {
+			cfg.Database.File = defaultDatabaseFile
+		}
+		b, err := db.OpenBoltStore(cfg.Database.File)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer b.Close()
+		imgp, err = db.NewImageBoltProvider(b)
+		if err != nil {
+			log.Fatal(err)
+		}
+		attp, err = db.NewAttachmentBoltProvider(b)
+		if err != nil {
+			log.Fatal(err)
+		}
+		itemp, err = db.NewItemBoltProvider(b, imgp)
+		if err != nil {
+			log.Fatal(err)
+		}
+		polp, err = db.NewPolicyBoltProvider(b)
+		if err != nil {
+			log.Fatal(err)
+		}
+		userp, err = db.NewUserBoltProvider(b, itemp, polp)
+		if err != nil {
+			log.Fatal(err)
+		}
+		loanp, err = db.NewLoanBoltProvider(b)
+		if err != nil {
+			log.Fatal(err)
+		}
+		resp, err = db.NewReservationBoltProvider(b)
+		if err != nil {
+			log.Fatal(err)
+		}
+		tokp, err = db.NewTokenBoltProvider(b)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.WithFields(log.Fields{"File": cfg.Database.File}).Info("Database file opened")
+	case "memory":
+		log.Warn("Using the in-memory backend, all data is lost on exit")
+		imgp = db.NewImageMemProvider()
+		attp = db.NewAttachmentMemProvider()
+		itemp = db.NewItemMemProvider(imgp)
+		polp = db.NewPolicyMemProvider()
+		userp = db.NewUserMemProvider(itemp, polp)
+		loanp = db.NewLoanMemProvider()
+		resp = db.NewReservationMemProvider()
+		tokp = db.NewTokenMemProvider()
+	default:
+		log.WithFields(log.Fields{"Backend": cfg.Database.Backend}).Fatal("Unknown database backend")
+	}
+	for _, name := range cfg.Auth.Admin {
+		err = userp.SetRole(name, db.RoleAdmin)
+		if err != nil {
+			log.WithFields(log.Fields{"User": name, "Error Msg": err}).Warn("Could not promote user to admin")
+		}
+	}
+	auth := webservice.NewBasicAuthService(userp, tokp)
+	us := webservice.NewUpdateService(itemp, auth)
+	iws := webservice.NewItemWebService(itemp, imgp, attp, loanp, polp, resp, auth, us)
+	if cfg.Images.MaxUploadSize > 0 {
+		iws.SetMaxImageSize(cfg.Images.MaxUploadSize)
+	}
+	if cfg.Attachments.MaxUploadSize > 0 {
+		iws.SetMaxAttachmentSize(cfg.Attachments.MaxUploadSize)
+	}
 	pws := webservice.NewPolicyService(polp, auth, us)
-	uws := webservice.NewUserService(userp, auth)
+	uws := webservice.NewUserService(userp, loanp, resp, itemp, tokp, auth)
+	lws := webservice.NewLoanService(loanp, itemp, auth, us)
 	imws := webservice.NewImageService(imgp)
+	sws := webservice.NewSearchService(itemp, polp, userp)
+	aws := webservice.NewAuthWebService(userp, tokp, auth)
+	prws := webservice.NewPasswordResetService(userp, tokp)
+	auws := webservice.NewAuditService(itemp, polp, userp, imgp, attp, auth)
+
+	var (
+		ms *notification.MailNotificationService
+		cn *notification.ChangeNotifier
+	)
+	if cfg.Mail.Enabled {
+		err = cfg.Mail.Verify()
+		if err != nil {
+			log.Fatal(err)
+		}
+		// the links in the mails have to work outside of the server
+		u, err := url.Parse(cfg.Network.PublicURL)
+		if err != nil || !u.IsAbs() || u.Host == "" {
+			log.WithFields(log.Fields{"PublicURL": cfg.Network.PublicURL}).
+				Fatal("Mail needs an absolute PublicURL in the Network section")
+		}
+		ms = notification.NewMailNotificationService(deferred, &cfg.Mail)
+		cn = notification.NewChangeNotifier(ms, userp, itemp)
+		us.AddListener(cn.Notify)
+		uws.EnableMail(ms, cfg.Network.PublicURL)
+		log.WithFields(log.Fields{"Server": cfg.Mail.ServerAddress}).Info("Mail notifications enabled")
+	}
 
 	restful.DefaultContainer.Filter(restful.DefaultContainer.OPTIONSFilter)
 	restful.Add(iws.S)
 	restful.Add(pws.S)
 	restful.Add(uws.S)
 	restful.Add(imws.S)
+	restful.Add(sws.S)
+	restful.Add(lws.S)
+	restful.Add(aws.S)
+	restful.Add(prws.S)
+	restful.Add(auws.S)
 	restful.Add(us.S)
 
 	if log.GetLevel() == log.DebugLevel {
@@ -197,9 +370,23 @@ func main() {
 
 	log.WithFields(log.Fields{"Address": cfg.Network.ListenTo, "TLS": cfg.Crypto.Enabled}).
 		Info("lsms started successfully")
-	if cfg.Crypto.Enabled {
-		log.Fatal(http.ListenAndServeTLS(cfg.Network.ListenTo, cfg.Crypto.Certificate, cfg.Crypto.KeyFile, nil))
+	go func() {
+		if cfg.Crypto.Enabled {
+			log.Fatal(http.ListenAndServeTLS(cfg.Network.ListenTo, cfg.Crypto.Certificate, cfg.Crypto.KeyFile, nil))
+		} else {
+			log.Fatal(http.ListenAndServe(cfg.Network.ListenTo, nil))
+		}
+	}()
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	<-sig
+	if cn != nil {
+		log.Info("Shutting down, sending queued mails …")
+		cn.Quit()
+		ms.Quit()
 	} else {
-		log.Fatal(http.ListenAndServe(cfg.Network.ListenTo, nil))
+		log.Info("Shutting down")
 	}
+	// returning runs the deferred closing of the database
 }
@@ -0,0 +1,94 @@
+/*
+ *    Copyright (C) 2015 Stefan Luecke
+ *
+ *    This program is free software: you can redistribute it and/or modify
+ *    it under the terms of the GNU Affero General Public License as published
+ *    by the Free Software Foundation, either version 3 of the License, or
+ *    (at your option) any later version.
+ *
+ *    This program is distributed in the hope that it will be useful,
+ *    but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *    GNU Affero General Public License for more details.
+ *
+ *    You should have received a copy of the GNU Affero General Public License
+ *    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ *    Authors: Stefan Luecke <glaxx@glaxx.net>
+ */
+
+package main
+
+import (
+	"flag"
+	log "github.com/Sirupsen/logrus"
+	db "github.com/openlab-aux/lsmsd/database"
+	"gopkg.in/gcfg.v1"
+	"gopkg.in/mgo.v2"
+	"os"
+)
+
+// migrate implements "lsmsd migrate", which copies a mongodb database into a
+// new bolt database file. The database settings are taken from the config
+// file and can be overridden with flags.
+func migrate(args []string) {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	var configpath = fs.String("cfgpath", defaultConfigPath, "path to your config file")
+	var from = fs.String("from", "mongo", "backend to copy from, only mongo is supported")
+	var to = fs.String("to", "bolt", "backend to copy to, only bolt is supported")
+	var dbserver = fs.String("dbserver", "", "address of your mongo db server")
+	var dbdb = fs.String("dbdb", "", "mongo database name")
+	var dbfile = fs.String("dbfile", "", "database file to create")
+	fs.Parse(args)
+
+	if *from != "mongo" && *from != "mongodb" {
+		log.WithFields(log.Fields{"From": *from}).Fatal("Unsupported source backend")
+	}
+	if *to != "bolt" {
+		log.WithFields(log.Fields{"To": *to}).Fatal("Unsupported target backend")
+	}
+
+	var cfg Config
+	err := gcfg.ReadFileInto(&cfg, *configpath)
+	if err != nil && !os.IsNotExist(err) {
+		log.Fatal(err)
+	}
+	if *dbserver != "" {
+		cfg.Database.Server = *dbserver
+	}
+	if *dbdb != "" {
+		cfg.Database.DB = *dbdb
+	}
+	if *dbfile != "" {
+		cfg.Database.File = *dbfile
+	}
+	if cfg.Database.Server == "" {
+		cfg.Database.Server = defaultDatabaseServer
+	}
+	if cfg.Database.DB == "" {
+		cfg.Database.DB = defaultDatabase
+	}
+	if cfg.Database.File == "" {
+		cfg.Database.File = defaultDatabaseFile
+	}
+
+	s, err := mgo.Dial(cfg.Database.Server)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer s.Close()
+	b, err := db.OpenBoltStore(cfg.Database.File)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer b.Close()
+
+	log.WithFields(log.Fields{"Server": cfg.Database.Server, "DB": cfg.Database.DB, "File": cfg.Database.File}).
+		Info("Migrating database …")
+	err = db.MigrateMongoToBolt(s, cfg.Database.DB, b)
+	if err != nil {
+		b.Close()
+		log.WithFields(log.Fields{"Error Msg": err}).Fatal("Migration failed")
+	}
+	log.Info("Migration finished, set Backend = \"bolt\" in your config to use it")
+}
@@ -0,0 +1,218 @@
+/*
+ *    Copyright (C) 2015 Stefan Luecke
+ *
+ *    This program is free software: you can redistribute it and/or modify
+ *    it under the terms of the GNU Affero General Public License as published
+ *    by the Free Software Foundation, either version 3 of the License, or
+ *    (at your option) any later version.
+ *
+ *    This program is distributed in the hope that it will be useful,
+ *    but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *    GNU Affero General Public License for more details.
+ *
+ *    You should have received a copy of the GNU Affero General Public License
+ *    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ *    Authors: Stefan Luecke <glaxx@glaxx.net>
+ */
+
+package notification
+
+import (
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	db "github.com/openlab-aux/lsmsd/database"
+	"gopkg.in/mgo.v2/bson"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// Mailer queues emails for delivery
+type Mailer interface {
+	AddMailToQueue(rcpt, subject, text string)
+}
+
+type event struct {
+	_type string
+	obj   interface{}
+}
+
+// ChangeNotifier mails item and policy changes to the owners and
+// maintainers of the affected items.
+type ChangeNotifier struct {
+	m      Mailer
+	u      db.UserProvider
+	i      db.ItemProvider
+	events chan event
+	done   chan bool
+}
+
+const eventQueueSize = 256
+
+func NewChangeNotifier(m Mailer, u db.UserProvider, i db.ItemProvider) *ChangeNotifier {
+	res := new(ChangeNotifier)
+	res.m = m
+	res.u = u
+	res.i = i
+	res.events = make(chan event, eventQueueSize)
+	res.done = make(chan bool)
+	go res.process()
+	return res
+}
+
+// Notify queues an update for mailing. It never blocks; if the queue is full
+// the update is dropped.
+func (n *ChangeNotifier) Notify(_type string, obj interface{}) {
+	if _type != db.MailEventItem && _type != db.MailEventPolicy {
+		return
+	}
+	select {
+	case n.events <- event{_type, obj}:
+	default:
+		log.WithFields(log.Fields{"Type": _type}).Warn("Notification queue full, dropping event")
+	}
+}
+
+// Quit stops the notifier after all queued events are processed
+func (n *ChangeNotifier) Quit() {
+	close(n.events)
+	<-n.done
+}
+
+func (n *ChangeNotifier) process() {
+	for e := range n.events {
+		switch o := e.obj.(type) {
+		case *db.ItemHistory:
+			n.itemChanged(o)
+		case *db.PolicyHistory:
+			n.policyChanged(o)
+		}
+	}
+	n.done <- true
+}
+
+func (n *ChangeNotifier) itemChanged(h *db.ItemHistory) {
+	id, ok := h.Item["eid"].(uint64)
+	if !ok {
+		return
+	}
+	itm, err := n.i.GetItemById(id)
+	if err != nil {
+		// deleted items are gone, but their log knows who cared for them
+		itm, err = n.itemFromLog(id)
+		if err != nil {
+			log.WithFields(log.Fields{"Item": id, "Err": err}).Warn("Could not notify about item change")
+			return
+		}
+	}
+	what := "changed"
+	if _, ok := h.Item["deleted"]; ok {
+		what = "deleted"
+	} else if _, ok := h.Item["created"]; ok {
+		what = "restored"
+	}
+	subject := fmt.Sprintf("Item %v (#%v) was %v", headerText(itm.Name), itm.EID, what)
+	text := fmt.Sprintf("%v by %v.\n", subject, h.User)
+	if f := changedFields(h.Item); what == "changed" && len(f) != 0 {
+		text += "\nChanged fields: " + strings.Join(f, ", ") + "\n"
+	}
+	n.send(db.MailEventItem, h.User, subject, text, []db.Item{itm})
+}
+
+func (n *ChangeNotifier) policyChanged(h *db.PolicyHistory) {
+	name, ok := h.Policy["name"].(string)
+	if !ok {
+		return
+	}
+	items, _, err := n.i.ListItem(&db.Query{Filter: map[string]interface{}{
+		"$or": []bson.M{{"usage": name}, {"discard": name}},
+	}})
+	if err != nil {
+		log.WithFields(log.Fields{"Policy": name, "Err": err}).Warn("Could not notify about policy change")
+		return
+	}
+	what := "changed"
+	if _, ok := h.Policy["deleted"]; ok {
+		what = "deleted"
+	} else if _, ok := h.Policy["created"]; ok {
+		what = "restored"
+	}
+	subject := fmt.Sprintf("Policy %v was %v", headerText(name), what)
+	text := fmt.Sprintf("%v by %v. It applies to these items of yours:\n\n", subject, h.User)
+	n.send(db.MailEventPolicy, h.User, subject, text, items)
+}
+
+// send mails subject and text to the owners and maintainers of items, except
+// for actor and users who muted event. Every user gets one mail; if text
+// ends with a blank line, the items concerning the user are appended.
+func (n *ChangeNotifier) send(event, actor, subject, text string, items []db.Item) {
+	rcpts := make(map[string][]db.Item)
+	for _, itm := range items {
+		for _, name := range []string{itm.Owner, itm.Maintainer} {
+			if name == "" || name == actor {
+				continue
+			}
+			if l := rcpts[name]; len(l) == 0 || l[len(l)-1].EID != itm.EID {
+				rcpts[name] = append(l, itm)
+			}
+		}
+	}
+	for name, l := range rcpts {
+		usr, err := n.u.GetUserByName(name)
+		if err != nil || usr.EMail == "" || !usr.WantsMail(event) {
+			continue
+		}
+		body := text
+		if strings.HasSuffix(text, "\n\n") {
+			for _, itm := range l {
+				body += fmt.Sprintf("  %v (#%v)\n", itm.Name, itm.EID)
+			}
+		}
+		n.m.AddMailToQueue(usr.EMail, subject, body)
+	}
+}
+
+// headerText drops line breaks and other control characters from s, so
+// names can't add header lines to a mail
+func headerText(s string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, s)
+}
+
+// itemFromLog rebuilds name, owner and maintainer of item id from its log
+func (n *ChangeNotifier) itemFromLog(id uint64) (db.Item, error) {
+	itm := db.Item{EID: id}
+	hist, err := n.i.GetItemLog(id)
+	if err != nil {
+		return itm, err
+	}
+	for _, h := range hist {
+		if v, ok := h.Item["name"].(string); ok {
+			itm.Name = v
+		}
+		if v, ok := h.Item["owner"].(string); ok {
+			itm.Owner = v
+		}
+		if v, ok := h.Item["maintainer"].(string); ok {
+			itm.Maintainer = v
+		}
+	}
+	return itm, nil
+}
+
+func changedFields(m map[string]interface{}) []string {
+	res := make([]string, 0, len(m))
+	for k := range m {
+		if k != "eid" && k != "revert" {
+			res = append(res, k)
+		}
+	}
+	sort.Strings(res)
+	return res
+}
@@ -27,8 +27,10 @@ import (
 	"github.com/fatih/structs"
 	"gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
+	"mime"
 	"net/smtp"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
@@ -58,13 +60,14 @@ type MailNotificationService struct {
 	nextDefAttempt time.Time
 }
 
+// mail is stored in the deferred collection, so all fields are exported
 type mail struct {
 	Id          bson.ObjectId `bson:"_id,omitempty"`
-	header      header
-	status      uint
-	rcpt        string
-	body        string
-	nextAttempt time.Time
+	Header      header
+	Status      uint
+	Rcpt        string
+	Body        string
+	NextAttempt time.Time
 }
 
 type header struct {
@@ -76,19 +79,25 @@ type header struct {
 	ReturnPath  string `mailheader:"Return-Path"`
 }
 
+// toByte formats the header. Line breaks are dropped from the values and
+// the subject is encoded, so it may hold any text.
 func (h *header) toByte() []byte {
 	var res string
 	for _, f := range structs.Fields(h) {
-		switch f.Value().(type) {
+		switch v := f.Value().(type) {
 		case string:
+			v = strings.NewReplacer("\r", "", "\n", "").Replace(v)
+			if f.Name() == "Subject" {
+				v = mime.QEncoding.Encode("utf-8", v)
+			}
 			if t := f.Tag("mailheader"); t != "" {
-				res = res + fmt.Sprintf("%v: %v \n", t, f.Value())
+				res = res + fmt.Sprintf("%v: %v \n", t, v)
 			} else {
-				res = res + fmt.Sprintf("%v: %v \n", f.Name(), f.Value())
+				res = res + fmt.Sprintf("%v: %v \n", f.Name(), v)
 			}
 			break
 		case time.Time:
-			res = res + fmt.Sprintf("%v: %v\n", f.Name(), f.Value().(time.Time).Format(time.RFC1123Z))
+			res = res + fmt.Sprintf("%v: %v\n", f.Name(), v.Format(time.RFC1123Z))
 			break
 		}
 	}
@@ -102,6 +111,9 @@ const (
 	mailStatusAttemptOffset
 )
 
+// NewMailNotificationService starts the mail queue. Failed mails are stored in
+// deferred and retried later, a nil collection drops them after notifying the
+// admin.
 func NewMailNotificationService(deferred *mgo.Collection, mailcfg *Mailconfig) *MailNotificationService {
 	res := new(MailNotificationService)
 	res.deferred = deferred
@@ -115,15 +127,15 @@ func NewMailNotificationService(deferred *mgo.Collection, mailcfg *Mailconfig) *
 
 func (m *MailNotificationService) AddMailToQueue(rcpt, subject, text string) {
 	ml := new(mail)
-	ml.status = mailStatusNew
-	ml.rcpt = rcpt
-	ml.body = text
-	ml.header.ContentType = "text/plain; charset=UTF-8"
-	ml.header.Date = time.Now()
-	ml.header.From = "lsmsd Notification Service <" + m.mc.EMailAddress + ">"
-	ml.header.ReturnPath = m.mc.Admin
-	ml.header.Subject = subject
-	ml.header.To = rcpt
+	ml.Status = mailStatusNew
+	ml.Rcpt = rcpt
+	ml.Body = text
+	ml.Header.ContentType = "text/plain; charset=UTF-8"
+	ml.Header.Date = time.Now()
+	ml.Header.From = "lsmsd Notification Service <" + m.mc.EMailAddress + ">"
+	ml.Header.ReturnPath = m.mc.Admin
+	ml.Header.Subject = subject
+	ml.Header.To = rcpt
 	m.msg <- *ml
 }
 
@@ -167,6 +179,10 @@ func (m *MailNotificationService) processQueue() {
 }
 
 func (m *MailNotificationService) deferSend(ma mail) {
+	if m.deferred == nil {
+		m.notifyAdmin(ma, errors.New("mail dropped, no deferred queue configured"))
+		return
+	}
 	err := m.deferred.Insert(ma)
 	if err != nil {
 		m.notifyAdmin(ma, err)
@@ -174,6 +190,9 @@ func (m *MailNotificationService) deferSend(ma mail) {
 }
 
 func (m *MailNotificationService) processDeferred() {
+	if m.deferred == nil {
+		return
+	}
 	ma := make([]mail, 0)
 	err := m.deferred.Find(nil).All(&ma)
 	for i := 0; i != len(ma); i++ {
@@ -189,10 +208,10 @@ func (m *MailNotificationService) processDeferred() {
 }
 
 func (m *MailNotificationService) notifyAdmin(ma mail, err error) {
-	ma.body = "Error while transmitting email to: " + ma.header.To + "\n" + err.Error() + "\n" + ma.body
-	ma.header.Subject = "[ERROR]" + ma.header.Subject
-	ma.header.To = m.mc.Admin
-	ma.rcpt = m.mc.Admin
+	ma.Body = "Error while transmitting email to: " + ma.Header.To + "\n" + err.Error() + "\n" + ma.Body
+	ma.Header.Subject = "[ERROR]" + ma.Header.Subject
+	ma.Header.To = m.mc.Admin
+	ma.Rcpt = m.mc.Admin
 	er := m.sendMail(ma)
 	if er != nil {
 		log.Warn("Failed to notify admin: " + er.Error())
@@ -227,7 +246,7 @@ func (m *MailNotificationService) sendMail(ma mail) error {
 	if err != nil {
 		return err
 	}
-	err = c.Rcpt(ma.rcpt)
+	err = c.Rcpt(ma.Rcpt)
 	if err != nil {
 		return err
 	}
@@ -235,11 +254,11 @@ func (m *MailNotificationService) sendMail(ma mail) error {
 	if err != nil {
 		return err
 	}
-	_, err = data.Write(ma.header.toByte())
+	_, err = data.Write(ma.Header.toByte())
 	if err != nil {
 		return err
 	}
-	_, err = data.Write([]byte(ma.body))
+	_, err = data.Write([]byte(ma.Body))
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,99 @@
+/*
+ *    Copyright (C) 2015 Stefan Luecke
+ *
+ *    This program is free software: you can redistribute it and/or modify
+ *    it under the terms of the GNU Affero General Public License as published
+ *    by the Free Software Foundation, either version 3 of the License, or
+ *    (at your option) any later version.
+ *
+ *    This program is distributed in the hope that it will be useful,
+ *    but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *    GNU Affero General Public License for more details.
+ *
+ *    You should have received a copy of the GNU Affero General Public License
+ *    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ *    Authors: Stefan Luecke <glaxx@glaxx.net>
+ */
+
+package webservice
+
+import (
+	log "github.com/Sirupsen/logrus"
+	"github.com/emicklei/go-restful"
+	db "github.com/openlab-aux/lsmsd/database"
+	"net/http"
+)
+
+type PasswordResetWebService struct {
+	d db.UserProvider
+	t db.TokenProvider
+	S *restful.WebService
+}
+
+type PasswordResetRequest struct {
+	Password string
+}
+
+func NewPasswordResetService(d db.UserProvider, t db.TokenProvider) *PasswordResetWebService {
+	res := new(PasswordResetWebService)
+	res.d = d
+	res.t = t
+	service := new(restful.WebService)
+	service.
+		Path("/password-reset").
+		Doc("Set a new password with a token sent by mail").
+		ApiVersion("0.1").
+		Consumes(restful.MIME_JSON).
+		Produces(restful.MIME_JSON)
+
+	service.Route(service.POST("/{token}").
+		Param(restful.PathParameter("token", "Token from the password reset email")).
+		Doc("Set a new password. The token can only be used once and all sessions of the user are ended").
+		To(res.ResetPassword).
+		Reads(PasswordResetRequest{}).
+		Do(returnsInternalServerError, returnsNotFound, returnsBadRequest, returnsUpdateSuccessful))
+
+	res.S = service
+	return res
+}
+
+func (s *PasswordResetWebService) ResetPassword(request *restful.Request, response *restful.Response) {
+	pr := new(PasswordResetRequest)
+	err := request.ReadEntity(pr)
+	if err != nil || pr.Password == "" {
+		response.WriteErrorString(http.StatusBadRequest, ERROR_INVALID_INPUT)
+		log.WithFields(log.Fields{"Error Msg": err}).Info(ERROR_INVALID_INPUT)
+		return
+	}
+	tok, err := s.t.ConsumeToken(request.PathParameter("token"), db.TokenPasswordReset)
+	if err == db.ErrNotFound {
+		response.WriteErrorString(http.StatusNotFound, "Token invalid or expired")
+		return
+	}
+	var usr db.User
+	if err == nil {
+		usr, err = s.d.GetUserByName(tok.User)
+	}
+	if err == nil {
+		err = usr.Secret.SetPassword(pr.Password)
+	}
+	if err == nil {
+		err = s.d.SetSecret(usr.Name, usr.Secret)
+	}
+	if err == nil {
+		err = s.t.DeleteUserTokens(usr.Name, db.TokenSession, db.TokenPasswordReset)
+	}
+	if err == nil && usr.Unverified {
+		// the token was mailed, so the address works
+		err = s.d.SetVerified(usr.Name)
+	}
+	if err != nil {
+		response.WriteErrorString(http.StatusInternalServerError, ERROR_INTERNAL)
+		log.WithFields(log.Fields{"Error Msg": err}).Warn(ERROR_INTERNAL)
+		return
+	}
+	log.WithFields(log.Fields{"User": usr.Name}).Info("Password reset")
+	response.WriteEntity(true)
+}
@@ -0,0 +1,120 @@
+/*
+ *    Copyright (C) 2015 Stefan Luecke
+ *
+ *    This program is free software: you can redistribute it and/or modify
+ *    it under the terms of the GNU Affero General Public License as published
+ *    by the Free Software Foundation, either version 3 of the License, or
+ *    (at your option) any later version.
+ *
+ *    This program is distributed in the hope that it will be useful,
+ *    but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *    GNU Affero General Public License for more details.
+ *
+ *    You should have received a copy of the GNU Affero General Public License
+ *    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ *    Authors: Stefan Luecke <glaxx@glaxx.net>
+ */
+
+package webservice_test
+
+import (
+	"github.com/emicklei/go-restful"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	db "github.com/openlab-aux/lsmsd/database"
+	"github.com/openlab-aux/lsmsd/webservice"
+	"gopkg.in/mgo.v2"
+	"net/http"
+	"net/http/httptest"
+)
+
+var _ = Describe("Accounts", func() {
+	var (
+		session *mgo.Session
+		cont    *restful.Container
+		itm     db.ItemProvider
+		usr     db.UserProvider
+		hw      *httptest.ResponseRecorder
+	)
+
+	BeforeEach(func() {
+		session, cont, itm, _, usr = newTestContainer()
+	})
+
+	AfterEach(func() {
+		flushDB(session, itm)
+	})
+
+	Describe("Email verification", func() {
+		BeforeEach(func() {
+			hw = request(cont, "POST", "/users", "", db.User{Name: "alice", EMail: "alice@example.com", Password: "testpw"})
+			Expect(hw.Code).To(Equal(http.StatusOK))
+		})
+
+		It("should be required before changing items and make the user a member", func() {
+			hw = request(cont, "POST", "/items", "alice", db.Item{Name: "Lathe"})
+			Expect(hw.Code).To(Equal(http.StatusForbidden))
+
+			Eventually(func() string { return mails.link("alice@example.com", "/verify/") }).ShouldNot(BeEmpty())
+			token := mails.link("alice@example.com", "/verify/")
+			hw = request(cont, "GET", "/users/alice/verify/"+token, "", nil)
+			Expect(hw.Code).To(Equal(http.StatusOK))
+			u, _ := usr.GetUserByName("alice")
+			Expect(u.Role).To(Equal(db.RoleMember))
+
+			hw = request(cont, "POST", "/items", "alice", db.Item{Name: "Lathe"})
+			Expect(hw.Code).To(Equal(http.StatusOK))
+		})
+
+		It("should refuse unknown tokens", func() {
+			hw = request(cont, "GET", "/users/alice/verify/abcdef", "", nil)
+			Expect(hw.Code).To(Equal(http.StatusNotFound))
+
+			u, _ := usr.GetUserByName("alice")
+			Expect(u.Unverified).To(BeTrue())
+		})
+	})
+
+	Describe("Password reset", func() {
+		var token string
+
+		BeforeEach(func() {
+			populateUserDB(usr)
+			hw = request(cont, "POST", "/users/2/password-reset", "", nil)
+			Expect(hw.Code).To(Equal(http.StatusOK))
+			Eventually(func() string { return mails.link("test2@example.com", "/password-reset/") }).ShouldNot(BeEmpty())
+			token = mails.link("test2@example.com", "/password-reset/")
+		})
+
+		It("should set a new password once", func() {
+			hw = request(cont, "POST", "/password-reset/"+token, "", webservice.PasswordResetRequest{Password: "newpw"})
+			Expect(hw.Code).To(Equal(http.StatusOK))
+
+			hw = request(cont, "GET", "/users/2/tokens", "2", nil)
+			Expect(hw.Code).To(Equal(http.StatusUnauthorized))
+			req, _ := http.NewRequest("GET", "/users/2/tokens", nil)
+			req.SetBasicAuth("2", "newpw")
+			hw = httptest.NewRecorder()
+			cont.ServeHTTP(hw, req)
+			Expect(hw.Code).To(Equal(http.StatusOK))
+
+			hw = request(cont, "POST", "/password-reset/"+token, "", webservice.PasswordResetRequest{Password: "otherpw"})
+			Expect(hw.Code).To(Equal(http.StatusNotFound))
+		})
+
+		It("should not be usable as login token", func() {
+			req, _ := http.NewRequest("GET", "/users/2/tokens", nil)
+			req.Header.Set("Authorization", "Bearer "+token)
+			hw = httptest.NewRecorder()
+			cont.ServeHTTP(hw, req)
+			Expect(hw.Code).To(Equal(http.StatusUnauthorized))
+		})
+
+		It("should not reveal whether a user exists", func() {
+			hw = request(cont, "POST", "/users/nobody/password-reset", "", nil)
+			Expect(hw.Code).To(Equal(http.StatusOK))
+		})
+	})
+})
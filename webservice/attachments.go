@@ -0,0 +1,345 @@
+/*
+ *    Copyright (C) 2015 Stefan Luecke
+ *
+ *    This program is free software: you can redistribute it and/or modify
+ *    it under the terms of the GNU Affero General Public License as published
+ *    by the Free Software Foundation, either version 3 of the License, or
+ *    (at your option) any later version.
+ *
+ *    This program is distributed in the hope that it will be useful,
+ *    but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *    GNU Affero General Public License for more details.
+ *
+ *    You should have received a copy of the GNU Affero General Public License
+ *    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ *    Authors: Stefan Luecke <glaxx@glaxx.net>
+ */
+
+package webservice
+
+import (
+	"encoding/hex"
+	"errors"
+	log "github.com/Sirupsen/logrus"
+	"github.com/emicklei/go-restful"
+	db "github.com/openlab-aux/lsmsd/database"
+	"gopkg.in/mgo.v2/bson"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"unicode"
+)
+
+// Attachments are files of any type attached to an item, like manuals or
+// receipts. Public attachments can be read by everyone, private ones only by
+// those who may manage the item. They are always served for download, so
+// browsers do not render uploaded HTML.
+
+const (
+	// DefaultMaxAttachmentSize is the largest attachment accepted in bytes
+	DefaultMaxAttachmentSize = 50 << 20
+	maxFilenameLength        = 255
+)
+
+var (
+	errAttachmentTooLarge = errors.New("The attachment is too large")
+	errInvalidFilename    = errors.New("A filename without path is required")
+)
+
+// addAttachmentRoutes adds the routes below /items/{id}/attachments
+func (s *ItemWebService) addAttachmentRoutes(service *restful.WebService) {
+	service.Route(service.GET("/{id}/attachments").
+		Filter(s.a.OptionalAuth).
+		Param(restful.PathParameter("id", "Item ID")).
+		Doc("Returns the attachments of this item. Private attachments are only listed to those managing the item").
+		To(s.ListAttachments).
+		Writes([]db.Attachment{}).
+		Do(returnsInternalServerError, returnsNotFound, returnsBadRequest))
+
+	service.Route(service.GET("/{id}/attachments/{attachmentid}").
+		Filter(s.a.OptionalAuth).
+		Param(restful.PathParameter("id", "Item ID")).
+		Param(restful.PathParameter("attachmentid", "Attachment identifier")).
+		Doc("Download an attachment").
+		To(s.GetAttachment).
+		Do(returnsInternalServerError, returnsNotFound, returnsBadRequest))
+
+	service.Route(service.POST("/{id}/attachments").
+		Filter(s.a.Auth).
+		Filter(s.a.Require(PERM_ITEM_EDIT_OWN)).
+		Param(restful.PathParameter("id", "Item ID")).
+		Param(restful.BodyParameter("file", "The file, its Content-Type is kept")).
+		Param(restful.QueryParameter("filename", "Name of the file, required")).
+		Param(restful.QueryParameter("description", "What the file is about")).
+		Param(restful.QueryParameter("public", "true to show the attachment to everyone, defaults to false")).
+		Doc("Attach a file to this item").
+		Consumes("*/*").
+		To(s.CreateAttachment).
+		Returns(http.StatusOK, "Insert successful", "/items/{id}/attachments/{attachmentid}").
+		Returns(http.StatusRequestEntityTooLarge, errAttachmentTooLarge.Error(), nil).
+		Do(returnsInternalServerError, returnsNotFound, returnsBadRequest, returnsForbidden))
+
+	service.Route(service.DELETE("/{id}/attachments/{attachmentid}").
+		Filter(s.a.Auth).
+		Filter(s.a.Require(PERM_ITEM_EDIT_OWN)).
+		Param(restful.PathParameter("id", "Item ID")).
+		Param(restful.PathParameter("attachmentid", "Attachment identifier")).
+		Doc("Remove an attachment from this item").
+		To(s.RemoveAttachment).
+		Do(returnsInternalServerError, returnsNotFound, returnsDeleteSuccessful, returnsBadRequest, returnsForbidden))
+}
+
+// SetMaxAttachmentSize limits attachment uploads to n bytes
+func (s *ItemWebService) SetMaxAttachmentSize(n int64) {
+	s.maxAttachmentSize = n
+}
+
+func (s *ItemWebService) ListAttachments(request *restful.Request, response *restful.Response) {
+	itm, ok := s.readItem(request, response)
+	if !ok {
+		return
+	}
+	manage := mayManage(request, &itm)
+	res := make([]db.Attachment, 0, len(itm.Attachments))
+	for _, ref := range itm.Attachments {
+		a, err := s.f.GetAttachmentById(ref)
+		if err == db.ErrNotFound {
+			log.WithFields(log.Fields{"Item": itm.EID, "Attachment": ref.Hex()}).Warn("Attachment is missing")
+			continue
+		}
+		if err != nil {
+			response.WriteErrorString(http.StatusInternalServerError, ERROR_INTERNAL)
+			log.WithFields(log.Fields{"Error Msg": err}).Warn(ERROR_INTERNAL)
+			return
+		}
+		if a.Public || manage {
+			res = append(res, *a)
+		}
+	}
+	response.WriteEntity(res)
+}
+
+func (s *ItemWebService) GetAttachment(request *restful.Request, response *restful.Response) {
+	itm, ok := s.readItem(request, response)
+	if !ok {
+		return
+	}
+	a, ok := s.readAttachment(request, response, &itm)
+	if !ok {
+		return
+	}
+	f, err := s.f.OpenAttachment(a.ID)
+	if err != nil {
+		writeAttachmentError(response, err)
+		return
+	}
+	defer f.Close()
+
+	disposition := mime.FormatMediaType("attachment", map[string]string{"filename": a.Filename})
+	if disposition == "" {
+		disposition = "attachment"
+	}
+	response.AddHeader("Content-Type", a.ContentType)
+	response.AddHeader("Content-Disposition", disposition)
+	response.AddHeader("X-Content-Type-Options", "nosniff")
+	response.AddHeader("ETag", `"`+f.MD5()+`"`)
+	// like images, attachments never change under their id
+	if a.Public {
+		response.AddHeader("Cache-Control", imageCacheControl)
+	} else {
+		response.AddHeader("Cache-Control", "private, max-age=31536000")
+	}
+	http.ServeContent(response.ResponseWriter, request.Request, "", a.Uploaded, f)
+}
+
+func (s *ItemWebService) CreateAttachment(request *restful.Request, response *restful.Response) {
+	itm, ok := s.readItem(request, response)
+	if !ok {
+		return
+	}
+	if !mayManage(request, &itm) {
+		log.WithFields(log.Fields{"User": request.Attribute("User"), "Item": itm.EID}).Warn("Unauthorized attachment change")
+		response.WriteErrorString(http.StatusForbidden, "Permission denied")
+		return
+	}
+
+	a := new(db.Attachment)
+	a.ItmRef = itm.EID
+	a.User = request.Attribute("User").(string)
+	a.Filename = request.QueryParameter("filename")
+	a.Description = request.QueryParameter("description")
+	if !validFilename(a.Filename) {
+		response.WriteErrorString(http.StatusBadRequest, errInvalidFilename.Error())
+		return
+	}
+	var err error
+	if p := request.QueryParameter("public"); p != "" {
+		a.Public, err = strconv.ParseBool(p)
+		if err != nil {
+			response.WriteErrorString(http.StatusBadRequest, ERROR_INVALID_INPUT)
+			return
+		}
+	}
+	a.ContentType = "application/octet-stream"
+	if ct := request.HeaderParameter("Content-Type"); ct != "" {
+		mt, params, err := mime.ParseMediaType(ct)
+		if err != nil {
+			log.WithFields(log.Fields{"Content-Type": ct}).Info(ERROR_INVALID_INPUT)
+			response.WriteErrorString(http.StatusBadRequest, ERROR_INVALID_INPUT)
+			return
+		}
+		a.ContentType = mime.FormatMediaType(mt, params)
+	}
+
+	if request.Request.ContentLength > s.maxAttachmentSize {
+		log.WithFields(log.Fields{"Size": request.Request.ContentLength}).Info(errAttachmentTooLarge)
+		response.WriteErrorString(http.StatusRequestEntityTooLarge, errAttachmentTooLarge.Error())
+		return
+	}
+	err = s.f.Create(&sizeLimitedReader{request.Request.Body, s.maxAttachmentSize}, a)
+	if err != nil {
+		if err == errAttachmentTooLarge {
+			log.WithFields(log.Fields{"Item": itm.EID}).Info(err)
+			response.WriteErrorString(http.StatusRequestEntityTooLarge, err.Error())
+			return
+		}
+		response.WriteErrorString(http.StatusInternalServerError, ERROR_INTERNAL)
+		log.WithFields(log.Fields{"Error Msg": err}).Warn(ERROR_INTERNAL)
+		return
+	}
+	h, err := s.d.AddAttachment(itm.EID, a.ID, a.User)
+	if err != nil {
+		response.WriteErrorString(http.StatusInternalServerError, ERROR_INTERNAL)
+		log.WithFields(log.Fields{"Error Msg": err}).Warn(ERROR_INTERNAL)
+		err = s.f.Remove(a.ID)
+		if err != nil {
+			log.WithFields(log.Fields{"Attachment": a.ID.Hex(), "Error Msg": err}).Warn("Could not remove attachment")
+		}
+		return
+	}
+	s.u.PushUpdate(h)
+	response.WriteEntity("/items/" + strconv.FormatUint(itm.EID, 10) + "/attachments/" + a.ID.Hex())
+}
+
+// RemoveAttachment detaches the attachment from the item before deleting
+// it, so a failure leaves an unreferenced file at worst
+func (s *ItemWebService) RemoveAttachment(request *restful.Request, response *restful.Response) {
+	itm, ok := s.readItem(request, response)
+	if !ok {
+		return
+	}
+	if !mayManage(request, &itm) {
+		log.WithFields(log.Fields{"User": request.Attribute("User"), "Item": itm.EID}).Warn("Unauthorized attachment change")
+		response.WriteErrorString(http.StatusForbidden, "Permission denied")
+		return
+	}
+	ref, ok := attachmentRef(request, response, &itm)
+	if !ok {
+		return
+	}
+	h, err := s.d.RemoveAttachment(itm.EID, ref, request.Attribute("User").(string))
+	if err != nil {
+		response.WriteErrorString(http.StatusInternalServerError, ERROR_INTERNAL)
+		log.WithFields(log.Fields{"Error Msg": err}).Warn(ERROR_INTERNAL)
+		return
+	}
+	// nothing changed if the reference was removed meanwhile
+	if h != nil {
+		s.u.PushUpdate(h)
+	}
+	s.removeAttachments([]bson.ObjectId{ref})
+	response.WriteEntity(true)
+}
+
+// removeAttachments deletes the files of attachments which are no longer
+// referenced by their item. Failures are only logged.
+func (s *ItemWebService) removeAttachments(refs []bson.ObjectId) {
+	for _, ref := range refs {
+		err := s.f.Remove(ref)
+		if err != nil {
+			log.WithFields(log.Fields{"Attachment": ref.Hex(), "Error Msg": err}).Warn("Could not remove attachment")
+		}
+	}
+}
+
+// readAttachment looks up the attachment referenced in the path of request,
+// which has to belong to itm and be visible to the user. It writes an error
+// response if this fails.
+func (s *ItemWebService) readAttachment(request *restful.Request, response *restful.Response, itm *db.Item) (*db.Attachment, bool) {
+	ref, ok := attachmentRef(request, response, itm)
+	if !ok {
+		return nil, false
+	}
+	a, err := s.f.GetAttachmentById(ref)
+	if err != nil {
+		writeAttachmentError(response, err)
+		return nil, false
+	}
+	if !a.Public && !mayManage(request, itm) {
+		// private attachments are not revealed
+		response.WriteErrorString(http.StatusNotFound, ERROR_INVALID_ID)
+		return nil, false
+	}
+	return a, true
+}
+
+// attachmentRef returns the attachment id in the path of request if it
+// belongs to itm and writes an error response otherwise
+func attachmentRef(request *restful.Request, response *restful.Response, itm *db.Item) (bson.ObjectId, bool) {
+	b, err := hex.DecodeString(request.PathParameter("attachmentid"))
+	if err != nil || len(b) != 12 {
+		response.WriteErrorString(http.StatusBadRequest, ERROR_INVALID_ID)
+		log.WithFields(log.Fields{"Error Msg": err}).Info(ERROR_INVALID_ID)
+		return "", false
+	}
+	ref := bson.ObjectId(b)
+	for _, r := range itm.Attachments {
+		if r == ref {
+			return ref, true
+		}
+	}
+	response.WriteErrorString(http.StatusNotFound, ERROR_INVALID_ID)
+	return "", false
+}
+
+func writeAttachmentError(response *restful.Response, err error) {
+	if err == db.ErrNotFound {
+		response.WriteErrorString(http.StatusNotFound, ERROR_INVALID_ID)
+		return
+	}
+	response.WriteErrorString(http.StatusInternalServerError, ERROR_INTERNAL)
+	log.WithFields(log.Fields{"Error Msg": err}).Warn(ERROR_INTERNAL)
+}
+
+// validFilename reports whether name can be used as filename of an
+// attachment: it may not be empty, contain a path or control characters
+func validFilename(name string) bool {
+	if name == "" || len(name) > maxFilenameLength || name == "." || name == ".." {
+		return false
+	}
+	for _, r := range name {
+		if r == '/' || r == '\\' || unicode.IsControl(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// sizeLimitedReader fails with errAttachmentTooLarge once more than n bytes
+// are read
+type sizeLimitedReader struct {
+	r io.Reader
+	n int64
+}
+
+func (l *sizeLimitedReader) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	l.n -= int64(n)
+	if l.n < 0 {
+		return n, errAttachmentTooLarge
+	}
+	return n, err
+}
@@ -0,0 +1,180 @@
+/*
+ *    Copyright (C) 2015 Stefan Luecke
+ *
+ *    This program is free software: you can redistribute it and/or modify
+ *    it under the terms of the GNU Affero General Public License as published
+ *    by the Free Software Foundation, either version 3 of the License, or
+ *    (at your option) any later version.
+ *
+ *    This program is distributed in the hope that it will be useful,
+ *    but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *    GNU Affero General Public License for more details.
+ *
+ *    You should have received a copy of the GNU Affero General Public License
+ *    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ *    Authors: Stefan Luecke <glaxx@glaxx.net>
+ */
+
+package webservice_test
+
+import (
+	"encoding/json"
+	"github.com/emicklei/go-restful"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	db "github.com/openlab-aux/lsmsd/database"
+	"github.com/openlab-aux/lsmsd/webservice"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path"
+	"strconv"
+)
+
+var _ = Describe("Attachments", func() {
+	var (
+		session *mgo.Session
+		cont    *restful.Container
+		itm     db.ItemProvider
+		usr     db.UserProvider
+		hw      *httptest.ResponseRecorder
+		eid     uint64
+		id      string
+	)
+
+	// attach uploads data as user and returns the attachment id
+	attach := func(user, filename, contentType string, public bool, data []byte) string {
+		q := url.Values{"filename": {filename}, "description": {"about " + filename},
+			"public": {strconv.FormatBool(public)}}
+		hw = request(cont, "POST", "/items/"+id+"/attachments?"+q.Encode(), user, data, "Content-Type", contentType)
+		Expect(hw.Code).To(Equal(http.StatusOK))
+		var loc string
+		Expect(json.Unmarshal(hw.Body.Bytes(), &loc)).To(Succeed())
+		return path.Base(loc)
+	}
+	list := func(user string) []db.Attachment {
+		hw = request(cont, "GET", "/items/"+id+"/attachments", user, nil)
+		Expect(hw.Code).To(Equal(http.StatusOK))
+		var res []db.Attachment
+		Expect(json.Unmarshal(hw.Body.Bytes(), &res)).To(Succeed())
+		return res
+	}
+
+	BeforeEach(func() {
+		session, cont, itm, _, usr = newTestContainer()
+		populateUserDB(usr)
+		var err error
+		eid, err = itm.CreateItem(&db.Item{Name: "Lathe", Owner: "2"}, "2")
+		Expect(err).NotTo(HaveOccurred())
+		id = strconv.FormatUint(eid, 10)
+	})
+
+	AfterEach(func() {
+		flushDB(session, itm)
+	})
+
+	It("should store and serve files of any type", func() {
+		pdf := []byte("%PDF-1.4 manual")
+		ref := attach("2", "manual.pdf", "application/pdf", true, pdf)
+
+		hw = request(cont, "GET", "/items/"+id+"/attachments/"+ref, "", nil)
+		Expect(hw.Code).To(Equal(http.StatusOK))
+		Expect(hw.Body.Bytes()).To(Equal(pdf))
+		Expect(hw.Header().Get("Content-Type")).To(Equal("application/pdf"))
+		Expect(hw.Header().Get("Content-Disposition")).To(Equal(`attachment; filename=manual.pdf`))
+		Expect(hw.Header().Get("X-Content-Type-Options")).To(Equal("nosniff"))
+
+		l := list("")
+		Expect(l).To(HaveLen(1))
+		Expect(l[0].ID.Hex()).To(Equal(ref))
+		Expect(l[0].Filename).To(Equal("manual.pdf"))
+		Expect(l[0].Description).To(Equal("about manual.pdf"))
+		Expect(l[0].ContentType).To(Equal("application/pdf"))
+		Expect(l[0].Size).To(Equal(int64(len(pdf))))
+		Expect(l[0].User).To(Equal("2"))
+		Expect(l[0].ItmRef).To(Equal(eid))
+	})
+
+	It("should hide private attachments from others", func() {
+		pub := attach("2", "datasheet.txt", "text/plain", true, []byte("wear goggles"))
+		priv := attach("2", "receipt.txt", "", false, []byte("499 EUR"))
+
+		Expect(list("")).To(HaveLen(1))
+		Expect(list("3")).To(HaveLen(1))
+		Expect(list("2")).To(HaveLen(2))
+		Expect(list("1")).To(HaveLen(2))
+
+		hw = request(cont, "GET", "/items/"+id+"/attachments/"+priv, "", nil)
+		Expect(hw.Code).To(Equal(http.StatusNotFound))
+		hw = request(cont, "GET", "/items/"+id+"/attachments/"+priv, "3", nil)
+		Expect(hw.Code).To(Equal(http.StatusNotFound))
+		hw = request(cont, "GET", "/items/"+id+"/attachments/"+priv, "2", nil)
+		Expect(hw.Code).To(Equal(http.StatusOK))
+		Expect(hw.Header().Get("Content-Type")).To(Equal("application/octet-stream"))
+		Expect(hw.Header().Get("Cache-Control")).To(HavePrefix("private"))
+		hw = request(cont, "GET", "/items/"+id+"/attachments/"+pub, "", nil)
+		Expect(hw.Code).To(Equal(http.StatusOK))
+		Expect(hw.Header().Get("Cache-Control")).To(HavePrefix("public"))
+	})
+
+	It("should only let managers change attachments", func() {
+		q := "?filename=firmware.bin"
+		hw = request(cont, "POST", "/items/"+id+"/attachments"+q, "3", []byte{1, 2, 3}, "Content-Type", "application/octet-stream")
+		Expect(hw.Code).To(Equal(http.StatusForbidden))
+		hw = request(cont, "POST", "/items/"+id+"/attachments"+q, "", []byte{1, 2, 3}, "Content-Type", "application/octet-stream")
+		Expect(hw.Code).To(Equal(http.StatusUnauthorized))
+
+		ref := attach("2", "firmware.bin", "application/octet-stream", true, []byte{1, 2, 3})
+		hw = request(cont, "DELETE", "/items/"+id+"/attachments/"+ref, "3", nil)
+		Expect(hw.Code).To(Equal(http.StatusForbidden))
+		Expect(list("")).To(HaveLen(1))
+	})
+
+	It("should reject bad uploads", func() {
+		for _, name := range []string{"", "../passwd", `c:\boot.ini`, "a\nb", ".."} {
+			hw = request(cont, "POST", "/items/"+id+"/attachments?filename="+url.QueryEscape(name), "2", []byte("x"),
+				"Content-Type", "text/plain")
+			Expect(hw.Code).To(Equal(http.StatusBadRequest), name)
+		}
+		hw = request(cont, "POST", "/items/"+id+"/attachments?filename=a.txt&public=maybe", "2", []byte("x"), "Content-Type", "text/plain")
+		Expect(hw.Code).To(Equal(http.StatusBadRequest))
+		hw = request(cont, "POST", "/items/"+id+"/attachments?filename=big.bin", "2",
+			make([]byte, webservice.DefaultMaxAttachmentSize+1), "Content-Type", "application/octet-stream")
+		Expect(hw.Code).To(Equal(http.StatusRequestEntityTooLarge))
+		Expect(list("2")).To(BeEmpty())
+	})
+
+	It("should record attachments in the history and delete them", func() {
+		ref := attach("2", "manual.pdf", "application/pdf", true, []byte("%PDF"))
+		i, err := itm.GetItemById(eid)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(i.Attachments).To(ConsistOf(bson.ObjectIdHex(ref)))
+
+		hw = request(cont, "DELETE", "/items/"+id+"/attachments/"+ref, "2", nil)
+		Expect(hw.Code).To(Equal(http.StatusOK))
+		_, err = testAttachments.GetAttachmentById(bson.ObjectIdHex(ref))
+		Expect(err).To(Equal(db.ErrNotFound))
+		hw = request(cont, "GET", "/items/"+id+"/attachments/"+ref, "2", nil)
+		Expect(hw.Code).To(Equal(http.StatusNotFound))
+
+		hw = request(cont, "GET", "/items/"+id+"/log?format=rendered", "", nil)
+		Expect(hw.Code).To(Equal(http.StatusOK))
+		var l []db.RenderedHistory
+		Expect(json.Unmarshal(hw.Body.Bytes(), &l)).To(Succeed())
+		Expect(l).To(HaveLen(3))
+		Expect(l[1].Changes).To(Equal([]db.FieldChange{{Field: "Attachments", Added: []bson.ObjectId{bson.ObjectIdHex(ref)}}}))
+		Expect(l[2].Changes).To(Equal([]db.FieldChange{{Field: "Attachments", Removed: []bson.ObjectId{bson.ObjectIdHex(ref)}}}))
+	})
+
+	It("should remove attachments along with their item", func() {
+		ref := attach("2", "manual.pdf", "application/pdf", true, []byte("%PDF"))
+		hw = request(cont, "DELETE", "/items/"+id, "0", nil)
+		Expect(hw.Code).To(Equal(http.StatusOK))
+		_, err := testAttachments.GetAttachmentById(bson.ObjectIdHex(ref))
+		Expect(err).To(Equal(db.ErrNotFound))
+	})
+})
@@ -0,0 +1,111 @@
+/*
+ *    Copyright (C) 2015 Stefan Luecke
+ *
+ *    This program is free software: you can redistribute it and/or modify
+ *    it under the terms of the GNU Affero General Public License as published
+ *    by the Free Software Foundation, either version 3 of the License, or
+ *    (at your option) any later version.
+ *
+ *    This program is distributed in the hope that it will be useful,
+ *    but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *    GNU Affero General Public License for more details.
+ *
+ *    You should have received a copy of the GNU Affero General Public License
+ *    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ *    Authors: Stefan Luecke <glaxx@glaxx.net>
+ */
+
+package webservice
+
+import (
+	log "github.com/Sirupsen/logrus"
+	"github.com/emicklei/go-restful"
+	db "github.com/openlab-aux/lsmsd/database"
+	"net/http"
+)
+
+type AuditWebService struct {
+	logs []func() (*db.AuditReport, error)
+	i    db.ItemProvider
+	p    db.PolicyProvider
+	u    db.UserProvider
+	img  db.ImageProvider
+	f    db.AttachmentProvider
+	S    *restful.WebService
+	a    *BasicAuthService
+}
+
+func NewAuditService(i db.ItemProvider, p db.PolicyProvider, u db.UserProvider, img db.ImageProvider,
+	f db.AttachmentProvider, a *BasicAuthService) *AuditWebService {
+	res := new(AuditWebService)
+	res.logs = []func() (*db.AuditReport, error){i.VerifyLog, p.VerifyLog}
+	res.i, res.p, res.u, res.img, res.f = i, p, u, img, f
+	res.a = a
+
+	service := new(restful.WebService)
+	service.
+		Path("/audit").
+		Doc("Audit the change logs").
+		ApiVersion("0.1").
+		Produces(restful.MIME_JSON)
+
+	service.Route(service.GET("/verify").
+		Filter(res.a.Auth).
+		Filter(res.a.Require(PERM_AUDIT)).
+		Doc("Walk the hash chains of the item and policy logs and report records which were changed, "+
+			"removed or added outside of lsmsd").
+		To(res.Verify).
+		Writes([]db.AuditReport{}).
+		Do(returnsInternalServerError, returnsForbidden))
+
+	service.Route(service.GET("/fsck").
+		Filter(res.a.Auth).
+		Filter(res.a.Require(PERM_AUDIT)).
+		Doc("Check the references between items, images, attachments, users and policies and the item id counter. "+
+			"Files younger than a minute may still be uploading and are ignored").
+		To(res.Fsck).
+		Writes(db.FsckReport{}).
+		Do(returnsInternalServerError, returnsForbidden))
+
+	service.Route(service.POST("/fsck").
+		Filter(res.a.Auth).
+		Filter(res.a.Require(PERM_AUDIT)).
+		Doc("Check like GET and repair what was found: unreferenced files are removed, references to missing "+
+			"entities are dropped from the items and the item id counter is advanced").
+		To(res.Fsck).
+		Writes(db.FsckReport{}).
+		Do(returnsInternalServerError, returnsForbidden))
+
+	res.S = service
+	return res
+}
+
+func (s *AuditWebService) Verify(request *restful.Request, response *restful.Response) {
+	reports := make([]*db.AuditReport, 0, len(s.logs))
+	for _, verify := range s.logs {
+		r, err := verify()
+		if err != nil {
+			response.WriteErrorString(http.StatusInternalServerError, ERROR_INTERNAL)
+			log.WithFields(log.Fields{"Error Msg": err}).Warn(ERROR_INTERNAL)
+			return
+		}
+		if !r.Valid {
+			log.WithFields(log.Fields{"Log": r.Log, "Problems": len(r.Problems)}).Warn("Log verification failed")
+		}
+		reports = append(reports, r)
+	}
+	response.WriteEntity(reports)
+}
+
+func (s *AuditWebService) Fsck(request *restful.Request, response *restful.Response) {
+	repair := request.Request.Method == "POST"
+	r, err := db.Fsck(s.i, s.p, s.u, s.img, s.f, repair, request.Attribute("User").(string))
+	if err != nil {
+		response.WriteErrorString(http.StatusInternalServerError, ERROR_INTERNAL)
+		log.WithFields(log.Fields{"Error Msg": err}).Warn(ERROR_INTERNAL)
+		return
+	}
+	response.WriteEntity(r)
+}
@@ -0,0 +1,386 @@
+/*
+ *    Copyright (C) 2015 Stefan Luecke
+ *
+ *    This program is free software: you can redistribute it and/or modify
+ *    it under the terms of the GNU Affero General Public License as published
+ *    by the Free Software Foundation, either version 3 of the License, or
+ *    (at your option) any later version.
+ *
+ *    This program is distributed in the hope that it will be useful,
+ *    but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *    GNU Affero General Public License for more details.
+ *
+ *    You should have received a copy of the GNU Affero General Public License
+ *    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ *    Authors: Stefan Luecke <glaxx@glaxx.net>
+ */
+
+package webservice_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/emicklei/go-restful"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	db "github.com/openlab-aux/lsmsd/database"
+	bolt "go.etcd.io/bbolt"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"time"
+)
+
+var _ = Describe("Audit", func() {
+	Describe("Verifying the logs", func() {
+		var (
+			session *mgo.Session
+			cont    *restful.Container
+			itm     db.ItemProvider
+			pol     db.PolicyProvider
+			usr     db.UserProvider
+			hw      *httptest.ResponseRecorder
+		)
+
+		verify := func(user string) {
+			req, _ := http.NewRequest("GET", "/audit/verify", nil)
+			req.SetBasicAuth(user, "testpw")
+			hw = httptest.NewRecorder()
+			cont.ServeHTTP(hw, req)
+		}
+
+		BeforeEach(func() {
+			session, cont, itm, pol, usr = newTestContainer()
+			populateDB(itm, pol, usr)
+		})
+
+		AfterEach(func() {
+			flushDB(session, itm)
+		})
+
+		It("should chain the log records", func() {
+			i, _ := itm.GetItemById(1)
+			n := i
+			n.Name = "renamed"
+			Expect(itm.UpdateItem(&n, i.NewItemHistory(&n, "0"))).To(Succeed())
+
+			log, err := itm.GetItemLog(1)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(log).To(HaveLen(2))
+			Expect(log[1].Seq).To(BeNumerically(">", log[0].Seq))
+			Expect(log[0].Hash).To(HaveLen(64))
+			Expect(log[1].Prev).NotTo(BeEmpty())
+		})
+
+		It("should report intact logs to admins", func() {
+			verify("0")
+			Expect(hw.Code).To(Equal(http.StatusOK))
+			var reports []db.AuditReport
+			Expect(json.Unmarshal(hw.Body.Bytes(), &reports)).To(Succeed())
+			Expect(reports).To(HaveLen(2))
+			for _, r := range reports {
+				Expect(r.Valid).To(BeTrue())
+				Expect(r.Problems).To(BeEmpty())
+				Expect(r.Records).To(Equal(10))
+				Expect(r.Head.Seq).To(Equal(uint64(10)))
+			}
+		})
+
+		It("should refuse other users", func() {
+			verify("1")
+			Expect(hw.Code).To(Equal(http.StatusForbidden))
+		})
+	})
+
+	Describe("Tampering with the database file", func() {
+		var (
+			path  string
+			store *db.BoltStore
+			itm   db.ItemProvider
+			ids   []bson.ObjectId
+		)
+
+		open := func() {
+			var err error
+			store, err = db.OpenBoltStore(path)
+			Expect(err).NotTo(HaveOccurred())
+			itm, err = db.NewItemBoltProvider(store, nil)
+			Expect(err).NotTo(HaveOccurred())
+		}
+		// tamper closes the store, applies f to the item log bucket and
+		// opens the store again
+		tamper := func(f func(bk *bolt.Bucket) error) {
+			store.Close()
+			raw, err := bolt.Open(path, 0600, nil)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(raw.Update(func(tx *bolt.Tx) error {
+				return f(tx.Bucket([]byte("item_history")))
+			})).To(Succeed())
+			raw.Close()
+			open()
+		}
+		key := func(id bson.ObjectId) []byte {
+			k, _ := bson.Marshal(bson.M{"_id": id})
+			return k
+		}
+		problems := func() []db.AuditProblem {
+			r, err := itm.VerifyLog()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(r.Valid).To(Equal(len(r.Problems) == 0))
+			return r.Problems
+		}
+
+		BeforeEach(func() {
+			f, err := ioutil.TempFile("", "lsmsd_audit")
+			Expect(err).NotTo(HaveOccurred())
+			f.Close()
+			path = f.Name()
+			open()
+
+			id, err := itm.CreateItem(&db.Item{Name: "Donated lathe", Owner: "1"}, "1")
+			Expect(err).NotTo(HaveOccurred())
+			for _, name := range []string{"Lathe", "Old lathe"} {
+				i, _ := itm.GetItemById(id)
+				n := i
+				n.Name = name
+				Expect(itm.UpdateItem(&n, i.NewItemHistory(&n, "1"))).To(Succeed())
+			}
+			i, _ := itm.GetItemById(id)
+			Expect(itm.DeleteItem(&i, i.NewItemHistory(nil, "1"))).To(Succeed())
+
+			log, err := itm.GetItemLog(id)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(log).To(HaveLen(4))
+			ids = nil
+			for _, h := range log {
+				ids = append(ids, h.ID)
+			}
+			Expect(problems()).To(BeEmpty())
+		})
+
+		AfterEach(func() {
+			store.Close()
+			os.Remove(path)
+		})
+
+		It("should continue the chain after reopening the file", func() {
+			_, err := itm.CreateItem(&db.Item{Name: "Drill"}, "1")
+			Expect(err).NotTo(HaveOccurred())
+			r, err := itm.VerifyLog()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(r.Valid).To(BeTrue())
+			Expect(r.Records).To(Equal(5))
+		})
+
+		It("should detect modified records", func() {
+			tamper(func(bk *bolt.Bucket) error {
+				doc := bson.M{}
+				Expect(bson.Unmarshal(bk.Get(key(ids[1])), &doc)).To(Succeed())
+				doc["user"] = "2"
+				data, _ := bson.Marshal(doc)
+				return bk.Put(key(ids[1]), data)
+			})
+			Expect(problems()).To(ConsistOf(db.AuditProblem{Seq: 2, ID: ids[1], Problem: "Record was modified"}))
+		})
+
+		It("should detect removed records", func() {
+			tamper(func(bk *bolt.Bucket) error {
+				return bk.Delete(key(ids[2]))
+			})
+			p := problems()
+			Expect(p).To(HaveLen(1))
+			Expect(p[0].Seq).To(Equal(uint64(3)))
+			Expect(p[0].Problem).To(ContainSubstring("missing"))
+		})
+
+		It("should detect records added outside of the chain", func() {
+			tamper(func(bk *bolt.Bucket) error {
+				id := bson.NewObjectId()
+				data, _ := bson.Marshal(bson.M{"_id": id, "user": "2", "item": bson.M{"eid": 1, "owner": "2"}})
+				return bk.Put(key(id), data)
+			})
+			p := problems()
+			Expect(p).To(HaveLen(1))
+			Expect(p[0].Problem).To(Equal("Record was added outside of the chain"))
+		})
+
+		It("should detect rewritten links", func() {
+			tamper(func(bk *bolt.Bucket) error {
+				doc := bson.M{}
+				Expect(bson.Unmarshal(bk.Get(key(ids[1])), &doc)).To(Succeed())
+				doc["prev"] = "00"
+				data, _ := bson.Marshal(doc)
+				return bk.Put(key(ids[1]), data)
+			})
+			Expect(problems()).To(ConsistOf(
+				db.AuditProblem{Seq: 2, ID: ids[1], Problem: "Record does not link to its predecessor"},
+				db.AuditProblem{Seq: 2, ID: ids[1], Problem: "Record was modified"},
+			))
+		})
+	})
+
+	Describe("Checking references", func() {
+		var (
+			session *mgo.Session
+			cont    *restful.Container
+			itm     db.ItemProvider
+			pol     db.PolicyProvider
+			usr     db.UserProvider
+			hw      *httptest.ResponseRecorder
+		)
+
+		fsck := func(method, user string) *db.FsckReport {
+			req, _ := http.NewRequest(method, "/audit/fsck", nil)
+			req.SetBasicAuth(user, "testpw")
+			hw = httptest.NewRecorder()
+			cont.ServeHTTP(hw, req)
+			if hw.Code != http.StatusOK {
+				return nil
+			}
+			r := new(db.FsckReport)
+			Expect(json.Unmarshal(hw.Body.Bytes(), r)).To(Succeed())
+			return r
+		}
+
+		BeforeEach(func() {
+			session, cont, itm, pol, usr = newTestContainer()
+			populatePolicyDB(pol)
+			populateUserDB(usr)
+			// the files created below count as fully uploaded
+			db.FsckGracePeriod = 0
+		})
+
+		AfterEach(func() {
+			db.FsckGracePeriod = time.Minute
+			flushDB(session, itm)
+		})
+
+		It("should report a consistent database as valid", func() {
+			parent, err := itm.CreateItem(&db.Item{Name: "Workshop", Owner: "2"}, "2")
+			Expect(err).NotTo(HaveOccurred())
+			eid, err := itm.CreateItem(&db.Item{Name: "Lathe", Parent: parent, Owner: "2", Maintainer: "3",
+				Usage: "1", Discard: "2"}, "2")
+			Expect(err).NotTo(HaveOccurred())
+			ref, err := testImages.Create(bytes.NewReader([]byte("lathe")), "2", "image/png", eid)
+			Expect(err).NotTo(HaveOccurred())
+			_, err = itm.AddImage(eid, ref, "2")
+			Expect(err).NotTo(HaveOccurred())
+			a := &db.Attachment{ItmRef: eid, User: "2", Filename: "manual.pdf"}
+			Expect(testAttachments.Create(bytes.NewReader([]byte("%PDF")), a)).To(Succeed())
+			_, err = itm.AddAttachment(eid, a.ID, "2")
+			Expect(err).NotTo(HaveOccurred())
+
+			r := fsck("GET", "0")
+			Expect(hw.Code).To(Equal(http.StatusOK))
+			Expect(r.Valid).To(BeTrue())
+			Expect(r.Problems).To(BeEmpty())
+			Expect(r.Items).To(Equal(2))
+			Expect(r.Images).To(Equal(1))
+			Expect(r.Attachments).To(Equal(1))
+			Expect(r.MaxID).To(Equal(eid))
+			Expect(r.Counter).To(Equal(eid))
+		})
+
+		It("should find and repair broken references", func() {
+			eid, err := itm.CreateItem(&db.Item{Name: "Lathe", Parent: 999, Owner: "ghost", Maintainer: "3",
+				Usage: "nopolicy", Discard: "2"}, "2")
+			Expect(err).NotTo(HaveOccurred())
+			missing := bson.NewObjectId()
+			_, err = itm.AddImage(eid, missing, "2")
+			Expect(err).NotTo(HaveOccurred())
+			i, _ := itm.GetItemById(eid)
+			n := i
+			n.ImageInfo = map[string]db.ImageInfo{missing.Hex(): {Caption: "gone"}}
+			Expect(itm.UpdateItem(&n, i.NewItemHistory(&n, "2"))).To(Succeed())
+			orphan, err := testImages.Create(bytes.NewReader([]byte("lathe")), "2", "image/png", eid)
+			Expect(err).NotTo(HaveOccurred())
+			a := &db.Attachment{ItmRef: eid, User: "2", Filename: "manual.pdf"}
+			Expect(testAttachments.Create(bytes.NewReader([]byte("%PDF")), a)).To(Succeed())
+
+			found := []db.FsckProblem{
+				{Problem: "Unknown parent", Item: eid, Field: "parent", Ref: "999"},
+				{Problem: "Unknown user", Item: eid, Field: "owner", Ref: "ghost"},
+				{Problem: "Unknown policy", Item: eid, Field: "usage", Ref: "nopolicy"},
+				{Problem: "Missing image", Item: eid, Field: "images", Ref: missing.Hex()},
+				{Problem: "Orphaned image", Item: eid, Ref: orphan.Hex()},
+				{Problem: "Orphaned attachment", Item: eid, Ref: a.ID.Hex()},
+			}
+			r := fsck("GET", "0")
+			Expect(hw.Code).To(Equal(http.StatusOK))
+			Expect(r.Valid).To(BeFalse())
+			Expect(r.Problems).To(ConsistOf(found))
+			i, _ = itm.GetItemById(eid)
+			Expect(i.Owner).To(Equal("ghost"))
+			Expect(i.Images).To(ConsistOf(missing))
+
+			for k := range found {
+				found[k].Repaired = true
+			}
+			r = fsck("POST", "0")
+			Expect(hw.Code).To(Equal(http.StatusOK))
+			Expect(r.Problems).To(ConsistOf(found))
+
+			i, _ = itm.GetItemById(eid)
+			Expect(i.Parent).To(BeZero())
+			Expect(i.Owner).To(BeEmpty())
+			Expect(i.Maintainer).To(Equal("3"))
+			Expect(i.Usage).To(BeEmpty())
+			Expect(i.Discard).To(Equal("2"))
+			Expect(i.Images).To(BeEmpty())
+			Expect(i.ImageInfo).To(BeEmpty())
+			_, err = testImages.GetImageMetadataById(orphan)
+			Expect(err).To(Equal(db.ErrNotFound))
+			_, err = testAttachments.GetAttachmentById(a.ID)
+			Expect(err).To(Equal(db.ErrNotFound))
+
+			l, err := itm.GetItemLog(eid)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(l[len(l)-1].User).To(Equal("0"))
+			Expect(fsck("GET", "0").Valid).To(BeTrue())
+		})
+
+		It("should ignore files which may still be uploading", func() {
+			db.FsckGracePeriod = time.Minute
+			eid, err := itm.CreateItem(&db.Item{Name: "Lathe", Owner: "2"}, "2")
+			Expect(err).NotTo(HaveOccurred())
+			_, err = testImages.Create(bytes.NewReader([]byte("lathe")), "2", "image/png", eid)
+			Expect(err).NotTo(HaveOccurred())
+
+			r := fsck("POST", "0")
+			Expect(r.Valid).To(BeTrue())
+			Expect(r.Images).To(Equal(1))
+		})
+
+		It("should advance a counter behind the items", func() {
+			last, err := itm.LastID()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(itm.ImportItem(&db.Item{EID: last + 3, Name: "Imported lathe", Revision: 1})).To(Succeed())
+
+			r := fsck("GET", "0")
+			Expect(r.Counter).To(Equal(last))
+			Expect(r.MaxID).To(Equal(last + 3))
+			Expect(r.Problems).To(ConsistOf(db.FsckProblem{Problem: "Item id counter is behind the items",
+				Ref: strconv.FormatUint(last, 10)}))
+
+			r = fsck("POST", "0")
+			Expect(r.Problems[0].Repaired).To(BeTrue())
+			Expect(r.Counter).To(Equal(last + 3))
+			eid, err := itm.CreateItem(&db.Item{Name: "Drill"}, "2")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(eid).To(Equal(last + 4))
+		})
+
+		It("should refuse other users", func() {
+			fsck("GET", "1")
+			Expect(hw.Code).To(Equal(http.StatusForbidden))
+			fsck("POST", "1")
+			Expect(hw.Code).To(Equal(http.StatusForbidden))
+		})
+	})
+})
@@ -20,46 +20,119 @@
 package webservice
 
 import (
-	//"crypto/sha512"
 	log "github.com/Sirupsen/logrus"
 	"github.com/emicklei/go-restful"
-	//	"gopkg.in/mgo.v2/bson"
 	db "github.com/openlab-aux/lsmsd/database"
 	"net/http"
+	"strings"
 )
 
 type BasicAuthService struct {
-	d *db.UserDBProvider
+	d db.UserProvider
+	t db.TokenProvider
 }
 
-func NewBasicAuthService(d *db.UserDBProvider) *BasicAuthService {
+func NewBasicAuthService(d db.UserProvider, t db.TokenProvider) *BasicAuthService {
 	res := new(BasicAuthService)
 	res.d = d
+	res.t = t
 	return res
 }
 
+// Auth authenticates requests with either a bearer token (session or API
+// token) or HTTP basic auth. Basic auth accepts the password as well as an
+// API token of the user, for clients which can't send bearer tokens.
 func (s *BasicAuthService) Auth(request *restful.Request, response *restful.Response, chain *restful.FilterChain) {
+	if h := request.HeaderParameter("Authorization"); strings.HasPrefix(h, "Bearer ") {
+		tok, err := s.t.GetTokenBySecret(strings.TrimPrefix(h, "Bearer "))
+		if err != nil {
+			log.Warn("Failed login attempt, invalid token")
+			unauthorized(request, response, "Token invalid or expired")
+			return
+		}
+		s.login(tok.User, &tok, request, response, chain)
+		return
+	}
+
 	u, p, ok := request.Request.BasicAuth()
 	if !ok {
+		unauthorized(request, response, "Authentication required")
+		return
 	}
 	usr, err := s.d.GetUserByName(u)
-	if err != nil || !ok {
+	if err != nil {
 		log.WithFields(log.Fields{"User": u}).Warn("Failed login attempt")
-		response.AddHeader("WWW-Authenticate", "Basic realm=\""+request.SelectedRoutePath()+"\"")
-		response.WriteErrorString(http.StatusUnauthorized, "Username / Password incorrect")
+		unauthorized(request, response, "Username / Password incorrect")
 		return
 	}
 
 	pwcorrect := usr.Secret.VerifyPassword(p)
 	if pwcorrect {
 		log.Debug("User Authentication successful")
+		s.upgradeSecret(&usr, p)
 	} else {
+		tok, err := s.t.GetTokenBySecret(p)
+		if err == nil && tok.User == usr.Name && tok.Kind == db.TokenAPI {
+			s.login(tok.User, &tok, request, response, chain)
+			return
+		}
 		log.WithFields(log.Fields{"User": u}).Warn("Failed login attempt, incorrect password")
-		response.AddHeader("WWW-Authenticate", "Basic realm=\""+request.SelectedRoutePath()+"\"")
-		response.WriteErrorString(http.StatusUnauthorized, "Username / Password incorrect")
+		unauthorized(request, response, "Username / Password incorrect")
 		return
 
 	}
-	request.SetAttribute("User", usr.Name)
+	setUser(request, &usr)
+	chain.ProcessFilter(request, response)
+}
+
+// OptionalAuth authenticates requests carrying credentials like Auth and
+// lets anonymous requests pass. Handlers tell them apart by the User
+// attribute.
+func (s *BasicAuthService) OptionalAuth(request *restful.Request, response *restful.Response, chain *restful.FilterChain) {
+	if request.HeaderParameter("Authorization") == "" {
+		chain.ProcessFilter(request, response)
+		return
+	}
+	s.Auth(request, response, chain)
+}
+
+func (s *BasicAuthService) login(name string, tok *db.Token, request *restful.Request, response *restful.Response, chain *restful.FilterChain) {
+	usr, err := s.d.GetUserByName(name)
+	if err != nil {
+		log.WithFields(log.Fields{"User": name}).Warn("Token of unknown user")
+		unauthorized(request, response, "Token invalid or expired")
+		return
+	}
+	log.WithFields(log.Fields{"User": name, "Token": tok.ID.Hex()}).Debug("Token Authentication successful")
+	setUser(request, &usr)
+	request.SetAttribute("Token", tok)
 	chain.ProcessFilter(request, response)
 }
+
+// upgradeSecret rehashes the password of usr if it was stored with an
+// outdated algorithm. p has to be the verified password.
+func (s *BasicAuthService) upgradeSecret(usr *db.User, p string) {
+	if !usr.Secret.NeedsUpgrade() {
+		return
+	}
+	sec := usr.Secret
+	err := sec.SetPassword(p)
+	if err == nil {
+		err = s.d.SetSecret(usr.Name, sec)
+	}
+	if err != nil {
+		log.WithFields(log.Fields{"User": usr.Name, "Error Msg": err}).Warn("Could not upgrade password hash")
+		return
+	}
+	log.WithFields(log.Fields{"User": usr.Name, "Algorithm": sec.Algorithm}).Info("Upgraded password hash")
+}
+
+func setUser(request *restful.Request, usr *db.User) {
+	request.SetAttribute("User", usr.Name)
+	request.SetAttribute("Role", usr.EffectiveRole())
+}
+
+func unauthorized(request *restful.Request, response *restful.Response, msg string) {
+	response.AddHeader("WWW-Authenticate", "Basic realm=\""+request.SelectedRoutePath()+"\"")
+	response.WriteErrorString(http.StatusUnauthorized, msg)
+}
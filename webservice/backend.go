@@ -24,6 +24,7 @@ import (
 	"github.com/emicklei/go-restful"
 	mrand "math/rand"
 	"net/http"
+	"time"
 )
 
 const (
@@ -33,6 +34,7 @@ const (
 	ERROR_INTERNAL      = "Error: Internal Server Error"
 	ERROR_INSERT        = "Error: DB Insert failed"
 	ERROR_QUERY         = "Error: DB Query failed"
+	ERROR_PRECONDITION  = "Error: The resource was changed in the meantime"
 )
 
 func DebugLoggingFilter(rq *restful.Request, rs *restful.Response, ch *restful.FilterChain) {
@@ -72,6 +74,16 @@ func DebugLoggingFilter(rq *restful.Request, rs *restful.Response, ch *restful.F
 	ch.ProcessFilter(rq, rs)
 }
 
+// timeParameter parses the RFC 3339 query parameter name of rq. def is
+// returned if the parameter is not set.
+func timeParameter(rq *restful.Request, name string, def time.Time) (time.Time, error) {
+	s := rq.QueryParameter(name)
+	if s == "" {
+		return def, nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
 func returnsInternalServerError(b *restful.RouteBuilder) {
 	b.Returns(http.StatusInternalServerError, ERROR_INTERNAL, nil)
 }
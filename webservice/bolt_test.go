@@ -0,0 +1,134 @@
+/*
+ *    Copyright (C) 2015 Stefan Luecke
+ *
+ *    This program is free software: you can redistribute it and/or modify
+ *    it under the terms of the GNU Affero General Public License as published
+ *    by the Free Software Foundation, either version 3 of the License, or
+ *    (at your option) any later version.
+ *
+ *    This program is distributed in the hope that it will be useful,
+ *    but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *    GNU Affero General Public License for more details.
+ *
+ *    You should have received a copy of the GNU Affero General Public License
+ *    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ *    Authors: Stefan Luecke <glaxx@glaxx.net>
+ */
+
+package webservice_test
+
+import (
+	"bytes"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	db "github.com/openlab-aux/lsmsd/database"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+var _ = Describe("Bolt backend", func() {
+	var (
+		path  string
+		store *db.BoltStore
+		img   *db.ImageBoltProvider
+		itm   db.ItemProvider
+		tok   db.TokenProvider
+	)
+
+	open := func() {
+		var err error
+		store, err = db.OpenBoltStore(path)
+		Expect(err).NotTo(HaveOccurred())
+		img, err = db.NewImageBoltProvider(store)
+		Expect(err).NotTo(HaveOccurred())
+		itm, err = db.NewItemBoltProvider(store, img)
+		Expect(err).NotTo(HaveOccurred())
+		tok, err = db.NewTokenBoltProvider(store)
+		Expect(err).NotTo(HaveOccurred())
+	}
+
+	BeforeEach(func() {
+		f, err := ioutil.TempFile("", "lsmsd_bolt")
+		Expect(err).NotTo(HaveOccurred())
+		f.Close()
+		path = f.Name()
+		open()
+	})
+
+	AfterEach(func() {
+		store.Close()
+		os.Remove(path)
+	})
+
+	It("should keep items, history and images after reopening the file", func() {
+		id, err := itm.CreateItem(&db.Item{Name: "Drill", Owner: "1"}, "0")
+		Expect(err).NotTo(HaveOccurred())
+		i, _ := itm.GetItemById(id)
+		i.Description = "cordless"
+		Expect(itm.UpdateItem(&i, i.NewItemHistory(&i, "1"))).To(Succeed())
+		ref, err := img.Create(bytes.NewBufferString("png"), "1", "image/png", id)
+		Expect(err).NotTo(HaveOccurred())
+		_, err = itm.AddImage(id, ref, "1")
+		Expect(err).NotTo(HaveOccurred())
+
+		store.Close()
+		open()
+
+		i, err = itm.GetItemById(id)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(i.Description).To(Equal("cordless"))
+		Expect(i.Images).To(ConsistOf(ref))
+		log, err := itm.GetItemLog(id)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(log).To(HaveLen(3))
+		buf, ct, err := img.GetImageById(ref)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ct).To(Equal("image/png"))
+		Expect(buf.String()).To(Equal("png"))
+	})
+
+	It("should continue the item counter after reopening the file", func() {
+		id, err := itm.CreateItem(&db.Item{Name: "Drill"}, "0")
+		Expect(err).NotTo(HaveOccurred())
+
+		store.Close()
+		open()
+
+		next, err := itm.CreateItem(&db.Item{Name: "Saw"}, "0")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(next).To(Equal(id + 1))
+	})
+
+	It("should forget deleted items", func() {
+		id, _ := itm.CreateItem(&db.Item{Name: "Drill"}, "0")
+		i, _ := itm.GetItemById(id)
+		Expect(itm.DeleteItem(&i, i.NewItemHistory(&i, "1"))).To(Succeed())
+
+		store.Close()
+		open()
+
+		_, err := itm.GetItemById(id)
+		Expect(err).To(Equal(db.ErrNotFound))
+	})
+
+	It("should drop expired tokens when opening the file", func() {
+		_, expired, err := tok.CreateToken("1", "", db.TokenAPI, time.Now().Add(-time.Minute))
+		Expect(err).NotTo(HaveOccurred())
+		_, valid, err := tok.CreateToken("1", "", db.TokenAPI, time.Now().Add(time.Hour))
+		Expect(err).NotTo(HaveOccurred())
+
+		store.Close()
+		open()
+
+		_, err = tok.GetTokenBySecret(expired)
+		Expect(err).To(Equal(db.ErrNotFound))
+		_, err = tok.GetTokenBySecret(valid)
+		Expect(err).NotTo(HaveOccurred())
+		t, err := tok.ListTokens("1", db.TokenAPI)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(t).To(HaveLen(1))
+	})
+})
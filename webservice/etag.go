@@ -0,0 +1,96 @@
+/*
+ *    Copyright (C) 2015 Stefan Luecke
+ *
+ *    This program is free software: you can redistribute it and/or modify
+ *    it under the terms of the GNU Affero General Public License as published
+ *    by the Free Software Foundation, either version 3 of the License, or
+ *    (at your option) any later version.
+ *
+ *    This program is distributed in the hope that it will be useful,
+ *    but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *    GNU Affero General Public License for more details.
+ *
+ *    You should have received a copy of the GNU Affero General Public License
+ *    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ *    Authors: Stefan Luecke <glaxx@glaxx.net>
+ */
+
+package webservice
+
+import (
+	"github.com/emicklei/go-restful"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Items and policies carry a revision which is incremented on every change.
+// It is sent as ETag, so clients can make their changes conditional with
+// If-Match and revalidate cached copies with If-None-Match.
+
+func etag(rev uint64) string {
+	return `"` + strconv.FormatUint(rev, 10) + `"`
+}
+
+// etagMatches reports whether header, the value of an If-Match or
+// If-None-Match header, lists the entity tag of rev. weak enables the weak
+// comparison If-None-Match uses.
+func etagMatches(header string, rev uint64, weak bool) bool {
+	tag := etag(rev)
+	for _, t := range strings.Split(header, ",") {
+		t = strings.TrimSpace(t)
+		if weak {
+			t = strings.TrimPrefix(t, "W/")
+		}
+		if t == "*" || t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// notModified sets the ETag of rev and writes 304 Not Modified if the
+// If-None-Match header of request lists it
+func notModified(request *restful.Request, response *restful.Response, rev uint64) bool {
+	response.AddHeader("ETag", etag(rev))
+	h := request.HeaderParameter("If-None-Match")
+	if h != "" && etagMatches(h, rev, true) {
+		response.WriteHeader(http.StatusNotModified)
+		return true
+	}
+	return false
+}
+
+// checkIfMatch writes 412 Precondition Failed if request has an If-Match
+// header which does not list rev
+func checkIfMatch(request *restful.Request, response *restful.Response, rev uint64) bool {
+	h := request.HeaderParameter("If-Match")
+	if h == "" || etagMatches(h, rev, false) {
+		return true
+	}
+	response.WriteErrorString(http.StatusPreconditionFailed, ERROR_PRECONDITION)
+	return false
+}
+
+// baseRevision returns the revision a client based the update of an object
+// stored at revision cur on. If-Match has already been checked against cur.
+// Without it the revision in the request body counts, clients which send
+// none overwrite whatever is stored.
+func baseRevision(request *restful.Request, body, cur uint64) uint64 {
+	if body == 0 || request.HeaderParameter("If-Match") != "" {
+		return cur
+	}
+	return body
+}
+
+func returnsNotModified(b *restful.RouteBuilder) {
+	b.Param(restful.HeaderParameter("If-None-Match", "ETags of cached copies"))
+	b.Returns(http.StatusNotModified, "The cached copy is up to date", nil)
+}
+
+func returnsPreconditionFailed(b *restful.RouteBuilder) {
+	b.Param(restful.HeaderParameter("If-Match", "ETag of the revision the change is based on"))
+	b.Returns(http.StatusPreconditionFailed, ERROR_PRECONDITION, nil)
+}
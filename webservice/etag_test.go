@@ -0,0 +1,154 @@
+/*
+ *    Copyright (C) 2015 Stefan Luecke
+ *
+ *    This program is free software: you can redistribute it and/or modify
+ *    it under the terms of the GNU Affero General Public License as published
+ *    by the Free Software Foundation, either version 3 of the License, or
+ *    (at your option) any later version.
+ *
+ *    This program is distributed in the hope that it will be useful,
+ *    but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *    GNU Affero General Public License for more details.
+ *
+ *    You should have received a copy of the GNU Affero General Public License
+ *    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ *    Authors: Stefan Luecke <glaxx@glaxx.net>
+ */
+
+package webservice_test
+
+import (
+	"github.com/emicklei/go-restful"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	db "github.com/openlab-aux/lsmsd/database"
+	"gopkg.in/mgo.v2"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+)
+
+var _ = Describe("Conditional requests", func() {
+	var (
+		session *mgo.Session
+		cont    *restful.Container
+		itm     db.ItemProvider
+		pol     db.PolicyProvider
+		usr     db.UserProvider
+		hw      *httptest.ResponseRecorder
+		eid     uint64
+		id      string
+	)
+
+	BeforeEach(func() {
+		session, cont, itm, pol, usr = newTestContainer()
+		populateUserDB(usr)
+		populatePolicyDB(pol)
+		var err error
+		eid, err = itm.CreateItem(&db.Item{Name: "Oscilloscope", Owner: "0"}, "0")
+		Expect(err).NotTo(HaveOccurred())
+		id = strconv.FormatUint(eid, 10)
+	})
+
+	AfterEach(func() {
+		flushDB(session, itm)
+	})
+
+	Describe("Items", func() {
+		It("should send the revision as ETag", func() {
+			hw = request(cont, "GET", "/items/"+id, "0", nil)
+			Expect(hw.Code).To(Equal(http.StatusOK))
+			Expect(hw.Header().Get("ETag")).To(Equal(`"1"`))
+		})
+
+		It("should answer 304 if the cached copy is current", func() {
+			hw = request(cont, "GET", "/items/"+id, "0", nil, "If-None-Match", `"7", W/"1"`)
+			Expect(hw.Code).To(Equal(http.StatusNotModified))
+			Expect(hw.Body.Len()).To(BeZero())
+
+			hw = request(cont, "GET", "/items/"+id, "0", nil, "If-None-Match", `"7"`)
+			Expect(hw.Code).To(Equal(http.StatusOK))
+		})
+
+		It("should update a matching revision and send the new ETag", func() {
+			i, _ := itm.GetItemById(eid)
+			i.Description = "200MHz"
+			hw = request(cont, "PUT", "/items", "0", i, "If-Match", `"1"`)
+			Expect(hw.Code).To(Equal(http.StatusOK))
+			Expect(hw.Header().Get("ETag")).To(Equal(`"2"`))
+		})
+
+		It("should refuse updates based on a stale revision", func() {
+			i, _ := itm.GetItemById(eid)
+			first := i
+			i.Description = "first"
+			hw = request(cont, "PUT", "/items", "0", i)
+			Expect(hw.Code).To(Equal(http.StatusOK))
+
+			first.Description = "second"
+			hw = request(cont, "PUT", "/items", "0", first)
+			Expect(hw.Code).To(Equal(http.StatusPreconditionFailed))
+			hw = request(cont, "PUT", "/items", "0", first, "If-Match", `"1"`)
+			Expect(hw.Code).To(Equal(http.StatusPreconditionFailed))
+
+			i, _ = itm.GetItemById(eid)
+			Expect(i.Description).To(Equal("first"))
+		})
+
+		It("should let clients without revisions overwrite the item", func() {
+			hw = request(cont, "PUT", "/items", "0", map[string]interface{}{"Id": eid, "Name": "Scope", "Owner": "0"})
+			Expect(hw.Code).To(Equal(http.StatusOK))
+			i, _ := itm.GetItemById(eid)
+			Expect(i.Name).To(Equal("Scope"))
+			Expect(i.Revision).To(Equal(uint64(2)))
+		})
+
+		It("should change the ETag on checkout", func() {
+			hw = request(cont, "POST", "/items/"+id+"/checkout", "0", nil)
+			Expect(hw.Code).To(Equal(http.StatusOK))
+			hw = request(cont, "GET", "/items/"+id, "0", nil, "If-None-Match", `"1"`)
+			Expect(hw.Code).To(Equal(http.StatusOK))
+		})
+
+		It("should refuse to delete a changed item", func() {
+			hw = request(cont, "DELETE", "/items/"+id, "0", nil, "If-Match", `"3"`)
+			Expect(hw.Code).To(Equal(http.StatusPreconditionFailed))
+			Expect(itm.CheckItemExistance(&db.Item{EID: eid})).To(BeTrue())
+
+			hw = request(cont, "DELETE", "/items/"+id, "0", nil, "If-Match", `"1"`)
+			Expect(hw.Code).To(Equal(http.StatusOK))
+		})
+	})
+
+	Describe("Policies", func() {
+		It("should send the revision as ETag", func() {
+			hw = request(cont, "GET", "/policies/1", "0", nil)
+			Expect(hw.Header().Get("ETag")).To(Equal(`"1"`))
+			hw = request(cont, "GET", "/policies/1", "0", nil, "If-None-Match", "*")
+			Expect(hw.Code).To(Equal(http.StatusNotModified))
+		})
+
+		It("should refuse updates based on a stale revision", func() {
+			p, _ := pol.GetPolicyByName("1")
+			p.Description = "first"
+			hw = request(cont, "PUT", "/policies", "0", p, "If-Match", `"1"`)
+			Expect(hw.Code).To(Equal(http.StatusOK))
+			Expect(hw.Header().Get("ETag")).To(Equal(`"2"`))
+
+			p.Description = "second"
+			hw = request(cont, "PUT", "/policies", "0", p)
+			Expect(hw.Code).To(Equal(http.StatusPreconditionFailed))
+			p, _ = pol.GetPolicyByName("1")
+			Expect(p.Description).To(Equal("first"))
+		})
+
+		It("should refuse to delete a changed policy", func() {
+			hw = request(cont, "DELETE", "/policies/1", "0", nil, "If-Match", `"2"`)
+			Expect(hw.Code).To(Equal(http.StatusPreconditionFailed))
+			hw = request(cont, "DELETE", "/policies/1", "0", nil, "If-Match", `"1"`)
+			Expect(hw.Code).To(Equal(http.StatusOK))
+		})
+	})
+})
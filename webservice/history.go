@@ -0,0 +1,63 @@
+/*
+ *    Copyright (C) 2015 Stefan Luecke
+ *
+ *    This program is free software: you can redistribute it and/or modify
+ *    it under the terms of the GNU Affero General Public License as published
+ *    by the Free Software Foundation, either version 3 of the License, or
+ *    (at your option) any later version.
+ *
+ *    This program is distributed in the hope that it will be useful,
+ *    but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *    GNU Affero General Public License for more details.
+ *
+ *    You should have received a copy of the GNU Affero General Public License
+ *    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ *    Authors: Stefan Luecke <glaxx@glaxx.net>
+ */
+
+package webservice
+
+import (
+	log "github.com/Sirupsen/logrus"
+	"github.com/emicklei/go-restful"
+	db "github.com/openlab-aux/lsmsd/database"
+	"net/http"
+)
+
+// Items and policies can be rebuilt as they were at a past time from their
+// log, and single log entries can be reverted. Reverts are recorded like
+// any other change, with the id of the reverted entry under "revert".
+
+// writeHistoryError writes the response for err, which occurred while
+// rebuilding or reverting an object from its log
+func writeHistoryError(response *restful.Response, err error) {
+	switch err {
+	case db.ErrNotFound:
+		response.WriteErrorString(http.StatusNotFound, ERROR_INVALID_ID)
+	case db.ErrHistoryIncomplete:
+		response.WriteErrorString(http.StatusNotFound, err.Error())
+	case db.ErrNotRevertable:
+		response.WriteErrorString(422, err.Error())
+	case db.ErrRevertConflict, db.ErrDuplicateID:
+		response.WriteErrorString(http.StatusConflict, db.ErrRevertConflict.Error())
+	case db.ErrRevisionConflict:
+		response.WriteErrorString(http.StatusPreconditionFailed, ERROR_PRECONDITION)
+	default:
+		response.WriteErrorString(http.StatusInternalServerError, ERROR_INTERNAL)
+		log.WithFields(log.Fields{"Error Msg": err}).Warn(ERROR_INTERNAL)
+		return
+	}
+	log.Info(err)
+}
+
+func returnsAt(b *restful.RouteBuilder) {
+	b.Param(restful.QueryParameter("at", "Return the state at this time (RFC 3339, precise to the second), rebuilt from the log"))
+}
+
+func returnsRevertErrors(b *restful.RouteBuilder) {
+	b.Param(restful.PathParameter("historyid", "Id of the log entry"))
+	b.Returns(http.StatusConflict, db.ErrRevertConflict.Error(), nil)
+	b.Returns(422, db.ErrNotRevertable.Error(), nil)
+}
@@ -0,0 +1,295 @@
+/*
+ *    Copyright (C) 2015 Stefan Luecke
+ *
+ *    This program is free software: you can redistribute it and/or modify
+ *    it under the terms of the GNU Affero General Public License as published
+ *    by the Free Software Foundation, either version 3 of the License, or
+ *    (at your option) any later version.
+ *
+ *    This program is distributed in the hope that it will be useful,
+ *    but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *    GNU Affero General Public License for more details.
+ *
+ *    You should have received a copy of the GNU Affero General Public License
+ *    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ *    Authors: Stefan Luecke <glaxx@glaxx.net>
+ */
+
+package webservice_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/emicklei/go-restful"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	db "github.com/openlab-aux/lsmsd/database"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"time"
+)
+
+var _ = Describe("History", func() {
+	var (
+		session *mgo.Session
+		cont    *restful.Container
+		itm     db.ItemProvider
+		pol     db.PolicyProvider
+		usr     db.UserProvider
+		hw      *httptest.ResponseRecorder
+		eid     uint64
+		id      string
+	)
+
+	update := func(user string, change map[string]interface{}) {
+		data, _ := json.Marshal(change)
+		req, _ := http.NewRequest("PATCH", "/items/"+id, bytes.NewReader(data))
+		req.Header.Set("Content-Type", "application/merge-patch+json")
+		req.SetBasicAuth(user, "testpw")
+		hw = httptest.NewRecorder()
+		cont.ServeHTTP(hw, req)
+		Expect(hw.Code).To(Equal(http.StatusOK))
+	}
+	lastEntry := func() string {
+		log, err := itm.GetItemLog(eid)
+		Expect(err).NotTo(HaveOccurred())
+		return log[len(log)-1].ID.Hex()
+	}
+	// nextSecond waits until the log timestamps, which are precise to the
+	// second, can tell earlier changes from later ones
+	nextSecond := func() time.Time {
+		t := time.Now().Truncate(time.Second)
+		time.Sleep(t.Add(time.Second).Sub(time.Now()))
+		return t
+	}
+	at := func(t time.Time) string {
+		return "?at=" + t.UTC().Format(time.RFC3339)
+	}
+	item := func() db.Item {
+		i, err := itm.GetItemById(eid)
+		Expect(err).NotTo(HaveOccurred())
+		return i
+	}
+
+	BeforeEach(func() {
+		session, cont, itm, pol, usr = newTestContainer()
+		populateUserDB(usr)
+		populatePolicyDB(pol)
+		var err error
+		eid, err = itm.CreateItem(&db.Item{Name: "Band saw", Description: "for wood", Owner: "2"}, "2")
+		Expect(err).NotTo(HaveOccurred())
+		id = strconv.FormatUint(eid, 10)
+	})
+
+	AfterEach(func() {
+		flushDB(session, itm)
+	})
+
+	Describe("Items at a past time", func() {
+		It("should rebuild the item from its log", func() {
+			created := nextSecond()
+			update("2", map[string]interface{}{"Name": "Table saw", "Description": "for wood and metal", "Maintainer": "3"})
+
+			hw = request(cont, "GET", "/items/"+id+at(created), "", nil)
+			Expect(hw.Code).To(Equal(http.StatusOK))
+			old := db.Item{}
+			Expect(json.Unmarshal(hw.Body.Bytes(), &old)).To(Succeed())
+			Expect(old.EID).To(Equal(eid))
+			Expect(old.Name).To(Equal("Band saw"))
+			Expect(old.Description).To(Equal("for wood"))
+			Expect(old.Maintainer).To(BeEmpty())
+			Expect(old.Owner).To(Equal("2"))
+
+			hw = request(cont, "GET", "/items/"+id+at(time.Now()), "", nil)
+			Expect(hw.Code).To(Equal(http.StatusOK))
+			Expect(json.Unmarshal(hw.Body.Bytes(), &old)).To(Succeed())
+			Expect(old.Name).To(Equal("Table saw"))
+			Expect(old.Maintainer).To(Equal("3"))
+		})
+
+		It("should not know items before their creation or after their deletion", func() {
+			hw = request(cont, "GET", "/items/"+id+at(time.Now().Add(-time.Hour)), "", nil)
+			Expect(hw.Code).To(Equal(http.StatusNotFound))
+
+			hw = request(cont, "DELETE", "/items/"+id, "0", nil)
+			Expect(hw.Code).To(Equal(http.StatusOK))
+			hw = request(cont, "GET", "/items/"+id+at(time.Now()), "", nil)
+			Expect(hw.Code).To(Equal(http.StatusNotFound))
+			hw = request(cont, "GET", "/items/"+id+at(time.Now().Add(-time.Hour)), "", nil)
+			Expect(hw.Code).To(Equal(http.StatusNotFound))
+		})
+
+		It("should refuse invalid times", func() {
+			hw = request(cont, "GET", "/items/"+id+"?at=yesterday", "", nil)
+			Expect(hw.Code).To(Equal(http.StatusBadRequest))
+		})
+
+		It("should not guess what the log of older items does not tell", func() {
+			first, err := itm.ReserveIDs(1)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(itm.ImportItem(&db.Item{EID: first, Name: "Planer", Description: "old"})).To(Succeed())
+			eid, id = first, strconv.FormatUint(first, 10)
+			before := nextSecond()
+			update("0", map[string]interface{}{"Description": "new"})
+
+			hw = request(cont, "GET", "/items/"+id+at(before), "", nil)
+			Expect(hw.Code).To(Equal(http.StatusOK))
+			old := db.Item{}
+			Expect(json.Unmarshal(hw.Body.Bytes(), &old)).To(Succeed())
+			Expect(old.Name).To(Equal("Planer"))
+			Expect(old.Description).To(Equal("old"))
+
+			update("0", map[string]interface{}{"Name": "Thicknesser"})
+			hw = request(cont, "GET", "/items/"+id+at(before), "", nil)
+			Expect(hw.Code).To(Equal(http.StatusNotFound))
+			Expect(hw.Body.String()).To(ContainSubstring(db.ErrHistoryIncomplete.Error()))
+		})
+	})
+
+	Describe("Reverting items", func() {
+		It("should undo a change and record the revert", func() {
+			update("2", map[string]interface{}{"Name": "Table saw", "Owner": "3"})
+			ref := lastEntry()
+			update("3", map[string]interface{}{"Description": "for wood and metal"})
+
+			hw = request(cont, "POST", "/items/"+id+"/revert/"+ref, "3", nil)
+			Expect(hw.Code).To(Equal(http.StatusOK))
+			i := item()
+			Expect(i.Name).To(Equal("Band saw"))
+			Expect(i.Owner).To(Equal("2"))
+			Expect(i.Description).To(Equal("for wood and metal"))
+			Expect(hw.Header().Get("ETag")).To(Equal(`"4"`))
+
+			log, _ := itm.GetItemLog(eid)
+			Expect(log[len(log)-1].Item).To(HaveKeyWithValue("revert", ref))
+			Expect(log[len(log)-1].User).To(Equal("3"))
+		})
+
+		It("should merge description changes with later edits", func() {
+			update("2", map[string]interface{}{"Description": "for soft wood"})
+			ref := lastEntry()
+			update("2", map[string]interface{}{"Description": "for soft wood, up to 20cm"})
+
+			hw = request(cont, "POST", "/items/"+id+"/revert/"+ref, "2", nil)
+			Expect(hw.Code).To(Equal(http.StatusOK))
+			Expect(item().Description).To(Equal("for wood, up to 20cm"))
+		})
+
+		It("should refuse to revert changes which were overwritten", func() {
+			update("2", map[string]interface{}{"Name": "Table saw"})
+			ref := lastEntry()
+			update("2", map[string]interface{}{"Name": "Mitre saw"})
+
+			hw = request(cont, "POST", "/items/"+id+"/revert/"+ref, "2", nil)
+			Expect(hw.Code).To(Equal(http.StatusConflict))
+			Expect(item().Name).To(Equal("Mitre saw"))
+		})
+
+		It("should refuse to revert creations, images and checkouts", func() {
+			hw = request(cont, "POST", "/items/"+id+"/revert/"+lastEntry(), "2", nil)
+			Expect(hw.Code).To(Equal(422))
+
+			_, err := itm.AddImage(eid, bson.NewObjectId(), "2")
+			Expect(err).NotTo(HaveOccurred())
+			hw = request(cont, "POST", "/items/"+id+"/revert/"+lastEntry(), "2", nil)
+			Expect(hw.Code).To(Equal(422))
+
+			hw = request(cont, "POST", "/items/"+id+"/checkout", "4", nil)
+			Expect(hw.Code).To(Equal(http.StatusOK))
+			hw = request(cont, "POST", "/items/"+id+"/revert/"+lastEntry(), "2", nil)
+			Expect(hw.Code).To(Equal(422))
+		})
+
+		It("should check the permissions, the entry and If-Match", func() {
+			update("2", map[string]interface{}{"Name": "Table saw"})
+			ref := lastEntry()
+
+			hw = request(cont, "POST", "/items/"+id+"/revert/"+ref, "4", nil)
+			Expect(hw.Code).To(Equal(http.StatusForbidden))
+			hw = request(cont, "POST", "/items/"+id+"/revert/nope", "2", nil)
+			Expect(hw.Code).To(Equal(http.StatusBadRequest))
+			hw = request(cont, "POST", "/items/"+id+"/revert/"+bson.NewObjectId().Hex(), "2", nil)
+			Expect(hw.Code).To(Equal(http.StatusNotFound))
+			hw = request(cont, "POST", "/items/"+id+"/revert/"+ref, "2", nil, "If-Match", `"1"`)
+			Expect(hw.Code).To(Equal(http.StatusPreconditionFailed))
+			Expect(item().Name).To(Equal("Table saw"))
+		})
+
+		It("should restore deleted items", func() {
+			_, err := itm.AddImage(eid, bson.NewObjectId(), "2")
+			Expect(err).NotTo(HaveOccurred())
+			update("2", map[string]interface{}{"Maintainer": "3"})
+			hw = request(cont, "DELETE", "/items/"+id, "0", nil)
+			Expect(hw.Code).To(Equal(http.StatusOK))
+			ref := lastEntry()
+
+			hw = request(cont, "POST", "/items/"+id+"/revert/"+ref, "2", nil)
+			Expect(hw.Code).To(Equal(http.StatusForbidden))
+			hw = request(cont, "POST", "/items/"+id+"/revert/"+ref, "0", nil)
+			Expect(hw.Code).To(Equal(http.StatusOK))
+
+			i := item()
+			Expect(i.Name).To(Equal("Band saw"))
+			Expect(i.Description).To(Equal("for wood"))
+			Expect(i.Maintainer).To(Equal("3"))
+			Expect(i.Images).To(BeEmpty())
+			Expect(i.Revision).To(BeNumerically(">", 3))
+
+			hw = request(cont, "POST", "/items/"+id+"/revert/"+ref, "0", nil)
+			Expect(hw.Code).To(Equal(http.StatusConflict))
+			hw = request(cont, "GET", "/items/"+id+at(time.Now()), "", nil)
+			Expect(hw.Code).To(Equal(http.StatusOK))
+		})
+	})
+
+	Describe("Policies", func() {
+		lastPolicyEntry := func() string {
+			log, err := pol.GetPolicyLog("ask")
+			Expect(err).NotTo(HaveOccurred())
+			return log[len(log)-1].ID.Hex()
+		}
+
+		BeforeEach(func() {
+			hw = request(cont, "POST", "/policies", "1", db.Policy{Name: "ask", Description: "Ask first", Checkout: db.CheckoutApproval})
+			Expect(hw.Code).To(Equal(http.StatusOK))
+		})
+
+		It("should rebuild policies at a past time", func() {
+			created := nextSecond()
+			hw = request(cont, "PUT", "/policies/ask", "1", db.Policy{Description: "Just take it"})
+			Expect(hw.Code).To(Equal(http.StatusOK))
+
+			hw = request(cont, "GET", "/policies/ask"+at(created), "", nil)
+			Expect(hw.Code).To(Equal(http.StatusOK))
+			old := db.Policy{}
+			Expect(json.Unmarshal(hw.Body.Bytes(), &old)).To(Succeed())
+			Expect(old).To(Equal(db.Policy{Name: "ask", Description: "Ask first", Checkout: db.CheckoutApproval}))
+		})
+
+		It("should revert changes and restore deleted policies", func() {
+			hw = request(cont, "PUT", "/policies/ask", "1", db.Policy{Description: "Ask first", Checkout: db.CheckoutForbidden})
+			Expect(hw.Code).To(Equal(http.StatusOK))
+			hw = request(cont, "POST", "/policies/ask/revert/"+lastPolicyEntry(), "1", nil)
+			Expect(hw.Code).To(Equal(http.StatusOK))
+			p, _ := pol.GetPolicyByName("ask")
+			Expect(p.Checkout).To(Equal(db.CheckoutApproval))
+
+			hw = request(cont, "DELETE", "/policies/ask", "0", nil)
+			Expect(hw.Code).To(Equal(http.StatusOK))
+			ref := lastPolicyEntry()
+			hw = request(cont, "POST", "/policies/ask/revert/"+ref, "1", nil)
+			Expect(hw.Code).To(Equal(http.StatusForbidden))
+			hw = request(cont, "POST", "/policies/ask/revert/"+ref, "0", nil)
+			Expect(hw.Code).To(Equal(http.StatusOK))
+			p, err := pol.GetPolicyByName("ask")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(p.Description).To(Equal("Ask first"))
+			Expect(p.Checkout).To(Equal(db.CheckoutApproval))
+		})
+	})
+})
@@ -0,0 +1,82 @@
+/*
+ *    Copyright (C) 2015 Stefan Luecke
+ *
+ *    This program is free software: you can redistribute it and/or modify
+ *    it under the terms of the GNU Affero General Public License as published
+ *    by the Free Software Foundation, either version 3 of the License, or
+ *    (at your option) any later version.
+ *
+ *    This program is distributed in the hope that it will be useful,
+ *    but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *    GNU Affero General Public License for more details.
+ *
+ *    You should have received a copy of the GNU Affero General Public License
+ *    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ *    Authors: Stefan Luecke <glaxx@glaxx.net>
+ */
+
+package webservice
+
+import (
+	"bytes"
+	"github.com/emicklei/go-restful"
+	db "github.com/openlab-aux/lsmsd/database"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	MIME_ICAL = "text/calendar"
+
+	icalTimeFormat = "20060102T150405Z"
+	icalLineLength = 75
+)
+
+var icalEscaper = strings.NewReplacer("\\", "\\\\", ";", "\\;", ",", "\\,", "\r\n", "\\n", "\n", "\\n")
+
+// writeICalendar writes the reservations as RFC 5545 calendar called name.
+// itemName is used to look up the summary of each event.
+func writeICalendar(response *restful.Response, name string, rs []db.Reservation, itemName func(uint64) string) {
+	buf := new(bytes.Buffer)
+	icalLine(buf, "BEGIN:VCALENDAR")
+	icalLine(buf, "VERSION:2.0")
+	icalLine(buf, "PRODID:-//openlab-aux//lsmsd//EN")
+	icalLine(buf, "CALSCALE:GREGORIAN")
+	icalLine(buf, "METHOD:PUBLISH")
+	icalLine(buf, "X-WR-CALNAME:"+icalEscaper.Replace(name))
+	for _, r := range rs {
+		icalLine(buf, "BEGIN:VEVENT")
+		icalLine(buf, "UID:"+r.ID.Hex()+"@lsmsd")
+		icalLine(buf, "DTSTAMP:"+r.ID.Time().UTC().Format(icalTimeFormat))
+		icalLine(buf, "DTSTART:"+r.Start.UTC().Format(icalTimeFormat))
+		icalLine(buf, "DTEND:"+r.End.UTC().Format(icalTimeFormat))
+		icalLine(buf, "SUMMARY:"+icalEscaper.Replace(itemName(r.Item)+" ("+r.User+")"))
+		if r.Comment != "" {
+			icalLine(buf, "DESCRIPTION:"+icalEscaper.Replace(r.Comment))
+		}
+		icalLine(buf, "END:VEVENT")
+	}
+	icalLine(buf, "END:VCALENDAR")
+
+	response.AddHeader("Content-Type", MIME_ICAL+"; charset=utf-8")
+	response.Write(buf.Bytes())
+}
+
+// icalLine writes a content line, folded after icalLineLength octets
+// without splitting UTF-8 sequences
+func icalLine(buf *bytes.Buffer, line string) {
+	limit := icalLineLength
+	for len(line) > limit {
+		i := limit
+		for i > 0 && !utf8.RuneStart(line[i]) {
+			i--
+		}
+		buf.WriteString(line[:i] + "\r\n ")
+		line = line[i:]
+		// the leading space of a continuation line counts as well
+		limit = icalLineLength - 1
+	}
+	buf.WriteString(line + "\r\n")
+}
@@ -20,22 +20,29 @@
 package webservice
 
 import (
+	"bytes"
+	"crypto/md5"
 	"encoding/hex"
 	log "github.com/Sirupsen/logrus"
 	"github.com/emicklei/go-restful"
 	db "github.com/openlab-aux/lsmsd/database"
-	"gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
+	"image"
 	"io"
 	"net/http"
+	"time"
 )
 
+// imageCacheControl lets clients keep images for a year, an image id always
+// refers to the same data
+const imageCacheControl = "public, max-age=31536000, immutable"
+
 type ImageWebService struct {
-	d *db.ImageDBProvider
+	d db.ImageProvider
 	S *restful.WebService
 }
 
-func NewImageService(d *db.ImageDBProvider) *ImageWebService {
+func NewImageService(d db.ImageProvider) *ImageWebService {
 	res := new(ImageWebService)
 	res.d = d
 
@@ -49,9 +56,13 @@ func NewImageService(d *db.ImageDBProvider) *ImageWebService {
 
 	s.Route(s.GET("/{id}").
 		Param(restful.PathParameter("id", "Unique image identifier")).
+		Param(restful.QueryParameter("size", "Return the image scaled down to thumb (160x160), medium (800x800) or "+
+			"to fit into WIDTHxHEIGHT pixels, at most 800x800. JPEGs stay JPEGs, other images are returned as PNG. "+
+			"Only thumb and medium are kept, other sizes are rendered on every request")).
 		Doc("Returns a image").
 		To(res.GetImageById).
 		//Writes(db.Image{}).
+		Returns(422, errNotRenderable.Error(), nil).
 		Do(returnsInternalServerError, returnsNotFound, returnsBadRequest))
 
 	s.Route(s.GET("/{id}/meta").
@@ -75,18 +86,97 @@ func (p *ImageWebService) GetImageById(req *restful.Request, res *restful.Respon
 		res.WriteErrorString(http.StatusBadRequest, "")
 		return
 	}
-	buf, ct, err := p.d.GetImageById(bson.ObjectId(id))
+	if size := req.QueryParameter("size"); size != "" {
+		p.getRendition(req, res, bson.ObjectId(id), size)
+		return
+	}
+	f, err := p.d.OpenImage(bson.ObjectId(id))
 	if err != nil {
 		log.Debug(err)
-		if err == mgo.ErrNotFound {
+		if err == db.ErrNotFound {
 			res.WriteErrorString(http.StatusNotFound, err.Error())
 			return
 		}
 		res.WriteErrorString(http.StatusInternalServerError, ERROR_INTERNAL)
 		return
 	}
+	defer f.Close()
+	serveImage(req, res, f, f.ContentType(), f.MD5(), f.UploadDate())
+}
+
+// serveImage streams an image with its validators. Images never change, so
+// they may be cached for long. Range and conditional requests are answered
+// by http.ServeContent.
+func serveImage(req *restful.Request, res *restful.Response, r io.ReadSeeker, ct, md5 string, modified time.Time) {
 	res.AddHeader("Content-Type", ct)
-	io.Copy(res, buf)
+	res.AddHeader("ETag", `"`+md5+`"`)
+	res.AddHeader("Cache-Control", imageCacheControl)
+	http.ServeContent(res.ResponseWriter, req.Request, "", modified, r)
+}
+
+// getRendition writes image id scaled down to size. Renditions in the named
+// sizes are made on their first request and stored until the image is
+// removed. Other sizes are made on every request, storing them would let
+// anybody fill the database with millions of sizes of every image.
+func (p *ImageWebService) getRendition(req *restful.Request, res *restful.Response, id bson.ObjectId, size string) {
+	box, err := parseImageSize(size)
+	if err != nil {
+		log.Debug(err)
+		res.WriteErrorString(http.StatusBadRequest, err.Error())
+		return
+	}
+	var (
+		buf *bytes.Buffer
+		ct  string
+	)
+	_, named := imageSizes[size]
+	if named {
+		buf, ct, err = p.d.GetRendition(id, size)
+	}
+	if !named || err == db.ErrNotFound {
+		buf, ct, err = p.render(id, size, box, named)
+	}
+	if err != nil {
+		log.Debug(err)
+		switch err {
+		case db.ErrNotFound:
+			res.WriteErrorString(http.StatusNotFound, err.Error())
+		case errNotRenderable:
+			res.WriteErrorString(422, err.Error())
+		default:
+			res.WriteErrorString(http.StatusInternalServerError, ERROR_INTERNAL)
+		}
+		return
+	}
+	sum := md5.Sum(buf.Bytes())
+	serveImage(req, res, bytes.NewReader(buf.Bytes()), ct, hex.EncodeToString(sum[:]), id.Time())
+}
+
+// render makes the rendition of image id in size, which has to fit into box,
+// and stores it if store is set. Images fitting already are returned as
+// they are.
+func (p *ImageWebService) render(id bson.ObjectId, size string, box image.Point, store bool) (*bytes.Buffer, string, error) {
+	orig, ct, err := p.d.GetImageById(id)
+	if err != nil {
+		return nil, "", err
+	}
+	buf, rct, ok, err := renderImage(orig.Bytes(), box)
+	if err != nil {
+		log.WithFields(log.Fields{"Image": id.Hex(), "Error Msg": err}).Info(errNotRenderable)
+		return nil, "", errNotRenderable
+	}
+	if !ok {
+		return orig, ct, nil
+	}
+	if !store {
+		return buf, rct, nil
+	}
+	// a failed store only costs rendering the image again
+	err = p.d.CreateRendition(bytes.NewReader(buf.Bytes()), rct, id, size)
+	if err != nil {
+		log.WithFields(log.Fields{"Image": id.Hex(), "Size": size, "Error Msg": err}).Warn("Could not store image rendition")
+	}
+	return buf, rct, nil
 }
 
 func (p *ImageWebService) GetImageMetadataById(req *restful.Request, res *restful.Response) {
@@ -100,7 +190,7 @@ func (p *ImageWebService) GetImageMetadataById(req *restful.Request, res *restfu
 	meta, err := p.d.GetImageMetadataById(bson.ObjectId(id))
 	if err != nil {
 		log.Debug(err)
-		if err == mgo.ErrNotFound {
+		if err == db.ErrNotFound {
 			res.WriteErrorString(http.StatusNotFound, err.Error())
 			return
 		}
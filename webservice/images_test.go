@@ -0,0 +1,438 @@
+/*
+ *    Copyright (C) 2015 Stefan Luecke
+ *
+ *    This program is free software: you can redistribute it and/or modify
+ *    it under the terms of the GNU Affero General Public License as published
+ *    by the Free Software Foundation, either version 3 of the License, or
+ *    (at your option) any later version.
+ *
+ *    This program is distributed in the hope that it will be useful,
+ *    but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *    GNU Affero General Public License for more details.
+ *
+ *    You should have received a copy of the GNU Affero General Public License
+ *    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ *    Authors: Stefan Luecke <glaxx@glaxx.net>
+ */
+
+package webservice_test
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/emicklei/go-restful"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	db "github.com/openlab-aux/lsmsd/database"
+	"github.com/openlab-aux/lsmsd/webservice"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+)
+
+var _ = Describe("Images", func() {
+	var (
+		session *mgo.Session
+		cont    *restful.Container
+		itm     db.ItemProvider
+		usr     db.UserProvider
+		hw      *httptest.ResponseRecorder
+		eid     uint64
+		id      string
+	)
+
+	upload := func(contentType string, data []byte) {
+		hw = request(cont, "POST", "/items/"+id+"/image", "2", data, "Content-Type", contentType)
+	}
+	// halves returns a w x h image with a red left and a blue right half
+	halves := func(w, h int) *image.RGBA {
+		img := image.NewRGBA(image.Rect(0, 0, w, h))
+		for y := 0; y != h; y++ {
+			for x := 0; x != w; x++ {
+				c := color.RGBA{255, 0, 0, 255}
+				if x >= w/2 {
+					c = color.RGBA{0, 0, 255, 255}
+				}
+				img.Set(x, y, c)
+			}
+		}
+		return img
+	}
+	// attach uploads halves(w, h) and returns the image id
+	attach := func(w, h int, contentType string) string {
+		img := halves(w, h)
+		buf := new(bytes.Buffer)
+		if contentType == "image/jpeg" {
+			Expect(jpeg.Encode(buf, img, nil)).To(Succeed())
+		} else {
+			Expect(png.Encode(buf, img)).To(Succeed())
+		}
+		upload(contentType, buf.Bytes())
+		Expect(hw.Code).To(Equal(http.StatusOK))
+		i, err := itm.GetItemById(eid)
+		Expect(err).NotTo(HaveOccurred())
+		return i.Images[len(i.Images)-1].Hex()
+	}
+	get := func(path string) image.Image {
+		hw = request(cont, "GET", path, "", nil)
+		Expect(hw.Code).To(Equal(http.StatusOK))
+		img, _, err := image.Decode(bytes.NewReader(hw.Body.Bytes()))
+		Expect(err).NotTo(HaveOccurred())
+		return img
+	}
+
+	BeforeEach(func() {
+		session, cont, itm, _, usr = newTestContainer()
+		populateUserDB(usr)
+		var err error
+		eid, err = itm.CreateItem(&db.Item{Name: "Camera", Owner: "2"}, "2")
+		Expect(err).NotTo(HaveOccurred())
+		id = strconv.FormatUint(eid, 10)
+	})
+
+	AfterEach(func() {
+		flushDB(session, itm)
+	})
+
+	Describe("Renditions", func() {
+		It("should scale images down keeping their aspect ratio", func() {
+			ref := attach(1000, 500, "image/jpeg")
+			thumb := get("/images/" + ref + "?size=thumb")
+			Expect(hw.Header().Get("Content-Type")).To(Equal("image/jpeg"))
+			Expect(thumb.Bounds().Size()).To(Equal(image.Pt(160, 80)))
+
+			medium := get("/images/" + ref + "?size=medium")
+			Expect(medium.Bounds().Size()).To(Equal(image.Pt(800, 400)))
+
+			custom := get("/images/" + ref + "?size=100x100")
+			Expect(custom.Bounds().Size()).To(Equal(image.Pt(100, 50)))
+			huge := get("/images/" + ref + "?size=5000x5000")
+			Expect(huge.Bounds().Size()).To(Equal(image.Pt(800, 400)))
+			r, _, b, _ := custom.At(10, 25).RGBA()
+			Expect(r).To(BeNumerically(">", b))
+			r, _, b, _ = custom.At(90, 25).RGBA()
+			Expect(b).To(BeNumerically(">", r))
+		})
+
+		It("should keep PNGs and small images", func() {
+			ref := attach(300, 600, "image/png")
+			thumb := get("/images/" + ref + "?size=thumb")
+			Expect(hw.Header().Get("Content-Type")).To(Equal("image/png"))
+			Expect(thumb.Bounds().Size()).To(Equal(image.Pt(80, 160)))
+
+			hw = request(cont, "GET", "/images/"+ref, "", nil)
+			orig := hw.Body.Bytes()
+			hw = request(cont, "GET", "/images/"+ref+"?size=400x0600", "", nil)
+			Expect(hw.Code).To(Equal(http.StatusOK))
+			Expect(hw.Body.Bytes()).To(Equal(orig))
+		})
+
+		It("should store renditions in named sizes until the image is removed", func() {
+			ref := attach(400, 400, "image/png")
+			get("/images/" + ref + "?size=thumb")
+			custom := get("/images/" + ref + "?size=0200x100")
+			Expect(custom.Bounds().Size()).To(Equal(image.Pt(100, 100)))
+			_, ct, err := testImages.GetRendition(bson.ObjectIdHex(ref), "thumb")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ct).To(Equal("image/png"))
+			_, _, err = testImages.GetRendition(bson.ObjectIdHex(ref), "200x100")
+			Expect(err).To(Equal(db.ErrNotFound))
+			_, _, err = testImages.GetRendition(bson.ObjectIdHex(ref), "0200x100")
+			Expect(err).To(Equal(db.ErrNotFound))
+
+			hw = request(cont, "DELETE", "/items/"+id+"/image/"+ref, "2", nil)
+			Expect(hw.Code).To(Equal(http.StatusOK))
+			_, _, err = testImages.GetRendition(bson.ObjectIdHex(ref), "thumb")
+			Expect(err).To(Equal(db.ErrNotFound))
+			hw = request(cont, "GET", "/images/"+ref+"?size=thumb", "", nil)
+			Expect(hw.Code).To(Equal(http.StatusNotFound))
+		})
+
+		It("should reject invalid sizes", func() {
+			ref := attach(10, 10, "image/png")
+			for _, size := range []string{"huge", "100", "0x100", "100x-1", "axb"} {
+				hw = request(cont, "GET", "/images/"+ref+"?size="+size, "", nil)
+				Expect(hw.Code).To(Equal(http.StatusBadRequest), size)
+			}
+		})
+
+		It("should not resize broken images", func() {
+			ref, err := testImages.Create(bytes.NewBufferString("no image"), "2", "image/png", eid)
+			Expect(err).NotTo(HaveOccurred())
+			hw = request(cont, "GET", "/images/"+ref.Hex()+"?size=thumb", "", nil)
+			Expect(hw.Code).To(Equal(422))
+		})
+	})
+
+	Describe("Uploads", func() {
+		lastImage := func() string {
+			i, err := itm.GetItemById(eid)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(i.Images).NotTo(BeEmpty())
+			return i.Images[len(i.Images)-1].Hex()
+		}
+		encodePNG := func(img image.Image) []byte {
+			buf := new(bytes.Buffer)
+			Expect(png.Encode(buf, img)).To(Succeed())
+			return buf.Bytes()
+		}
+
+		It("should take the type from the content", func() {
+			upload("application/octet-stream", encodePNG(halves(4, 4)))
+			Expect(hw.Code).To(Equal(http.StatusOK))
+			hw = request(cont, "GET", "/images/"+lastImage(), "", nil)
+			Expect(hw.Header().Get("Content-Type")).To(Equal("image/png"))
+
+			upload("image/jpeg", encodePNG(halves(4, 4)))
+			Expect(hw.Code).To(Equal(http.StatusOK))
+			hw = request(cont, "GET", "/images/"+lastImage(), "", nil)
+			Expect(hw.Header().Get("Content-Type")).To(Equal("image/png"))
+		})
+
+		It("should reject other types", func() {
+			upload("image/png", []byte("<svg xmlns=\"http://www.w3.org/2000/svg\"></svg>"))
+			Expect(hw.Code).To(Equal(http.StatusUnsupportedMediaType))
+			upload("image/webp", encodePNG(halves(4, 4)))
+			Expect(hw.Code).To(Equal(http.StatusUnsupportedMediaType))
+			upload("image/png", encodePNG(halves(4, 4))[:40])
+			Expect(hw.Code).To(Equal(http.StatusBadRequest))
+			i, err := itm.GetItemById(eid)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(i.Images).To(BeEmpty())
+		})
+
+		It("should reject large uploads", func() {
+			upload("image/png", make([]byte, webservice.DefaultMaxImageSize+1))
+			Expect(hw.Code).To(Equal(http.StatusRequestEntityTooLarge))
+
+			// a tiny file claiming a huge image
+			data := encodePNG(image.NewGray(image.Rect(0, 0, 1, 1)))
+			binary.BigEndian.PutUint32(data[16:], 20000)
+			binary.BigEndian.PutUint32(data[20:], 20000)
+			binary.BigEndian.PutUint32(data[29:], crc32.ChecksumIEEE(data[12:29]))
+			upload("image/png", data)
+			Expect(hw.Code).To(Equal(http.StatusRequestEntityTooLarge))
+		})
+
+		It("should strip EXIF and keep the orientation", func() {
+			buf := new(bytes.Buffer)
+			Expect(jpeg.Encode(buf, halves(40, 20), nil)).To(Succeed())
+			// orientation 6, the camera was turned clockwise
+			exif := []byte("Exif\x00\x00MM\x00\x2a\x00\x00\x00\x08" +
+				"\x00\x01\x01\x12\x00\x03\x00\x00\x00\x01\x00\x06\x00\x00\x00\x00\x00\x00")
+			data := []byte{0xff, 0xd8, 0xff, 0xe1, 0, byte(len(exif) + 2)}
+			data = append(data, exif...)
+			data = append(data, buf.Bytes()[2:]...)
+			upload("image/jpeg", data)
+			Expect(hw.Code).To(Equal(http.StatusOK))
+
+			ref := lastImage()
+			img := get("/images/" + ref)
+			stored := hw.Body.Bytes()
+			Expect(bytes.Contains(stored, []byte("Exif"))).To(BeFalse())
+			Expect(img.Bounds().Size()).To(Equal(image.Pt(20, 40)))
+			r, _, b, _ := img.At(10, 5).RGBA()
+			Expect(r).To(BeNumerically(">", b))
+			r, _, b, _ = img.At(10, 35).RGBA()
+			Expect(b).To(BeNumerically(">", r))
+
+			meta, err := testImages.GetImageMetadataById(bson.ObjectIdHex(ref))
+			Expect(err).NotTo(HaveOccurred())
+			sum := sha256.Sum256(stored)
+			Expect(*meta).To(Equal(db.ImageMetadata{ItmRef: eid, User: "2", Width: 20, Height: 40,
+				Size: int64(len(stored)), SHA256: hex.EncodeToString(sum[:])}))
+		})
+	})
+
+	Describe("Delivery", func() {
+		getWith := func(path string, header http.Header) {
+			req, _ := http.NewRequest("GET", path, nil)
+			req.Header = header
+			hw = httptest.NewRecorder()
+			cont.ServeHTTP(hw, req)
+		}
+
+		It("should send length and caching headers", func() {
+			ref := attach(20, 20, "image/png")
+			hw = request(cont, "GET", "/images/"+ref, "", nil)
+			Expect(hw.Code).To(Equal(http.StatusOK))
+			sum := md5.Sum(hw.Body.Bytes())
+			Expect(hw.Header().Get("ETag")).To(Equal(`"` + hex.EncodeToString(sum[:]) + `"`))
+			Expect(hw.Header().Get("Content-Length")).To(Equal(strconv.Itoa(hw.Body.Len())))
+			Expect(hw.Header().Get("Cache-Control")).To(ContainSubstring("max-age="))
+			Expect(hw.Header().Get("Last-Modified")).NotTo(BeEmpty())
+		})
+
+		It("should answer conditional requests", func() {
+			ref := attach(20, 20, "image/png")
+			for _, path := range []string{"/images/" + ref, "/images/" + ref + "?size=10x10"} {
+				hw = request(cont, "GET", path, "", nil)
+				Expect(hw.Code).To(Equal(http.StatusOK))
+				etag, modified := hw.Header().Get("ETag"), hw.Header().Get("Last-Modified")
+
+				getWith(path, http.Header{"If-None-Match": {etag}})
+				Expect(hw.Code).To(Equal(http.StatusNotModified), path)
+				Expect(hw.Body.Len()).To(BeZero())
+				getWith(path, http.Header{"If-None-Match": {`"other"`}})
+				Expect(hw.Code).To(Equal(http.StatusOK), path)
+				getWith(path, http.Header{"If-Modified-Since": {modified}})
+				Expect(hw.Code).To(Equal(http.StatusNotModified), path)
+			}
+		})
+
+		It("should serve ranges", func() {
+			ref := attach(20, 20, "image/png")
+			hw = request(cont, "GET", "/images/"+ref, "", nil)
+			full := hw.Body.Bytes()
+
+			getWith("/images/"+ref, http.Header{"Range": {"bytes=0-7"}})
+			Expect(hw.Code).To(Equal(http.StatusPartialContent))
+			Expect(hw.Body.Bytes()).To(Equal(full[:8]))
+			Expect(hw.Header().Get("Content-Range")).To(Equal("bytes 0-7/" + strconv.Itoa(len(full))))
+
+			getWith("/images/"+ref, http.Header{"Range": {"bytes=-4"}})
+			Expect(hw.Code).To(Equal(http.StatusPartialContent))
+			Expect(hw.Body.Bytes()).To(Equal(full[len(full)-4:]))
+
+			getWith("/images/"+ref, http.Header{"Range": {"bytes=0-3"}, "If-Range": {`"other"`}})
+			Expect(hw.Code).To(Equal(http.StatusOK))
+			Expect(hw.Body.Bytes()).To(Equal(full))
+
+			getWith("/images/"+ref, http.Header{"Range": {"bytes=100000-"}})
+			Expect(hw.Code).To(Equal(http.StatusRequestedRangeNotSatisfiable))
+		})
+	})
+
+	Describe("Management", func() {
+		list := func() []db.ItemImage {
+			hw = request(cont, "GET", "/items/"+id+"/images", "", nil)
+			Expect(hw.Code).To(Equal(http.StatusOK))
+			var res []db.ItemImage
+			Expect(json.Unmarshal(hw.Body.Bytes(), &res)).To(Succeed())
+			return res
+		}
+		ids := func(imgs []db.ItemImage) []string {
+			res := make([]string, len(imgs))
+			for k := range imgs {
+				res[k] = imgs[k].ID.Hex()
+			}
+			return res
+		}
+
+		It("should list images with their metadata", func() {
+			a := attach(30, 20, "image/png")
+			b := attach(10, 10, "image/png")
+			l := list()
+			Expect(ids(l)).To(Equal([]string{a, b}))
+			Expect(l[0].Width).To(Equal(30))
+			Expect(l[0].Height).To(Equal(20))
+			Expect(l[0].User).To(Equal("2"))
+			Expect(l[0].Cover).To(BeFalse())
+		})
+
+		It("should caption images and pick a cover", func() {
+			a := attach(10, 10, "image/png")
+			b := attach(10, 10, "image/png")
+			hw = request(cont, "PUT", "/items/"+id+"/images/"+a, "2", db.ImageInfo{Caption: "front", Alt: "a lathe", Cover: true})
+			Expect(hw.Code).To(Equal(http.StatusOK))
+			hw = request(cont, "PUT", "/items/"+id+"/images/"+b, "2", db.ImageInfo{Caption: "back", Cover: true})
+			Expect(hw.Code).To(Equal(http.StatusOK))
+
+			l := list()
+			Expect(l[0].ImageInfo).To(Equal(db.ImageInfo{Caption: "front", Alt: "a lathe"}))
+			Expect(l[1].ImageInfo).To(Equal(db.ImageInfo{Caption: "back", Cover: true}))
+
+			hw = request(cont, "PUT", "/items/"+id+"/images/"+b, "3", db.ImageInfo{Caption: "mine"})
+			Expect(hw.Code).To(Equal(http.StatusForbidden))
+			hw = request(cont, "PUT", "/items/"+id+"/images/"+bson.NewObjectId().Hex(), "2", db.ImageInfo{Caption: "gone"})
+			Expect(hw.Code).To(Equal(http.StatusNotFound))
+		})
+
+		It("should reorder images", func() {
+			a := attach(10, 10, "image/png")
+			b := attach(10, 10, "image/png")
+			c := attach(10, 10, "image/png")
+			hw = request(cont, "PUT", "/items/"+id+"/images", "2", []string{c, a, b})
+			Expect(hw.Code).To(Equal(http.StatusOK))
+			Expect(ids(list())).To(Equal([]string{c, a, b}))
+			d := attach(10, 10, "image/png")
+			Expect(ids(list())).To(Equal([]string{c, a, b, d}))
+
+			for _, order := range [][]string{{c, a}, {c, a, b, b}, {c, a, b, bson.NewObjectId().Hex()}, {c, a, b, "x"}} {
+				hw = request(cont, "PUT", "/items/"+id+"/images", "2", order)
+				Expect(hw.Code).To(Equal(http.StatusBadRequest))
+			}
+		})
+
+		It("should record changes in the history and check revisions", func() {
+			a := attach(10, 10, "image/png")
+			hw = request(cont, "GET", "/items/"+id, "", nil)
+			tag := hw.Header().Get("ETag")
+			hw = request(cont, "PUT", "/items/"+id+"/images/"+a, "2", db.ImageInfo{Caption: "front", Cover: true}, "If-Match", tag)
+			Expect(hw.Code).To(Equal(http.StatusOK))
+			hw = request(cont, "PUT", "/items/"+id+"/images/"+a, "2", db.ImageInfo{Caption: "side"}, "If-Match", tag)
+			Expect(hw.Code).To(Equal(http.StatusPreconditionFailed))
+
+			hw = request(cont, "GET", "/items/"+id+"/log?format=rendered", "", nil)
+			var l []db.RenderedHistory
+			Expect(json.Unmarshal(hw.Body.Bytes(), &l)).To(Succeed())
+			Expect(l[len(l)-1].Changes).To(HaveLen(1))
+			Expect(l[len(l)-1].Changes[0].Field).To(Equal("ImageInfo"))
+			Expect(l[len(l)-1].User).To(Equal("2"))
+
+			// removing the image drops its info
+			hw = request(cont, "DELETE", "/items/"+id+"/image/"+a, "2", nil)
+			Expect(hw.Code).To(Equal(http.StatusOK))
+			i, err := itm.GetItemById(eid)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(i.ImageInfo).To(BeEmpty())
+		})
+
+		It("should only remove images of the item", func() {
+			a := attach(10, 10, "image/png")
+			other, err := itm.CreateItem(&db.Item{Name: "Tripod", Owner: "3"}, "3")
+			Expect(err).NotTo(HaveOccurred())
+			hw = request(cont, "DELETE", "/items/"+strconv.FormatUint(other, 10)+"/image/"+a, "3", nil)
+			Expect(hw.Code).To(Equal(http.StatusNotFound))
+
+			hw = request(cont, "GET", "/images/"+a, "", nil)
+			Expect(hw.Code).To(Equal(http.StatusOK))
+			Expect(ids(list())).To(Equal([]string{a}))
+		})
+
+		It("should record only changes of the image list", func() {
+			a := bson.ObjectIdHex(attach(10, 10, "image/png"))
+			before, err := itm.GetItemById(eid)
+			Expect(err).NotTo(HaveOccurred())
+			log, err := itm.GetItemLog(eid)
+			Expect(err).NotTo(HaveOccurred())
+
+			h, err := itm.AddImage(eid, a, "2")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(h).To(BeNil())
+			h, err = itm.RemoveImage(eid, bson.NewObjectId(), "2")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(h).To(BeNil())
+			_, err = itm.AddImage(eid+1000, a, "2")
+			Expect(err).To(Equal(db.ErrNotFound))
+
+			after, err := itm.GetItemById(eid)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(after.Revision).To(Equal(before.Revision))
+			Expect(itm.GetItemLog(eid)).To(HaveLen(len(log)))
+		})
+	})
+})
@@ -26,32 +26,56 @@ import (
 	//"html/template"
 	//	"github.com/fatih/structs"
 	"net/http"
+	"reflect"
 	"strconv"
 	//"strings"
 	"bytes"
 	"encoding/hex"
 	db "github.com/openlab-aux/lsmsd/database"
 	"gopkg.in/mgo.v2/bson"
-	"image/gif"
-	"image/jpeg"
-	"image/png"
+	"io"
 	"io/ioutil"
+	"time"
+)
+
+const (
+	CHILDREN_REFUSE   = "refuse"
+	CHILDREN_CASCADE  = "cascade"
+	CHILDREN_REPARENT = "reparent"
 )
 
 type ItemWebService struct {
-	d *db.ItemDBProvider
+	d db.ItemProvider
 	S *restful.WebService
 	a *BasicAuthService
-	i *db.ImageDBProvider
+	i db.ImageProvider
+	f db.AttachmentProvider
+	l db.LoanProvider
+	p db.PolicyProvider
+	r db.ReservationProvider
 	u *UpdateService
+
+	maxImageSize      int64
+	maxAttachmentSize int64
+}
+
+// CheckoutRequest is the optional body of a checkout
+type CheckoutRequest struct {
+	Due time.Time `description:"Time the item will be returned"`
 }
 
-func NewItemWebService(d *db.ItemDBProvider, i *db.ImageDBProvider, a *BasicAuthService, u *UpdateService) *ItemWebService {
+func NewItemWebService(d db.ItemProvider, i db.ImageProvider, f db.AttachmentProvider, l db.LoanProvider, p db.PolicyProvider, r db.ReservationProvider, a *BasicAuthService, u *UpdateService) *ItemWebService {
 	res := new(ItemWebService)
 	res.d = d
 	res.a = a
 	res.i = i
+	res.f = f
+	res.l = l
+	res.p = p
+	res.r = r
 	res.u = u
+	res.maxImageSize = DefaultMaxImageSize
+	res.maxAttachmentSize = DefaultMaxAttachmentSize
 
 	service := new(restful.WebService)
 	service.
@@ -67,7 +91,7 @@ func NewItemWebService(d *db.ItemDBProvider, i *db.ImageDBProvider, a *BasicAuth
 		//Returns(http.StatusOK, "Item request successful", Item{}).
 		To(res.GetItemById).
 		Writes(db.Item{}).
-		Do(returnsInternalServerError, returnsNotFound, returnsBadRequest))
+		Do(returnsInternalServerError, returnsNotFound, returnsBadRequest, returnsNotModified, returnsAt))
 
 	service.Route(service.GET("/coffee").
 		Doc("Obviously not an easteregg. Go away. Leave me alone.").
@@ -79,51 +103,208 @@ func NewItemWebService(d *db.ItemDBProvider, i *db.ImageDBProvider, a *BasicAuth
 		Doc("Returns the items changelog").
 		To(res.GetItemLog).
 		Writes(db.ItemHistory{}).
+		Do(returnsInternalServerError, returnsNotFound, returnsBadRequest, returnsLogFormat))
+
+	service.Route(service.GET("/{id}/blame").
+		Param(restful.PathParameter("id", "Item ID")).
+		Doc("Returns who changed each field of the item last and when. Fields unchanged since the log begins are missing").
+		To(res.GetItemBlame).
+		Writes([]db.FieldBlame{}).
+		Do(returnsInternalServerError, returnsNotFound, returnsBadRequest))
+
+	service.Route(service.POST("/{id}/revert/{historyid}").
+		Filter(res.a.Auth).
+		Filter(res.a.Require(PERM_ITEM_EDIT_OWN)).
+		Param(restful.PathParameter("id", "Item ID")).
+		Doc("Undo a change from the items log. Reverting its deletion restores the item without images and attachments. "+
+			"Image and attachment changes, checkouts and checkins can not be reverted").
+		To(res.RevertItem).
+		Do(returnsInternalServerError, returnsNotFound, returnsUpdateSuccessful, returnsBadRequest, returnsForbidden,
+			returnsPreconditionFailed, returnsRevertErrors))
+
+	service.Route(service.GET("/{id}/children").
+		Param(restful.PathParameter("id", "Item ID")).
+		Doc("Returns the items directly contained in this item").
+		To(res.GetItemChildren).
+		Writes([]db.Item{}).
+		Do(returnsInternalServerError, returnsNotFound, returnsBadRequest))
+
+	service.Route(service.GET("/{id}/ancestors").
+		Param(restful.PathParameter("id", "Item ID")).
+		Doc("Returns the items containing this item, starting with the outermost one").
+		To(res.GetItemAncestors).
+		Writes([]db.Item{}).
+		Do(returnsInternalServerError, returnsNotFound, returnsBadRequest))
+
+	service.Route(service.GET("/{id}/tree").
+		Param(restful.PathParameter("id", "Item ID")).
+		Doc("Returns this item and recursively everything it contains").
+		To(res.GetItemTree).
+		Writes(db.ItemTree{}).
 		Do(returnsInternalServerError, returnsNotFound, returnsBadRequest))
 
 	service.Route(service.GET("").
-		Doc("List all available items (this may be replaced by a paginated version)").
+		Doc("List items, paginated, optionally filtered and sorted").
 		To(res.ListItem).
 		Writes([]db.Item{}).
-		Do(returnsInternalServerError))
+		Do(returnsInternalServerError, returnsBadRequest, itemListSpec.params))
+
+	service.Route(service.PUT("/{id}").
+		Filter(res.a.Auth).
+		Filter(res.a.Require(PERM_ITEM_EDIT_OWN)).
+		Param(restful.PathParameter("id", "Item ID")).
+		Doc("Replace a item. The update fails if the item was changed since the revision given in If-Match or the body. "+
+			"Borrower, images, their ImageInfo and attachments are kept").
+		To(res.UpdateItem).
+		Reads(db.Item{}).
+		Do(returnsInternalServerError, returnsNotFound, returnsUpdateSuccessful, returnsBadRequest, returnsForbidden,
+			returnsPreconditionFailed))
+
+	service.Route(service.PATCH("/{id}").
+		Filter(res.a.Auth).
+		Filter(res.a.Require(PERM_ITEM_EDIT_OWN)).
+		Param(restful.PathParameter("id", "Item ID")).
+		Doc("Change a item with a JSON merge patch (RFC 7396) or a JSON patch (RFC 6902). "+
+			"Id, Revision, Borrower, Images, ImageInfo and Attachments are read-only").
+		To(res.PatchItem).
+		Do(returnsInternalServerError, returnsNotFound, returnsUpdateSuccessful, returnsBadRequest, returnsForbidden,
+			returnsPreconditionFailed, returnsPatchErrors))
 
 	service.Route(service.PUT("").
 		Filter(res.a.Auth).
-		Doc("Update a item.").
+		Filter(res.a.Require(PERM_ITEM_EDIT_OWN)).
+		Doc("Deprecated, use PUT /items/{id}. Update the item whose Id is given in the body").
 		To(res.UpdateItem).
 		Reads(db.Item{}).
-		Do(returnsInternalServerError, returnsNotFound, returnsUpdateSuccessful, returnsBadRequest))
+		Do(returnsInternalServerError, returnsNotFound, returnsUpdateSuccessful, returnsBadRequest, returnsForbidden,
+			returnsPreconditionFailed))
 
 	service.Route(service.POST("").
 		Filter(res.a.Auth).
+		Filter(res.a.Require(PERM_ITEM_CREATE)).
 		Doc("Insert a item into the database").
 		To(res.CreateItem).
 		Reads(db.Item{}).
 		Returns(http.StatusOK, "Insert successful", "/items/{id}").
-		Do(returnsInternalServerError, returnsBadRequest))
+		Do(returnsInternalServerError, returnsBadRequest, returnsForbidden))
 
 	service.Route(service.POST("/{id}/image").
 		Filter(res.a.Auth).
+		Filter(res.a.Require(PERM_ITEM_EDIT_OWN)).
 		Param(restful.BodyParameter("image", "Your png, jpeg or gif.")).
-		Doc("Attach a image to this item").
+		Doc("Attach a image to this item. The type is taken from the content, metadata like EXIF is removed").
 		To(res.AttachImage).
-		Consumes("image/png", "image/jpeg", "image/gif").
-		Do(returnsInternalServerError, returnsNotFound, returnsBadRequest))
+		Consumes("image/png", "image/jpeg", "image/gif", "application/octet-stream").
+		Returns(http.StatusRequestEntityTooLarge, errImageTooLarge.Error(), nil).
+		Returns(http.StatusUnsupportedMediaType, errUnsupportedImage.Error(), nil).
+		Do(returnsInternalServerError, returnsNotFound, returnsBadRequest, returnsForbidden))
 
 	service.Route(service.DELETE("/{id}/image/{imageid}").
 		Filter(res.a.Auth).
+		Filter(res.a.Require(PERM_ITEM_EDIT_OWN)).
 		Param(restful.PathParameter("id", "Item ID")).
 		Param(restful.PathParameter("imageid", "Image identifier")).
 		Doc("Remove a image from this item").
 		To(res.RemoveImage).
+		Do(returnsInternalServerError, returnsNotFound, returnsBadRequest, returnsForbidden))
+
+	res.addImageRoutes(service)
+	res.addAttachmentRoutes(service)
+
+	service.Route(service.POST("/{id}/checkout").
+		Filter(res.a.Auth).
+		Filter(res.a.Require(PERM_ITEM_BORROW)).
+		Param(restful.PathParameter("id", "Item ID")).
+		Doc("Borrow this item. If its usage policy requires approval, the checkout has to be approved by the owner or maintainer first").
+		To(res.Checkout).
+		Reads(CheckoutRequest{}).
+		Returns(http.StatusOK, "Checkout successful", "/loans/{id}").
+		Returns(http.StatusAccepted, "Checkout requested, waiting for approval", "/loans/{id}").
+		Returns(http.StatusForbidden, "The usage policy of this item does not allow lending", nil).
+		Returns(http.StatusConflict, db.ErrItemLent.Error(), nil).
+		Do(returnsInternalServerError, returnsNotFound, returnsBadRequest))
+
+	service.Route(service.POST("/{id}/checkin").
+		Filter(res.a.Auth).
+		Filter(res.a.Require(PERM_ITEM_BORROW)).
+		Param(restful.PathParameter("id", "Item ID")).
+		Doc("Return this item. Only the borrower, owner or maintainer may do this").
+		To(res.Checkin).
+		Returns(http.StatusForbidden, "Request not allowed", nil).
+		Returns(http.StatusConflict, "Item is not lent", nil).
+		Do(returnsInternalServerError, returnsNotFound, returnsBadRequest))
+
+	service.Route(service.GET("/{id}/reservations").
+		Param(restful.PathParameter("id", "Item ID")).
+		Param(restful.QueryParameter("from", "Only list reservations ending after this time (RFC 3339), defaults to now")).
+		Param(restful.QueryParameter("to", "Only list reservations starting before this time (RFC 3339)")).
+		Doc("Returns the reservations of this item").
+		To(res.ListReservations).
+		Writes([]db.Reservation{}).
+		Do(returnsInternalServerError, returnsNotFound, returnsBadRequest))
+
+	service.Route(service.GET("/{id}/reservations.ics").
+		Param(restful.PathParameter("id", "Item ID")).
+		Doc("Returns the reservations of this item as iCalendar feed").
+		To(res.GetReservationCalendar).
+		Produces(MIME_ICAL).
+		Do(returnsInternalServerError, returnsNotFound, returnsBadRequest))
+
+	service.Route(service.POST("/{id}/reservations").
+		Filter(res.a.Auth).
+		Filter(res.a.Require(PERM_ITEM_BORROW)).
+		Param(restful.PathParameter("id", "Item ID")).
+		Doc("Reserve this item. Only Start, End and Comment are read").
+		To(res.CreateReservation).
+		Reads(db.Reservation{}).
+		Returns(http.StatusOK, "Insert successful", "/items/{id}/reservations/{reservationid}").
+		Returns(http.StatusConflict, db.ErrReservationConflict.Error(), nil).
+		Returns(http.StatusServiceUnavailable, db.ErrReservationBusy.Error(), nil).
+		Do(returnsInternalServerError, returnsNotFound, returnsBadRequest, returnsForbidden))
+
+	service.Route(service.GET("/{id}/reservations/{reservationid}").
+		Param(restful.PathParameter("id", "Item ID")).
+		Param(restful.PathParameter("reservationid", "Reservation identifier")).
+		Doc("Returns a single reservation").
+		To(res.GetReservation).
+		Writes(db.Reservation{}).
 		Do(returnsInternalServerError, returnsNotFound, returnsBadRequest))
 
+	service.Route(service.PUT("/{id}/reservations/{reservationid}").
+		Filter(res.a.Auth).
+		Filter(res.a.Require(PERM_ITEM_BORROW)).
+		Param(restful.PathParameter("id", "Item ID")).
+		Param(restful.PathParameter("reservationid", "Reservation identifier")).
+		Doc("Move a reservation or change its comment. Only the user who made it, the owner or the maintainer may do this").
+		To(res.UpdateReservation).
+		Reads(db.Reservation{}).
+		Returns(http.StatusForbidden, "Request not allowed", nil).
+		Returns(http.StatusConflict, db.ErrReservationConflict.Error(), nil).
+		Returns(http.StatusServiceUnavailable, db.ErrReservationBusy.Error(), nil).
+		Do(returnsInternalServerError, returnsNotFound, returnsUpdateSuccessful, returnsBadRequest))
+
+	service.Route(service.DELETE("/{id}/reservations/{reservationid}").
+		Filter(res.a.Auth).
+		Filter(res.a.Require(PERM_ITEM_BORROW)).
+		Param(restful.PathParameter("id", "Item ID")).
+		Param(restful.PathParameter("reservationid", "Reservation identifier")).
+		Doc("Cancel a reservation. Only the user who made it, the owner or the maintainer may do this").
+		To(res.DeleteReservation).
+		Returns(http.StatusForbidden, "Request not allowed", nil).
+		Do(returnsInternalServerError, returnsNotFound, returnsDeleteSuccessful, returnsBadRequest))
+
 	service.Route(service.DELETE("/{id}").
 		Filter(res.a.Auth).
+		Filter(res.a.Require(PERM_ITEM_DELETE)).
 		Param(restful.PathParameter("id", "Item ID")).
+		Param(restful.QueryParameter("children", "What to do with the items contained in this item: "+
+			CHILDREN_REFUSE+" to fail (default), "+CHILDREN_CASCADE+" to delete them as well or "+
+			CHILDREN_REPARENT+" to move them into the parent of this item")).
 		Doc("Delete a item").
 		To(res.DeleteItem).
-		Do(returnsInternalServerError, returnsNotFound, returnsDeleteSuccessful, returnsBadRequest))
+		Returns(http.StatusConflict, db.ErrHasChildren.Error(), nil).
+		Do(returnsInternalServerError, returnsNotFound, returnsDeleteSuccessful, returnsBadRequest, returnsForbidden,
+			returnsPreconditionFailed))
 
 	res.S = service
 	return res
@@ -139,6 +320,16 @@ func (s *ItemWebService) GetItemById(request *restful.Request, response *restful
 			Info(ERROR_INVALID_ID)
 		return
 	}
+	t, err := timeParameter(request, "at", time.Time{})
+	if err != nil {
+		response.WriteErrorString(http.StatusBadRequest, ERROR_INVALID_INPUT)
+		log.WithFields(log.Fields{"Error Msg": err}).Info(ERROR_INVALID_INPUT)
+		return
+	}
+	if !t.IsZero() {
+		s.getItemAt(response, id, t)
+		return
+	}
 	itm, err := s.d.GetItemById(id)
 	if err != nil {
 		response.WriteErrorString(http.StatusNotFound, ERROR_INVALID_ID)
@@ -146,9 +337,104 @@ func (s *ItemWebService) GetItemById(request *restful.Request, response *restful
 			Info(ERROR_INVALID_ID)
 		return
 	}
+	if notModified(request, response, itm.Revision) {
+		return
+	}
+	response.WriteEntity(itm)
+}
+
+// getItemAt writes item id as it was at t
+func (s *ItemWebService) getItemAt(response *restful.Response, id uint64, t time.Time) {
+	history, cur, err := s.itemWithLog(id)
+	if err != nil {
+		writeHistoryError(response, err)
+		return
+	}
+	itm, err := db.ItemAt(id, history, cur, t)
+	if err != nil {
+		writeHistoryError(response, err)
+		return
+	}
+	if itm == nil {
+		response.WriteErrorString(http.StatusNotFound, ERROR_INVALID_ID)
+		log.WithFields(log.Fields{"ID": id, "At": t}).Info(ERROR_INVALID_ID)
+		return
+	}
 	response.WriteEntity(itm)
 }
 
+// itemWithLog returns the log of item id and the item, which is nil if it
+// was deleted
+func (s *ItemWebService) itemWithLog(id uint64) ([]db.ItemHistory, *db.Item, error) {
+	history, err := s.d.GetItemLog(id)
+	if err != nil {
+		return nil, nil, err
+	}
+	itm, err := s.d.GetItemById(id)
+	if err == db.ErrNotFound {
+		if len(history) == 0 {
+			return nil, nil, err
+		}
+		return history, nil, nil
+	}
+	return history, &itm, err
+}
+
+func (s *ItemWebService) RevertItem(request *restful.Request, response *restful.Response) {
+	id, err := strconv.ParseUint(request.PathParameter("id"), 10, 64)
+	if err != nil {
+		response.WriteErrorString(http.StatusBadRequest, ERROR_INVALID_ID)
+		log.Info(err)
+		return
+	}
+	ref := request.PathParameter("historyid")
+	if !bson.IsObjectIdHex(ref) {
+		response.WriteErrorString(http.StatusBadRequest, ERROR_INVALID_ID)
+		log.WithFields(log.Fields{"History ID": ref}).Info(ERROR_INVALID_ID)
+		return
+	}
+	history, cur, err := s.itemWithLog(id)
+	if err != nil {
+		writeHistoryError(response, err)
+		return
+	}
+	if cur != nil && !checkIfMatch(request, response, cur.Revision) {
+		return
+	}
+	itm, err := db.RevertItem(id, history, cur, bson.ObjectIdHex(ref))
+	if err != nil {
+		writeHistoryError(response, err)
+		return
+	}
+	// restoring needs the right to delete, everything else the right to
+	// manage the item
+	if (cur == nil && !hasPermission(request, PERM_ITEM_DELETE)) || (cur != nil && !mayManage(request, cur)) {
+		response.WriteErrorString(http.StatusForbidden, "Permission denied")
+		return
+	}
+	if cur == nil || itm.Parent != cur.Parent {
+		err = s.d.CheckParent(id, itm.Parent)
+		if err != nil {
+			writeParentError(response, err)
+			return
+		}
+	}
+
+	h := db.NewItemRevertHistory(cur, itm, bson.ObjectIdHex(ref), request.Attribute("User").(string))
+	if cur == nil {
+		err = s.d.RestoreItem(itm, h)
+	} else {
+		err = s.d.UpdateItem(itm, h)
+	}
+	if err != nil {
+		writeHistoryError(response, err)
+		return
+	}
+	s.u.PushUpdate(h)
+	response.AddHeader("ETag", etag(itm.Revision))
+	response.WriteEntity(true)
+}
+
 func (s *ItemWebService) GetItemLog(request *restful.Request, response *restful.Response) {
 	sid := request.PathParameter("id")
 	id, err := strconv.ParseUint(sid, 10, 64)
@@ -157,13 +443,60 @@ func (s *ItemWebService) GetItemLog(request *restful.Request, response *restful.
 		log.Info(err)
 		return
 	}
-	history, err := s.d.GetItemLog(id)
+	format, ok := logFormat(request, response)
+	if !ok {
+		return
+	}
+	if format == logFormatRaw {
+		history, err := s.d.GetItemLog(id)
+		if err != nil {
+			response.WriteErrorString(http.StatusNotFound, ERROR_INVALID_ID)
+			log.Info(err)
+			return
+		}
+		response.WriteEntity(history)
+		return
+	}
+	history, cur, err := s.itemWithLog(id)
 	if err != nil {
-		response.WriteErrorString(http.StatusNotFound, ERROR_INVALID_ID)
+		writeHistoryError(response, err)
+		return
+	}
+	rendered, err := db.RenderItemLog(history, cur)
+	if err != nil {
+		writeHistoryError(response, err)
+		return
+	}
+	title := "Item #" + sid
+	if cur != nil {
+		title = cur.Name + " (#" + sid + ")"
+	}
+	writeRenderedLog(response, format, title, rendered)
+}
+
+func (s *ItemWebService) GetItemBlame(request *restful.Request, response *restful.Response) {
+	id, err := strconv.ParseUint(request.PathParameter("id"), 10, 64)
+	if err != nil {
+		response.WriteErrorString(http.StatusBadRequest, ERROR_INVALID_ID)
 		log.Info(err)
 		return
 	}
-	response.WriteEntity(history)
+	itm, err := s.d.GetItemById(id)
+	if err != nil {
+		writeHistoryError(response, err)
+		return
+	}
+	history, err := s.d.GetItemLog(id)
+	if err != nil {
+		writeHistoryError(response, err)
+		return
+	}
+	blame, err := db.BlameItem(history, &itm)
+	if err != nil {
+		writeHistoryError(response, err)
+		return
+	}
+	response.WriteEntity(blame)
 }
 
 func (s *ItemWebService) CreateItem(request *restful.Request, response *restful.Response) {
@@ -175,22 +508,37 @@ func (s *ItemWebService) CreateItem(request *restful.Request, response *restful.
 		return
 	}
 
-	id, err := s.d.CreateItem(itm)
+	err = s.d.CheckParent(0, itm.Parent)
+	if err != nil {
+		writeParentError(response, err)
+		return
+	}
+	itm.Borrower = ""
+
+	id, err := s.d.CreateItem(itm, request.Attribute("User").(string))
 	if err != nil {
 		response.WriteErrorString(http.StatusInternalServerError, ERROR_INTERNAL)
 		log.WithFields(log.Fields{"Error Msg": err}).Warn(ERROR_INTERNAL)
 		return
 	}
+	s.u.PushUpdate(itm.NewCreatedHistory(request.Attribute("User").(string)))
 	response.WriteEntity("/items/" + strconv.FormatUint(id, 10))
 }
 
 func (s *ItemWebService) ListItem(request *restful.Request, response *restful.Response) {
-	itm, err := s.d.ListItem()
+	q, err := itemListSpec.parse(request)
+	if err != nil {
+		response.WriteErrorString(http.StatusBadRequest, ERROR_INVALID_INPUT)
+		log.WithFields(log.Fields{"Error Msg": err}).Info(ERROR_INVALID_INPUT)
+		return
+	}
+	itm, total, err := s.d.ListItem(q)
 	if err != nil {
 		response.WriteErrorString(http.StatusInternalServerError, ERROR_INTERNAL)
 		log.WithFields(log.Fields{"Error Msg": err}).Warn(ERROR_INTERNAL)
 		return
 	}
+	writePageHeaders(request, response, q, total)
 	response.WriteEntity(itm)
 }
 
@@ -202,24 +550,94 @@ func (s *ItemWebService) UpdateItem(request *restful.Request, response *restful.
 		log.WithFields(log.Fields{"Error Msg": err}).Warn(ERROR_INVALID_ID)
 		return
 	}
+	if sid := request.PathParameter("id"); sid != "" {
+		id, err := strconv.ParseUint(sid, 10, 64)
+		if err != nil || (itm.EID != 0 && itm.EID != id) {
+			response.WriteErrorString(http.StatusBadRequest, ERROR_INVALID_ID)
+			log.WithFields(log.Fields{"Path": sid, "Body": itm.EID}).Info(ERROR_INVALID_ID)
+			return
+		}
+		itm.EID = id
+	}
 	i, err := s.d.GetItemById(itm.EID)
 	if err != nil {
 		response.WriteErrorString(http.StatusNotFound, ERROR_INVALID_ID)
 		log.Warn(err)
 		return
 	}
+	if !mayManage(request, &i) {
+		log.WithFields(log.Fields{"User": request.Attribute("User"), "attempted to update": i.EID}).Warn("Unauthorized update request")
+		response.WriteErrorString(http.StatusForbidden, "Permission denied")
+		return
+	}
+	if !checkIfMatch(request, response, i.Revision) {
+		return
+	}
+	itm.Revision = baseRevision(request, itm.Revision, i.Revision)
+	if itm.Revision != i.Revision {
+		response.WriteErrorString(http.StatusPreconditionFailed, ERROR_PRECONDITION)
+		return
+	}
+	s.saveItem(request, response, &i, itm)
+}
+
+func (s *ItemWebService) PatchItem(request *restful.Request, response *restful.Response) {
+	i, ok := s.readItem(request, response)
+	if !ok {
+		return
+	}
+	if !mayManage(request, &i) {
+		log.WithFields(log.Fields{"User": request.Attribute("User"), "attempted to update": i.EID}).Warn("Unauthorized update request")
+		response.WriteErrorString(http.StatusForbidden, "Permission denied")
+		return
+	}
+	if !checkIfMatch(request, response, i.Revision) {
+		return
+	}
+	itm := new(db.Item)
+	err := patchEntity(request, &i, itm)
+	if err == nil && (itm.EID != i.EID || itm.Revision != i.Revision || itm.Borrower != i.Borrower ||
+		!reflect.DeepEqual(itm.Images, i.Images) || !reflect.DeepEqual(itm.Attachments, i.Attachments) ||
+		(len(itm.ImageInfo) != 0 || len(i.ImageInfo) != 0) && !reflect.DeepEqual(itm.ImageInfo, i.ImageInfo)) {
+		err = errPatchReadOnly
+	}
+	if err != nil {
+		writePatchError(response, err)
+		return
+	}
+	s.saveItem(request, response, &i, itm)
+}
+
+// saveItem stores itm as the new version of i. Borrower, images with their
+// info and attachments are managed by their own endpoints and kept.
+func (s *ItemWebService) saveItem(request *restful.Request, response *restful.Response, i, itm *db.Item) {
+	if itm.Parent != i.Parent {
+		err := s.d.CheckParent(itm.EID, itm.Parent)
+		if err != nil {
+			writeParentError(response, err)
+			return
+		}
+	}
+	itm.Borrower = i.Borrower
+	itm.Images = i.Images
+	itm.Attachments = i.Attachments
+	itm.ImageInfo = i.ImageInfo
 	h := i.NewItemHistory(itm, request.Attribute("User").(string))
 
-	err = s.d.UpdateItem(itm, h)
+	err := s.d.UpdateItem(itm, h)
 	if err != nil {
+		if err == db.ErrRevisionConflict {
+			response.WriteErrorString(http.StatusPreconditionFailed, ERROR_PRECONDITION)
+			return
+		}
 		response.WriteErrorString(http.StatusInternalServerError, ERROR_INTERNAL)
 		log.Warn(err)
 		return
 	}
 
 	s.u.PushUpdate(h)
+	response.AddHeader("ETag", etag(itm.Revision))
 	response.WriteEntity(true)
-	return
 }
 
 func (s *ItemWebService) DeleteItem(request *restful.Request, response *restful.Response) {
@@ -243,96 +661,599 @@ func (s *ItemWebService) DeleteItem(request *restful.Request, response *restful.
 		response.WriteErrorString(http.StatusInternalServerError, ERROR_INTERNAL)
 		return
 	}
+	if !checkIfMatch(request, response, i.Revision) {
+		return
+	}
+
+	mode := request.QueryParameter("children")
+	switch mode {
+	case "":
+		mode = CHILDREN_REFUSE
+	case CHILDREN_REFUSE, CHILDREN_CASCADE, CHILDREN_REPARENT:
+	default:
+		log.WithFields(log.Fields{"Mode": mode}).Info(ERROR_INVALID_INPUT)
+		response.WriteErrorString(http.StatusBadRequest, ERROR_INVALID_INPUT)
+		return
+	}
 
-	h := i.NewItemHistory(nil, request.Attribute("User").(string))
-	err = s.d.DeleteItem(&i, h)
+	err = s.deleteItem(&i, mode, request.Attribute("User").(string), make(map[uint64]bool))
 	if err != nil {
+		if err == db.ErrHasChildren {
+			log.WithFields(log.Fields{"ID": id}).Info(err)
+			response.WriteErrorString(http.StatusConflict, err.Error())
+			return
+		}
+		if err == db.ErrRevisionConflict {
+			response.WriteErrorString(http.StatusPreconditionFailed, ERROR_PRECONDITION)
+			return
+		}
 		log.Warn(err)
 		response.WriteErrorString(http.StatusInternalServerError, ERROR_INTERNAL)
 		return
 	}
-	s.u.PushUpdate(h)
 
 	response.WriteEntity(true)
 }
 
-func (s *ItemWebService) NotAnEasterEgg(req *restful.Request, res *restful.Response) {
-	res.WriteErrorString(http.StatusTeapot, "Try some mate tea")
-	return
+// deleteItem deletes i and takes care of its children according to mode.
+// visited guards against cycles in the item hierarchy.
+func (s *ItemWebService) deleteItem(i *db.Item, mode, user string, visited map[uint64]bool) error {
+	visited[i.EID] = true
+	children, err := s.d.GetChildren(i.EID)
+	if err != nil {
+		return err
+	}
+	if len(children) != 0 && mode == CHILDREN_REFUSE {
+		return db.ErrHasChildren
+	}
+	for k := 0; k != len(children); k++ {
+		c := children[k]
+		if visited[c.EID] {
+			continue
+		}
+		if mode == CHILDREN_CASCADE {
+			err = s.deleteItem(&c, mode, user, visited)
+		} else {
+			n := c
+			n.Parent = i.Parent
+			h := c.NewItemHistory(&n, user)
+			err = s.d.UpdateItem(&n, h)
+			if err == nil {
+				s.u.PushUpdate(h)
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	h := i.NewItemHistory(nil, user)
+	err = s.d.DeleteItem(i, h)
+	if err != nil {
+		return err
+	}
+	s.removeAttachments(i.Attachments)
+	s.u.PushUpdate(h)
+	return nil
 }
 
-func (s *ItemWebService) AttachImage(req *restful.Request, res *restful.Response) {
-	sid := req.PathParameter("id")
+func (s *ItemWebService) GetItemChildren(request *restful.Request, response *restful.Response) {
+	sid := request.PathParameter("id")
 	id, err := strconv.ParseUint(sid, 10, 64)
 	if err != nil {
-		log.Debug(err)
-		res.WriteErrorString(http.StatusBadRequest, ERROR_INVALID_ID)
+		response.WriteErrorString(http.StatusBadRequest, ERROR_INVALID_ID)
+		log.Info(err)
 		return
 	}
-
 	if !s.d.CheckItemExistance(&db.Item{EID: id}) {
-		log.Debug(err)
-		res.WriteErrorString(http.StatusNotFound, ERROR_INVALID_ID)
+		response.WriteErrorString(http.StatusNotFound, ERROR_INVALID_ID)
+		log.WithFields(log.Fields{"ID": id}).Info(ERROR_INVALID_ID)
 		return
 	}
-
-	_body, err := ioutil.ReadAll(req.Request.Body)
-
+	children, err := s.d.GetChildren(id)
 	if err != nil {
-		log.Debug(err)
-		res.WriteErrorString(http.StatusBadRequest, "")
+		response.WriteErrorString(http.StatusInternalServerError, ERROR_INTERNAL)
+		log.WithFields(log.Fields{"Error Msg": err}).Warn(ERROR_INTERNAL)
 		return
 	}
+	response.WriteEntity(children)
+}
 
-	body := bytes.NewReader(_body)
-
-	switch req.HeaderParameter("Content-Type") {
-	case "image/png":
-		log.Println("png")
-		_, err := png.Decode(body)
-		if err != nil {
-			log.Debug(err)
-			res.WriteErrorString(http.StatusBadRequest, "")
+func (s *ItemWebService) GetItemAncestors(request *restful.Request, response *restful.Response) {
+	sid := request.PathParameter("id")
+	id, err := strconv.ParseUint(sid, 10, 64)
+	if err != nil {
+		response.WriteErrorString(http.StatusBadRequest, ERROR_INVALID_ID)
+		log.Info(err)
+		return
+	}
+	ancestors, err := s.d.GetAncestors(id)
+	if err != nil {
+		if err == db.ErrNotFound {
+			response.WriteErrorString(http.StatusNotFound, ERROR_INVALID_ID)
+			log.WithFields(log.Fields{"ID": id}).Info(ERROR_INVALID_ID)
 			return
 		}
-		body.Seek(0, 0)
+		response.WriteErrorString(http.StatusInternalServerError, ERROR_INTERNAL)
+		log.WithFields(log.Fields{"Error Msg": err}).Warn(ERROR_INTERNAL)
+		return
+	}
+	response.WriteEntity(ancestors)
+}
 
-	case "image/jpeg":
-		log.Println("jpeg")
-		_, err := jpeg.Decode(body)
-		if err != nil {
-			log.Debug(err)
-			res.WriteErrorString(http.StatusBadRequest, "")
-			return
+func (s *ItemWebService) GetItemTree(request *restful.Request, response *restful.Response) {
+	sid := request.PathParameter("id")
+	id, err := strconv.ParseUint(sid, 10, 64)
+	if err != nil {
+		response.WriteErrorString(http.StatusBadRequest, ERROR_INVALID_ID)
+		log.Info(err)
+		return
+	}
+	tree, err := s.d.GetItemTree(id)
+	if err != nil {
+		if err == db.ErrNotFound {
+			response.WriteErrorString(http.StatusNotFound, ERROR_INVALID_ID)
+			log.WithFields(log.Fields{"ID": id}).Info(ERROR_INVALID_ID)
+			return
+		}
+		response.WriteErrorString(http.StatusInternalServerError, ERROR_INTERNAL)
+		log.WithFields(log.Fields{"Error Msg": err}).Warn(ERROR_INTERNAL)
+		return
+	}
+	response.WriteEntity(tree)
+}
+
+// writeParentError reports a failed db.ItemDBProvider.CheckParent
+func writeParentError(response *restful.Response, err error) {
+	if err == db.ErrParentNotFound || err == db.ErrParentCycle {
+		response.WriteErrorString(http.StatusBadRequest, err.Error())
+		log.Info(err)
+		return
+	}
+	response.WriteErrorString(http.StatusInternalServerError, ERROR_INTERNAL)
+	log.WithFields(log.Fields{"Error Msg": err}).Warn(ERROR_INTERNAL)
+}
+
+func (s *ItemWebService) Checkout(request *restful.Request, response *restful.Response) {
+	sid := request.PathParameter("id")
+	id, err := strconv.ParseUint(sid, 10, 64)
+	if err != nil {
+		response.WriteErrorString(http.StatusBadRequest, ERROR_INVALID_ID)
+		log.Info(err)
+		return
+	}
+	cr := new(CheckoutRequest)
+	err = request.ReadEntity(cr)
+	if err != nil && err != io.EOF {
+		response.WriteErrorString(http.StatusBadRequest, ERROR_INVALID_INPUT)
+		log.WithFields(log.Fields{"Error Msg": err}).Info(ERROR_INVALID_INPUT)
+		return
+	}
+	itm, err := s.d.GetItemById(id)
+	if err != nil {
+		response.WriteErrorString(http.StatusNotFound, ERROR_INVALID_ID)
+		log.WithFields(log.Fields{"Error Msg": err}).Info(ERROR_INVALID_ID)
+		return
+	}
+	if itm.Borrower != "" {
+		response.WriteErrorString(http.StatusConflict, db.ErrItemLent.Error())
+		return
+	}
+
+	rule := db.CheckoutAllowed
+	if itm.Usage != "" {
+		pol, err := s.p.GetPolicyByName(itm.Usage)
+		if err == nil {
+			rule = pol.CheckoutRule()
+		} else if err != db.ErrNotFound {
+			response.WriteErrorString(http.StatusInternalServerError, ERROR_INTERNAL)
+			log.WithFields(log.Fields{"Error Msg": err}).Warn(ERROR_INTERNAL)
+			return
 		}
-		body.Seek(0, 0)
+	}
+	if rule == db.CheckoutForbidden {
+		response.WriteErrorString(http.StatusForbidden, "The usage policy of this item does not allow lending")
+		return
+	}
 
-	case "image/gif":
-		log.Println("gif")
-		_, err := gif.Decode(body)
+	user := request.Attribute("User").(string)
+	loan := &db.Loan{
+		Item:      id,
+		Borrower:  user,
+		State:     db.LoanRequested,
+		Requested: time.Now(),
+		Due:       cr.Due,
+	}
+	if rule == db.CheckoutApproval && !mayManage(request, &itm) {
+		err = s.l.CreateLoan(loan)
 		if err != nil {
-			log.Debug(err)
-			res.WriteErrorString(http.StatusBadRequest, "")
+			response.WriteErrorString(http.StatusInternalServerError, ERROR_INTERNAL)
+			log.WithFields(log.Fields{"Error Msg": err}).Warn(ERROR_INTERNAL)
 			return
 		}
-		body.Seek(0, 0)
+		s.u.PushUpdate(loan)
+		response.WriteHeaderAndEntity(http.StatusAccepted, "/loans/"+loan.ID.Hex())
+		return
+	}
 
+	if rule == db.CheckoutApproval {
+		loan.ApprovedBy = user
+	}
+	err = lend(s.d, s.l, s.u, loan, user)
+	if err != nil {
+		if err == db.ErrItemLent {
+			response.WriteErrorString(http.StatusConflict, err.Error())
+			return
+		}
+		response.WriteErrorString(http.StatusInternalServerError, ERROR_INTERNAL)
+		log.WithFields(log.Fields{"Error Msg": err}).Warn(ERROR_INTERNAL)
+		return
+	}
+	response.WriteEntity("/loans/" + loan.ID.Hex())
+}
+
+func (s *ItemWebService) Checkin(request *restful.Request, response *restful.Response) {
+	sid := request.PathParameter("id")
+	id, err := strconv.ParseUint(sid, 10, 64)
+	if err != nil {
+		response.WriteErrorString(http.StatusBadRequest, ERROR_INVALID_ID)
+		log.Info(err)
+		return
+	}
+	itm, err := s.d.GetItemById(id)
+	if err != nil {
+		response.WriteErrorString(http.StatusNotFound, ERROR_INVALID_ID)
+		log.WithFields(log.Fields{"Error Msg": err}).Info(ERROR_INVALID_ID)
+		return
+	}
+	if itm.Borrower == "" {
+		response.WriteErrorString(http.StatusConflict, "Item is not lent")
+		return
+	}
+	user := request.Attribute("User").(string)
+	if user != itm.Borrower && !mayManage(request, &itm) {
+		log.WithFields(log.Fields{"User": user, "attempted to check in": id}).Warn("Unauthorized checkin request")
+		response.WriteErrorString(http.StatusForbidden, "Request not allowed")
+		return
+	}
+
+	h, err := s.d.SetBorrower(id, "", time.Time{}, user)
+	if err != nil {
+		response.WriteErrorString(http.StatusInternalServerError, ERROR_INTERNAL)
+		log.WithFields(log.Fields{"Error Msg": err}).Warn(ERROR_INTERNAL)
+		return
+	}
+	s.u.PushUpdate(h)
+
+	loan, err := s.l.GetCurrentLoan(id)
+	if err == nil {
+		loan.State = db.LoanReturned
+		loan.Returned = time.Now()
+		err = s.l.UpdateLoan(&loan)
+		if err == nil {
+			s.u.PushUpdate(&loan)
+		}
+	} else if err == db.ErrNotFound {
+		// lent before loans were recorded
+		err = nil
+	}
+	if err != nil {
+		response.WriteErrorString(http.StatusInternalServerError, ERROR_INTERNAL)
+		log.WithFields(log.Fields{"Error Msg": err}).Warn(ERROR_INTERNAL)
+		return
+	}
+	response.WriteEntity(true)
+}
+
+func (s *ItemWebService) ListReservations(request *restful.Request, response *restful.Response) {
+	sid := request.PathParameter("id")
+	id, err := strconv.ParseUint(sid, 10, 64)
+	if err != nil {
+		response.WriteErrorString(http.StatusBadRequest, ERROR_INVALID_ID)
+		log.Info(err)
+		return
+	}
+	from, err := timeParameter(request, "from", time.Now())
+	if err != nil {
+		response.WriteErrorString(http.StatusBadRequest, ERROR_INVALID_INPUT)
+		log.Info(err)
+		return
+	}
+	to, err := timeParameter(request, "to", time.Time{})
+	if err != nil {
+		response.WriteErrorString(http.StatusBadRequest, ERROR_INVALID_INPUT)
+		log.Info(err)
+		return
+	}
+	if !s.d.CheckItemExistance(&db.Item{EID: id}) {
+		response.WriteErrorString(http.StatusNotFound, ERROR_INVALID_ID)
+		return
+	}
+	rs, err := s.r.GetReservations(id, "", from, to)
+	if err != nil {
+		response.WriteErrorString(http.StatusInternalServerError, ERROR_INTERNAL)
+		log.WithFields(log.Fields{"Error Msg": err}).Warn(ERROR_INTERNAL)
+		return
+	}
+	response.WriteEntity(rs)
+}
+
+func (s *ItemWebService) GetReservationCalendar(request *restful.Request, response *restful.Response) {
+	sid := request.PathParameter("id")
+	id, err := strconv.ParseUint(sid, 10, 64)
+	if err != nil {
+		response.WriteErrorString(http.StatusBadRequest, ERROR_INVALID_ID)
+		log.Info(err)
+		return
+	}
+	itm, err := s.d.GetItemById(id)
+	if err != nil {
+		response.WriteErrorString(http.StatusNotFound, ERROR_INVALID_ID)
+		log.WithFields(log.Fields{"Error Msg": err}).Info(ERROR_INVALID_ID)
+		return
+	}
+	rs, err := s.r.GetReservations(id, "", time.Time{}, time.Time{})
+	if err != nil {
+		response.WriteErrorString(http.StatusInternalServerError, ERROR_INTERNAL)
+		log.WithFields(log.Fields{"Error Msg": err}).Warn(ERROR_INTERNAL)
+		return
+	}
+	writeICalendar(response, itm.Name, rs, func(uint64) string { return itm.Name })
+}
+
+func (s *ItemWebService) CreateReservation(request *restful.Request, response *restful.Response) {
+	sid := request.PathParameter("id")
+	id, err := strconv.ParseUint(sid, 10, 64)
+	if err != nil {
+		response.WriteErrorString(http.StatusBadRequest, ERROR_INVALID_ID)
+		log.Info(err)
+		return
+	}
+	in := new(db.Reservation)
+	err = request.ReadEntity(in)
+	if err != nil {
+		response.WriteErrorString(http.StatusBadRequest, ERROR_INVALID_INPUT)
+		log.WithFields(log.Fields{"Error Msg": err}).Info(ERROR_INVALID_INPUT)
+		return
+	}
+	if !s.d.CheckItemExistance(&db.Item{EID: id}) {
+		response.WriteErrorString(http.StatusNotFound, ERROR_INVALID_ID)
+		return
+	}
+
+	r := &db.Reservation{
+		Item:    id,
+		User:    request.Attribute("User").(string),
+		Start:   in.Start,
+		End:     in.End,
+		Comment: in.Comment,
+	}
+	err = s.r.CreateReservation(r)
+	if err != nil {
+		writeReservationError(response, err)
+		return
+	}
+	s.u.PushUpdate(r)
+	response.WriteEntity("/items/" + sid + "/reservations/" + r.ID.Hex())
+}
+
+func (s *ItemWebService) GetReservation(request *restful.Request, response *restful.Response) {
+	r, _, ok := s.readReservation(request, response)
+	if !ok {
+		return
+	}
+	response.WriteEntity(r)
+}
+
+func (s *ItemWebService) UpdateReservation(request *restful.Request, response *restful.Response) {
+	in := new(db.Reservation)
+	err := request.ReadEntity(in)
+	if err != nil {
+		response.WriteErrorString(http.StatusBadRequest, ERROR_INVALID_INPUT)
+		log.WithFields(log.Fields{"Error Msg": err}).Info(ERROR_INVALID_INPUT)
+		return
+	}
+	r, itm, ok := s.readReservation(request, response)
+	if !ok {
+		return
+	}
+	user := request.Attribute("User").(string)
+	if user != r.User && !mayManage(request, &itm) {
+		log.WithFields(log.Fields{"User": user, "attempted to update": r.ID.Hex()}).Warn("Unauthorized reservation update")
+		response.WriteErrorString(http.StatusForbidden, "Request not allowed")
+		return
+	}
+
+	r.Start = in.Start
+	r.End = in.End
+	r.Comment = in.Comment
+	err = s.r.UpdateReservation(&r)
+	if err != nil {
+		writeReservationError(response, err)
+		return
+	}
+	s.u.PushUpdate(&r)
+	response.WriteEntity(true)
+}
+
+func (s *ItemWebService) DeleteReservation(request *restful.Request, response *restful.Response) {
+	r, itm, ok := s.readReservation(request, response)
+	if !ok {
+		return
+	}
+	user := request.Attribute("User").(string)
+	if user != r.User && !mayManage(request, &itm) {
+		log.WithFields(log.Fields{"User": user, "attempted to delete": r.ID.Hex()}).Warn("Unauthorized reservation deletion")
+		response.WriteErrorString(http.StatusForbidden, "Request not allowed")
+		return
+	}
+
+	err := s.r.DeleteReservation(r.ID)
+	if err != nil {
+		response.WriteErrorString(http.StatusInternalServerError, ERROR_INTERNAL)
+		log.WithFields(log.Fields{"Error Msg": err}).Warn(ERROR_INTERNAL)
+		return
+	}
+	r.Deleted = true
+	s.u.PushUpdate(&r)
+	response.WriteEntity(true)
+}
+
+// readItem looks up the item referenced in the path of request and writes an
+// error response if this fails
+func (s *ItemWebService) readItem(request *restful.Request, response *restful.Response) (db.Item, bool) {
+	id, err := strconv.ParseUint(request.PathParameter("id"), 10, 64)
+	if err != nil {
+		response.WriteErrorString(http.StatusBadRequest, ERROR_INVALID_ID)
+		log.Info(err)
+		return db.Item{}, false
+	}
+	itm, err := s.d.GetItemById(id)
+	if err != nil {
+		if err == db.ErrNotFound {
+			response.WriteErrorString(http.StatusNotFound, ERROR_INVALID_ID)
+			return itm, false
+		}
+		response.WriteErrorString(http.StatusInternalServerError, ERROR_INTERNAL)
+		log.WithFields(log.Fields{"Error Msg": err}).Warn(ERROR_INTERNAL)
+		return itm, false
+	}
+	return itm, true
+}
+
+// readReservation looks up the reservation referenced in the path of request
+// together with its item and writes an error response if this fails
+func (s *ItemWebService) readReservation(request *restful.Request, response *restful.Response) (db.Reservation, db.Item, bool) {
+	id, err := strconv.ParseUint(request.PathParameter("id"), 10, 64)
+	if err != nil {
+		response.WriteErrorString(http.StatusBadRequest, ERROR_INVALID_ID)
+		log.Info(err)
+		return db.Reservation{}, db.Item{}, false
+	}
+	rid, err := hex.DecodeString(request.PathParameter("reservationid"))
+	if err != nil || len(rid) != 12 {
+		response.WriteErrorString(http.StatusBadRequest, ERROR_INVALID_ID)
+		log.WithFields(log.Fields{"Error Msg": err}).Info(ERROR_INVALID_ID)
+		return db.Reservation{}, db.Item{}, false
+	}
+	r, err := s.r.GetReservationById(bson.ObjectId(rid))
+	if err == nil && r.Item != id {
+		err = db.ErrNotFound
+	}
+	if err != nil {
+		if err == db.ErrNotFound {
+			response.WriteErrorString(http.StatusNotFound, ERROR_INVALID_ID)
+			return r, db.Item{}, false
+		}
+		response.WriteErrorString(http.StatusInternalServerError, ERROR_INTERNAL)
+		log.WithFields(log.Fields{"Error Msg": err}).Warn(ERROR_INTERNAL)
+		return r, db.Item{}, false
+	}
+	itm, err := s.d.GetItemById(id)
+	if err != nil {
+		response.WriteErrorString(http.StatusNotFound, ERROR_INVALID_ID)
+		log.WithFields(log.Fields{"Error Msg": err}).Info(ERROR_INVALID_ID)
+		return r, itm, false
+	}
+	return r, itm, true
+}
+
+// writeReservationError reports a failed creation or update of a reservation
+func writeReservationError(response *restful.Response, err error) {
+	switch err {
+	case db.ErrReservationConflict:
+		response.WriteErrorString(http.StatusConflict, err.Error())
+	case db.ErrReservationInvalid:
+		response.WriteErrorString(http.StatusBadRequest, err.Error())
+	case db.ErrReservationBusy:
+		response.WriteErrorString(http.StatusServiceUnavailable, err.Error())
 	default:
-		//TODO
-		log.Debug("none")
+		response.WriteErrorString(http.StatusInternalServerError, ERROR_INTERNAL)
+		log.WithFields(log.Fields{"Error Msg": err}).Warn(ERROR_INTERNAL)
 	}
-	im, err := s.i.Create(body, req.Attribute("User").(string), req.HeaderParameter("Content-Type"), id)
+}
+
+func (s *ItemWebService) NotAnEasterEgg(req *restful.Request, res *restful.Response) {
+	res.WriteErrorString(http.StatusTeapot, "Try some mate tea")
+	return
+}
+
+// SetMaxImageSize limits image uploads to n bytes
+func (s *ItemWebService) SetMaxImageSize(n int64) {
+	s.maxImageSize = n
+}
+
+func (s *ItemWebService) AttachImage(req *restful.Request, res *restful.Response) {
+	sid := req.PathParameter("id")
+	id, err := strconv.ParseUint(sid, 10, 64)
+	if err != nil {
+		log.Debug(err)
+		res.WriteErrorString(http.StatusBadRequest, ERROR_INVALID_ID)
+		return
+	}
+
+	itm, err := s.d.GetItemById(id)
+	if err != nil {
+		log.Debug(err)
+		res.WriteErrorString(http.StatusNotFound, ERROR_INVALID_ID)
+		return
+	}
+	if !mayManage(req, &itm) {
+		log.WithFields(log.Fields{"User": req.Attribute("User"), "Item": id}).Warn("Unauthorized image change")
+		res.WriteErrorString(http.StatusForbidden, "Permission denied")
+		return
+	}
+
+	if req.Request.ContentLength > s.maxImageSize {
+		log.WithFields(log.Fields{"Size": req.Request.ContentLength}).Info(errImageTooLarge)
+		res.WriteErrorString(http.StatusRequestEntityTooLarge, errImageTooLarge.Error())
+		return
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(req.Request.Body, s.maxImageSize+1))
+	if err != nil {
+		log.Debug(err)
+		res.WriteErrorString(http.StatusBadRequest, "")
+		return
+	}
+	if int64(len(data)) > s.maxImageSize {
+		log.WithFields(log.Fields{"Item": id}).Info(errImageTooLarge)
+		res.WriteErrorString(http.StatusRequestEntityTooLarge, errImageTooLarge.Error())
+		return
+	}
+
+	// the content decides the type, not the header
+	data, ct, err := cleanImage(data)
+	if err != nil {
+		log.WithFields(log.Fields{"Item": id, "Error Msg": err}).Info("Image rejected")
+		switch err {
+		case errUnsupportedImage:
+			res.WriteErrorString(http.StatusUnsupportedMediaType, err.Error())
+		case errImageTooLarge:
+			res.WriteErrorString(http.StatusRequestEntityTooLarge, err.Error())
+		case errBrokenImage:
+			res.WriteErrorString(http.StatusBadRequest, err.Error())
+		default:
+			res.WriteErrorString(http.StatusInternalServerError, ERROR_INTERNAL)
+		}
+		return
+	}
+	im, err := s.i.Create(bytes.NewReader(data), req.Attribute("User").(string), ct, id)
 	if err != nil {
 		log.Debug(err)
 		res.WriteErrorString(http.StatusInternalServerError, ERROR_INTERNAL)
 		return
 	}
-	err = s.d.AddImage(id, im, req.Attribute("User").(string))
+	h, err := s.d.AddImage(id, im, req.Attribute("User").(string))
 	if err != nil {
 		log.Debug(err)
 		res.WriteErrorString(http.StatusInternalServerError, ERROR_INTERNAL)
+		err = s.i.Remove(im)
+		if err != nil {
+			log.WithFields(log.Fields{"Image": im.Hex(), "Error Msg": err}).Warn("Could not remove image")
+		}
 		return
 	}
+	s.u.PushUpdate(h)
 	return
 }
 
@@ -345,31 +1266,38 @@ func (s *ItemWebService) RemoveImage(req *restful.Request, res *restful.Response
 		return
 	}
 
-	simgid := req.PathParameter("imageid")
-	imgid, err := hex.DecodeString(simgid)
+	itm, err := s.d.GetItemById(id)
 	if err != nil {
 		log.Debug(err)
-		res.WriteErrorString(http.StatusBadRequest, ERROR_INVALID_ID)
+		res.WriteErrorString(http.StatusNotFound, ERROR_INVALID_ID)
 		return
 	}
-
-	if !s.d.CheckItemExistance(&db.Item{EID: id}) {
-		log.Debug(err)
-		res.WriteErrorString(http.StatusNotFound, ERROR_INVALID_ID)
+	if !mayManage(req, &itm) {
+		log.WithFields(log.Fields{"User": req.Attribute("User"), "Item": id}).Warn("Unauthorized image change")
+		res.WriteErrorString(http.StatusForbidden, "Permission denied")
+		return
+	}
+	// images of other items are not found here
+	imgid, ok := imageRef(req, res, &itm)
+	if !ok {
 		return
 	}
 
-	err = s.i.Remove(bson.ObjectId(imgid))
+	// the reference goes first, a file left behind is found by fsck
+	h, err := s.d.RemoveImage(id, imgid, req.Attribute("User").(string))
 	if err != nil {
 		log.Debug(err)
 		res.WriteErrorString(http.StatusInternalServerError, ERROR_INTERNAL)
 		return
 	}
+	// nothing changed if the reference was removed meanwhile
+	if h != nil {
+		s.u.PushUpdate(h)
+	}
+	s.dropImageInfo(id, imgid, req.Attribute("User").(string))
 
-	err = s.d.RemoveImage(id, bson.ObjectId(imgid), req.Attribute("User").(string))
+	err = s.i.Remove(imgid)
 	if err != nil {
-		log.Debug(err)
-		res.WriteErrorString(http.StatusInternalServerError, ERROR_INTERNAL)
-		return
+		log.WithFields(log.Fields{"Image": imgid.Hex(), "Error Msg": err}).Warn("Could not remove image")
 	}
 }
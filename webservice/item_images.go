@@ -0,0 +1,255 @@
+/*
+ *    Copyright (C) 2015 Stefan Luecke
+ *
+ *    This program is free software: you can redistribute it and/or modify
+ *    it under the terms of the GNU Affero General Public License as published
+ *    by the Free Software Foundation, either version 3 of the License, or
+ *    (at your option) any later version.
+ *
+ *    This program is distributed in the hope that it will be useful,
+ *    but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *    GNU Affero General Public License for more details.
+ *
+ *    You should have received a copy of the GNU Affero General Public License
+ *    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ *    Authors: Stefan Luecke <glaxx@glaxx.net>
+ */
+
+package webservice
+
+import (
+	"encoding/hex"
+	log "github.com/Sirupsen/logrus"
+	"github.com/emicklei/go-restful"
+	db "github.com/openlab-aux/lsmsd/database"
+	"gopkg.in/mgo.v2/bson"
+	"net/http"
+)
+
+// The presentation of item images, their captions, order and cover, is kept
+// in Item.ImageInfo. Changing it is an item update like any other, so it is
+// recorded in the item history and checked against If-Match.
+
+// addImageRoutes adds the routes below /items/{id}/images
+func (s *ItemWebService) addImageRoutes(service *restful.WebService) {
+	service.Route(service.GET("/{id}/images").
+		Param(restful.PathParameter("id", "Item ID")).
+		Doc("Returns the images of this item in the order they are presented, with caption, alt text and metadata").
+		To(s.ListImages).
+		Writes([]db.ItemImage{}).
+		Do(returnsInternalServerError, returnsNotFound, returnsBadRequest))
+
+	service.Route(service.PUT("/{id}/images").
+		Filter(s.a.Auth).
+		Filter(s.a.Require(PERM_ITEM_EDIT_OWN)).
+		Param(restful.PathParameter("id", "Item ID")).
+		Doc("Reorder the images of this item. The body lists the ids of all images in their new order").
+		To(s.ReorderImages).
+		Reads([]bson.ObjectId{}).
+		Do(returnsInternalServerError, returnsNotFound, returnsUpdateSuccessful, returnsBadRequest, returnsForbidden,
+			returnsPreconditionFailed))
+
+	service.Route(service.PUT("/{id}/images/{imageid}").
+		Filter(s.a.Auth).
+		Filter(s.a.Require(PERM_ITEM_EDIT_OWN)).
+		Param(restful.PathParameter("id", "Item ID")).
+		Param(restful.PathParameter("imageid", "Image identifier")).
+		Doc("Set caption and alt text of an image and whether it is the cover of this item. "+
+			"Making it the cover takes the flag from the previous cover. Order is changed by reordering").
+		To(s.UpdateImage).
+		Reads(db.ImageInfo{}).
+		Do(returnsInternalServerError, returnsNotFound, returnsUpdateSuccessful, returnsBadRequest, returnsForbidden,
+			returnsPreconditionFailed))
+}
+
+func (s *ItemWebService) ListImages(request *restful.Request, response *restful.Response) {
+	itm, ok := s.readItem(request, response)
+	if !ok {
+		return
+	}
+	if notModified(request, response, itm.Revision) {
+		return
+	}
+	imgs := itm.SortedImages()
+	for k := range imgs {
+		meta, err := s.i.GetImageMetadataById(imgs[k].ID)
+		if err == db.ErrNotFound {
+			log.WithFields(log.Fields{"Item": itm.EID, "Image": imgs[k].ID.Hex()}).Warn("Image is missing")
+			continue
+		}
+		if err != nil {
+			response.WriteErrorString(http.StatusInternalServerError, ERROR_INTERNAL)
+			log.WithFields(log.Fields{"Error Msg": err}).Warn(ERROR_INTERNAL)
+			return
+		}
+		imgs[k].ImageMetadata = *meta
+	}
+	response.WriteEntity(imgs)
+}
+
+func (s *ItemWebService) ReorderImages(request *restful.Request, response *restful.Response) {
+	i, ok := s.readImageUpdate(request, response)
+	if !ok {
+		return
+	}
+	var order []bson.ObjectId
+	err := request.ReadEntity(&order)
+	if err != nil || !samePermutation(order, i.Images) {
+		log.WithFields(log.Fields{"Error Msg": err}).Info(ERROR_INVALID_INPUT)
+		response.WriteErrorString(http.StatusBadRequest, ERROR_INVALID_INPUT)
+		return
+	}
+	itm := i
+	itm.ImageInfo = copyImageInfo(i.ImageInfo)
+	for k, ref := range order {
+		info := itm.ImageInfo[ref.Hex()]
+		info.Order = k + 1
+		itm.ImageInfo[ref.Hex()] = info
+	}
+	s.saveImageInfo(request, response, &i, &itm)
+}
+
+func (s *ItemWebService) UpdateImage(request *restful.Request, response *restful.Response) {
+	i, ok := s.readImageUpdate(request, response)
+	if !ok {
+		return
+	}
+	ref, ok := imageRef(request, response, &i)
+	if !ok {
+		return
+	}
+	var upd db.ImageInfo
+	err := request.ReadEntity(&upd)
+	if err != nil {
+		log.WithFields(log.Fields{"Error Msg": err}).Info(ERROR_INVALID_INPUT)
+		response.WriteErrorString(http.StatusBadRequest, ERROR_INVALID_INPUT)
+		return
+	}
+	itm := i
+	itm.ImageInfo = copyImageInfo(i.ImageInfo)
+	if upd.Cover {
+		for k, info := range itm.ImageInfo {
+			info.Cover = false
+			itm.ImageInfo[k] = info
+		}
+	}
+	info := itm.ImageInfo[ref.Hex()]
+	info.Caption, info.Alt, info.Cover = upd.Caption, upd.Alt, upd.Cover
+	itm.ImageInfo[ref.Hex()] = info
+	s.saveImageInfo(request, response, &i, &itm)
+}
+
+// readImageUpdate reads the item whose images a request changes and checks
+// that the user may do this. It writes an error response if not.
+func (s *ItemWebService) readImageUpdate(request *restful.Request, response *restful.Response) (db.Item, bool) {
+	i, ok := s.readItem(request, response)
+	if !ok {
+		return i, false
+	}
+	if !mayManage(request, &i) {
+		log.WithFields(log.Fields{"User": request.Attribute("User"), "Item": i.EID}).Warn("Unauthorized image change")
+		response.WriteErrorString(http.StatusForbidden, "Permission denied")
+		return i, false
+	}
+	if !checkIfMatch(request, response, i.Revision) {
+		return i, false
+	}
+	return i, true
+}
+
+// saveImageInfo stores itm, which differs from i in its ImageInfo only.
+// Entries of images which are gone are dropped.
+func (s *ItemWebService) saveImageInfo(request *restful.Request, response *restful.Response, i, itm *db.Item) {
+	for k := range itm.ImageInfo {
+		if !containsImage(itm.Images, k) || itm.ImageInfo[k] == (db.ImageInfo{}) {
+			delete(itm.ImageInfo, k)
+		}
+	}
+	h := i.NewItemHistory(itm, request.Attribute("User").(string))
+	err := s.d.UpdateItem(itm, h)
+	if err != nil {
+		if err == db.ErrRevisionConflict {
+			response.WriteErrorString(http.StatusPreconditionFailed, ERROR_PRECONDITION)
+			return
+		}
+		response.WriteErrorString(http.StatusInternalServerError, ERROR_INTERNAL)
+		log.Warn(err)
+		return
+	}
+	s.u.PushUpdate(h)
+	response.AddHeader("ETag", etag(itm.Revision))
+	response.WriteEntity(true)
+}
+
+// dropImageInfo removes the presentation of the removed image ref from item
+// id. Failures are only logged, the entry is ignored anyway.
+func (s *ItemWebService) dropImageInfo(id uint64, ref bson.ObjectId, user string) {
+	i, err := s.d.GetItemById(id)
+	if err != nil {
+		log.WithFields(log.Fields{"Item": id, "Error Msg": err}).Warn("Could not remove image info")
+		return
+	}
+	if _, ok := i.ImageInfo[ref.Hex()]; !ok {
+		return
+	}
+	itm := i
+	itm.ImageInfo = copyImageInfo(i.ImageInfo)
+	delete(itm.ImageInfo, ref.Hex())
+	h := i.NewItemHistory(&itm, user)
+	err = s.d.UpdateItem(&itm, h)
+	if err != nil {
+		log.WithFields(log.Fields{"Item": id, "Error Msg": err}).Warn("Could not remove image info")
+		return
+	}
+	s.u.PushUpdate(h)
+}
+
+// imageRef returns the image id in the path of request if it belongs to itm
+// and writes an error response otherwise
+func imageRef(request *restful.Request, response *restful.Response, itm *db.Item) (bson.ObjectId, bool) {
+	b, err := hex.DecodeString(request.PathParameter("imageid"))
+	if err != nil || len(b) != 12 {
+		response.WriteErrorString(http.StatusBadRequest, ERROR_INVALID_ID)
+		log.WithFields(log.Fields{"Error Msg": err}).Info(ERROR_INVALID_ID)
+		return "", false
+	}
+	if !containsImage(itm.Images, bson.ObjectId(b).Hex()) {
+		response.WriteErrorString(http.StatusNotFound, ERROR_INVALID_ID)
+		return "", false
+	}
+	return bson.ObjectId(b), true
+}
+
+func containsImage(refs []bson.ObjectId, hexid string) bool {
+	for _, r := range refs {
+		if r.Hex() == hexid {
+			return true
+		}
+	}
+	return false
+}
+
+// samePermutation reports whether a lists the ids of b exactly once each
+func samePermutation(a, b []bson.ObjectId) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	seen := make(map[bson.ObjectId]bool, len(a))
+	for _, ref := range a {
+		if seen[ref] || !containsImage(b, ref.Hex()) {
+			return false
+		}
+		seen[ref] = true
+	}
+	return true
+}
+
+func copyImageInfo(m map[string]db.ImageInfo) map[string]db.ImageInfo {
+	res := make(map[string]db.ImageInfo, len(m))
+	for k, v := range m {
+		res[k] = v
+	}
+	return res
+}
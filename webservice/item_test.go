@@ -30,22 +30,23 @@ import (
 	"gopkg.in/mgo.v2"
 	"net/http"
 	"net/http/httptest"
+	"strconv"
+	"sync"
 )
 
 var _ = Describe("Item", func() {
 	var (
 		session *mgo.Session
 		cont    *restful.Container
-		itm     *db.ItemDBProvider
-		pol     *db.PolicyDBProvider
-		usr     *db.UserDBProvider
+		itm     db.ItemProvider
+		usr     db.UserProvider
 		hw      *httptest.ResponseRecorder
 		req     *http.Request
 		body    []byte
 	)
 
 	BeforeEach(func() {
-		session, cont, itm, pol, usr = newTestContainer()
+		session, cont, itm, _, usr = newTestContainer()
 		hw = httptest.NewRecorder()
 	})
 
@@ -104,7 +105,7 @@ var _ = Describe("Item", func() {
 			})
 			Context("being authenticated", func() {
 				JustBeforeEach(func() {
-					req.SetBasicAuth("1", "testpw")
+					req.SetBasicAuth("0", "testpw")
 				})
 
 				Context("but the item does not exist", func() {
@@ -155,7 +156,7 @@ var _ = Describe("Item", func() {
 
 			Context("being authenticated", func() {
 				JustBeforeEach(func() {
-					req.SetBasicAuth("1", "testpw")
+					req.SetBasicAuth("0", "testpw")
 				})
 
 				It("should return 400 bad request", func() {
@@ -245,6 +246,70 @@ var _ = Describe("Item", func() {
 
 			Expect(hw.Code).To(Equal(http.StatusOK))
 		})
+
+		Context("without limit and offset", func() {
+			BeforeEach(func() {
+				for i := 0; i != 6; i++ {
+					populateItemDB(itm)
+				}
+			})
+			It("should return all items", func() {
+				cont.ServeHTTP(hw, req)
+
+				Expect(hw.Code).To(Equal(http.StatusOK))
+				Expect(hw.Header().Get("X-Total-Count")).To(Equal("70"))
+				Expect(hw.Header().Get("Link")).To(BeEmpty())
+
+				var res []db.Item
+				Expect(json.Unmarshal(hw.Body.Bytes(), &res)).To(Succeed())
+				Expect(res).To(HaveLen(70))
+			})
+		})
+
+		Context("with limit and offset", func() {
+			BeforeEach(func() {
+				req, _ = http.NewRequest("GET", "/items?limit=3&offset=3&sort=-id", nil)
+				req.Header.Set("Content-Type", restful.MIME_JSON)
+			})
+			It("should return a single page", func() {
+				cont.ServeHTTP(hw, req)
+
+				Expect(hw.Code).To(Equal(http.StatusOK))
+				Expect(hw.Header().Get("X-Total-Count")).To(Equal("10"))
+				Expect(hw.Header().Get("Link")).To(ContainSubstring(`rel="next"`))
+				Expect(hw.Header().Get("Link")).To(ContainSubstring(`rel="prev"`))
+
+				var res []db.Item
+				Expect(json.Unmarshal(hw.Body.Bytes(), &res)).To(Succeed())
+				Expect(res).To(HaveLen(3))
+				Expect(res[0].EID).To(BeNumerically(">", res[1].EID))
+			})
+		})
+
+		Context("with an invalid limit", func() {
+			BeforeEach(func() {
+				req, _ = http.NewRequest("GET", "/items?limit=0", nil)
+				req.Header.Set("Content-Type", restful.MIME_JSON)
+			})
+			It("should return 400 bad request", func() {
+				cont.ServeHTTP(hw, req)
+
+				Expect(hw.Code).To(Equal(http.StatusBadRequest))
+			})
+		})
+
+		Context("filtered by owner", func() {
+			BeforeEach(func() {
+				req, _ = http.NewRequest("GET", "/items?owner=nobody", nil)
+				req.Header.Set("Content-Type", restful.MIME_JSON)
+			})
+			It("should only return matching items", func() {
+				cont.ServeHTTP(hw, req)
+
+				Expect(hw.Code).To(Equal(http.StatusOK))
+				Expect(hw.Header().Get("X-Total-Count")).To(Equal("0"))
+			})
+		})
 	})
 
 	Describe("Update a item", func() {
@@ -312,6 +377,119 @@ var _ = Describe("Item", func() {
 
 	})
 
+	Describe("Item hierarchy", func() {
+		var room, shelf, box uint64
+
+		BeforeEach(func() {
+			populateUserDB(usr)
+			room, _ = itm.CreateItem(&db.Item{Name: "Room"}, "0")
+			shelf, _ = itm.CreateItem(&db.Item{Name: "Shelf", Parent: room}, "0")
+			box, _ = itm.CreateItem(&db.Item{Name: "Box", Parent: shelf}, "0")
+		})
+
+		Context("listing the children of an item", func() {
+			It("should return the directly contained items", func() {
+				req, _ = http.NewRequest("GET", "/items/"+strconv.FormatUint(room, 10)+"/children", nil)
+				cont.ServeHTTP(hw, req)
+
+				Expect(hw.Code).To(Equal(http.StatusOK))
+				var res []db.Item
+				Expect(json.Unmarshal(hw.Body.Bytes(), &res)).To(Succeed())
+				Expect(res).To(HaveLen(1))
+				Expect(res[0].EID).To(Equal(shelf))
+			})
+
+			It("should return 404 for an unknown item", func() {
+				req, _ = http.NewRequest("GET", "/items/1337/children", nil)
+				cont.ServeHTTP(hw, req)
+
+				Expect(hw.Code).To(Equal(http.StatusNotFound))
+			})
+		})
+
+		Context("listing the ancestors of an item", func() {
+			It("should return the outermost item first", func() {
+				req, _ = http.NewRequest("GET", "/items/"+strconv.FormatUint(box, 10)+"/ancestors", nil)
+				cont.ServeHTTP(hw, req)
+
+				Expect(hw.Code).To(Equal(http.StatusOK))
+				var res []db.Item
+				Expect(json.Unmarshal(hw.Body.Bytes(), &res)).To(Succeed())
+				Expect(res).To(HaveLen(2))
+				Expect(res[0].Name).To(Equal("Room"))
+				Expect(res[1].Name).To(Equal("Shelf"))
+			})
+		})
+
+		Context("requesting the tree of an item", func() {
+			It("should contain all descendants", func() {
+				req, _ = http.NewRequest("GET", "/items/"+strconv.FormatUint(room, 10)+"/tree", nil)
+				cont.ServeHTTP(hw, req)
+
+				Expect(hw.Code).To(Equal(http.StatusOK))
+				var res db.ItemTree
+				Expect(json.Unmarshal(hw.Body.Bytes(), &res)).To(Succeed())
+				Expect(res.Children).To(HaveLen(1))
+				Expect(res.Children[0].Children).To(HaveLen(1))
+				Expect(res.Children[0].Children[0].Name).To(Equal("Box"))
+			})
+		})
+
+		Context("moving an item into its own descendant", func() {
+			It("should return 400 bad request", func() {
+				body, _ = json.Marshal(db.Item{EID: room, Name: "Room", Parent: box})
+				req, _ = http.NewRequest("PUT", "/items", bytes.NewReader(body))
+				req.Header.Set("Content-Type", restful.MIME_JSON)
+				req.SetBasicAuth("1", "testpw")
+				cont.ServeHTTP(hw, req)
+
+				Expect(hw.Code).To(Equal(http.StatusBadRequest))
+			})
+		})
+
+		Context("moving an item into a non existing item", func() {
+			It("should return 400 bad request", func() {
+				body, _ = json.Marshal(db.Item{EID: box, Name: "Box", Parent: 1337})
+				req, _ = http.NewRequest("PUT", "/items", bytes.NewReader(body))
+				req.Header.Set("Content-Type", restful.MIME_JSON)
+				req.SetBasicAuth("1", "testpw")
+				cont.ServeHTTP(hw, req)
+
+				Expect(hw.Code).To(Equal(http.StatusBadRequest))
+			})
+		})
+
+		Context("deleting a container", func() {
+			It("should refuse by default", func() {
+				req, _ = http.NewRequest("DELETE", "/items/"+strconv.FormatUint(shelf, 10), nil)
+				req.SetBasicAuth("0", "testpw")
+				cont.ServeHTTP(hw, req)
+
+				Expect(hw.Code).To(Equal(http.StatusConflict))
+			})
+
+			It("should move the children up when reparenting", func() {
+				req, _ = http.NewRequest("DELETE", "/items/"+strconv.FormatUint(shelf, 10)+"?children=reparent", nil)
+				req.SetBasicAuth("0", "testpw")
+				cont.ServeHTTP(hw, req)
+
+				Expect(hw.Code).To(Equal(http.StatusOK))
+				b, err := itm.GetItemById(box)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(b.Parent).To(Equal(room))
+			})
+
+			It("should delete the children when cascading", func() {
+				req, _ = http.NewRequest("DELETE", "/items/"+strconv.FormatUint(room, 10)+"?children=cascade", nil)
+				req.SetBasicAuth("0", "testpw")
+				cont.ServeHTTP(hw, req)
+
+				Expect(hw.Code).To(Equal(http.StatusOK))
+				Expect(itm.CheckItemExistance(&db.Item{EID: box})).To(BeFalse())
+			})
+		})
+	})
+
 	Describe("Insert a item", func() {
 		JustBeforeEach(func() {
 			rd := bytes.NewReader(body)
@@ -365,4 +543,52 @@ var _ = Describe("Item", func() {
 
 		})
 	})
+
+	Describe("Allocate item ids", func() {
+		It("should not hand out an id twice to concurrent callers", func() {
+			ids := make(chan uint64, 50)
+			var wg sync.WaitGroup
+			for i := 0; i != cap(ids); i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					defer GinkgoRecover()
+					id, err := itm.CreateItem(&db.Item{Name: "concurrent"}, "0")
+					Expect(err).NotTo(HaveOccurred())
+					ids <- id
+				}()
+			}
+			wg.Wait()
+			close(ids)
+			seen := make(map[uint64]bool)
+			for id := range ids {
+				Expect(seen).NotTo(HaveKey(id))
+				seen[id] = true
+			}
+		})
+
+		It("should reserve blocks of ids for imports", func() {
+			first, err := itm.ReserveIDs(5)
+			Expect(err).NotTo(HaveOccurred())
+			for i := uint64(0); i != 5; i++ {
+				Expect(itm.ImportItem(&db.Item{EID: first + i, Name: "imported"})).To(Succeed())
+			}
+			id, err := itm.CreateItem(&db.Item{Name: "new"}, "0")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(id).To(Equal(first + 5))
+
+			i, err := itm.GetItemById(first + 2)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(i.Name).To(Equal("imported"))
+		})
+
+		It("should refuse to import an item twice or without an id", func() {
+			first, _ := itm.ReserveIDs(1)
+			Expect(itm.ImportItem(&db.Item{EID: first})).To(Succeed())
+			Expect(itm.ImportItem(&db.Item{EID: first})).To(Equal(db.ErrDuplicateID))
+			Expect(itm.ImportItem(&db.Item{})).To(Equal(db.ErrInvalidID))
+			_, err := itm.ReserveIDs(0)
+			Expect(err).To(Equal(db.ErrInvalidIDCount))
+		})
+	})
 })
@@ -0,0 +1,232 @@
+/*
+ *    Copyright (C) 2015 Stefan Luecke
+ *
+ *    This program is free software: you can redistribute it and/or modify
+ *    it under the terms of the GNU Affero General Public License as published
+ *    by the Free Software Foundation, either version 3 of the License, or
+ *    (at your option) any later version.
+ *
+ *    This program is distributed in the hope that it will be useful,
+ *    but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *    GNU Affero General Public License for more details.
+ *
+ *    You should have received a copy of the GNU Affero General Public License
+ *    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ *    Authors: Stefan Luecke <glaxx@glaxx.net>
+ */
+
+package webservice
+
+import (
+	"encoding/hex"
+	log "github.com/Sirupsen/logrus"
+	"github.com/emicklei/go-restful"
+	db "github.com/openlab-aux/lsmsd/database"
+	"gopkg.in/mgo.v2/bson"
+	"net/http"
+	"time"
+)
+
+var loanListSpec = &listSpec{
+	Sort: map[string]string{"requested": "requested", "due": "due"},
+	Filter: map[string]string{
+		"borrower": "borrower",
+		"item":     "item",
+		"state":    "state",
+	},
+	Numeric: map[string]bool{"item": true},
+}
+
+type LoanWebService struct {
+	l db.LoanProvider
+	d db.ItemProvider
+	S *restful.WebService
+	a *BasicAuthService
+	u *UpdateService
+}
+
+func NewLoanService(l db.LoanProvider, d db.ItemProvider, a *BasicAuthService, u *UpdateService) *LoanWebService {
+	res := new(LoanWebService)
+	res.l = l
+	res.d = d
+	res.a = a
+	res.u = u
+
+	service := new(restful.WebService)
+	service.
+		Path("/loans").
+		Doc("Lending related services").
+		ApiVersion("0.1").
+		Consumes(restful.MIME_JSON).
+		Produces(restful.MIME_JSON)
+
+	service.Route(service.GET("").
+		Param(restful.QueryParameter("overdue", "Only list active loans past their due date").DataType("boolean")).
+		Doc("List loans, paginated, optionally filtered and sorted").
+		To(res.ListLoans).
+		Writes([]db.Loan{}).
+		Do(returnsInternalServerError, returnsBadRequest, loanListSpec.params))
+
+	service.Route(service.GET("/{id}").
+		Param(restful.PathParameter("id", "Loan ID")).
+		Doc("Returns a single loan").
+		To(res.GetLoanById).
+		Writes(db.Loan{}).
+		Do(returnsInternalServerError, returnsNotFound, returnsBadRequest))
+
+	service.Route(service.POST("/{id}/approve").
+		Filter(res.a.Auth).
+		Filter(res.a.Require(PERM_ITEM_EDIT_OWN)).
+		Param(restful.PathParameter("id", "Loan ID")).
+		Doc("Approve a requested checkout. Only the owner or maintainer of the item may do this").
+		To(res.ApproveLoan).
+		Returns(http.StatusConflict, "Loan is not waiting for approval or the item is already lent", nil).
+		Do(returnsInternalServerError, returnsNotFound, returnsBadRequest, returnsForbidden))
+
+	service.Route(service.POST("/{id}/reject").
+		Filter(res.a.Auth).
+		Filter(res.a.Require(PERM_ITEM_EDIT_OWN)).
+		Param(restful.PathParameter("id", "Loan ID")).
+		Doc("Reject a requested checkout. Only the owner or maintainer of the item may do this").
+		To(res.RejectLoan).
+		Returns(http.StatusConflict, "Loan is not waiting for approval", nil).
+		Do(returnsInternalServerError, returnsNotFound, returnsBadRequest, returnsForbidden))
+
+	res.S = service
+	return res
+}
+
+func (s *LoanWebService) ListLoans(request *restful.Request, response *restful.Response) {
+	q, err := loanListSpec.parse(request)
+	if err != nil {
+		response.WriteErrorString(http.StatusBadRequest, ERROR_INVALID_INPUT)
+		log.WithFields(log.Fields{"Error Msg": err}).Info(ERROR_INVALID_INPUT)
+		return
+	}
+	overdue := request.QueryParameter("overdue") == "true"
+	loans, total, err := s.l.ListLoans(q, overdue)
+	if err != nil {
+		response.WriteErrorString(http.StatusInternalServerError, ERROR_INTERNAL)
+		log.WithFields(log.Fields{"Error Msg": err}).Warn(ERROR_INTERNAL)
+		return
+	}
+	writePageHeaders(request, response, q, total)
+	response.WriteEntity(loans)
+}
+
+func (s *LoanWebService) GetLoanById(request *restful.Request, response *restful.Response) {
+	loan, ok := s.readLoan(request, response)
+	if !ok {
+		return
+	}
+	response.WriteEntity(loan)
+}
+
+func (s *LoanWebService) ApproveLoan(request *restful.Request, response *restful.Response) {
+	loan, itm, ok := s.readRequestedLoan(request, response)
+	if !ok {
+		return
+	}
+	user := request.Attribute("User").(string)
+	loan.ApprovedBy = user
+	err := lend(s.d, s.l, s.u, &loan, user)
+	if err != nil {
+		if err == db.ErrItemLent {
+			response.WriteErrorString(http.StatusConflict, err.Error())
+			return
+		}
+		response.WriteErrorString(http.StatusInternalServerError, ERROR_INTERNAL)
+		log.WithFields(log.Fields{"Error Msg": err}).Warn(ERROR_INTERNAL)
+		return
+	}
+	log.WithFields(log.Fields{"Item": itm.EID, "Borrower": loan.Borrower, "User": user}).Debug("Loan approved")
+	response.WriteEntity(true)
+}
+
+func (s *LoanWebService) RejectLoan(request *restful.Request, response *restful.Response) {
+	loan, _, ok := s.readRequestedLoan(request, response)
+	if !ok {
+		return
+	}
+	loan.State = db.LoanRejected
+	err := s.l.UpdateLoan(&loan)
+	if err != nil {
+		response.WriteErrorString(http.StatusInternalServerError, ERROR_INTERNAL)
+		log.WithFields(log.Fields{"Error Msg": err}).Warn(ERROR_INTERNAL)
+		return
+	}
+	s.u.PushUpdate(&loan)
+	response.WriteEntity(true)
+}
+
+// readLoan looks up the loan referenced in the path of request and writes an
+// error response if this fails
+func (s *LoanWebService) readLoan(request *restful.Request, response *restful.Response) (db.Loan, bool) {
+	id, err := hex.DecodeString(request.PathParameter("id"))
+	if err != nil || len(id) != 12 {
+		response.WriteErrorString(http.StatusBadRequest, ERROR_INVALID_ID)
+		log.WithFields(log.Fields{"Error Msg": err}).Info(ERROR_INVALID_ID)
+		return db.Loan{}, false
+	}
+	loan, err := s.l.GetLoanById(bson.ObjectId(id))
+	if err != nil {
+		if err == db.ErrNotFound {
+			response.WriteErrorString(http.StatusNotFound, ERROR_INVALID_ID)
+			return loan, false
+		}
+		response.WriteErrorString(http.StatusInternalServerError, ERROR_INTERNAL)
+		log.WithFields(log.Fields{"Error Msg": err}).Warn(ERROR_INTERNAL)
+		return loan, false
+	}
+	return loan, true
+}
+
+// readRequestedLoan is readLoan for loans waiting for approval by the
+// authenticated user
+func (s *LoanWebService) readRequestedLoan(request *restful.Request, response *restful.Response) (db.Loan, db.Item, bool) {
+	loan, ok := s.readLoan(request, response)
+	if !ok {
+		return loan, db.Item{}, false
+	}
+	itm, err := s.d.GetItemById(loan.Item)
+	if err != nil {
+		response.WriteErrorString(http.StatusNotFound, ERROR_INVALID_ID)
+		log.WithFields(log.Fields{"Error Msg": err}).Info(ERROR_INVALID_ID)
+		return loan, itm, false
+	}
+	if !mayManage(request, &itm) {
+		log.WithFields(log.Fields{"User": request.Attribute("User"), "Loan": loan.ID.Hex()}).Warn("Unauthorized loan approval")
+		response.WriteErrorString(http.StatusForbidden, "Request not allowed")
+		return loan, itm, false
+	}
+	if loan.State != db.LoanRequested {
+		response.WriteErrorString(http.StatusConflict, "Loan is not waiting for approval")
+		return loan, itm, false
+	}
+	return loan, itm, true
+}
+
+// lend hands the item of loan over to its borrower and stores the loan as
+// active
+func lend(d db.ItemProvider, l db.LoanProvider, u *UpdateService, loan *db.Loan, user string) error {
+	h, err := d.SetBorrower(loan.Item, loan.Borrower, loan.Due, user)
+	if err != nil {
+		return err
+	}
+	u.PushUpdate(h)
+
+	loan.State = db.LoanActive
+	loan.Out = time.Now()
+	if loan.ID == "" {
+		err = l.CreateLoan(loan)
+	} else {
+		err = l.UpdateLoan(loan)
+	}
+	if err != nil {
+		return err
+	}
+	u.PushUpdate(loan)
+	return nil
+}
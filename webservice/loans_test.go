@@ -0,0 +1,167 @@
+/*
+ *    Copyright (C) 2015 Stefan Luecke
+ *
+ *    This program is free software: you can redistribute it and/or modify
+ *    it under the terms of the GNU Affero General Public License as published
+ *    by the Free Software Foundation, either version 3 of the License, or
+ *    (at your option) any later version.
+ *
+ *    This program is distributed in the hope that it will be useful,
+ *    but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *    GNU Affero General Public License for more details.
+ *
+ *    You should have received a copy of the GNU Affero General Public License
+ *    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ *    Authors: Stefan Luecke <glaxx@glaxx.net>
+ */
+
+package webservice_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/emicklei/go-restful"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	db "github.com/openlab-aux/lsmsd/database"
+	"gopkg.in/mgo.v2"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"time"
+)
+
+var _ = Describe("Loans", func() {
+	var (
+		session *mgo.Session
+		cont    *restful.Container
+		itm     db.ItemProvider
+		pol     db.PolicyProvider
+		usr     db.UserProvider
+		hw      *httptest.ResponseRecorder
+		eid     uint64
+		id      string
+	)
+
+	post := func(path, user string, body []byte) {
+		req, _ := http.NewRequest("POST", path, bytes.NewReader(body))
+		req.Header.Set("Content-Type", restful.MIME_JSON)
+		req.SetBasicAuth(user, "testpw")
+		hw = httptest.NewRecorder()
+		cont.ServeHTTP(hw, req)
+	}
+
+	BeforeEach(func() {
+		session, cont, itm, pol, usr = newTestContainer()
+		populateUserDB(usr)
+		err := pol.CreatePolicy(&db.Policy{Name: "ask", Checkout: db.CheckoutApproval}, "0")
+		Expect(err).NotTo(HaveOccurred())
+		err = pol.CreatePolicy(&db.Policy{Name: "never", Checkout: db.CheckoutForbidden}, "0")
+		Expect(err).NotTo(HaveOccurred())
+		eid, err = itm.CreateItem(&db.Item{Name: "Soldering station", Owner: "2"}, "0")
+		Expect(err).NotTo(HaveOccurred())
+		id = strconv.FormatUint(eid, 10)
+	})
+
+	AfterEach(func() {
+		flushDB(session, itm)
+	})
+
+	Describe("Check out an item", func() {
+		It("should lend the item", func() {
+			post("/items/"+id+"/checkout", "1", nil)
+			Expect(hw.Code).To(Equal(http.StatusOK))
+
+			i, _ := itm.GetItemById(eid)
+			Expect(i.Borrower).To(Equal("1"))
+		})
+
+		It("should not lend the item twice", func() {
+			post("/items/"+id+"/checkout", "1", nil)
+			post("/items/"+id+"/checkout", "3", nil)
+			Expect(hw.Code).To(Equal(http.StatusConflict))
+		})
+
+		It("should refuse items whose policy forbids lending", func() {
+			i, _ := itm.GetItemById(eid)
+			i.Usage = "never"
+			Expect(itm.UpdateItem(&i, i.NewItemHistory(&i, "2"))).To(Succeed())
+
+			post("/items/"+id+"/checkout", "1", nil)
+			Expect(hw.Code).To(Equal(http.StatusForbidden))
+		})
+
+		Context("whose policy requires approval", func() {
+			BeforeEach(func() {
+				i, _ := itm.GetItemById(eid)
+				i.Usage = "ask"
+				Expect(itm.UpdateItem(&i, i.NewItemHistory(&i, "2"))).To(Succeed())
+			})
+
+			It("should wait for the owner", func() {
+				post("/items/"+id+"/checkout", "4", nil)
+				Expect(hw.Code).To(Equal(http.StatusAccepted))
+				var loan string
+				Expect(json.Unmarshal(hw.Body.Bytes(), &loan)).To(Succeed())
+
+				post(loan+"/approve", "3", nil)
+				Expect(hw.Code).To(Equal(http.StatusForbidden))
+
+				post(loan+"/approve", "2", nil)
+				Expect(hw.Code).To(Equal(http.StatusOK))
+				i, _ := itm.GetItemById(eid)
+				Expect(i.Borrower).To(Equal("4"))
+			})
+		})
+	})
+
+	Describe("Check in an item", func() {
+		BeforeEach(func() {
+			post("/items/"+id+"/checkout", "1", nil)
+		})
+
+		It("should not be allowed for other users", func() {
+			post("/items/"+id+"/checkin", "3", nil)
+			Expect(hw.Code).To(Equal(http.StatusForbidden))
+		})
+
+		It("should return the item", func() {
+			post("/items/"+id+"/checkin", "1", nil)
+			Expect(hw.Code).To(Equal(http.StatusOK))
+
+			i, _ := itm.GetItemById(eid)
+			Expect(i.Borrower).To(BeEmpty())
+		})
+	})
+
+	Describe("List loans", func() {
+		BeforeEach(func() {
+			body, _ := json.Marshal(map[string]time.Time{"Due": time.Now().Add(-time.Hour)})
+			post("/items/"+id+"/checkout", "1", body)
+			Expect(hw.Code).To(Equal(http.StatusOK))
+		})
+
+		It("should list overdue loans", func() {
+			req, _ := http.NewRequest("GET", "/loans?overdue=true", nil)
+			hw = httptest.NewRecorder()
+			cont.ServeHTTP(hw, req)
+
+			Expect(hw.Code).To(Equal(http.StatusOK))
+			var res []db.Loan
+			Expect(json.Unmarshal(hw.Body.Bytes(), &res)).To(Succeed())
+			Expect(res).To(HaveLen(1))
+			Expect(res[0].Borrower).To(Equal("1"))
+		})
+
+		It("should list the loans of a user", func() {
+			req, _ := http.NewRequest("GET", "/users/1/loans", nil)
+			hw = httptest.NewRecorder()
+			cont.ServeHTTP(hw, req)
+
+			Expect(hw.Code).To(Equal(http.StatusOK))
+			Expect(hw.Header().Get("X-Total-Count")).To(Equal("1"))
+		})
+	})
+})
@@ -0,0 +1,98 @@
+/*
+ *    Copyright (C) 2015 Stefan Luecke
+ *
+ *    This program is free software: you can redistribute it and/or modify
+ *    it under the terms of the GNU Affero General Public License as published
+ *    by the Free Software Foundation, either version 3 of the License, or
+ *    (at your option) any later version.
+ *
+ *    This program is distributed in the hope that it will be useful,
+ *    but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *    GNU Affero General Public License for more details.
+ *
+ *    You should have received a copy of the GNU Affero General Public License
+ *    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ *    Authors: Stefan Luecke <glaxx@glaxx.net>
+ */
+
+package webservice_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	db "github.com/openlab-aux/lsmsd/database"
+	"github.com/openlab-aux/lsmsd/notification"
+	"gopkg.in/mgo.v2"
+	"strconv"
+)
+
+var _ = Describe("Mail notifications", func() {
+	var (
+		session *mgo.Session
+		itm     db.ItemProvider
+		usr     db.UserProvider
+		m       *fakeMailer
+		cn      *notification.ChangeNotifier
+		i       db.Item
+	)
+
+	BeforeEach(func() {
+		session, _, itm, _, usr = newTestContainer()
+		populateUserDB(usr)
+		m = new(fakeMailer)
+		cn = notification.NewChangeNotifier(m, usr, itm)
+		i = db.Item{Name: "Drill", Owner: "2", Maintainer: "3", Usage: "members"}
+		eid, err := itm.CreateItem(&i, "0")
+		Expect(err).NotTo(HaveOccurred())
+		i.EID = eid
+	})
+
+	AfterEach(func() {
+		flushDB(session, itm)
+	})
+
+	It("should mail owner and maintainer of a changed item, but not the editor", func() {
+		cn.Notify(db.MailEventItem, i.NewItemHistory(&db.Item{Name: "Cordless drill"}, "3"))
+		cn.Quit()
+		Expect(m.sent()).To(ConsistOf("test2@example.com"))
+	})
+
+	It("should keep names from adding header lines", func() {
+		name := "Drill\r\nBcc: all@example.com"
+		e := db.Item{Name: name, Owner: "2", Usage: name}
+		eid, err := itm.CreateItem(&e, "0")
+		Expect(err).NotTo(HaveOccurred())
+		e.EID = eid
+
+		cn.Notify(db.MailEventItem, e.NewItemHistory(&db.Item{Description: "new"}, "3"))
+		cn.Notify(db.MailEventPolicy, &db.PolicyHistory{User: "1", Policy: map[string]interface{}{"name": name}})
+		cn.Quit()
+		Expect(m.subjects).To(ConsistOf(
+			"Item DrillBcc: all@example.com (#"+strconv.FormatUint(eid, 10)+") was changed",
+			"Policy DrillBcc: all@example.com was changed"))
+	})
+
+	It("should mail the owners of items using a changed policy", func() {
+		cn.Notify(db.MailEventPolicy, &db.PolicyHistory{User: "1", Policy: map[string]interface{}{"name": "members"}})
+		cn.Quit()
+		Expect(m.sent()).To(ConsistOf("test2@example.com", "test3@example.com"))
+	})
+
+	It("should respect opt-outs", func() {
+		u, _ := usr.GetUserByName("2")
+		u.MuteMail = []string{db.MailEventItem}
+		Expect(usr.UpdateUser(&u)).To(Succeed())
+
+		cn.Notify(db.MailEventItem, i.NewItemHistory(&db.Item{Name: "Cordless drill"}, "1"))
+		cn.Quit()
+		Expect(m.sent()).To(ConsistOf("test3@example.com"))
+	})
+
+	It("should ignore other updates", func() {
+		cn.Notify("Loan", &db.Loan{Item: i.EID})
+		cn.Quit()
+		Expect(m.sent()).To(BeEmpty())
+	})
+})
@@ -0,0 +1,383 @@
+/*
+ *    Copyright (C) 2015 Stefan Luecke
+ *
+ *    This program is free software: you can redistribute it and/or modify
+ *    it under the terms of the GNU Affero General Public License as published
+ *    by the Free Software Foundation, either version 3 of the License, or
+ *    (at your option) any later version.
+ *
+ *    This program is distributed in the hope that it will be useful,
+ *    but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *    GNU Affero General Public License for more details.
+ *
+ *    You should have received a copy of the GNU Affero General Public License
+ *    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ *    Authors: Stefan Luecke <glaxx@glaxx.net>
+ */
+
+package webservice
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	log "github.com/Sirupsen/logrus"
+	"github.com/emicklei/go-restful"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+const (
+	MIME_MERGE_PATCH = "application/merge-patch+json"
+	MIME_JSON_PATCH  = "application/json-patch+json"
+)
+
+var (
+	errPatchType     = errors.New("Unsupported patch format")
+	errPatchPath     = errors.New("Patch path does not exist")
+	errPatchOp       = errors.New("Unknown patch operation")
+	errPatchTest     = errors.New("Patch test failed")
+	errPatchReadOnly = errors.New("Patch changes a read-only field")
+)
+
+// patchOp is an operation of a JSON Patch (RFC 6902). Value stays empty if
+// the operation has none, a JSON null is kept as "null".
+type patchOp struct {
+	Op    string
+	Path  string
+	From  string
+	Value json.RawMessage
+}
+
+// patchEntity applies the patch in the body of request to the JSON form of
+// cur and decodes the result into res. Merge patches (RFC 7396) and JSON
+// patches (RFC 6902) are told apart by the Content-Type.
+func patchEntity(request *restful.Request, cur, res interface{}) error {
+	data, err := json.Marshal(cur)
+	if err != nil {
+		return err
+	}
+	var doc interface{}
+	err = json.Unmarshal(data, &doc)
+	if err != nil {
+		return err
+	}
+	body, err := ioutil.ReadAll(request.Request.Body)
+	if err != nil {
+		return err
+	}
+	ct, _, _ := mime.ParseMediaType(request.HeaderParameter("Content-Type"))
+	switch ct {
+	case MIME_MERGE_PATCH:
+		var p interface{}
+		err = json.Unmarshal(body, &p)
+		if err != nil {
+			return err
+		}
+		doc = mergePatch(doc, p)
+	case MIME_JSON_PATCH:
+		var ops []patchOp
+		err = json.Unmarshal(body, &ops)
+		if err != nil {
+			return err
+		}
+		doc, err = jsonPatch(doc, ops)
+		if err != nil {
+			return err
+		}
+	default:
+		return errPatchType
+	}
+	data, err = json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	return dec.Decode(res)
+}
+
+// writePatchError answers a request whose patch could not be applied
+func writePatchError(response *restful.Response, err error) {
+	log.WithFields(log.Fields{"Error Msg": err}).Info(ERROR_INVALID_INPUT)
+	switch err {
+	case errPatchType:
+		response.WriteErrorString(http.StatusUnsupportedMediaType, err.Error())
+	case errPatchTest:
+		response.WriteErrorString(http.StatusConflict, err.Error())
+	case errPatchPath, errPatchReadOnly:
+		response.WriteErrorString(422, err.Error())
+	default:
+		response.WriteErrorString(http.StatusBadRequest, ERROR_INVALID_INPUT)
+	}
+}
+
+func returnsPatchErrors(b *restful.RouteBuilder) {
+	b.Consumes(MIME_MERGE_PATCH, MIME_JSON_PATCH)
+	b.Returns(http.StatusUnsupportedMediaType, errPatchType.Error(), nil)
+	b.Returns(http.StatusConflict, errPatchTest.Error(), nil)
+	b.Returns(422, "The patch does not fit the resource or changes read-only fields", nil)
+}
+
+// mergePatch applies the merge patch p to doc as described in RFC 7396
+func mergePatch(doc, p interface{}) interface{} {
+	pm, ok := p.(map[string]interface{})
+	if !ok {
+		return p
+	}
+	dm, ok := doc.(map[string]interface{})
+	if !ok {
+		dm = make(map[string]interface{})
+	}
+	for k, v := range pm {
+		if v == nil {
+			delete(dm, k)
+		} else {
+			dm[k] = mergePatch(dm[k], v)
+		}
+	}
+	return dm
+}
+
+// jsonPatch applies ops to doc as described in RFC 6902. doc is modified in
+// place, so callers have to throw it away on errors.
+func jsonPatch(doc interface{}, ops []patchOp) (interface{}, error) {
+	for _, op := range ops {
+		path, err := parsePointer(op.Path)
+		if err != nil {
+			return nil, err
+		}
+		var value interface{}
+		switch op.Op {
+		case "add", "replace", "test":
+			if len(op.Value) == 0 {
+				return nil, errors.New("Patch operation " + op.Op + " needs a value")
+			}
+			err = json.Unmarshal(op.Value, &value)
+		case "move", "copy":
+			var from []string
+			from, err = parsePointer(op.From)
+			if err != nil {
+				return nil, err
+			}
+			if op.Op == "move" && isPrefix(from, path) && len(from) != len(path) {
+				return nil, errPatchPath
+			}
+			value, err = pointerGet(doc, from)
+			if err == nil && op.Op == "copy" {
+				value, err = deepCopy(value)
+			}
+			if err == nil && op.Op == "move" {
+				doc, err = pointerRemove(doc, from)
+			}
+		case "remove":
+		default:
+			return nil, errPatchOp
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch op.Op {
+		case "add", "move", "copy":
+			doc, err = pointerAdd(doc, path, value)
+		case "replace":
+			doc, err = pointerReplace(doc, path, value)
+		case "remove":
+			doc, err = pointerRemove(doc, path)
+		case "test":
+			var cur interface{}
+			cur, err = pointerGet(doc, path)
+			if err == nil && !reflect.DeepEqual(cur, value) {
+				err = errPatchTest
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return doc, nil
+}
+
+// parsePointer splits a JSON pointer (RFC 6901) into its unescaped tokens
+func parsePointer(p string) ([]string, error) {
+	if p == "" {
+		return []string{}, nil
+	}
+	if p[0] != '/' {
+		return nil, errPatchPath
+	}
+	res := strings.Split(p[1:], "/")
+	for i := range res {
+		res[i] = strings.Replace(strings.Replace(res[i], "~1", "/", -1), "~0", "~", -1)
+	}
+	return res, nil
+}
+
+func isPrefix(prefix, path []string) bool {
+	if len(prefix) > len(path) {
+		return false
+	}
+	for i := range prefix {
+		if prefix[i] != path[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// arrayIndex parses the array index key, which has to be less than max
+func arrayIndex(key string, max int) (int, error) {
+	if key == "" || (len(key) > 1 && key[0] == '0') {
+		return 0, errPatchPath
+	}
+	i, err := strconv.Atoi(key)
+	if err != nil || i < 0 || i >= max {
+		return 0, errPatchPath
+	}
+	return i, nil
+}
+
+// pointerAt calls f with the container holding the value path points to and
+// the last token of path. f returns the modified container, which replaces
+// the old one in the document.
+func pointerAt(node interface{}, path []string, f func(node interface{}, key string) (interface{}, error)) (interface{}, error) {
+	if len(path) == 1 {
+		return f(node, path[0])
+	}
+	switch n := node.(type) {
+	case map[string]interface{}:
+		c, ok := n[path[0]]
+		if !ok {
+			return nil, errPatchPath
+		}
+		c, err := pointerAt(c, path[1:], f)
+		if err != nil {
+			return nil, err
+		}
+		n[path[0]] = c
+		return n, nil
+	case []interface{}:
+		i, err := arrayIndex(path[0], len(n))
+		if err != nil {
+			return nil, err
+		}
+		c, err := pointerAt(n[i], path[1:], f)
+		if err != nil {
+			return nil, err
+		}
+		n[i] = c
+		return n, nil
+	}
+	return nil, errPatchPath
+}
+
+func pointerGet(doc interface{}, path []string) (interface{}, error) {
+	for _, key := range path {
+		switch n := doc.(type) {
+		case map[string]interface{}:
+			v, ok := n[key]
+			if !ok {
+				return nil, errPatchPath
+			}
+			doc = v
+		case []interface{}:
+			i, err := arrayIndex(key, len(n))
+			if err != nil {
+				return nil, err
+			}
+			doc = n[i]
+		default:
+			return nil, errPatchPath
+		}
+	}
+	return doc, nil
+}
+
+func pointerAdd(doc interface{}, path []string, value interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+	return pointerAt(doc, path, func(node interface{}, key string) (interface{}, error) {
+		switch n := node.(type) {
+		case map[string]interface{}:
+			n[key] = value
+			return n, nil
+		case []interface{}:
+			if key == "-" {
+				return append(n, value), nil
+			}
+			i, err := arrayIndex(key, len(n)+1)
+			if err != nil {
+				return nil, err
+			}
+			n = append(n, nil)
+			copy(n[i+1:], n[i:])
+			n[i] = value
+			return n, nil
+		}
+		return nil, errPatchPath
+	})
+}
+
+func pointerRemove(doc interface{}, path []string) (interface{}, error) {
+	if len(path) == 0 {
+		return nil, errPatchPath
+	}
+	return pointerAt(doc, path, func(node interface{}, key string) (interface{}, error) {
+		switch n := node.(type) {
+		case map[string]interface{}:
+			if _, ok := n[key]; !ok {
+				return nil, errPatchPath
+			}
+			delete(n, key)
+			return n, nil
+		case []interface{}:
+			i, err := arrayIndex(key, len(n))
+			if err != nil {
+				return nil, err
+			}
+			return append(n[:i], n[i+1:]...), nil
+		}
+		return nil, errPatchPath
+	})
+}
+
+func pointerReplace(doc interface{}, path []string, value interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+	return pointerAt(doc, path, func(node interface{}, key string) (interface{}, error) {
+		switch n := node.(type) {
+		case map[string]interface{}:
+			if _, ok := n[key]; !ok {
+				return nil, errPatchPath
+			}
+			n[key] = value
+			return n, nil
+		case []interface{}:
+			i, err := arrayIndex(key, len(n))
+			if err != nil {
+				return nil, err
+			}
+			n[i] = value
+			return n, nil
+		}
+		return nil, errPatchPath
+	})
+}
+
+func deepCopy(v interface{}) (interface{}, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var res interface{}
+	err = json.Unmarshal(data, &res)
+	return res, err
+}
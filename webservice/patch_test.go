@@ -0,0 +1,217 @@
+/*
+ *    Copyright (C) 2015 Stefan Luecke
+ *
+ *    This program is free software: you can redistribute it and/or modify
+ *    it under the terms of the GNU Affero General Public License as published
+ *    by the Free Software Foundation, either version 3 of the License, or
+ *    (at your option) any later version.
+ *
+ *    This program is distributed in the hope that it will be useful,
+ *    but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *    GNU Affero General Public License for more details.
+ *
+ *    You should have received a copy of the GNU Affero General Public License
+ *    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ *    Authors: Stefan Luecke <glaxx@glaxx.net>
+ */
+
+package webservice_test
+
+import (
+	"github.com/emicklei/go-restful"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	db "github.com/openlab-aux/lsmsd/database"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+)
+
+var _ = Describe("Patch", func() {
+	var (
+		session *mgo.Session
+		cont    *restful.Container
+		itm     db.ItemProvider
+		pol     db.PolicyProvider
+		usr     db.UserProvider
+		hw      *httptest.ResponseRecorder
+		eid     uint64
+		id      string
+	)
+
+	merge := func(path, user string, body interface{}, header ...string) {
+		hw = request(cont, "PATCH", path, user, body, append([]string{"Content-Type", "application/merge-patch+json"}, header...)...)
+	}
+	patch := func(path, user string, body interface{}) {
+		hw = request(cont, "PATCH", path, user, body, "Content-Type", "application/json-patch+json")
+	}
+
+	BeforeEach(func() {
+		session, cont, itm, pol, usr = newTestContainer()
+		populateUserDB(usr)
+		populatePolicyDB(pol)
+		var err error
+		eid, err = itm.CreateItem(&db.Item{Name: "Lathe", Description: "metal", Owner: "2", Maintainer: "2"}, "0")
+		Expect(err).NotTo(HaveOccurred())
+		id = strconv.FormatUint(eid, 10)
+		_, err = itm.AddImage(eid, bson.NewObjectId(), "2")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		flushDB(session, itm)
+	})
+
+	Describe("Items", func() {
+		It("should change only the fields in a merge patch", func() {
+			merge("/items/"+id, "2", map[string]interface{}{"Maintainer": "3"})
+			Expect(hw.Code).To(Equal(http.StatusOK))
+
+			i, _ := itm.GetItemById(eid)
+			Expect(i.Maintainer).To(Equal("3"))
+			Expect(i.Name).To(Equal("Lathe"))
+			Expect(i.Images).To(HaveLen(1))
+			log, _ := itm.GetItemLog(eid)
+			Expect(log[len(log)-1].Item).To(HaveLen(2))
+			Expect(log[len(log)-1].Item).To(HaveKeyWithValue("maintainer", "3"))
+		})
+
+		It("should clear fields set to null", func() {
+			merge("/items/"+id, "2", map[string]interface{}{"Description": nil})
+			Expect(hw.Code).To(Equal(http.StatusOK))
+			i, _ := itm.GetItemById(eid)
+			Expect(i.Description).To(BeEmpty())
+		})
+
+		It("should apply json patches", func() {
+			patch("/items/"+id, "2", []map[string]interface{}{
+				{"op": "test", "path": "/Name", "value": "Lathe"},
+				{"op": "replace", "path": "/Name", "value": "Mini lathe"},
+				{"op": "copy", "from": "/Owner", "path": "/Usage"},
+				{"op": "remove", "path": "/Description"},
+			})
+			Expect(hw.Code).To(Equal(http.StatusOK))
+			i, _ := itm.GetItemById(eid)
+			Expect(i.Name).To(Equal("Mini lathe"))
+			Expect(i.Usage).To(Equal("2"))
+			Expect(i.Description).To(BeEmpty())
+		})
+
+		It("should apply nothing if a test fails", func() {
+			patch("/items/"+id, "2", []map[string]interface{}{
+				{"op": "replace", "path": "/Name", "value": "Drill"},
+				{"op": "test", "path": "/Owner", "value": "3"},
+			})
+			Expect(hw.Code).To(Equal(http.StatusConflict))
+			i, _ := itm.GetItemById(eid)
+			Expect(i.Name).To(Equal("Lathe"))
+		})
+
+		It("should refuse paths that do not exist", func() {
+			patch("/items/"+id, "2", []map[string]interface{}{{"op": "remove", "path": "/Images/3"}})
+			Expect(hw.Code).To(Equal(422))
+			patch("/items/"+id, "2", []map[string]interface{}{{"op": "jump", "path": "/Name"}})
+			Expect(hw.Code).To(Equal(http.StatusBadRequest))
+		})
+
+		It("should refuse changes to read-only fields", func() {
+			merge("/items/"+id, "2", map[string]interface{}{"Borrower": "2"})
+			Expect(hw.Code).To(Equal(422))
+			merge("/items/"+id, "2", map[string]interface{}{"Id": 42})
+			Expect(hw.Code).To(Equal(422))
+			merge("/items/"+id, "2", map[string]interface{}{"Colour": "red"})
+			Expect(hw.Code).To(Equal(http.StatusBadRequest))
+		})
+
+		It("should refuse other formats", func() {
+			hw = request(cont, "PATCH", "/items/"+id, "2", map[string]interface{}{"Name": "x"})
+			Expect(hw.Code).To(Equal(http.StatusUnsupportedMediaType))
+		})
+
+		It("should honour If-Match", func() {
+			merge("/items/"+id, "2", map[string]interface{}{"Name": "x"}, "If-Match", `"1"`)
+			Expect(hw.Code).To(Equal(http.StatusPreconditionFailed))
+		})
+
+		It("should refuse users who may not manage the item", func() {
+			merge("/items/"+id, "4", map[string]interface{}{"Name": "x"})
+			Expect(hw.Code).To(Equal(http.StatusForbidden))
+		})
+
+		It("should replace items on their own path", func() {
+			hw = request(cont, "PUT", "/items/"+id, "2", map[string]interface{}{"Name": "Drill", "Owner": "2"})
+			Expect(hw.Code).To(Equal(http.StatusOK))
+			i, _ := itm.GetItemById(eid)
+			Expect(i.Name).To(Equal("Drill"))
+			Expect(i.Maintainer).To(BeEmpty())
+			Expect(i.Images).To(HaveLen(1))
+
+			hw = request(cont, "PUT", "/items/"+id, "2", map[string]interface{}{"Id": eid + 1, "Name": "Saw"})
+			Expect(hw.Code).To(Equal(http.StatusBadRequest))
+		})
+	})
+
+	Describe("Policies", func() {
+		It("should apply merge patches", func() {
+			merge("/policies/1", "0", map[string]interface{}{"Checkout": "approval"})
+			Expect(hw.Code).To(Equal(http.StatusOK))
+			p, _ := pol.GetPolicyByName("1")
+			Expect(p.Checkout).To(Equal("approval"))
+			Expect(p.Description).To(Equal("testdescr"))
+			log, _ := pol.GetPolicyLog("1")
+			Expect(log[len(log)-1].Policy).To(HaveKeyWithValue("checkout", "approval"))
+			Expect(log[len(log)-1].Policy).NotTo(HaveKey("description"))
+		})
+
+		It("should validate the result", func() {
+			merge("/policies/1", "0", map[string]interface{}{"Checkout": "sometimes"})
+			Expect(hw.Code).To(Equal(http.StatusBadRequest))
+			merge("/policies/1", "0", map[string]interface{}{"Name": "2"})
+			Expect(hw.Code).To(Equal(422))
+			merge("/policies/nope", "0", map[string]interface{}{"Description": "x"})
+			Expect(hw.Code).To(Equal(http.StatusNotFound))
+		})
+
+		It("should replace policies on their own path", func() {
+			hw = request(cont, "PUT", "/policies/1", "0", map[string]interface{}{"Description": "new"})
+			Expect(hw.Code).To(Equal(http.StatusOK))
+			p, _ := pol.GetPolicyByName("1")
+			Expect(p.Description).To(Equal("new"))
+		})
+	})
+
+	Describe("Users", func() {
+		It("should apply patches to the own user", func() {
+			patch("/users/4", "4", []map[string]interface{}{
+				{"op": "add", "path": "/MuteMail", "value": []string{db.MailEventItem}},
+				{"op": "add", "path": "/MuteMail/-", "value": db.MailEventPolicy},
+				{"op": "add", "path": "/Password", "value": "newpw"},
+			})
+			Expect(hw.Code).To(Equal(http.StatusOK))
+			u, _ := usr.GetUserByName("4")
+			Expect(u.MuteMail).To(Equal([]string{db.MailEventItem, db.MailEventPolicy}))
+			Expect(u.Secret.VerifyPassword("newpw")).To(BeTrue())
+			Expect(u.EMail).To(Equal("test4@example.com"))
+		})
+
+		It("should refuse role changes and other users", func() {
+			merge("/users/4", "4", map[string]interface{}{"Role": db.RoleAdmin})
+			Expect(hw.Code).To(Equal(422))
+			merge("/users/5", "4", map[string]interface{}{"EMail": "x@example.com"})
+			Expect(hw.Code).To(Equal(http.StatusForbidden))
+		})
+
+		It("should replace users on their own path", func() {
+			hw = request(cont, "PUT", "/users/4", "4", map[string]interface{}{"EMail": "new@example.com"})
+			Expect(hw.Code).To(Equal(http.StatusOK))
+			u, _ := usr.GetUserByName("4")
+			Expect(u.EMail).To(Equal("new@example.com"))
+			hw = request(cont, "PUT", "/users/4", "4", map[string]interface{}{"Name": "5"})
+			Expect(hw.Code).To(Equal(http.StatusBadRequest))
+		})
+	})
+})
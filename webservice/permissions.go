@@ -0,0 +1,107 @@
+/*
+ *    Copyright (C) 2015 Stefan Luecke
+ *
+ *    This program is free software: you can redistribute it and/or modify
+ *    it under the terms of the GNU Affero General Public License as published
+ *    by the Free Software Foundation, either version 3 of the License, or
+ *    (at your option) any later version.
+ *
+ *    This program is distributed in the hope that it will be useful,
+ *    but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *    GNU Affero General Public License for more details.
+ *
+ *    You should have received a copy of the GNU Affero General Public License
+ *    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ *    Authors: Stefan Luecke <glaxx@glaxx.net>
+ */
+
+package webservice
+
+import (
+	log "github.com/Sirupsen/logrus"
+	"github.com/emicklei/go-restful"
+	db "github.com/openlab-aux/lsmsd/database"
+	"net/http"
+)
+
+// A Permission is required by a route. Which permissions a user has, depends
+// on their role.
+type Permission string
+
+const (
+	PERM_ITEM_CREATE   Permission = "item.create"
+	PERM_ITEM_EDIT_OWN Permission = "item.edit.own" // edit items you own or maintain
+	PERM_ITEM_EDIT     Permission = "item.edit"
+	PERM_ITEM_DELETE   Permission = "item.delete"
+	PERM_ITEM_BORROW   Permission = "item.borrow" // checkout and reserve items
+	PERM_POLICY_EDIT   Permission = "policy.edit"
+	PERM_POLICY_DELETE Permission = "policy.delete"
+	PERM_USER_ADMIN    Permission = "user.admin"
+	PERM_AUDIT         Permission = "audit" // verify the item and policy logs
+)
+
+var memberPermissions = []Permission{PERM_ITEM_CREATE, PERM_ITEM_EDIT_OWN, PERM_ITEM_BORROW}
+var maintainerPermissions = append([]Permission{PERM_ITEM_EDIT, PERM_POLICY_EDIT}, memberPermissions...)
+var adminPermissions = append([]Permission{PERM_ITEM_DELETE, PERM_POLICY_DELETE, PERM_USER_ADMIN, PERM_AUDIT},
+	maintainerPermissions...)
+
+var rolePermissions = map[string][]Permission{
+	db.RoleGuest:      {},
+	db.RoleMember:     memberPermissions,
+	db.RoleMaintainer: maintainerPermissions,
+	db.RoleAdmin:      adminPermissions,
+}
+
+// HasPermission reports whether role grants p
+func HasPermission(role string, p Permission) bool {
+	for _, rp := range rolePermissions[role] {
+		if rp == p {
+			return true
+		}
+	}
+	return false
+}
+
+// Require returns a filter which only lets authenticated requests of users
+// holding p pass. It has to be used after Auth.
+func (s *BasicAuthService) Require(p Permission) restful.FilterFunction {
+	return func(request *restful.Request, response *restful.Response, chain *restful.FilterChain) {
+		if !hasPermission(request, p) {
+			log.WithFields(log.Fields{"User": request.Attribute("User"), "Permission": p}).Warn("Permission denied")
+			response.WriteErrorString(http.StatusForbidden, "Permission denied")
+			return
+		}
+		chain.ProcessFilter(request, response)
+	}
+}
+
+// hasPermission reports whether the authenticated user of request holds p
+func hasPermission(request *restful.Request, p Permission) bool {
+	role, _ := request.Attribute("Role").(string)
+	return HasPermission(role, p)
+}
+
+// mayManage reports whether the authenticated user of request may manage
+// itm, i.e. edit it and decide about its loans and reservations. This is true
+// for its owner and maintainer and for everyone allowed to edit all items.
+func mayManage(request *restful.Request, itm *db.Item) bool {
+	if hasPermission(request, PERM_ITEM_EDIT) {
+		return true
+	}
+	user, _ := request.Attribute("User").(string)
+	return user != "" && hasPermission(request, PERM_ITEM_EDIT_OWN) &&
+		(user == itm.Owner || user == itm.Maintainer)
+}
+
+// isSelfOrAdmin reports whether the request was made by user name or by
+// someone allowed to administrate users
+func isSelfOrAdmin(request *restful.Request, name string) bool {
+	user, _ := request.Attribute("User").(string)
+	return user == name || hasPermission(request, PERM_USER_ADMIN)
+}
+
+func returnsForbidden(b *restful.RouteBuilder) {
+	b.Returns(http.StatusForbidden, "Permission denied", nil)
+}
@@ -27,16 +27,18 @@ import (
 	//"strconv"
 	//"strings"
 	db "github.com/openlab-aux/lsmsd/database"
+	"gopkg.in/mgo.v2/bson"
+	"time"
 )
 
 type PolicyWebService struct {
-	d *db.PolicyDBProvider
+	d db.PolicyProvider
 	S *restful.WebService
 	a *BasicAuthService
 	u *UpdateService
 }
 
-func NewPolicyService(d *db.PolicyDBProvider, a *BasicAuthService, u *UpdateService) *PolicyWebService {
+func NewPolicyService(d db.PolicyProvider, a *BasicAuthService, u *UpdateService) *PolicyWebService {
 	res := new(PolicyWebService)
 	res.d = d
 	res.a = a
@@ -55,42 +57,75 @@ func NewPolicyService(d *db.PolicyDBProvider, a *BasicAuthService, u *UpdateServ
 		Doc("Returns a single policy identified by its name").
 		To(res.GetPolicyByName).
 		Writes(db.Policy{}).
-		Do(returnsInternalServerError, returnsNotFound, returnsBadRequest))
+		Do(returnsInternalServerError, returnsNotFound, returnsBadRequest, returnsNotModified, returnsAt))
 
 	service.Route(service.GET("/{name}/log").
 		Param(restful.PathParameter("name", "Policy Name")).
 		Doc("Returns the policys changelog").
 		To(res.GetPolicyLog).
 		Writes(db.PolicyHistory{}).
-		Do(returnsInternalServerError, returnsNotFound, returnsBadRequest))
+		Do(returnsInternalServerError, returnsNotFound, returnsBadRequest, returnsLogFormat))
+
+	service.Route(service.POST("/{name}/revert/{historyid}").
+		Filter(res.a.Auth).
+		Filter(res.a.Require(PERM_POLICY_EDIT)).
+		Param(restful.PathParameter("name", "Policy Name")).
+		Doc("Undo a change from the policys log. Reverting its deletion restores the policy").
+		To(res.RevertPolicy).
+		Do(returnsInternalServerError, returnsNotFound, returnsUpdateSuccessful, returnsBadRequest, returnsForbidden,
+			returnsPreconditionFailed, returnsRevertErrors))
 
 	service.Route(service.GET("").
-		Doc("List all available policys (this may be replaced by a paginated version)").
+		Doc("List policies, paginated and optionally sorted").
 		To(res.ListPolicy).
 		Writes([]db.Policy{}).
-		Do(returnsInternalServerError))
+		Do(returnsInternalServerError, returnsBadRequest, policyListSpec.params))
+
+	service.Route(service.PUT("/{name}").
+		Filter(res.a.Auth).
+		Filter(res.a.Require(PERM_POLICY_EDIT)).
+		Param(restful.PathParameter("name", "Policy Name")).
+		Doc("Replace a policy. The update fails if the policy was changed since the revision given in If-Match or the body").
+		To(res.UpdatePolicy).
+		Reads(db.Policy{}).
+		Do(returnsInternalServerError, returnsNotFound, returnsUpdateSuccessful, returnsBadRequest, returnsForbidden,
+			returnsPreconditionFailed))
+
+	service.Route(service.PATCH("/{name}").
+		Filter(res.a.Auth).
+		Filter(res.a.Require(PERM_POLICY_EDIT)).
+		Param(restful.PathParameter("name", "Policy Name")).
+		Doc("Change a policy with a JSON merge patch (RFC 7396) or a JSON patch (RFC 6902). Name and Revision are read-only").
+		To(res.PatchPolicy).
+		Do(returnsInternalServerError, returnsNotFound, returnsUpdateSuccessful, returnsBadRequest, returnsForbidden,
+			returnsPreconditionFailed, returnsPatchErrors))
 
 	service.Route(service.PUT("").
 		Filter(res.a.Auth).
-		Doc("Update a policy").
+		Filter(res.a.Require(PERM_POLICY_EDIT)).
+		Doc("Deprecated, use PUT /policies/{name}. Update the policy whose Name is given in the body").
 		To(res.UpdatePolicy).
 		Reads(db.Policy{}).
-		Do(returnsInternalServerError, returnsNotFound, returnsUpdateSuccessful, returnsBadRequest))
+		Do(returnsInternalServerError, returnsNotFound, returnsUpdateSuccessful, returnsBadRequest, returnsForbidden,
+			returnsPreconditionFailed))
 
 	service.Route(service.POST("").
 		Filter(res.a.Auth).
+		Filter(res.a.Require(PERM_POLICY_EDIT)).
 		Doc("Insert a policy").
 		To(res.CreatePolicy).
 		Reads(db.Policy{}).
 		Returns(http.StatusOK, "Insert successful", "/policies/{name").
-		Do(returnsInternalServerError, returnsBadRequest))
+		Do(returnsInternalServerError, returnsBadRequest, returnsForbidden))
 
 	service.Route(service.DELETE("/{name}").
 		Filter(res.a.Auth).
+		Filter(res.a.Require(PERM_POLICY_DELETE)).
 		Param(restful.PathParameter("name", "Policy Name")).
 		Doc("Delete a policy").
 		To(res.DeletePolicy).
-		Do(returnsInternalServerError, returnsNotFound, returnsDeleteSuccessful, returnsBadRequest))
+		Do(returnsInternalServerError, returnsNotFound, returnsDeleteSuccessful, returnsBadRequest, returnsForbidden,
+			returnsPreconditionFailed))
 	res.S = service
 	return res
 }
@@ -98,6 +133,16 @@ func NewPolicyService(d *db.PolicyDBProvider, a *BasicAuthService, u *UpdateServ
 func (p *PolicyWebService) GetPolicyByName(request *restful.Request, response *restful.Response) {
 	log.WithFields(log.Fields{"Path": request.SelectedRoutePath()}).Debug("Got Request")
 	name := request.PathParameter("name")
+	t, err := timeParameter(request, "at", time.Time{})
+	if err != nil {
+		response.WriteErrorString(http.StatusBadRequest, ERROR_INVALID_INPUT)
+		log.WithFields(log.Fields{"Error Msg": err}).Info(ERROR_INVALID_INPUT)
+		return
+	}
+	if !t.IsZero() {
+		p.getPolicyAt(response, name, t)
+		return
+	}
 	pol, err := p.d.GetPolicyByName(name)
 	if err != nil {
 		response.WriteErrorString(http.StatusNotFound, ERROR_INVALID_ID)
@@ -105,28 +150,133 @@ func (p *PolicyWebService) GetPolicyByName(request *restful.Request, response *r
 			Info(ERROR_INVALID_ID)
 		return
 	}
+	if notModified(request, response, pol.Revision) {
+		return
+	}
 	response.WriteEntity(pol)
 }
 
-func (p *PolicyWebService) GetPolicyLog(request *restful.Request, response *restful.Response) {
-	name := request.PathParameter("name")
+// getPolicyAt writes policy name as it was at t
+func (p *PolicyWebService) getPolicyAt(response *restful.Response, name string, t time.Time) {
+	history, cur, err := p.policyWithLog(name)
+	if err != nil {
+		writeHistoryError(response, err)
+		return
+	}
+	pol, err := db.PolicyAt(name, history, cur, t)
+	if err != nil {
+		writeHistoryError(response, err)
+		return
+	}
+	if pol == nil {
+		response.WriteErrorString(http.StatusNotFound, ERROR_INVALID_ID)
+		log.WithFields(log.Fields{"Name": name, "At": t}).Info(ERROR_INVALID_ID)
+		return
+	}
+	response.WriteEntity(pol)
+}
 
+// policyWithLog returns the log of policy name and the policy, which is nil
+// if it was deleted
+func (p *PolicyWebService) policyWithLog(name string) ([]db.PolicyHistory, *db.Policy, error) {
 	history, err := p.d.GetPolicyLog(name)
 	if err != nil {
-		response.WriteErrorString(http.StatusNotFound, ERROR_INVALID_ID)
-		log.Info(err)
+		return nil, nil, err
+	}
+	pol, err := p.d.GetPolicyByName(name)
+	if err == db.ErrNotFound {
+		if len(history) == 0 {
+			return nil, nil, err
+		}
+		return history, nil, nil
+	}
+	return history, &pol, err
+}
+
+func (p *PolicyWebService) RevertPolicy(request *restful.Request, response *restful.Response) {
+	name := request.PathParameter("name")
+	ref := request.PathParameter("historyid")
+	if !bson.IsObjectIdHex(ref) {
+		response.WriteErrorString(http.StatusBadRequest, ERROR_INVALID_ID)
+		log.WithFields(log.Fields{"History ID": ref}).Info(ERROR_INVALID_ID)
+		return
+	}
+	history, cur, err := p.policyWithLog(name)
+	if err != nil {
+		writeHistoryError(response, err)
+		return
+	}
+	if cur != nil && !checkIfMatch(request, response, cur.Revision) {
+		return
+	}
+	pol, err := db.RevertPolicy(name, history, cur, bson.ObjectIdHex(ref))
+	if err != nil {
+		writeHistoryError(response, err)
 		return
 	}
-	response.WriteEntity(history)
+	if cur == nil && !hasPermission(request, PERM_POLICY_DELETE) {
+		response.WriteErrorString(http.StatusForbidden, "Permission denied")
+		return
+	}
+
+	h := db.NewPolicyRevertHistory(cur, pol, bson.ObjectIdHex(ref), request.Attribute("User").(string))
+	if cur == nil {
+		err = p.d.RestorePolicy(pol, h)
+	} else {
+		err = p.d.UpdatePolicy(pol, h)
+	}
+	if err != nil {
+		writeHistoryError(response, err)
+		return
+	}
+	p.u.PushUpdate(h)
+	response.AddHeader("ETag", etag(pol.Revision))
+	response.WriteEntity(true)
+}
+
+func (p *PolicyWebService) GetPolicyLog(request *restful.Request, response *restful.Response) {
+	name := request.PathParameter("name")
+	format, ok := logFormat(request, response)
+	if !ok {
+		return
+	}
+	if format == logFormatRaw {
+		history, err := p.d.GetPolicyLog(name)
+		if err != nil {
+			response.WriteErrorString(http.StatusNotFound, ERROR_INVALID_ID)
+			log.Info(err)
+			return
+		}
+		response.WriteEntity(history)
+		return
+	}
+	history, cur, err := p.policyWithLog(name)
+	if err != nil {
+		writeHistoryError(response, err)
+		return
+	}
+	rendered, err := db.RenderPolicyLog(history, cur)
+	if err != nil {
+		writeHistoryError(response, err)
+		return
+	}
+	writeRenderedLog(response, format, "Policy "+name, rendered)
 }
 
 func (p *PolicyWebService) ListPolicy(request *restful.Request, response *restful.Response) {
-	pol, err := p.d.ListPolicy()
+	q, err := policyListSpec.parse(request)
+	if err != nil {
+		response.WriteErrorString(http.StatusBadRequest, ERROR_INVALID_INPUT)
+		log.WithFields(log.Fields{"Error Msg": err}).Info(ERROR_INVALID_INPUT)
+		return
+	}
+	pol, total, err := p.d.ListPolicy(q)
 	if err != nil {
 		response.WriteErrorString(http.StatusInternalServerError, ERROR_INTERNAL)
 		log.WithFields(log.Fields{"Error Msg": err}).Warn(ERROR_INTERNAL)
 		return
 	}
+	writePageHeaders(request, response, q, total)
 	response.WriteEntity(pol)
 }
 
@@ -138,21 +288,78 @@ func (p *PolicyWebService) UpdatePolicy(request *restful.Request, response *rest
 		log.WithFields(log.Fields{"Error Msg": err}).Warn(ERROR_INVALID_ID)
 		return
 	}
+	if name := request.PathParameter("name"); name != "" {
+		if pol.Name != "" && pol.Name != name {
+			response.WriteErrorString(http.StatusBadRequest, ERROR_INVALID_ID)
+			log.WithFields(log.Fields{"Path": name, "Body": pol.Name}).Info(ERROR_INVALID_ID)
+			return
+		}
+		pol.Name = name
+	}
 	po, err := p.d.GetPolicyByName(pol.Name)
 	if err != nil {
 		response.WriteErrorString(http.StatusInternalServerError, ERROR_INTERNAL)
 		log.Warn(err)
 		return
 	}
+	if !checkIfMatch(request, response, po.Revision) {
+		return
+	}
+	pol.Revision = baseRevision(request, pol.Revision, po.Revision)
+	if pol.Revision != po.Revision {
+		response.WriteErrorString(http.StatusPreconditionFailed, ERROR_PRECONDITION)
+		return
+	}
+	p.savePolicy(request, response, &po, pol)
+}
+
+func (p *PolicyWebService) PatchPolicy(request *restful.Request, response *restful.Response) {
+	po, err := p.d.GetPolicyByName(request.PathParameter("name"))
+	if err != nil {
+		if err == db.ErrNotFound {
+			response.WriteErrorString(http.StatusNotFound, ERROR_INVALID_ID)
+			return
+		}
+		response.WriteErrorString(http.StatusInternalServerError, ERROR_INTERNAL)
+		log.WithFields(log.Fields{"Error Msg": err}).Warn(ERROR_INTERNAL)
+		return
+	}
+	if !checkIfMatch(request, response, po.Revision) {
+		return
+	}
+	pol := new(db.Policy)
+	err = patchEntity(request, &po, pol)
+	if err == nil && (pol.Name != po.Name || pol.Revision != po.Revision) {
+		err = errPatchReadOnly
+	}
+	if err != nil {
+		writePatchError(response, err)
+		return
+	}
+	p.savePolicy(request, response, &po, pol)
+}
+
+// savePolicy stores pol as the new version of po
+func (p *PolicyWebService) savePolicy(request *restful.Request, response *restful.Response, po, pol *db.Policy) {
+	if !pol.ValidCheckoutRule() {
+		response.WriteErrorString(http.StatusBadRequest, ERROR_INVALID_INPUT)
+		log.WithFields(log.Fields{"Checkout": pol.Checkout}).Info(ERROR_INVALID_INPUT)
+		return
+	}
 	h := po.NewPolicyHistory(pol, request.Attribute("User").(string))
 
-	err = p.d.UpdatePolicy(pol, h)
+	err := p.d.UpdatePolicy(pol, h)
 	if err != nil {
+		if err == db.ErrRevisionConflict {
+			response.WriteErrorString(http.StatusPreconditionFailed, ERROR_PRECONDITION)
+			return
+		}
 		response.WriteErrorString(http.StatusInternalServerError, ERROR_INTERNAL)
 		log.Warn(err)
 		return
 	}
 	p.u.PushUpdate(h)
+	response.AddHeader("ETag", etag(pol.Revision))
 	response.WriteEntity(true)
 }
 
@@ -164,6 +371,11 @@ func (p *PolicyWebService) CreatePolicy(request *restful.Request, response *rest
 		log.WithFields(log.Fields{"Error Msg": err}).Info(ERROR_INVALID_INPUT)
 		return
 	}
+	if !pol.ValidCheckoutRule() {
+		response.WriteErrorString(http.StatusBadRequest, ERROR_INVALID_INPUT)
+		log.WithFields(log.Fields{"Checkout": pol.Checkout}).Info(ERROR_INVALID_INPUT)
+		return
+	}
 
 	ex := p.d.CheckPolicyExistance(pol)
 
@@ -172,12 +384,13 @@ func (p *PolicyWebService) CreatePolicy(request *restful.Request, response *rest
 		return
 	}
 
-	err = p.d.CreatePolicy(pol)
+	err = p.d.CreatePolicy(pol, request.Attribute("User").(string))
 	if err != nil {
 		response.WriteErrorString(http.StatusInternalServerError, ERROR_INTERNAL)
 		log.WithFields(log.Fields{"Error Msg": err}).Warn(ERROR_INTERNAL)
 		return
 	}
+	p.u.PushUpdate(pol.NewCreatedHistory(request.Attribute("User").(string)))
 
 	response.WriteEntity("/policies/" + pol.Name)
 }
@@ -196,9 +409,17 @@ func (p *PolicyWebService) DeletePolicy(request *restful.Request, response *rest
 		return
 	}
 
+	if !checkIfMatch(request, response, po.Revision) {
+		return
+	}
+
 	h := po.NewPolicyHistory(nil, request.Attribute("User").(string))
 	err = p.d.DeletePolicy(&po, h)
 	if err != nil {
+		if err == db.ErrRevisionConflict {
+			response.WriteErrorString(http.StatusPreconditionFailed, ERROR_PRECONDITION)
+			return
+		}
 		log.WithFields(log.Fields{"Error Msg": err}).Info(ERROR_INTERNAL)
 		response.WriteErrorString(http.StatusInternalServerError, ERROR_INTERNAL)
 		return
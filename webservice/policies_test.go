@@ -36,9 +36,9 @@ var _ = Describe("Policies", func() {
 	var (
 		session *mgo.Session
 		cont    *restful.Container
-		itm     *db.ItemDBProvider
-		pol     *db.PolicyDBProvider
-		usr     *db.UserDBProvider
+		itm     db.ItemProvider
+		pol     db.PolicyProvider
+		usr     db.UserProvider
 		hw      *httptest.ResponseRecorder
 	)
 
@@ -0,0 +1,201 @@
+/*
+ *    Copyright (C) 2015 Stefan Luecke
+ *
+ *    This program is free software: you can redistribute it and/or modify
+ *    it under the terms of the GNU Affero General Public License as published
+ *    by the Free Software Foundation, either version 3 of the License, or
+ *    (at your option) any later version.
+ *
+ *    This program is distributed in the hope that it will be useful,
+ *    but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *    GNU Affero General Public License for more details.
+ *
+ *    You should have received a copy of the GNU Affero General Public License
+ *    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ *    Authors: Stefan Luecke <glaxx@glaxx.net>
+ */
+
+package webservice
+
+import (
+	"errors"
+	"github.com/emicklei/go-restful"
+	db "github.com/openlab-aux/lsmsd/database"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	defaultPageLimit = 50
+	maxPageLimit     = 500
+)
+
+// listSpec describes the query parameters a listing route understands. Sort
+// maps the accepted values of the sort parameter and Filter the accepted
+// filter parameters onto database field names. Filters listed in Numeric are
+// parsed as unsigned integers.
+type listSpec struct {
+	Sort    map[string]string
+	Filter  map[string]string
+	Numeric map[string]bool
+}
+
+var itemListSpec = &listSpec{
+	Sort: map[string]string{"name": "name", "id": "eid"},
+	Filter: map[string]string{
+		"owner":      "owner",
+		"maintainer": "maintainer",
+		"usage":      "usage",
+		"discard":    "discard",
+		"parent":     "parent",
+	},
+	Numeric: map[string]bool{"parent": true},
+}
+
+var policyListSpec = &listSpec{
+	Sort: map[string]string{"name": "name"},
+}
+
+var userListSpec = &listSpec{
+	Sort: map[string]string{"name": "name"},
+}
+
+// params documents the query parameters of a listing route
+func (l *listSpec) params(b *restful.RouteBuilder) {
+	pageParams(b)
+	b.Param(restful.QueryParameter("sort", "Comma separated list of sort keys ("+
+		strings.Join(sortedKeys(l.Sort), ", ")+"), prefix a key with - to sort descending"))
+	for _, f := range sortedKeys(l.Filter) {
+		p := restful.QueryParameter(f, "Only list entries with this "+f)
+		if l.Numeric[f] {
+			p.DataType("integer")
+		}
+		b.Param(p)
+	}
+}
+
+// pageParams documents the pagination parameters of a route
+func pageParams(b *restful.RouteBuilder) {
+	b.Param(restful.QueryParameter("offset", "Number of entries to skip").DataType("integer"))
+	b.Param(restful.QueryParameter("limit", "Maximum number of entries to return (all entries "+
+		"if neither offset nor limit is given, otherwise default "+strconv.Itoa(defaultPageLimit)+
+		", max "+strconv.Itoa(maxPageLimit)+")").DataType("integer"))
+	b.Returns(http.StatusOK, "The total number of entries is sent in the X-Total-Count header, "+
+		"links to the neighbouring pages in the Link header", nil)
+}
+
+// parse builds a database query out of the query parameters of rq. Listings
+// stay complete unless a page is requested, as they were before pagination.
+func (l *listSpec) parse(rq *restful.Request) (*db.Query, error) {
+	q, err := parsePage(rq)
+	if err != nil {
+		return nil, err
+	}
+	if rq.QueryParameter("offset") == "" && rq.QueryParameter("limit") == "" {
+		q.Limit = 0
+	}
+	q.Filter = make(map[string]interface{})
+
+	if s := rq.QueryParameter("sort"); s != "" {
+		for _, k := range strings.Split(s, ",") {
+			prefix := ""
+			if strings.HasPrefix(k, "-") {
+				prefix = "-"
+				k = k[1:]
+			}
+			f, ok := l.Sort[k]
+			if !ok {
+				return nil, errors.New("Invalid sort key: " + k)
+			}
+			q.Sort = append(q.Sort, prefix+f)
+		}
+	}
+	for p, f := range l.Filter {
+		s := rq.QueryParameter(p)
+		if s == "" {
+			continue
+		}
+		if l.Numeric[p] {
+			v, err := strconv.ParseUint(s, 10, 64)
+			if err != nil {
+				return nil, errors.New("Invalid value for " + p + ": " + s)
+			}
+			q.Filter[f] = v
+		} else {
+			q.Filter[f] = s
+		}
+	}
+	return q, nil
+}
+
+// parsePage reads the offset and limit query parameters of rq
+func parsePage(rq *restful.Request) (*db.Query, error) {
+	q := new(db.Query)
+	q.Limit = defaultPageLimit
+
+	if s := rq.QueryParameter("offset"); s != "" {
+		o, err := strconv.Atoi(s)
+		if err != nil || o < 0 {
+			return nil, errors.New("Invalid offset: " + s)
+		}
+		q.Offset = o
+	}
+	if s := rq.QueryParameter("limit"); s != "" {
+		li, err := strconv.Atoi(s)
+		if err != nil || li < 1 || li > maxPageLimit {
+			return nil, errors.New("Invalid limit: " + s)
+		}
+		q.Limit = li
+	}
+	return q, nil
+}
+
+// writePageHeaders adds the X-Total-Count and Link (RFC 5988) headers for a
+// page of a listing to the response. Unpaged listings only get X-Total-Count.
+func writePageHeaders(rq *restful.Request, rs *restful.Response, q *db.Query, total int) {
+	rs.AddHeader("X-Total-Count", strconv.Itoa(total))
+	if q.Limit == 0 {
+		return
+	}
+
+	links := make([]string, 0, 4)
+	link := func(rel string, offset int) {
+		u := *rq.Request.URL
+		v := u.Query()
+		v.Set("offset", strconv.Itoa(offset))
+		v.Set("limit", strconv.Itoa(q.Limit))
+		u.RawQuery = v.Encode()
+		links = append(links, "<"+u.RequestURI()+">; rel=\""+rel+"\"")
+	}
+
+	link("first", 0)
+	if q.Offset > 0 {
+		prev := q.Offset - q.Limit
+		if prev < 0 {
+			prev = 0
+		}
+		link("prev", prev)
+	}
+	if q.Offset+q.Limit < total {
+		link("next", q.Offset+q.Limit)
+	}
+	last := 0
+	if total > 0 {
+		last = (total - 1) / q.Limit * q.Limit
+	}
+	link("last", last)
+	rs.AddHeader("Link", strings.Join(links, ", "))
+}
+
+func sortedKeys(m map[string]string) []string {
+	res := make([]string, 0, len(m))
+	for k := range m {
+		res = append(res, k)
+	}
+	sort.Strings(res)
+	return res
+}
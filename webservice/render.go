@@ -0,0 +1,142 @@
+/*
+ *    Copyright (C) 2015 Stefan Luecke
+ *
+ *    This program is free software: you can redistribute it and/or modify
+ *    it under the terms of the GNU Affero General Public License as published
+ *    by the Free Software Foundation, either version 3 of the License, or
+ *    (at your option) any later version.
+ *
+ *    This program is distributed in the hope that it will be useful,
+ *    but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *    GNU Affero General Public License for more details.
+ *
+ *    You should have received a copy of the GNU Affero General Public License
+ *    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ *    Authors: Stefan Luecke <glaxx@glaxx.net>
+ */
+
+package webservice
+
+import (
+	"bytes"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/emicklei/go-restful"
+	db "github.com/openlab-aux/lsmsd/database"
+	"gopkg.in/mgo.v2/bson"
+	"html/template"
+	"net/http"
+	"strings"
+)
+
+const MIME_HTML = "text/html"
+
+// Formats of the item and policy logs
+const (
+	logFormatRaw      = "raw"
+	logFormatRendered = "rendered"
+	logFormatHTML     = "html"
+)
+
+var renderedLogTemplate = template.Must(template.New("log").Funcs(template.FuncMap{
+	"value":     renderValue,
+	"diffLines": renderDiffLines,
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+<style>
+body { font-family: sans-serif; }
+th { text-align: left; vertical-align: top; padding-right: 1em; }
+pre { margin: 0; }
+.del { background: #fdd; }
+.ins { background: #dfd; }
+.hunk { color: #888; }
+</style>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+{{range .Log}}<h2>{{.Timestamp.UTC.Format "2006-01-02 15:04:05 UTC"}} by {{.User}}{{with .Event}} ({{.}}){{end}}</h2>
+{{with .Revert}}<p>Reverts {{.}}</p>
+{{end}}<table>
+{{range .Changes}}<tr><th>{{.Field}}</th><td>{{if .Diff}}<pre>{{range diffLines .Diff}}<span class="{{.Class}}">{{.Text}}</span>
+{{end}}</pre>{{else}}{{with .Before}}<span class="del">{{value .}}</span> {{end}}{{with .After}}<span class="ins">{{value .}}</span>{{end}}{{range .Removed}}<span class="del">{{.Hex}}</span> {{end}}{{range .Added}}<span class="ins">{{.Hex}}</span> {{end}}{{end}}</td></tr>
+{{end}}</table>
+{{end}}</body>
+</html>
+`))
+
+// renderedDiffLine is a line of a unified diff with its CSS class
+type renderedDiffLine struct {
+	Class string
+	Text  string
+}
+
+func renderDiffLines(diff string) []renderedDiffLine {
+	res := make([]renderedDiffLine, 0)
+	for _, l := range strings.Split(strings.TrimSuffix(diff, "\n"), "\n") {
+		c := ""
+		switch {
+		case strings.HasPrefix(l, "@@"), strings.HasPrefix(l, "\\"):
+			c = "hunk"
+		case strings.HasPrefix(l, "-"):
+			c = "del"
+		case strings.HasPrefix(l, "+"):
+			c = "ins"
+		}
+		res = append(res, renderedDiffLine{c, l})
+	}
+	return res
+}
+
+func renderValue(v interface{}) string {
+	if id, ok := v.(bson.ObjectId); ok {
+		return id.Hex()
+	}
+	return fmt.Sprint(v)
+}
+
+func returnsLogFormat(b *restful.RouteBuilder) {
+	b.Param(restful.QueryParameter("format", "raw (default) returns the stored entries, rendered returns readable "+
+		"values and text diffs and html returns the rendered log as web page"))
+	b.Produces(restful.MIME_JSON, MIME_HTML)
+}
+
+// logFormat returns the log format requested, an unknown format is
+// reported to the client
+func logFormat(request *restful.Request, response *restful.Response) (string, bool) {
+	f := request.QueryParameter("format")
+	switch f {
+	case "", logFormatRaw:
+		return logFormatRaw, true
+	case logFormatRendered, logFormatHTML:
+		return f, true
+	}
+	response.WriteErrorString(http.StatusBadRequest, ERROR_INVALID_INPUT)
+	log.WithFields(log.Fields{"Format": f}).Info(ERROR_INVALID_INPUT)
+	return "", false
+}
+
+// writeRenderedLog writes l as JSON or, in html format, as web page called
+// title
+func writeRenderedLog(response *restful.Response, format, title string, l []db.RenderedHistory) {
+	if format != logFormatHTML {
+		response.WriteEntity(l)
+		return
+	}
+	buf := new(bytes.Buffer)
+	err := renderedLogTemplate.Execute(buf, struct {
+		Title string
+		Log   []db.RenderedHistory
+	}{title, l})
+	if err != nil {
+		response.WriteErrorString(http.StatusInternalServerError, ERROR_INTERNAL)
+		log.WithFields(log.Fields{"Error Msg": err}).Warn(ERROR_INTERNAL)
+		return
+	}
+	response.AddHeader("Content-Type", MIME_HTML+"; charset=utf-8")
+	response.Write(buf.Bytes())
+}
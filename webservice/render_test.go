@@ -0,0 +1,203 @@
+/*
+ *    Copyright (C) 2015 Stefan Luecke
+ *
+ *    This program is free software: you can redistribute it and/or modify
+ *    it under the terms of the GNU Affero General Public License as published
+ *    by the Free Software Foundation, either version 3 of the License, or
+ *    (at your option) any later version.
+ *
+ *    This program is distributed in the hope that it will be useful,
+ *    but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *    GNU Affero General Public License for more details.
+ *
+ *    You should have received a copy of the GNU Affero General Public License
+ *    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ *    Authors: Stefan Luecke <glaxx@glaxx.net>
+ */
+
+package webservice_test
+
+import (
+	"encoding/json"
+	"github.com/emicklei/go-restful"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	db "github.com/openlab-aux/lsmsd/database"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+)
+
+var _ = Describe("Rendered history", func() {
+	var (
+		session *mgo.Session
+		cont    *restful.Container
+		itm     db.ItemProvider
+		pol     db.PolicyProvider
+		usr     db.UserProvider
+		hw      *httptest.ResponseRecorder
+		eid     uint64
+		id      string
+		img     bson.ObjectId
+	)
+
+	update := func(user string, change func(i *db.Item)) {
+		i, err := itm.GetItemById(eid)
+		Expect(err).NotTo(HaveOccurred())
+		n := i
+		change(&n)
+		Expect(itm.UpdateItem(&n, i.NewItemHistory(&n, user))).To(Succeed())
+	}
+	rendered := func(path string) []db.RenderedHistory {
+		hw = request(cont, "GET", path+"?format=rendered", "", nil)
+		Expect(hw.Code).To(Equal(http.StatusOK))
+		res := make([]db.RenderedHistory, 0)
+		Expect(json.Unmarshal(hw.Body.Bytes(), &res)).To(Succeed())
+		return res
+	}
+
+	BeforeEach(func() {
+		session, cont, itm, pol, usr = newTestContainer()
+		populateUserDB(usr)
+		populatePolicyDB(pol)
+		var err error
+		eid, err = itm.CreateItem(&db.Item{Name: "Band saw", Description: "for wood\nblade 1/2\"\nguard missing\n", Owner: "2"}, "2")
+		Expect(err).NotTo(HaveOccurred())
+		id = strconv.FormatUint(eid, 10)
+		update("3", func(i *db.Item) {
+			i.Name = "<b>Table saw</b>"
+			i.Description = "for wood\nblade 1/2\"\nguard fitted\n"
+		})
+		img = bson.NewObjectId()
+		_, err = itm.AddImage(eid, img, "2")
+		Expect(err).NotTo(HaveOccurred())
+		update("2", func(i *db.Item) { i.Maintainer = "3" })
+	})
+
+	AfterEach(func() {
+		flushDB(session, itm)
+	})
+
+	Describe("Item logs", func() {
+		It("should show readable values and diffs", func() {
+			l := rendered("/items/" + id + "/log")
+			Expect(l).To(HaveLen(4))
+			for _, e := range l {
+				Expect(e.Timestamp.IsZero()).To(BeFalse())
+				Expect(e.ID.Valid()).To(BeTrue())
+			}
+
+			Expect(l[0].Event).To(Equal("created"))
+			Expect(l[0].User).To(Equal("2"))
+			Expect(l[0].Changes).To(ContainElement(db.FieldChange{Field: "Owner", After: "2"}))
+
+			Expect(l[1].Event).To(BeEmpty())
+			Expect(l[1].User).To(Equal("3"))
+			Expect(l[1].Changes).To(HaveLen(2))
+			Expect(l[1].Changes[0].Field).To(Equal("Description"))
+			Expect(l[1].Changes[0].Before).To(Equal("for wood\nblade 1/2\"\nguard missing\n"))
+			Expect(l[1].Changes[0].Diff).To(Equal("@@ -1,3 +1,3 @@\n for wood\n blade 1/2\"\n-guard missing\n+guard fitted\n"))
+			Expect(l[1].Changes[1]).To(Equal(db.FieldChange{Field: "Name", Before: "Band saw", After: "<b>Table saw</b>"}))
+
+			Expect(l[2].Changes).To(Equal([]db.FieldChange{{Field: "Images", Added: []bson.ObjectId{img}}}))
+			Expect(l[3].Changes).To(Equal([]db.FieldChange{{Field: "Maintainer", After: "3"}}))
+		})
+
+		It("should show the deleted values", func() {
+			hw = request(cont, "DELETE", "/items/"+id, "0", nil)
+			Expect(hw.Code).To(Equal(http.StatusOK))
+			l := rendered("/items/" + id + "/log")
+			Expect(l).To(HaveLen(5))
+			Expect(l[4].Event).To(Equal("deleted"))
+			Expect(l[4].Changes).To(ContainElement(db.FieldChange{Field: "Name", Before: "<b>Table saw</b>"}))
+			Expect(l[4].Changes).To(ContainElement(db.FieldChange{Field: "Images", Removed: []bson.ObjectId{img}}))
+		})
+
+		It("should render a web page", func() {
+			hw = request(cont, "GET", "/items/"+id+"/log?format=html", "", nil)
+			Expect(hw.Code).To(Equal(http.StatusOK))
+			Expect(hw.Header().Get("Content-Type")).To(HavePrefix("text/html"))
+			body := hw.Body.String()
+			Expect(body).To(ContainSubstring("&lt;b&gt;Table saw&lt;/b&gt;"))
+			Expect(body).NotTo(ContainSubstring("<b>"))
+			Expect(body).To(ContainSubstring(`<span class="ins">&#43;guard fitted</span>`))
+			Expect(body).To(ContainSubstring(img.Hex()))
+		})
+
+		It("should keep the stored entries by default", func() {
+			hw = request(cont, "GET", "/items/"+id+"/log", "", nil)
+			Expect(hw.Code).To(Equal(http.StatusOK))
+			l := make([]db.ItemHistory, 0)
+			Expect(json.Unmarshal(hw.Body.Bytes(), &l)).To(Succeed())
+			Expect(l).To(HaveLen(4))
+			Expect(l[1].Item).To(HaveKey("description"))
+		})
+
+		It("should reject unknown formats and items", func() {
+			hw = request(cont, "GET", "/items/"+id+"/log?format=pdf", "", nil)
+			Expect(hw.Code).To(Equal(http.StatusBadRequest))
+			hw = request(cont, "GET", "/items/4711/log?format=rendered", "", nil)
+			Expect(hw.Code).To(Equal(http.StatusNotFound))
+		})
+	})
+
+	Describe("Policy logs", func() {
+		It("should show readable values", func() {
+			p, err := pol.GetPolicyByName("1")
+			Expect(err).NotTo(HaveOccurred())
+			n := p
+			n.Checkout = "approval"
+			Expect(pol.UpdatePolicy(&n, p.NewPolicyHistory(&n, "0"))).To(Succeed())
+
+			l := rendered("/policies/1/log")
+			Expect(l).To(HaveLen(2))
+			Expect(l[0].Event).To(Equal("created"))
+			Expect(l[1].Changes).To(Equal([]db.FieldChange{{Field: "Checkout", After: "approval"}}))
+		})
+	})
+
+	Describe("Blame", func() {
+		It("should tell who changed each field last", func() {
+			hw = request(cont, "GET", "/items/"+id+"/blame", "", nil)
+			Expect(hw.Code).To(Equal(http.StatusOK))
+			blame := make([]db.FieldBlame, 0)
+			Expect(json.Unmarshal(hw.Body.Bytes(), &blame)).To(Succeed())
+			l, err := itm.GetItemLog(eid)
+			Expect(err).NotTo(HaveOccurred())
+
+			by := make(map[string]db.FieldBlame)
+			for _, b := range blame {
+				by[b.Field] = b
+			}
+			Expect(by["Name"].User).To(Equal("3"))
+			Expect(by["Name"].Value).To(Equal("<b>Table saw</b>"))
+			Expect(by["Name"].ID).To(Equal(l[1].ID))
+			Expect(by["Owner"].User).To(Equal("2"))
+			Expect(by["Owner"].ID).To(Equal(l[0].ID))
+			Expect(by["Images"].ID).To(Equal(l[2].ID))
+			Expect(by["Maintainer"].ID).To(Equal(l[3].ID))
+			Expect(by["Maintainer"].Timestamp.IsZero()).To(BeFalse())
+			Expect(by["Borrower"].ID).To(Equal(l[0].ID))
+		})
+
+		It("should not blame unknown items", func() {
+			hw = request(cont, "GET", "/items/4711/blame", "", nil)
+			Expect(hw.Code).To(Equal(http.StatusNotFound))
+		})
+	})
+
+	Describe("User logs", func() {
+		It("should have timestamps", func() {
+			hw = request(cont, "GET", "/users/3/log", "", nil)
+			Expect(hw.Code).To(Equal(http.StatusOK))
+			l := db.UserActionHistory{}
+			Expect(json.Unmarshal(hw.Body.Bytes(), &l)).To(Succeed())
+			Expect(l.ItemChanges).To(HaveLen(1))
+			Expect(l.ItemChanges[0].Timestamp.IsZero()).To(BeFalse())
+		})
+	})
+})
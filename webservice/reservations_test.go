@@ -0,0 +1,146 @@
+/*
+ *    Copyright (C) 2015 Stefan Luecke
+ *
+ *    This program is free software: you can redistribute it and/or modify
+ *    it under the terms of the GNU Affero General Public License as published
+ *    by the Free Software Foundation, either version 3 of the License, or
+ *    (at your option) any later version.
+ *
+ *    This program is distributed in the hope that it will be useful,
+ *    but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *    GNU Affero General Public License for more details.
+ *
+ *    You should have received a copy of the GNU Affero General Public License
+ *    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ *    Authors: Stefan Luecke <glaxx@glaxx.net>
+ */
+
+package webservice_test
+
+import (
+	"encoding/json"
+	"github.com/emicklei/go-restful"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	db "github.com/openlab-aux/lsmsd/database"
+	"gopkg.in/mgo.v2"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"time"
+)
+
+var _ = Describe("Reservations", func() {
+	var (
+		session *mgo.Session
+		cont    *restful.Container
+		itm     db.ItemProvider
+		usr     db.UserProvider
+		hw      *httptest.ResponseRecorder
+		path    string
+		start   time.Time
+	)
+
+	BeforeEach(func() {
+		session, cont, itm, _, usr = newTestContainer()
+		populateUserDB(usr)
+		eid, err := itm.CreateItem(&db.Item{Name: "Laser cutter", Owner: "2"}, "0")
+		Expect(err).NotTo(HaveOccurred())
+		path = "/items/" + strconv.FormatUint(eid, 10) + "/reservations"
+		start = time.Now().Add(24 * time.Hour).Truncate(time.Hour)
+	})
+
+	AfterEach(func() {
+		flushDB(session, itm)
+	})
+
+	Describe("Reserve an item", func() {
+		It("should require authentication", func() {
+			hw = request(cont, "POST", path, "", db.Reservation{Start: start, End: start.Add(time.Hour)})
+			Expect(hw.Code).To(Equal(http.StatusUnauthorized))
+		})
+
+		It("should reject reservations ending before they start", func() {
+			hw = request(cont, "POST", path, "1", db.Reservation{Start: start, End: start.Add(-time.Hour)})
+			Expect(hw.Code).To(Equal(http.StatusBadRequest))
+		})
+
+		It("should accept only one of concurrent overlapping reservations", func() {
+			codes := make(chan int)
+			for i := 0; i != 8; i++ {
+				go func() {
+					defer GinkgoRecover()
+					codes <- request(cont, "POST", path, "1", db.Reservation{Start: start, End: start.Add(time.Hour)}).Code
+				}()
+			}
+			accepted := 0
+			for i := 0; i != 8; i++ {
+				code := <-codes
+				Expect(code).To(Or(Equal(http.StatusOK), Equal(http.StatusConflict)))
+				if code == http.StatusOK {
+					accepted++
+				}
+			}
+			Expect(accepted).To(Equal(1))
+		})
+
+		Context("with an existing reservation", func() {
+			BeforeEach(func() {
+				hw = request(cont, "POST", path, "1", db.Reservation{Start: start, End: start.Add(2 * time.Hour)})
+				Expect(hw.Code).To(Equal(http.StatusOK))
+			})
+
+			It("should detect overlapping reservations", func() {
+				hw = request(cont, "POST", path, "3", db.Reservation{Start: start.Add(time.Hour), End: start.Add(3 * time.Hour)})
+				Expect(hw.Code).To(Equal(http.StatusConflict))
+			})
+
+			It("should accept adjacent reservations", func() {
+				hw = request(cont, "POST", path, "3", db.Reservation{Start: start.Add(2 * time.Hour), End: start.Add(3 * time.Hour)})
+				Expect(hw.Code).To(Equal(http.StatusOK))
+			})
+
+			It("should list the reservation", func() {
+				hw = request(cont, "GET", path, "", nil)
+				Expect(hw.Code).To(Equal(http.StatusOK))
+				var res []db.Reservation
+				Expect(json.Unmarshal(hw.Body.Bytes(), &res)).To(Succeed())
+				Expect(res).To(HaveLen(1))
+				Expect(res[0].User).To(Equal("1"))
+			})
+
+			It("should export the reservation as iCalendar", func() {
+				hw = request(cont, "GET", path+".ics", "", nil)
+				Expect(hw.Code).To(Equal(http.StatusOK))
+				Expect(hw.Header().Get("Content-Type")).To(HavePrefix("text/calendar"))
+				Expect(hw.Body.String()).To(ContainSubstring("BEGIN:VEVENT\r\n"))
+				Expect(hw.Body.String()).To(ContainSubstring("SUMMARY:Laser cutter (1)\r\n"))
+				Expect(hw.Body.String()).To(ContainSubstring("DTSTART:" + start.UTC().Format("20060102T150405Z")))
+			})
+		})
+	})
+
+	Describe("Cancel a reservation", func() {
+		var rpath string
+
+		BeforeEach(func() {
+			hw = request(cont, "POST", path, "1", db.Reservation{Start: start, End: start.Add(time.Hour)})
+			Expect(json.Unmarshal(hw.Body.Bytes(), &rpath)).To(Succeed())
+		})
+
+		It("should not be allowed for other users", func() {
+			hw = request(cont, "DELETE", rpath, "3", nil)
+			Expect(hw.Code).To(Equal(http.StatusForbidden))
+		})
+
+		It("should be allowed for the owner of the item", func() {
+			hw = request(cont, "DELETE", rpath, "2", nil)
+			Expect(hw.Code).To(Equal(http.StatusOK))
+
+			hw = request(cont, "GET", rpath, "", nil)
+			Expect(hw.Code).To(Equal(http.StatusNotFound))
+		})
+	})
+})
@@ -0,0 +1,121 @@
+/*
+ *    Copyright (C) 2015 Stefan Luecke
+ *
+ *    This program is free software: you can redistribute it and/or modify
+ *    it under the terms of the GNU Affero General Public License as published
+ *    by the Free Software Foundation, either version 3 of the License, or
+ *    (at your option) any later version.
+ *
+ *    This program is distributed in the hope that it will be useful,
+ *    but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *    GNU Affero General Public License for more details.
+ *
+ *    You should have received a copy of the GNU Affero General Public License
+ *    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ *    Authors: Stefan Luecke <glaxx@glaxx.net>
+ */
+
+package webservice
+
+import (
+	log "github.com/Sirupsen/logrus"
+	"github.com/emicklei/go-restful"
+	db "github.com/openlab-aux/lsmsd/database"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+type searchFunc func(term string, limit int) ([]db.SearchResult, int, error)
+
+type SearchWebService struct {
+	search map[string]searchFunc
+	S      *restful.WebService
+}
+
+func NewSearchService(i db.ItemProvider, p db.PolicyProvider, u db.UserProvider) *SearchWebService {
+	res := new(SearchWebService)
+	res.search = map[string]searchFunc{
+		db.SearchTypeItem:   i.Search,
+		db.SearchTypePolicy: p.Search,
+		db.SearchTypeUser:   u.Search,
+	}
+
+	service := new(restful.WebService)
+	service.
+		Path("/search").
+		Doc("Full text search").
+		ApiVersion("0.1").
+		Consumes(restful.MIME_JSON).
+		Produces(restful.MIME_JSON)
+
+	service.Route(service.GET("").
+		Param(restful.QueryParameter("q", "Words to search for. Prefix a word with - to exclude it, "+
+			"enclose a phrase in quotes to search for it as a whole").Required(true)).
+		Param(restful.QueryParameter("type", "Comma separated list of result types to include "+
+			"(item, policy, user), defaults to all")).
+		Doc("Search items, policies and users. Results are ranked by relevance").
+		To(res.Search).
+		Writes([]db.SearchResult{}).
+		Do(returnsInternalServerError, returnsBadRequest, pageParams))
+
+	res.S = service
+	return res
+}
+
+func (s *SearchWebService) Search(request *restful.Request, response *restful.Response) {
+	term := request.QueryParameter("q")
+	q, err := parsePage(request)
+	if err != nil || strings.TrimSpace(term) == "" {
+		response.WriteErrorString(http.StatusBadRequest, ERROR_INVALID_INPUT)
+		log.WithFields(log.Fields{"Error Msg": err, "Term": term}).Info(ERROR_INVALID_INPUT)
+		return
+	}
+
+	types := []string{db.SearchTypeItem, db.SearchTypePolicy, db.SearchTypeUser}
+	if t := request.QueryParameter("type"); t != "" {
+		types = strings.Split(t, ",")
+	}
+
+	// every type may contribute the whole requested page, so fetch enough
+	// hits of each to be able to cut the page out of the merged result
+	res := make(searchResults, 0)
+	total := 0
+	for _, t := range types {
+		search, ok := s.search[t]
+		if !ok {
+			response.WriteErrorString(http.StatusBadRequest, ERROR_INVALID_INPUT)
+			log.WithFields(log.Fields{"Type": t}).Info(ERROR_INVALID_INPUT)
+			return
+		}
+		r, n, err := search(term, q.Offset+q.Limit)
+		if err != nil {
+			response.WriteErrorString(http.StatusInternalServerError, ERROR_INTERNAL)
+			log.WithFields(log.Fields{"Error Msg": err}).Warn(ERROR_INTERNAL)
+			return
+		}
+		res = append(res, r...)
+		total += n
+	}
+	sort.Stable(res)
+
+	start := q.Offset
+	if start > len(res) {
+		start = len(res)
+	}
+	end := start + q.Limit
+	if end > len(res) {
+		end = len(res)
+	}
+	writePageHeaders(request, response, q, total)
+	response.WriteEntity(res[start:end])
+}
+
+// searchResults sorts search results by descending score
+type searchResults []db.SearchResult
+
+func (s searchResults) Len() int           { return len(s) }
+func (s searchResults) Less(i, j int) bool { return s[i].Score > s[j].Score }
+func (s searchResults) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
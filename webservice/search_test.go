@@ -0,0 +1,115 @@
+/*
+ *    Copyright (C) 2015 Stefan Luecke
+ *
+ *    This program is free software: you can redistribute it and/or modify
+ *    it under the terms of the GNU Affero General Public License as published
+ *    by the Free Software Foundation, either version 3 of the License, or
+ *    (at your option) any later version.
+ *
+ *    This program is distributed in the hope that it will be useful,
+ *    but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *    GNU Affero General Public License for more details.
+ *
+ *    You should have received a copy of the GNU Affero General Public License
+ *    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ *    Authors: Stefan Luecke <glaxx@glaxx.net>
+ */
+
+package webservice_test
+
+import (
+	"encoding/json"
+	"github.com/emicklei/go-restful"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	db "github.com/openlab-aux/lsmsd/database"
+	"gopkg.in/mgo.v2"
+	"net/http"
+	"net/http/httptest"
+)
+
+var _ = Describe("Search", func() {
+	var (
+		session *mgo.Session
+		cont    *restful.Container
+		itm     db.ItemProvider
+		pol     db.PolicyProvider
+		usr     db.UserProvider
+		hw      *httptest.ResponseRecorder
+		req     *http.Request
+		res     []db.SearchResult
+	)
+
+	BeforeEach(func() {
+		session, cont, itm, pol, usr = newTestContainer()
+		hw = httptest.NewRecorder()
+		populateDB(itm, pol, usr)
+	})
+
+	AfterEach(func() {
+		flushDB(session, itm)
+	})
+
+	Context("without search terms", func() {
+		It("should return 400 bad request", func() {
+			req, _ = http.NewRequest("GET", "/search", nil)
+			cont.ServeHTTP(hw, req)
+
+			Expect(hw.Code).To(Equal(http.StatusBadRequest))
+		})
+	})
+
+	Context("with an invalid type", func() {
+		It("should return 400 bad request", func() {
+			req, _ = http.NewRequest("GET", "/search?q=test&type=cheese", nil)
+			cont.ServeHTTP(hw, req)
+
+			Expect(hw.Code).To(Equal(http.StatusBadRequest))
+		})
+	})
+
+	Context("for an item name", func() {
+		It("should find and highlight the item", func() {
+			req, _ = http.NewRequest("GET", "/search?q=test3", nil)
+			cont.ServeHTTP(hw, req)
+
+			Expect(hw.Code).To(Equal(http.StatusOK))
+			Expect(json.Unmarshal(hw.Body.Bytes(), &res)).To(Succeed())
+			Expect(res).To(HaveLen(1))
+			Expect(res[0].Type).To(Equal(db.SearchTypeItem))
+			Expect(res[0].Name).To(Equal("test3"))
+			Expect(res[0].Snippet).To(Equal("<em>test3</em>"))
+		})
+
+		It("should escape the snippet", func() {
+			_, err := itm.CreateItem(&db.Item{Name: "Sniffer", Description: "<script>alert(1)</script> sniffs"}, "0")
+			Expect(err).NotTo(HaveOccurred())
+			req, _ = http.NewRequest("GET", "/search?q=alert", nil)
+			cont.ServeHTTP(hw, req)
+
+			Expect(hw.Code).To(Equal(http.StatusOK))
+			Expect(json.Unmarshal(hw.Body.Bytes(), &res)).To(Succeed())
+			Expect(res).To(HaveLen(1))
+			Expect(res[0].Snippet).To(Equal("&lt;script&gt;<em>alert</em>(1)&lt;/script&gt; sniffs"))
+
+			Expect(db.Snippet("nothing", "<b>bold</b>")).To(Equal("&lt;b&gt;bold&lt;/b&gt;"))
+		})
+	})
+
+	Context("restricted to policies", func() {
+		It("should return a page of policies", func() {
+			req, _ = http.NewRequest("GET", "/search?q=testdescr&type=policy&limit=4", nil)
+			cont.ServeHTTP(hw, req)
+
+			Expect(hw.Code).To(Equal(http.StatusOK))
+			Expect(hw.Header().Get("X-Total-Count")).To(Equal("10"))
+			Expect(json.Unmarshal(hw.Body.Bytes(), &res)).To(Succeed())
+			Expect(res).To(HaveLen(4))
+			for _, r := range res {
+				Expect(r.Type).To(Equal(db.SearchTypePolicy))
+			}
+		})
+	})
+})
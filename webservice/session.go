@@ -0,0 +1,119 @@
+/*
+ *    Copyright (C) 2015 Stefan Luecke
+ *
+ *    This program is free software: you can redistribute it and/or modify
+ *    it under the terms of the GNU Affero General Public License as published
+ *    by the Free Software Foundation, either version 3 of the License, or
+ *    (at your option) any later version.
+ *
+ *    This program is distributed in the hope that it will be useful,
+ *    but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *    GNU Affero General Public License for more details.
+ *
+ *    You should have received a copy of the GNU Affero General Public License
+ *    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ *    Authors: Stefan Luecke <glaxx@glaxx.net>
+ */
+
+package webservice
+
+import (
+	log "github.com/Sirupsen/logrus"
+	"github.com/emicklei/go-restful"
+	db "github.com/openlab-aux/lsmsd/database"
+	"gopkg.in/mgo.v2/bson"
+	"net/http"
+	"time"
+)
+
+type AuthWebService struct {
+	d db.UserProvider
+	t db.TokenProvider
+	a *BasicAuthService
+	S *restful.WebService
+}
+
+type LoginRequest struct {
+	Name     string
+	Password string
+}
+
+type TokenResponse struct {
+	Id      bson.ObjectId `json:",omitempty"`
+	Token   string        `description:"Send as 'Authorization: Bearer <Token>'. It is only shown once"`
+	Expires time.Time     `json:",omitempty"`
+}
+
+func NewAuthWebService(d db.UserProvider, t db.TokenProvider, a *BasicAuthService) *AuthWebService {
+	res := new(AuthWebService)
+	res.d = d
+	res.t = t
+	res.a = a
+	service := new(restful.WebService)
+	service.
+		Path("/auth").
+		Doc("Session management").
+		ApiVersion("0.1").
+		Consumes(restful.MIME_JSON).
+		Produces(restful.MIME_JSON)
+
+	service.Route(service.POST("/login").
+		Doc("Exchange username and password for a session token").
+		To(res.Login).
+		Reads(LoginRequest{}).
+		Writes(TokenResponse{}).
+		Returns(http.StatusUnauthorized, "Username / Password incorrect", nil).
+		Do(returnsInternalServerError, returnsBadRequest))
+
+	service.Route(service.POST("/logout").
+		Filter(res.a.Auth).
+		Doc("Revoke the session token used for this request").
+		To(res.Logout).
+		Do(returnsInternalServerError, returnsDeleteSuccessful))
+
+	res.S = service
+	return res
+}
+
+func (s *AuthWebService) Login(request *restful.Request, response *restful.Response) {
+	lr := new(LoginRequest)
+	err := request.ReadEntity(lr)
+	if err != nil || lr.Name == "" {
+		response.WriteErrorString(http.StatusBadRequest, ERROR_INVALID_INPUT)
+		log.WithFields(log.Fields{"Error Msg": err}).Info(ERROR_INVALID_INPUT)
+		return
+	}
+	usr, err := s.d.GetUserByName(lr.Name)
+	if err != nil || !usr.Secret.VerifyPassword(lr.Password) {
+		log.WithFields(log.Fields{"User": lr.Name}).Warn("Failed login attempt")
+		response.WriteErrorString(http.StatusUnauthorized, "Username / Password incorrect")
+		return
+	}
+	s.a.upgradeSecret(&usr, lr.Password)
+	tok, secret, err := s.t.CreateToken(usr.Name, "", db.TokenSession, time.Now().Add(db.SessionLifetime))
+	if err != nil {
+		response.WriteErrorString(http.StatusInternalServerError, ERROR_INTERNAL)
+		log.WithFields(log.Fields{"Error Msg": err}).Warn(ERROR_INTERNAL)
+		return
+	}
+	log.WithFields(log.Fields{"User": usr.Name}).Info("User logged in")
+	response.WriteEntity(TokenResponse{Token: secret, Expires: tok.Expires})
+}
+
+func (s *AuthWebService) Logout(request *restful.Request, response *restful.Response) {
+	tok, ok := request.Attribute("Token").(*db.Token)
+	if !ok || tok.Kind != db.TokenSession {
+		// nothing to revoke for basic auth or api tokens
+		response.WriteEntity(true)
+		return
+	}
+	err := s.t.DeleteToken(tok.User, tok.ID)
+	if err != nil {
+		response.WriteErrorString(http.StatusInternalServerError, ERROR_INTERNAL)
+		log.WithFields(log.Fields{"Error Msg": err}).Warn(ERROR_INTERNAL)
+		return
+	}
+	response.WriteEntity(true)
+}
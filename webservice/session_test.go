@@ -0,0 +1,173 @@
+/*
+ *    Copyright (C) 2015 Stefan Luecke
+ *
+ *    This program is free software: you can redistribute it and/or modify
+ *    it under the terms of the GNU Affero General Public License as published
+ *    by the Free Software Foundation, either version 3 of the License, or
+ *    (at your option) any later version.
+ *
+ *    This program is distributed in the hope that it will be useful,
+ *    but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *    GNU Affero General Public License for more details.
+ *
+ *    You should have received a copy of the GNU Affero General Public License
+ *    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ *    Authors: Stefan Luecke <glaxx@glaxx.net>
+ */
+
+package webservice_test
+
+import (
+	"crypto/sha512"
+	"encoding/json"
+	"github.com/emicklei/go-restful"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	db "github.com/openlab-aux/lsmsd/database"
+	"github.com/openlab-aux/lsmsd/webservice"
+	"gopkg.in/mgo.v2"
+	"net/http"
+	"net/http/httptest"
+)
+
+var _ = Describe("Sessions and tokens", func() {
+	var (
+		session *mgo.Session
+		cont    *restful.Container
+		itm     db.ItemProvider
+		usr     db.UserProvider
+		hw      *httptest.ResponseRecorder
+	)
+
+	login := func(name, password string) webservice.TokenResponse {
+		hw = request(cont, "POST", "/auth/login", "1", webservice.LoginRequest{Name: name, Password: password})
+		var res webservice.TokenResponse
+		json.Unmarshal(hw.Body.Bytes(), &res)
+		return res
+	}
+
+	BeforeEach(func() {
+		session, cont, itm, _, usr = newTestContainer()
+		populateUserDB(usr)
+	})
+
+	AfterEach(func() {
+		flushDB(session, itm)
+	})
+
+	Describe("Log in", func() {
+		It("should refuse a wrong password", func() {
+			login("1", "wrong")
+			Expect(hw.Code).To(Equal(http.StatusUnauthorized))
+		})
+
+		It("should ask for credentials if there are none", func() {
+			hw = request(cont, "GET", "/users/1/tokens", "", nil)
+			Expect(hw.Code).To(Equal(http.StatusUnauthorized))
+			Expect(hw.Header().Get("WWW-Authenticate")).To(HavePrefix("Basic"))
+		})
+
+		It("should hand out a session token until logout", func() {
+			tok := login("1", "testpw")
+			Expect(hw.Code).To(Equal(http.StatusOK))
+			Expect(tok.Token).NotTo(BeEmpty())
+			Expect(tok.Expires).NotTo(BeZero())
+
+			hw = request(cont, "GET", "/users/1/tokens", "", nil, "Authorization", "Bearer "+tok.Token)
+			Expect(hw.Code).To(Equal(http.StatusOK))
+
+			hw = request(cont, "POST", "/auth/logout", "", nil, "Authorization", "Bearer "+tok.Token)
+			Expect(hw.Code).To(Equal(http.StatusOK))
+
+			hw = request(cont, "GET", "/users/1/tokens", "", nil, "Authorization", "Bearer "+tok.Token)
+			Expect(hw.Code).To(Equal(http.StatusUnauthorized))
+		})
+	})
+
+	Describe("API tokens", func() {
+		var tok webservice.TokenResponse
+
+		BeforeEach(func() {
+			hw = request(cont, "POST", "/users/1/tokens", "1", webservice.TokenRequest{Name: "label printer"})
+			Expect(hw.Code).To(Equal(http.StatusOK))
+			Expect(json.Unmarshal(hw.Body.Bytes(), &tok)).To(Succeed())
+		})
+
+		It("should be listed without the secret", func() {
+			hw = request(cont, "GET", "/users/1/tokens", "1", nil)
+			var res []db.Token
+			Expect(json.Unmarshal(hw.Body.Bytes(), &res)).To(Succeed())
+			Expect(res).To(HaveLen(1))
+			Expect(res[0].Name).To(Equal("label printer"))
+			Expect(hw.Body.String()).NotTo(ContainSubstring(tok.Token))
+		})
+
+		It("should be accepted as bearer token and as basic auth password", func() {
+			hw = request(cont, "GET", "/users/1/tokens", "", nil, "Authorization", "Bearer "+tok.Token)
+			Expect(hw.Code).To(Equal(http.StatusOK))
+
+			req, _ := http.NewRequest("GET", "/users/1/tokens", nil)
+			req.SetBasicAuth("1", tok.Token)
+			hw = httptest.NewRecorder()
+			cont.ServeHTTP(hw, req)
+			Expect(hw.Code).To(Equal(http.StatusOK))
+		})
+
+		It("should not be usable by other users", func() {
+			req, _ := http.NewRequest("GET", "/users/2/tokens", nil)
+			req.SetBasicAuth("2", tok.Token)
+			hw = httptest.NewRecorder()
+			cont.ServeHTTP(hw, req)
+			Expect(hw.Code).To(Equal(http.StatusUnauthorized))
+		})
+
+		It("should stop working once revoked", func() {
+			hw = request(cont, "DELETE", "/users/1/tokens/"+tok.Id.Hex(), "1", nil)
+			Expect(hw.Code).To(Equal(http.StatusOK))
+
+			hw = request(cont, "GET", "/users/1/tokens", "", nil, "Authorization", "Bearer "+tok.Token)
+			Expect(hw.Code).To(Equal(http.StatusUnauthorized))
+		})
+
+		It("should only be managed by their user", func() {
+			req, _ := http.NewRequest("GET", "/users/1/tokens", nil)
+			req.SetBasicAuth("2", "testpw")
+			hw = httptest.NewRecorder()
+			cont.ServeHTTP(hw, req)
+			Expect(hw.Code).To(Equal(http.StatusForbidden))
+		})
+	})
+
+	Describe("Legacy password hashes", func() {
+		BeforeEach(func() {
+			// sha512(pw || salt) as written by servers without pepper file
+			sec := db.Secret{}
+			sec.Password = sha512.Sum512(append([]byte("testpw"), sec.Salt[:]...))
+			Expect(usr.CreateUser(&db.User{Name: "legacy", Secret: sec})).To(Succeed())
+		})
+
+		It("should be upgraded on login", func() {
+			for i := 0; i != 2; i++ {
+				req, _ := http.NewRequest("GET", "/users/legacy/tokens", nil)
+				req.SetBasicAuth("legacy", "testpw")
+				hw = httptest.NewRecorder()
+				cont.ServeHTTP(hw, req)
+				Expect(hw.Code).To(Equal(http.StatusOK))
+
+				u, _ := usr.GetUserByName("legacy")
+				Expect(u.Secret.Algorithm).To(Equal(db.AlgorithmArgon2id))
+				Expect(u.Secret.NeedsUpgrade()).To(BeFalse())
+			}
+		})
+
+		It("should still refuse wrong passwords", func() {
+			login("legacy", "wrong")
+			Expect(hw.Code).To(Equal(http.StatusUnauthorized))
+
+			u, _ := usr.GetUserByName("legacy")
+			Expect(u.Secret.Algorithm).To(BeEmpty())
+		})
+	})
+})
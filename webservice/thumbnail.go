@@ -0,0 +1,153 @@
+/*
+ *    Copyright (C) 2015 Stefan Luecke
+ *
+ *    This program is free software: you can redistribute it and/or modify
+ *    it under the terms of the GNU Affero General Public License as published
+ *    by the Free Software Foundation, either version 3 of the License, or
+ *    (at your option) any later version.
+ *
+ *    This program is distributed in the hope that it will be useful,
+ *    but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *    GNU Affero General Public License for more details.
+ *
+ *    You should have received a copy of the GNU Affero General Public License
+ *    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ *    Authors: Stefan Luecke <glaxx@glaxx.net>
+ */
+
+package webservice
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"strconv"
+	"strings"
+)
+
+// Named sizes of image renditions, as bounding box
+var imageSizes = map[string]image.Point{
+	"thumb":  {160, 160},
+	"medium": {800, 800},
+}
+
+// maxRenditionSide caps the sides of renditions given as WIDTHxHEIGHT. They
+// are rendered on every request, so they are not larger than medium.
+const maxRenditionSide = 800
+
+const renditionJPEGQuality = 85
+
+var (
+	errInvalidSize   = errors.New("Size has to be thumb, medium or WIDTHxHEIGHT")
+	errNotRenderable = errors.New("The image can not be resized")
+)
+
+// parseImageSize returns the bounding box of a named size or of a size
+// given as WIDTHxHEIGHT, whose sides are capped at maxRenditionSide
+func parseImageSize(size string) (image.Point, error) {
+	if p, ok := imageSizes[size]; ok {
+		return p, nil
+	}
+	wh := strings.Split(size, "x")
+	if len(wh) != 2 {
+		return image.Point{}, errInvalidSize
+	}
+	w, err := strconv.Atoi(wh[0])
+	if err != nil || w <= 0 {
+		return image.Point{}, errInvalidSize
+	}
+	h, err := strconv.Atoi(wh[1])
+	if err != nil || h <= 0 {
+		return image.Point{}, errInvalidSize
+	}
+	if w > maxRenditionSide {
+		w = maxRenditionSide
+	}
+	if h > maxRenditionSide {
+		h = maxRenditionSide
+	}
+	return image.Pt(w, h), nil
+}
+
+// renditionSize returns the size of src scaled down to fit into box,
+// keeping its aspect ratio. ok is false if src fits already.
+func renditionSize(src, box image.Point) (image.Point, bool) {
+	if src.X <= box.X && src.Y <= box.Y {
+		return src, false
+	}
+	res := image.Pt(box.X, src.Y*box.X/src.X)
+	if src.Y*box.X > box.Y*src.X {
+		res = image.Pt(src.X*box.Y/src.Y, box.Y)
+	}
+	if res.X == 0 {
+		res.X = 1
+	}
+	if res.Y == 0 {
+		res.Y = 1
+	}
+	return res, true
+}
+
+// renderImage scales the encoded image data down to fit into box. JPEGs
+// stay JPEGs, everything else becomes a PNG. ok is false if the image fits
+// already and data should be used as it is.
+func renderImage(data []byte, box image.Point) (*bytes.Buffer, string, bool, error) {
+	src, format, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", false, err
+	}
+	size, ok := renditionSize(src.Bounds().Size(), box)
+	if !ok {
+		return nil, "", false, nil
+	}
+	dst := scaleDown(src, size)
+	buf := new(bytes.Buffer)
+	if format == "jpeg" {
+		err = jpeg.Encode(buf, dst, &jpeg.Options{Quality: renditionJPEGQuality})
+		return buf, "image/jpeg", true, err
+	}
+	err = png.Encode(buf, dst)
+	return buf, "image/png", true, err
+}
+
+// scaleDown shrinks src to size by averaging the source pixels covered by
+// each destination pixel
+func scaleDown(src image.Image, size image.Point) *image.RGBA {
+	b := src.Bounds()
+	// draw has fast paths for the formats the decoders return
+	rgba := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(rgba, rgba.Bounds(), src, b.Min, draw.Src)
+
+	dst := image.NewRGBA(image.Rect(0, 0, size.X, size.Y))
+	sw, sh := b.Dx(), b.Dy()
+	for y := 0; y != size.Y; y++ {
+		y0, y1 := y*sh/size.Y, (y+1)*sh/size.Y
+		if y1 == y0 {
+			y1++
+		}
+		for x := 0; x != size.X; x++ {
+			x0, x1 := x*sw/size.X, (x+1)*sw/size.X
+			if x1 == x0 {
+				x1++
+			}
+			var sum [4]int
+			for sy := y0; sy != y1; sy++ {
+				row := rgba.Pix[sy*rgba.Stride+x0*4 : sy*rgba.Stride+x1*4]
+				for i := 0; i != len(row); i++ {
+					sum[i%4] += int(row[i])
+				}
+			}
+			n := (y1 - y0) * (x1 - x0)
+			off := y*dst.Stride + x*4
+			for i := 0; i != 4; i++ {
+				dst.Pix[off+i] = uint8(sum[i] / n)
+			}
+		}
+	}
+	return dst
+}
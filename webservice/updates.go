@@ -20,31 +20,111 @@
 package webservice
 
 import (
+	"context"
+	"errors"
 	log "github.com/Sirupsen/logrus"
 	"github.com/emicklei/go-restful"
 	db "github.com/openlab-aux/lsmsd/database"
 	"github.com/trevex/golem"
 	"net/http"
+	"sync"
 )
 
+// Clients of the update channel connect to /ws with the credentials of the
+// REST API. Browsers, which can't set headers on websocket requests, pass a
+// token as query parameter instead. A client receives nothing until it
+// subscribes. Messages are golem events, the name of the event followed by a
+// space and its data as JSON:
+//
+//	subscribe {"Topic": "item", "Item": 5}         changes of item 5
+//	subscribe {"Topic": "subtree", "Item": 5}      changes of item 5 and the items below it
+//	subscribe {"Topic": "policy", "Policy": "ask"} changes of policy ask
+//	subscribe {"Topic": "mine"}                    changes of the items the user owns or maintains
+//	unsubscribe {"Topic": "item", "Item": 5}       ends a subscription
+//
+// The server answers with "subscribed" or "unsubscribed" and the
+// subscription, or with "error" and a message. Every change matching at
+// least one subscription is sent once as "update" with an Event.
+
+const (
+	TopicItem    = "item"
+	TopicSubtree = "subtree"
+	TopicPolicy  = "policy"
+	TopicMine    = "mine"
+)
+
+// Kinds of events
+const (
+	EventCreated     = "created" // also sent for restored items and policies
+	EventUpdated     = "updated"
+	EventDeleted     = "deleted"
+	EventImage       = "image" // images were added, removed or rearranged
+	EventAttachment  = "attachment"
+	EventLoan        = "loan" // checkouts, checkins and loan requests
+	EventReservation = "reservation"
+)
+
+// maxSubscriptions limits the subscriptions of a connection
+const maxSubscriptions = 100
+
+var (
+	errInvalidSubscription  = errors.New("Invalid subscription")
+	errUnknownItem          = errors.New("Unknown item")
+	errTooManySubscriptions = errors.New("Too many subscriptions")
+)
+
+// Subscription selects the changes a client receives
+type Subscription struct {
+	Topic  string `description:"item, subtree, policy or mine"`
+	Item   uint64 `json:",omitempty" description:"The item of the item and subtree topics"`
+	Policy string `json:",omitempty" description:"The policy of the policy topic"`
+}
+
+// Event is a change sent to subscribed clients
+type Event struct {
+	Kind   string      `description:"created, updated, deleted, image, attachment, loan or reservation"`
+	Item   uint64      `json:",omitempty" description:"The item which changed"`
+	Policy string      `json:",omitempty" description:"The policy which changed"`
+	Type   string      `description:"Type of Data: ItemHistory, PolicyHistory, Loan or Reservation"`
+	Data   interface{} `description:"The history entry recording the change, or the loan or reservation"`
+}
+
 type UpdateService struct {
-	Router *golem.Router
-	u      *golem.Room
-	S      *restful.WebService
+	r         *golem.Router
+	d         db.ItemProvider
+	a         *BasicAuthService
+	mu        sync.RWMutex
+	clients   map[*golem.Connection]*wsClient
+	listeners []func(string, interface{})
+	S         *restful.WebService
+}
+
+// wsClient is an authenticated connection and its subscriptions
+type wsClient struct {
+	user string
+	subs []Subscription
 }
 
-func NewUpdateService() *UpdateService {
+// wsClientKey is the context key passing the wsClient of a request from the
+// route to golem
+type wsClientKey struct{}
+
+func NewUpdateService(d db.ItemProvider, a *BasicAuthService) *UpdateService {
 	res := new(UpdateService)
-	res.Router = golem.NewRouter()
-	err := res.Router.OnConnect(res.join)
+	res.d = d
+	res.a = a
+	res.clients = make(map[*golem.Connection]*wsClient)
+	res.r = golem.NewRouter()
+	err := res.r.OnConnect(res.join)
 	if err != nil {
 		panic(err)
 	}
-	err = res.Router.OnClose(res.leave)
+	err = res.r.OnClose(res.leave)
 	if err != nil {
 		panic(err)
 	}
-	res.u = golem.NewRoom()
+	res.r.On("subscribe", res.subscribe)
+	res.r.On("unsubscribe", res.unsubscribe)
 
 	service := new(restful.WebService)
 	service.
@@ -53,43 +133,285 @@ func NewUpdateService() *UpdateService {
 		ApiVersion("0.1")
 
 	service.Route(service.GET("").
-		Doc("Just use a GET request to invoke a websocket connection").
+		Filter(tokenParam).
+		Filter(res.a.Auth).
+		Param(restful.QueryParameter("token", "Session or API token, for clients which can't send an Authorization header")).
+		Doc("Just use a GET request to invoke a websocket connection. Subscribe to topics to receive events").
 		To(res.restfulHandlerWrapper))
 
 	res.S = service
 	return res
 }
 
-func (u *UpdateService) restfulHandlerWrapper(req *restful.Request, res *restful.Response) {
-	h := u.Router.Handler()
-	log.Debug("wrap", h, res.ResponseWriter, req)
+// tokenParam passes the token query parameter on to Auth as bearer token
+func tokenParam(request *restful.Request, response *restful.Response, chain *restful.FilterChain) {
+	if t := request.QueryParameter("token"); t != "" && request.HeaderParameter("Authorization") == "" {
+		request.Request.Header.Set("Authorization", "Bearer "+t)
+	}
+	chain.ProcessFilter(request, response)
+}
 
-	h(res.ResponseWriter, req.Request)
+func (u *UpdateService) restfulHandlerWrapper(req *restful.Request, res *restful.Response) {
+	c := &wsClient{user: req.Attribute("User").(string)}
+	r := req.Request.WithContext(context.WithValue(req.Request.Context(), wsClientKey{}, c))
+	u.r.Handler()(res.ResponseWriter, r)
 }
 
 func (u *UpdateService) leave(conn *golem.Connection) {
 	log.Debug("Lost ws connection")
-	u.u.Leave(conn)
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	delete(u.clients, conn)
 }
 
 func (u *UpdateService) join(conn *golem.Connection, req *http.Request) {
-	log.Debug("Got ws connect")
-	u.u.Join(conn)
+	c, ok := req.Context().Value(wsClientKey{}).(*wsClient)
+	if !ok {
+		// not authenticated by the route, the connection stays silent
+		log.Warn("Unauthenticated ws connection")
+		return
+	}
+	log.WithFields(log.Fields{"User": c.user}).Debug("Got ws connect")
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.clients[conn] = c
+}
+
+func (u *UpdateService) subscribe(conn *golem.Connection, s *Subscription) {
+	err := checkSubscription(s)
+	if err == nil && (s.Topic == TopicItem || s.Topic == TopicSubtree) && !u.d.CheckItemExistance(&db.Item{EID: s.Item}) {
+		err = errUnknownItem
+	}
+	if err == nil {
+		err = u.modify(conn, func(c *wsClient) error {
+			for _, cur := range c.subs {
+				if cur == *s {
+					return nil
+				}
+			}
+			if len(c.subs) >= maxSubscriptions {
+				return errTooManySubscriptions
+			}
+			c.subs = append(c.subs, *s)
+			return nil
+		})
+	}
+	if err != nil {
+		conn.Emit("error", err.Error())
+		return
+	}
+	conn.Emit("subscribed", s)
+}
+
+func (u *UpdateService) unsubscribe(conn *golem.Connection, s *Subscription) {
+	err := checkSubscription(s)
+	if err == nil {
+		err = u.modify(conn, func(c *wsClient) error {
+			kept := c.subs[:0]
+			for _, cur := range c.subs {
+				if cur != *s {
+					kept = append(kept, cur)
+				}
+			}
+			c.subs = kept
+			return nil
+		})
+	}
+	if err != nil {
+		conn.Emit("error", err.Error())
+		return
+	}
+	conn.Emit("unsubscribed", s)
+}
+
+// modify applies f to the client of conn
+func (u *UpdateService) modify(conn *golem.Connection, f func(c *wsClient) error) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	c, ok := u.clients[conn]
+	if !ok {
+		return errors.New("Not authenticated")
+	}
+	return f(c)
+}
+
+// checkSubscription validates s and clears the fields its topic ignores
+func checkSubscription(s *Subscription) error {
+	switch s.Topic {
+	case TopicItem, TopicSubtree:
+		if s.Item == 0 {
+			return errInvalidSubscription
+		}
+		s.Policy = ""
+	case TopicPolicy:
+		if s.Policy == "" {
+			return errInvalidSubscription
+		}
+		s.Item = 0
+	case TopicMine:
+		s.Item, s.Policy = 0, ""
+	default:
+		return errInvalidSubscription
+	}
+	return nil
+}
+
+// AddListener registers f to be called with the type and the object of every
+// update. f is called synchronously and must not block.
+func (u *UpdateService) AddListener(f func(_type string, obj interface{})) {
+	u.listeners = append(u.listeners, f)
 }
 
 func (u *UpdateService) PushUpdate(obj interface{}) {
-	var _type string
-	switch obj.(type) {
+	e := newEvent(obj)
+	log.Debug("ws: pushed obj")
+	u.emit(e)
+	for _, f := range u.listeners {
+		f(e.Type, obj)
+	}
+}
+
+func newEvent(obj interface{}) *Event {
+	res := &Event{Data: obj}
+	switch o := obj.(type) {
 	case *db.ItemHistory:
-		_type = "ItemHistory"
+		res.Type = "ItemHistory"
+		res.Item, _ = o.Item["eid"].(uint64)
+		res.Kind = historyKind(o.Item)
+		if res.Kind != EventUpdated {
+			break
+		}
+		has := func(field string) bool {
+			_, ok := o.Item[field]
+			return ok
+		}
+		switch {
+		case has("borrower"):
+			res.Kind = EventLoan
+		case has("images") || has("imageinfo"):
+			res.Kind = EventImage
+		case has("attachments"):
+			res.Kind = EventAttachment
+		}
 
 	case *db.PolicyHistory:
-		_type = "PolicyHistory"
+		res.Type = "PolicyHistory"
+		res.Policy, _ = o.Policy["name"].(string)
+		res.Kind = historyKind(o.Policy)
+
+	case *db.Loan:
+		res.Type = "Loan"
+		res.Item = o.Item
+		res.Kind = EventLoan
+
+	case *db.Reservation:
+		res.Type = "Reservation"
+		res.Item = o.Item
+		res.Kind = EventReservation
 
 	default:
 		panic("Invalid type; ws")
 
 	}
-	log.Debug("ws: pushed obj")
-	u.u.Emit(_type, obj)
+	return res
+}
+
+// historyKind tells creations and deletions from other changes in a history
+// entry
+func historyKind(entry map[string]interface{}) string {
+	switch {
+	case entry["deleted"] == true:
+		return EventDeleted
+	case entry["created"] == true:
+		return EventCreated
+	}
+	return EventUpdated
+}
+
+// audience describes whom an event concerns
+type audience struct {
+	item   uint64
+	path   []uint64 // the item and its ancestors
+	users  []string // owner and maintainer of the item
+	policy string
+}
+
+// emit sends e to every client with a matching subscription
+func (u *UpdateService) emit(e *Event) {
+	u.mu.RLock()
+	n := len(u.clients)
+	u.mu.RUnlock()
+	if n == 0 {
+		return
+	}
+	a := u.audienceOf(e)
+	conns := make([]*golem.Connection, 0)
+	u.mu.RLock()
+	for conn, c := range u.clients {
+		for _, s := range c.subs {
+			if s.matches(a, c.user) {
+				conns = append(conns, conn)
+				break
+			}
+		}
+	}
+	u.mu.RUnlock()
+	for _, conn := range conns {
+		conn.Emit("update", e)
+	}
+}
+
+func (u *UpdateService) audienceOf(e *Event) *audience {
+	res := &audience{item: e.Item, policy: e.Policy}
+	if e.Item == 0 {
+		return res
+	}
+	res.path = []uint64{e.Item}
+	itm, err := u.d.GetItemById(e.Item)
+	if err != nil {
+		// a deleted item is described by the snapshot recording its deletion
+		h, ok := e.Data.(*db.ItemHistory)
+		if !ok {
+			return res
+		}
+		itm.Parent, _ = h.Item["parent"].(uint64)
+		itm.Owner, _ = h.Item["owner"].(string)
+		itm.Maintainer, _ = h.Item["maintainer"].(string)
+	}
+	res.users = []string{itm.Owner, itm.Maintainer}
+	if itm.Parent == 0 {
+		return res
+	}
+	res.path = append(res.path, itm.Parent)
+	anc, err := u.d.GetAncestors(itm.Parent)
+	if err != nil {
+		log.WithFields(log.Fields{"Item": e.Item, "Error Msg": err}).Debug("Could not find ancestors")
+		return res
+	}
+	for _, a := range anc {
+		res.path = append(res.path, a.EID)
+	}
+	return res
+}
+
+func (s *Subscription) matches(a *audience, user string) bool {
+	switch s.Topic {
+	case TopicItem:
+		return a.item != 0 && a.item == s.Item
+	case TopicSubtree:
+		for _, id := range a.path {
+			if id == s.Item {
+				return true
+			}
+		}
+	case TopicPolicy:
+		return a.policy != "" && a.policy == s.Policy
+	case TopicMine:
+		for _, name := range a.users {
+			if name != "" && name == user {
+				return true
+			}
+		}
+	}
+	return false
 }
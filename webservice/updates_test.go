@@ -0,0 +1,228 @@
+/*
+ *    Copyright (C) 2015 Stefan Luecke
+ *
+ *    This program is free software: you can redistribute it and/or modify
+ *    it under the terms of the GNU Affero General Public License as published
+ *    by the Free Software Foundation, either version 3 of the License, or
+ *    (at your option) any later version.
+ *
+ *    This program is distributed in the hope that it will be useful,
+ *    but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *    GNU Affero General Public License for more details.
+ *
+ *    You should have received a copy of the GNU Affero General Public License
+ *    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ *    Authors: Stefan Luecke <glaxx@glaxx.net>
+ */
+
+package webservice_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/emicklei/go-restful"
+	"github.com/gorilla/websocket"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	db "github.com/openlab-aux/lsmsd/database"
+	"github.com/openlab-aux/lsmsd/webservice"
+	"gopkg.in/mgo.v2"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var _ = Describe("Updates", func() {
+	var (
+		session *mgo.Session
+		cont    *restful.Container
+		itm     db.ItemProvider
+		usr     db.UserProvider
+		srv     *httptest.Server
+		hw      *httptest.ResponseRecorder
+		conns   []*websocket.Conn
+		room    uint64
+		box     uint64
+		other   uint64
+	)
+
+	// do sends a request which has to succeed
+	do := func(method, path, user string, body interface{}) {
+		hw = request(cont, method, path, user, body)
+		Expect(hw.Code).To(Equal(http.StatusOK), path)
+	}
+	rename := func(id uint64, name string) {
+		i, err := itm.GetItemById(id)
+		Expect(err).NotTo(HaveOccurred())
+		i.Name = name
+		do("PUT", "/items", "0", i)
+	}
+	dial := func(user string) *websocket.Conn {
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.SetBasicAuth(user, "testpw")
+		ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/ws", req.Header)
+		Expect(err).NotTo(HaveOccurred())
+		conns = append(conns, ws)
+		return ws
+	}
+	// receive returns the name and the data of the next message
+	receive := func(ws *websocket.Conn) (string, []byte) {
+		ws.SetReadDeadline(time.Now().Add(2 * time.Second))
+		_, msg, err := ws.ReadMessage()
+		Expect(err).NotTo(HaveOccurred())
+		parts := bytes.SplitN(msg, []byte(" "), 2)
+		Expect(parts).To(HaveLen(2))
+		return string(parts[0]), parts[1]
+	}
+	send := func(ws *websocket.Conn, event string, s webservice.Subscription) string {
+		data, _ := json.Marshal(s)
+		Expect(ws.WriteMessage(websocket.TextMessage, append([]byte(event+" "), data...))).To(Succeed())
+		name, _ := receive(ws)
+		return name
+	}
+	next := func(ws *websocket.Conn) webservice.Event {
+		name, data := receive(ws)
+		Expect(name).To(Equal("update"))
+		var e webservice.Event
+		Expect(json.Unmarshal(data, &e)).To(Succeed())
+		return e
+	}
+
+	BeforeEach(func() {
+		session, cont, itm, _, usr = newTestContainer()
+		populateUserDB(usr)
+		srv = httptest.NewServer(cont)
+		conns = nil
+		var err error
+		room, err = itm.CreateItem(&db.Item{Name: "Workshop", Owner: "2"}, "0")
+		Expect(err).NotTo(HaveOccurred())
+		box, err = itm.CreateItem(&db.Item{Name: "Box", Parent: room, Owner: "3"}, "0")
+		Expect(err).NotTo(HaveOccurred())
+		other, err = itm.CreateItem(&db.Item{Name: "Lathe", Maintainer: "3"}, "0")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		for _, ws := range conns {
+			ws.Close()
+		}
+		srv.Close()
+		flushDB(session, itm)
+	})
+
+	It("should refuse connections without valid credentials", func() {
+		req, _ := http.NewRequest("GET", "/ws", nil)
+		hw = httptest.NewRecorder()
+		cont.ServeHTTP(hw, req)
+		Expect(hw.Code).To(Equal(http.StatusUnauthorized))
+
+		req.SetBasicAuth("5", "wrong")
+		hw = httptest.NewRecorder()
+		cont.ServeHTTP(hw, req)
+		Expect(hw.Code).To(Equal(http.StatusUnauthorized))
+
+		_, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/ws?token=nope", nil)
+		Expect(err).To(HaveOccurred())
+		Expect(resp.StatusCode).To(Equal(http.StatusUnauthorized))
+	})
+
+	It("should only send changes of subscribed items", func() {
+		ws := dial("5")
+		Expect(send(ws, "subscribe", webservice.Subscription{Topic: webservice.TopicItem, Item: box})).To(Equal("subscribed"))
+
+		rename(other, "Old lathe")
+		rename(box, "Crate")
+		e := next(ws)
+		Expect(e.Kind).To(Equal(webservice.EventUpdated))
+		Expect(e.Item).To(Equal(box))
+		Expect(e.Type).To(Equal("ItemHistory"))
+		Expect(e.Data).To(HaveKeyWithValue("User", "0"))
+	})
+
+	It("should send changes below a subtree", func() {
+		ws := dial("5")
+		Expect(send(ws, "subscribe", webservice.Subscription{Topic: webservice.TopicSubtree, Item: room})).To(Equal("subscribed"))
+
+		rename(other, "Old lathe")
+		rename(box, "Crate")
+		e := next(ws)
+		Expect(e.Item).To(Equal(box))
+
+		do("POST", "/items", "0", db.Item{Name: "Drill", Parent: box})
+		e = next(ws)
+		Expect(e.Kind).To(Equal(webservice.EventCreated))
+
+		do("DELETE", "/items/"+strconv.FormatUint(e.Item, 10), "0", nil)
+		e = next(ws)
+		Expect(e.Kind).To(Equal(webservice.EventDeleted))
+	})
+
+	It("should send changes of the items of the user", func() {
+		ws := dial("3")
+		Expect(send(ws, "subscribe", webservice.Subscription{Topic: webservice.TopicMine})).To(Equal("subscribed"))
+
+		rename(room, "Lab")
+		rename(box, "Crate")
+		Expect(next(ws).Item).To(Equal(box))
+		rename(other, "Old lathe")
+		Expect(next(ws).Item).To(Equal(other))
+
+		do("POST", "/items/"+strconv.FormatUint(box, 10)+"/checkout", "1", nil)
+		e := next(ws)
+		Expect(e.Kind).To(Equal(webservice.EventLoan))
+		Expect(e.Item).To(Equal(box))
+	})
+
+	It("should send policy changes", func() {
+		ws := dial("5")
+		Expect(send(ws, "subscribe", webservice.Subscription{Topic: webservice.TopicPolicy, Policy: "ask"})).To(Equal("subscribed"))
+
+		do("POST", "/policies", "1", db.Policy{Name: "never"})
+		do("POST", "/policies", "1", db.Policy{Name: "ask"})
+		e := next(ws)
+		Expect(e.Kind).To(Equal(webservice.EventCreated))
+		Expect(e.Policy).To(Equal("ask"))
+		Expect(e.Type).To(Equal("PolicyHistory"))
+	})
+
+	It("should send image events", func() {
+		ws := dial("2")
+		Expect(send(ws, "subscribe", webservice.Subscription{Topic: webservice.TopicItem, Item: room})).To(Equal("subscribed"))
+
+		ref, err := testImages.Create(bytes.NewReader([]byte("plan")), "2", "image/png", room)
+		Expect(err).NotTo(HaveOccurred())
+		_, err = itm.AddImage(room, ref, "2")
+		Expect(err).NotTo(HaveOccurred())
+		do("DELETE", "/items/"+strconv.FormatUint(room, 10)+"/image/"+ref.Hex(), "2", nil)
+		e := next(ws)
+		Expect(e.Kind).To(Equal(webservice.EventImage))
+		Expect(e.Item).To(Equal(room))
+	})
+
+	It("should stop after unsubscribing", func() {
+		ws := dial("5")
+		Expect(send(ws, "subscribe", webservice.Subscription{Topic: webservice.TopicItem, Item: box})).To(Equal("subscribed"))
+		Expect(send(ws, "subscribe", webservice.Subscription{Topic: webservice.TopicItem, Item: room})).To(Equal("subscribed"))
+		Expect(send(ws, "unsubscribe", webservice.Subscription{Topic: webservice.TopicItem, Item: box})).To(Equal("unsubscribed"))
+
+		rename(box, "Crate")
+		rename(room, "Lab")
+		Expect(next(ws).Item).To(Equal(room))
+	})
+
+	It("should reject invalid subscriptions", func() {
+		ws := dial("5")
+		for _, s := range []webservice.Subscription{
+			{Topic: webservice.TopicItem, Item: 1337},
+			{Topic: webservice.TopicSubtree},
+			{Topic: webservice.TopicPolicy},
+			{Topic: "everything"},
+		} {
+			Expect(send(ws, "subscribe", s)).To(Equal("error"), s.Topic)
+		}
+	})
+})
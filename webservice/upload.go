@@ -0,0 +1,200 @@
+/*
+ *    Copyright (C) 2015 Stefan Luecke
+ *
+ *    This program is free software: you can redistribute it and/or modify
+ *    it under the terms of the GNU Affero General Public License as published
+ *    by the Free Software Foundation, either version 3 of the License, or
+ *    (at your option) any later version.
+ *
+ *    This program is distributed in the hope that it will be useful,
+ *    but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *    GNU Affero General Public License for more details.
+ *
+ *    You should have received a copy of the GNU Affero General Public License
+ *    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ *    Authors: Stefan Luecke <glaxx@glaxx.net>
+ */
+
+package webservice
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/draw"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+)
+
+// Uploaded images are identified by their content, decoded and encoded
+// again. This drops EXIF data and other metadata, JPEGs are turned as their
+// EXIF orientation says first.
+
+const (
+	// DefaultMaxImageSize is the largest image upload accepted in bytes
+	DefaultMaxImageSize = 10 << 20
+	// maxImagePixels protects the decoder against small files of huge
+	// images
+	maxImagePixels = 40000000
+
+	uploadJPEGQuality = 90
+)
+
+var (
+	errUnsupportedImage = errors.New("Only png, jpeg and gif images are supported")
+	errImageTooLarge    = errors.New("The image is too large")
+	errBrokenImage      = errors.New("The image can not be decoded")
+)
+
+// cleanImage decodes the uploaded image data and encodes it again without
+// metadata. It returns the new data and its content type.
+func cleanImage(data []byte) ([]byte, string, error) {
+	ct := http.DetectContentType(data)
+	switch ct {
+	case "image/png", "image/jpeg", "image/gif":
+	default:
+		return nil, "", errUnsupportedImage
+	}
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", errBrokenImage
+	}
+	if cfg.Width*cfg.Height > maxImagePixels {
+		return nil, "", errImageTooLarge
+	}
+
+	buf := new(bytes.Buffer)
+	switch ct {
+	case "image/gif":
+		// keep the animation
+		g, err := gif.DecodeAll(bytes.NewReader(data))
+		if err != nil {
+			return nil, "", errBrokenImage
+		}
+		err = gif.EncodeAll(buf, g)
+		if err != nil {
+			return nil, "", err
+		}
+	case "image/png":
+		img, err := png.Decode(bytes.NewReader(data))
+		if err != nil {
+			return nil, "", errBrokenImage
+		}
+		err = png.Encode(buf, img)
+		if err != nil {
+			return nil, "", err
+		}
+	case "image/jpeg":
+		img, err := jpeg.Decode(bytes.NewReader(data))
+		if err != nil {
+			return nil, "", errBrokenImage
+		}
+		err = jpeg.Encode(buf, orient(img, jpegOrientation(data)), &jpeg.Options{Quality: uploadJPEGQuality})
+		if err != nil {
+			return nil, "", err
+		}
+	}
+	return buf.Bytes(), ct, nil
+}
+
+// jpegOrientation returns the EXIF orientation of a JPEG, 1 if it has none
+func jpegOrientation(data []byte) int {
+	if len(data) < 2 || data[0] != 0xff || data[1] != 0xd8 {
+		return 1
+	}
+	p := 2
+	for p+4 <= len(data) && data[p] == 0xff {
+		marker := data[p+1]
+		n := int(binary.BigEndian.Uint16(data[p+2:]))
+		// the image data starts with SOS, EXIF comes before
+		if marker == 0xda || n < 2 || p+2+n > len(data) {
+			return 1
+		}
+		seg := data[p+4 : p+2+n]
+		if marker == 0xe1 && len(seg) > 6 && string(seg[:6]) == "Exif\x00\x00" {
+			return exifOrientation(seg[6:])
+		}
+		p += 2 + n
+	}
+	return 1
+}
+
+// exifOrientation reads the orientation tag from the first IFD of the TIFF
+// structure in an EXIF segment
+func exifOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+	ifd := int(order.Uint32(tiff[4:]))
+	if ifd < 8 || ifd+2 > len(tiff) {
+		return 1
+	}
+	n := int(order.Uint16(tiff[ifd:]))
+	for i := 0; i != n; i++ {
+		e := ifd + 2 + 12*i
+		if e+12 > len(tiff) {
+			return 1
+		}
+		if order.Uint16(tiff[e:]) == 0x0112 {
+			o := int(order.Uint16(tiff[e+8:]))
+			if o < 1 || o > 8 {
+				return 1
+			}
+			return o
+		}
+	}
+	return 1
+}
+
+// orient turns and flips src as EXIF orientation o tells
+func orient(src image.Image, o int) image.Image {
+	if o <= 1 || o > 8 {
+		return src
+	}
+	b := src.Bounds()
+	w, h := b.Dx(), b.Dy()
+	rgba := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.Draw(rgba, rgba.Bounds(), src, b.Min, draw.Src)
+
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	if o >= 5 {
+		dst = image.NewRGBA(image.Rect(0, 0, h, w))
+	}
+	for y := 0; y != h; y++ {
+		for x := 0; x != w; x++ {
+			var dx, dy int
+			switch o {
+			case 2:
+				dx, dy = w-1-x, y
+			case 3:
+				dx, dy = w-1-x, h-1-y
+			case 4:
+				dx, dy = x, h-1-y
+			case 5:
+				dx, dy = y, x
+			case 6:
+				dx, dy = h-1-y, x
+			case 7:
+				dx, dy = h-1-y, w-1-x
+			case 8:
+				dx, dy = y, w-1-x
+			}
+			copy(dst.Pix[dy*dst.Stride+dx*4:dy*dst.Stride+dx*4+4], rgba.Pix[y*rgba.Stride+x*4:y*rgba.Stride+x*4+4])
+		}
+	}
+	return dst
+}
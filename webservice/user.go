@@ -20,24 +20,47 @@
 package webservice
 
 import (
+	"encoding/hex"
 	log "github.com/Sirupsen/logrus"
 	"github.com/emicklei/go-restful"
 	//"html/template"
-	"net/http"
-	//"strconv"
-	//"strings"
 	db "github.com/openlab-aux/lsmsd/database"
+	"github.com/openlab-aux/lsmsd/notification"
+	"gopkg.in/mgo.v2/bson"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
 )
 
 type UserWebService struct {
-	d *db.UserDBProvider
+	d db.UserProvider
+	l db.LoanProvider
+	r db.ReservationProvider
+	i db.ItemProvider
+	t db.TokenProvider
 	S *restful.WebService
 	a *BasicAuthService
+	m notification.Mailer
+	// url is the public address of the api, used for links in emails
+	url string
+}
+
+// EnableMail makes the service send verification and password reset emails
+// through m. Without mail, email addresses are not verified and passwords
+// can't be reset.
+func (p *UserWebService) EnableMail(m notification.Mailer, url string) {
+	p.m = m
+	p.url = strings.TrimSuffix(url, "/")
 }
 
-func NewUserService(d *db.UserDBProvider, a *BasicAuthService) *UserWebService {
+func NewUserService(d db.UserProvider, l db.LoanProvider, r db.ReservationProvider, i db.ItemProvider, t db.TokenProvider, a *BasicAuthService) *UserWebService {
 	res := new(UserWebService)
 	res.d = d
+	res.l = l
+	res.r = r
+	res.i = i
+	res.t = t
 	res.a = a
 	service := new(restful.WebService)
 	service.
@@ -61,15 +84,47 @@ func NewUserService(d *db.UserDBProvider, a *BasicAuthService) *UserWebService {
 		Writes(db.UserActionHistory{}).
 		Do(returnsInternalServerError, returnsNotFound, returnsBadRequest))
 
+	service.Route(service.GET("/{name}/loans").
+		Param(restful.PathParameter("name", "User identifier")).
+		Param(restful.QueryParameter("state", "Only list loans in this state (requested, active, returned or rejected)")).
+		Doc("Returns the loans of the user").
+		To(res.GetUserLoans).
+		Writes([]db.Loan{}).
+		Do(returnsInternalServerError, returnsBadRequest, pageParams))
+
+	service.Route(service.GET("/{name}/reservations.ics").
+		Param(restful.PathParameter("name", "User identifier")).
+		Doc("Returns the reservations of the user as iCalendar feed").
+		To(res.GetReservationCalendar).
+		Produces(MIME_ICAL).
+		Do(returnsInternalServerError, returnsNotFound))
+
 	service.Route(service.GET("").
-		Doc("List all users (this may be replaced by a paginated version)").
+		Doc("List users, paginated and optionally sorted").
 		To(res.ListUser).
 		Writes([]db.User{}).
-		Do(returnsInternalServerError))
+		Do(returnsInternalServerError, returnsBadRequest, userListSpec.params))
+
+	service.Route(service.PUT("/{name}").
+		Filter(res.a.Auth).
+		Param(restful.PathParameter("name", "User identifier")).
+		Doc("Replace your user information").
+		To(res.UpdateUser).
+		Reads(db.User{}).
+		Do(returnsInternalServerError, returnsNotFound, returnsUpdateSuccessful, returnsBadRequest, returnsForbidden))
+
+	service.Route(service.PATCH("/{name}").
+		Filter(res.a.Auth).
+		Param(restful.PathParameter("name", "User identifier")).
+		Doc("Change your user information with a JSON merge patch (RFC 7396) or a JSON patch (RFC 6902). "+
+			"Name, Role and Unverified are read-only, add a Password to change it").
+		To(res.PatchUser).
+		Do(returnsInternalServerError, returnsNotFound, returnsUpdateSuccessful, returnsBadRequest, returnsForbidden,
+			returnsPatchErrors))
 
 	service.Route(service.PUT("").
 		Filter(res.a.Auth).
-		Doc("Update user information").
+		Doc("Deprecated, use PUT /users/{name}. Update the user whose Name is given in the body").
 		To(res.UpdateUser).
 		Reads(db.User{}).
 		Do(returnsInternalServerError, returnsNotFound, returnsUpdateSuccessful, returnsBadRequest))
@@ -82,12 +137,60 @@ func NewUserService(d *db.UserDBProvider, a *BasicAuthService) *UserWebService {
 		Returns(http.StatusUnauthorized, "This username is not available", nil).
 		Do(returnsInternalServerError, returnsBadRequest))
 
+	service.Route(service.PUT("/{name}/role").
+		Filter(res.a.Auth).
+		Filter(res.a.Require(PERM_USER_ADMIN)).
+		Param(restful.PathParameter("name", "User identifier")).
+		Doc("Assign a role (admin, maintainer, member or guest) to a user").
+		To(res.SetUserRole).
+		Reads(RoleRequest{}).
+		Do(returnsInternalServerError, returnsNotFound, returnsUpdateSuccessful, returnsBadRequest, returnsForbidden))
+
+	service.Route(service.POST("/{name}/password-reset").
+		Param(restful.PathParameter("name", "User identifier")).
+		Doc("Mail a password reset token to the user. It is valid for an hour and can be redeemed at /password-reset/{token}").
+		To(res.RequestPasswordReset).
+		Returns(http.StatusServiceUnavailable, "Mail is disabled on this server", nil).
+		Do(returnsInternalServerError))
+
+	service.Route(service.GET("/{name}/verify/{token}").
+		Param(restful.PathParameter("name", "User identifier")).
+		Param(restful.PathParameter("token", "Token from the verification email")).
+		Doc("Confirm the email address of a user, which makes a guest a member").
+		To(res.VerifyEMail).
+		Do(returnsInternalServerError, returnsNotFound, returnsUpdateSuccessful))
+
+	service.Route(service.GET("/{name}/tokens").
+		Filter(res.a.Auth).
+		Param(restful.PathParameter("name", "User identifier")).
+		Doc("List the API tokens of a user").
+		To(res.ListTokens).
+		Writes([]db.Token{}).
+		Do(returnsInternalServerError, returnsForbidden))
+
+	service.Route(service.POST("/{name}/tokens").
+		Filter(res.a.Auth).
+		Param(restful.PathParameter("name", "User identifier")).
+		Doc("Create a named API token. The token is valid until it expires or is revoked").
+		To(res.CreateToken).
+		Reads(TokenRequest{}).
+		Writes(TokenResponse{}).
+		Do(returnsInternalServerError, returnsBadRequest, returnsNotFound, returnsForbidden))
+
+	service.Route(service.DELETE("/{name}/tokens/{tokenid}").
+		Filter(res.a.Auth).
+		Param(restful.PathParameter("name", "User identifier")).
+		Param(restful.PathParameter("tokenid", "Token identifier")).
+		Doc("Revoke an API token").
+		To(res.DeleteToken).
+		Do(returnsInternalServerError, returnsNotFound, returnsDeleteSuccessful, returnsBadRequest, returnsForbidden))
+
 	service.Route(service.DELETE("/{name}").
 		Filter(res.a.Auth).
 		Param(restful.PathParameter("name", "User identifier")).
 		Doc("Delete a user").
 		To(res.DeleteUser).
-		Returns(http.StatusForbidden, "Request not allowed; You may only delete your own account", nil).
+		Returns(http.StatusForbidden, "Request not allowed; Only admins may delete other accounts", nil).
 		Do(returnsInternalServerError, returnsNotFound, returnsDeleteSuccessful, returnsBadRequest))
 	res.S = service
 	return res
@@ -117,13 +220,68 @@ func (p *UserWebService) GetUserLogByName(request *restful.Request, response *re
 	return
 }
 
+func (p *UserWebService) GetUserLoans(request *restful.Request, response *restful.Response) {
+	q, err := parsePage(request)
+	if err != nil {
+		response.WriteErrorString(http.StatusBadRequest, ERROR_INVALID_INPUT)
+		log.WithFields(log.Fields{"Error Msg": err}).Info(ERROR_INVALID_INPUT)
+		return
+	}
+	q.Sort = []string{"-requested"}
+	q.Filter = map[string]interface{}{"borrower": request.PathParameter("name")}
+	if s := request.QueryParameter("state"); s != "" {
+		q.Filter["state"] = s
+	}
+	loans, total, err := p.l.ListLoans(q, false)
+	if err != nil {
+		response.WriteErrorString(http.StatusInternalServerError, ERROR_INTERNAL)
+		log.WithFields(log.Fields{"Error Msg": err}).Warn(ERROR_INTERNAL)
+		return
+	}
+	writePageHeaders(request, response, q, total)
+	response.WriteEntity(loans)
+}
+
+func (p *UserWebService) GetReservationCalendar(request *restful.Request, response *restful.Response) {
+	name := request.PathParameter("name")
+	if !p.d.CheckUserExistance(&db.User{Name: name}) {
+		response.WriteErrorString(http.StatusNotFound, ERROR_INVALID_ID)
+		return
+	}
+	rs, err := p.r.GetReservations(0, name, time.Time{}, time.Time{})
+	if err != nil {
+		response.WriteErrorString(http.StatusInternalServerError, ERROR_INTERNAL)
+		log.WithFields(log.Fields{"Error Msg": err}).Warn(ERROR_INTERNAL)
+		return
+	}
+	names := make(map[uint64]string)
+	writeICalendar(response, name, rs, func(id uint64) string {
+		if n, ok := names[id]; ok {
+			return n
+		}
+		n := "Item " + strconv.FormatUint(id, 10)
+		if itm, err := p.i.GetItemById(id); err == nil {
+			n = itm.Name
+		}
+		names[id] = n
+		return n
+	})
+}
+
 func (p *UserWebService) ListUser(request *restful.Request, response *restful.Response) {
-	usr, err := p.d.ListUser()
+	q, err := userListSpec.parse(request)
+	if err != nil {
+		response.WriteErrorString(http.StatusBadRequest, ERROR_INVALID_INPUT)
+		log.WithFields(log.Fields{"Error Msg": err}).Info(ERROR_INVALID_INPUT)
+		return
+	}
+	usr, total, err := p.d.ListUser(q)
 	if err != nil {
 		response.WriteErrorString(http.StatusInternalServerError, ERROR_INTERNAL)
 		log.WithFields(log.Fields{"Error Msg": err}).Warn(ERROR_INTERNAL)
 		return
 	}
+	writePageHeaders(request, response, q, total)
 	response.WriteEntity(usr)
 }
 
@@ -135,39 +293,97 @@ func (p *UserWebService) UpdateUser(request *restful.Request, response *restful.
 		log.WithFields(log.Fields{"Error Msg": err}).Warn(ERROR_INVALID_INPUT)
 		return
 	}
+	if name := request.PathParameter("name"); name != "" {
+		if usr.Name != "" && usr.Name != name {
+			response.WriteErrorString(http.StatusBadRequest, ERROR_INVALID_INPUT)
+			log.WithFields(log.Fields{"Path": name, "Body": usr.Name}).Info(ERROR_INVALID_INPUT)
+			return
+		}
+		usr.Name = name
+	}
 	if usr.Name != request.Attribute("User").(string) {
 		log.WithFields(log.Fields{"User": request.Attribute("User").(string), "attempted to update": usr.Name}).Warn("Unauthorized update request")
 		response.WriteErrorString(http.StatusForbidden, "Request not allowed")
 		return
 	}
+	if !p.d.CheckUserExistance(usr) {
+		response.WriteErrorString(http.StatusNotFound, "User not found. Please register first")
+		return
+	}
+	p.saveUser(response, usr)
+}
 
-	ex := p.d.CheckUserExistance(usr)
-	if ex {
-		if usr.Password != "" {
-			log.Debug("User supplied new password.")
-			err = usr.Secret.SetPassword(usr.Password)
-		} else {
-			temp, err := p.d.GetUserByName(usr.Name)
-			if err != nil {
-			} else {
-				usr.Secret = temp.Secret // if no new password will be set, preserve old
-			}
-		}
-		if err != nil { //fall through to error handling
-		} else {
-			err = p.d.UpdateUser(usr)
-		}
-		if err != nil {
-			response.WriteErrorString(http.StatusInternalServerError, ERROR_INTERNAL)
-			log.WithFields(log.Fields{"Err": err}).Warn("Error while updating User")
+func (p *UserWebService) PatchUser(request *restful.Request, response *restful.Response) {
+	name := request.PathParameter("name")
+	if name != request.Attribute("User").(string) {
+		log.WithFields(log.Fields{"User": request.Attribute("User").(string), "attempted to update": name}).Warn("Unauthorized update request")
+		response.WriteErrorString(http.StatusForbidden, "Request not allowed")
+		return
+	}
+	cur, err := p.d.GetUserByName(name)
+	if err != nil {
+		if err == db.ErrNotFound {
+			response.WriteErrorString(http.StatusNotFound, "User not found. Please register first")
 			return
 		}
-		response.WriteEntity(true)
+		response.WriteErrorString(http.StatusInternalServerError, ERROR_INTERNAL)
+		log.WithFields(log.Fields{"Error Msg": err}).Warn(ERROR_INTERNAL)
 		return
+	}
+	usr := new(db.User)
+	err = patchEntity(request, &cur, usr)
+	if err == nil && (usr.Name != cur.Name || usr.Role != cur.Role || usr.Unverified != cur.Unverified) {
+		err = errPatchReadOnly
+	}
+	if err != nil {
+		writePatchError(response, err)
+		return
+	}
+	p.saveUser(response, usr)
+}
+
+// saveUser stores usr as the new version of an existing user. Role and the
+// verification state are kept, the secret only changes if a new password is
+// given.
+func (p *UserWebService) saveUser(response *restful.Response, usr *db.User) {
+	for _, m := range usr.MuteMail {
+		if !db.ValidMailEvent(m) {
+			response.WriteErrorString(http.StatusBadRequest, ERROR_INVALID_INPUT)
+			log.WithFields(log.Fields{"Event": m}).Info(ERROR_INVALID_INPUT)
+			return
+		}
+	}
+	var err error
+	if usr.Password != "" {
+		log.Debug("User supplied new password.")
+		err = usr.Secret.SetPassword(usr.Password)
+	}
+	temp, gerr := p.d.GetUserByName(usr.Name)
+	if gerr != nil {
+		err = gerr
 	} else {
-		response.WriteErrorString(http.StatusNotFound, "User not found. Please register first")
+		if usr.Password == "" {
+			usr.Secret = temp.Secret // if no new password will be set, preserve old
+		}
+		usr.Role = temp.Role // roles can only be changed by admins
+		usr.Unverified = temp.Unverified
+		if usr.EMail != temp.EMail && p.m != nil {
+			usr.Unverified = true
+		}
+	}
+	if err != nil { //fall through to error handling
+	} else {
+		err = p.d.UpdateUser(usr)
+	}
+	if err != nil {
+		response.WriteErrorString(http.StatusInternalServerError, ERROR_INTERNAL)
+		log.WithFields(log.Fields{"Err": err}).Warn("Error while updating User")
 		return
 	}
+	if usr.Unverified {
+		p.sendVerification(usr)
+	}
+	response.WriteEntity(true)
 }
 
 func (p *UserWebService) CreateUser(request *restful.Request, response *restful.Response) {
@@ -187,6 +403,10 @@ func (p *UserWebService) CreateUser(request *restful.Request, response *restful.
 		response.WriteErrorString(http.StatusForbidden, "This username is not available")
 		return
 	}
+	// guests become members by confirming their email address, admins are
+	// promoted by another admin or the [Auth] section of the config
+	usr.Role = db.RoleGuest
+	usr.Unverified = p.m != nil
 	err = usr.Secret.SetPassword(usr.Password)
 	if err != nil {
 	} else {
@@ -198,6 +418,9 @@ func (p *UserWebService) CreateUser(request *restful.Request, response *restful.
 		log.WithFields(log.Fields{"Error Msg": err}).Warn(ERROR_INTERNAL)
 		return
 	}
+	if usr.Unverified {
+		p.sendVerification(usr)
+	}
 	response.WriteEntity("/users/" + usr.Name)
 }
 
@@ -205,13 +428,16 @@ func (p *UserWebService) DeleteUser(request *restful.Request, response *restful.
 	name := request.PathParameter("name")
 	log.WithFields(log.Fields{"Name": name}).Info("Got user DELETE request")
 
-	if name != request.Attribute("User").(string) {
+	if name != request.Attribute("User").(string) && !hasPermission(request, PERM_USER_ADMIN) {
 		log.WithFields(log.Fields{"User": request.Attribute("User").(string), "attempted to delete": name}).Warn("Unauthorized deletion request")
 		response.WriteErrorString(http.StatusForbidden, "Request not allowed")
 		return
 	}
 
 	err := p.d.DeleteUser(name)
+	if err == nil {
+		err = p.t.DeleteUserTokens(name)
+	}
 	if err != nil {
 		log.WithFields(log.Fields{"Error Msg": err}).Info(ERROR_INTERNAL)
 		response.WriteErrorString(http.StatusInternalServerError, ERROR_INTERNAL)
@@ -219,3 +445,164 @@ func (p *UserWebService) DeleteUser(request *restful.Request, response *restful.
 	}
 	response.WriteEntity(true)
 }
+
+type RoleRequest struct {
+	Role string
+}
+
+func (p *UserWebService) SetUserRole(request *restful.Request, response *restful.Response) {
+	name := request.PathParameter("name")
+	rr := new(RoleRequest)
+	err := request.ReadEntity(rr)
+	if err != nil || !db.ValidRole(rr.Role) {
+		response.WriteErrorString(http.StatusBadRequest, ERROR_INVALID_INPUT)
+		log.WithFields(log.Fields{"Error Msg": err, "Role": rr.Role}).Info(ERROR_INVALID_INPUT)
+		return
+	}
+	if !p.d.CheckUserExistance(&db.User{Name: name}) {
+		response.WriteErrorString(http.StatusNotFound, ERROR_INVALID_ID)
+		return
+	}
+	err = p.d.SetRole(name, rr.Role)
+	if err != nil {
+		response.WriteErrorString(http.StatusInternalServerError, ERROR_INTERNAL)
+		log.WithFields(log.Fields{"Error Msg": err}).Warn(ERROR_INTERNAL)
+		return
+	}
+	log.WithFields(log.Fields{"User": request.Attribute("User"), "Target": name, "Role": rr.Role}).Info("Role assigned")
+	response.WriteEntity(true)
+}
+
+type TokenRequest struct {
+	Name    string    `description:"What the token is used for"`
+	Expires time.Time `json:",omitempty" description:"Leave empty for a token which never expires"`
+}
+
+func (p *UserWebService) ListTokens(request *restful.Request, response *restful.Response) {
+	name := request.PathParameter("name")
+	if !isSelfOrAdmin(request, name) {
+		response.WriteErrorString(http.StatusForbidden, "Permission denied")
+		return
+	}
+	tokens, err := p.t.ListTokens(name, db.TokenAPI)
+	if err != nil {
+		response.WriteErrorString(http.StatusInternalServerError, ERROR_INTERNAL)
+		log.WithFields(log.Fields{"Error Msg": err}).Warn(ERROR_INTERNAL)
+		return
+	}
+	response.WriteEntity(tokens)
+}
+
+func (p *UserWebService) CreateToken(request *restful.Request, response *restful.Response) {
+	name := request.PathParameter("name")
+	if !isSelfOrAdmin(request, name) {
+		response.WriteErrorString(http.StatusForbidden, "Permission denied")
+		return
+	}
+	tr := new(TokenRequest)
+	err := request.ReadEntity(tr)
+	if err != nil || tr.Name == "" || (!tr.Expires.IsZero() && tr.Expires.Before(time.Now())) {
+		response.WriteErrorString(http.StatusBadRequest, ERROR_INVALID_INPUT)
+		log.WithFields(log.Fields{"Error Msg": err}).Info(ERROR_INVALID_INPUT)
+		return
+	}
+	if !p.d.CheckUserExistance(&db.User{Name: name}) {
+		response.WriteErrorString(http.StatusNotFound, ERROR_INVALID_ID)
+		return
+	}
+	tok, secret, err := p.t.CreateToken(name, tr.Name, db.TokenAPI, tr.Expires)
+	if err != nil {
+		response.WriteErrorString(http.StatusInternalServerError, ERROR_INTERNAL)
+		log.WithFields(log.Fields{"Error Msg": err}).Warn(ERROR_INTERNAL)
+		return
+	}
+	log.WithFields(log.Fields{"User": name, "Token": tr.Name}).Info("API token created")
+	response.WriteEntity(TokenResponse{Id: tok.ID, Token: secret, Expires: tok.Expires})
+}
+
+func (p *UserWebService) DeleteToken(request *restful.Request, response *restful.Response) {
+	name := request.PathParameter("name")
+	if !isSelfOrAdmin(request, name) {
+		response.WriteErrorString(http.StatusForbidden, "Permission denied")
+		return
+	}
+	id, err := hex.DecodeString(request.PathParameter("tokenid"))
+	if err != nil || len(id) != 12 {
+		response.WriteErrorString(http.StatusBadRequest, ERROR_INVALID_ID)
+		log.WithFields(log.Fields{"Error Msg": err}).Info(ERROR_INVALID_ID)
+		return
+	}
+	err = p.t.DeleteToken(name, bson.ObjectId(id))
+	if err == db.ErrNotFound {
+		response.WriteErrorString(http.StatusNotFound, ERROR_INVALID_ID)
+		return
+	} else if err != nil {
+		response.WriteErrorString(http.StatusInternalServerError, ERROR_INTERNAL)
+		log.WithFields(log.Fields{"Error Msg": err}).Warn(ERROR_INTERNAL)
+		return
+	}
+	response.WriteEntity(true)
+}
+
+// sendVerification mails a verification link to the address of usr
+func (p *UserWebService) sendVerification(usr *db.User) {
+	_, secret, err := p.t.CreateToken(usr.Name, "", db.TokenVerifyEMail, time.Now().Add(db.VerifyEMailLifetime))
+	if err != nil {
+		log.WithFields(log.Fields{"User": usr.Name, "Error Msg": err}).Warn("Could not create verification token")
+		return
+	}
+	text := "Hello " + usr.Name + ",\n\nplease confirm your email address by opening\n\n  " +
+		p.url + "/users/" + usr.Name + "/verify/" + secret + "\n\n" +
+		"Until then you can't change anything. The link is valid for a week.\n"
+	// the mail queue may block while it is sending
+	go p.m.AddMailToQueue(usr.EMail, "Please confirm your email address", text)
+}
+
+func (p *UserWebService) VerifyEMail(request *restful.Request, response *restful.Response) {
+	name := request.PathParameter("name")
+	tok, err := p.t.ConsumeToken(request.PathParameter("token"), db.TokenVerifyEMail)
+	if err == nil && tok.User != name {
+		err = db.ErrNotFound
+	}
+	if err == db.ErrNotFound {
+		response.WriteErrorString(http.StatusNotFound, "Token invalid or expired")
+		return
+	}
+	if err == nil {
+		err = p.d.SetVerified(name)
+	}
+	if err != nil {
+		response.WriteErrorString(http.StatusInternalServerError, ERROR_INTERNAL)
+		log.WithFields(log.Fields{"Error Msg": err}).Warn(ERROR_INTERNAL)
+		return
+	}
+	log.WithFields(log.Fields{"User": name}).Info("Email address verified")
+	response.WriteEntity(true)
+}
+
+// RequestPasswordReset always reports success for existing mail setups, so
+// it can't be used to find out which users exist.
+func (p *UserWebService) RequestPasswordReset(request *restful.Request, response *restful.Response) {
+	if p.m == nil {
+		response.WriteErrorString(http.StatusServiceUnavailable, "Mail is disabled on this server")
+		return
+	}
+	usr, err := p.d.GetUserByName(request.PathParameter("name"))
+	if err != nil || usr.EMail == "" {
+		log.WithFields(log.Fields{"User": request.PathParameter("name")}).Info("Password reset for unknown user")
+		response.WriteEntity(true)
+		return
+	}
+	_, secret, err := p.t.CreateToken(usr.Name, "", db.TokenPasswordReset, time.Now().Add(db.PasswordResetLifetime))
+	if err != nil {
+		response.WriteErrorString(http.StatusInternalServerError, ERROR_INTERNAL)
+		log.WithFields(log.Fields{"Error Msg": err}).Warn(ERROR_INTERNAL)
+		return
+	}
+	text := "Hello " + usr.Name + ",\n\nsomeone asked to reset your password. To choose a new one, send it\n" +
+		"within the next hour to\n\n  POST " + p.url + "/password-reset/" + secret + "\n\n" +
+		"If this wasn't you, just ignore this mail.\n"
+	go p.m.AddMailToQueue(usr.EMail, "Password reset", text)
+	log.WithFields(log.Fields{"User": usr.Name}).Info("Password reset requested")
+	response.WriteEntity(true)
+}
@@ -36,16 +36,15 @@ var _ = Describe("User", func() {
 	var (
 		session *mgo.Session
 		cont    *restful.Container
-		itm     *db.ItemDBProvider
-		pol     *db.PolicyDBProvider
-		usr     *db.UserDBProvider
+		itm     db.ItemProvider
+		usr     db.UserProvider
 		hw      *httptest.ResponseRecorder
 		req     *http.Request
 		body    []byte
 	)
 
 	BeforeEach(func() {
-		session, cont, itm, pol, usr = newTestContainer()
+		session, cont, itm, _, usr = newTestContainer()
 		hw = httptest.NewRecorder()
 	})
 
@@ -283,4 +282,79 @@ var _ = Describe("User", func() {
 			})
 		})
 	})
+
+	Describe("Assign a role", func() {
+		var role string
+
+		BeforeEach(func() {
+			populateUserDB(usr)
+			role = db.RoleMaintainer
+		})
+
+		JustBeforeEach(func() {
+			body, _ = json.Marshal(map[string]string{"Role": role})
+			req, _ = http.NewRequest("PUT", "/users/5/role", bytes.NewReader(body))
+			req.Header.Set("Content-Type", restful.MIME_JSON)
+		})
+
+		It("should be allowed for admins", func() {
+			req.SetBasicAuth("0", "testpw")
+			cont.ServeHTTP(hw, req)
+			Expect(hw.Code).To(Equal(http.StatusOK))
+
+			u, _ := usr.GetUserByName("5")
+			Expect(u.Role).To(Equal(db.RoleMaintainer))
+		})
+
+		It("should be forbidden for everyone else", func() {
+			req.SetBasicAuth("1", "testpw")
+			cont.ServeHTTP(hw, req)
+			Expect(hw.Code).To(Equal(http.StatusForbidden))
+		})
+
+		Context("which does not exist", func() {
+			BeforeEach(func() {
+				role = "overlord"
+			})
+
+			It("should return 400 Bad Request", func() {
+				req.SetBasicAuth("0", "testpw")
+				cont.ServeHTTP(hw, req)
+				Expect(hw.Code).To(Equal(http.StatusBadRequest))
+			})
+		})
+	})
+
+	Describe("Register a user as a stranger", func() {
+		register := func(name string) {
+			body, _ = json.Marshal(db.User{Name: name, EMail: name + "@example.com", Password: "testpw"})
+			req, _ = http.NewRequest("POST", "/users", bytes.NewReader(body))
+			req.Header.Set("Content-Type", restful.MIME_JSON)
+			cont.ServeHTTP(hw, req)
+			Expect(hw.Code).To(Equal(http.StatusOK))
+			hw = httptest.NewRecorder()
+		}
+
+		It("should register everyone as a guest", func() {
+			register("first")
+			register("second")
+
+			u, _ := usr.GetUserByName("first")
+			Expect(u.Role).To(Equal(db.RoleGuest))
+			u, _ = usr.GetUserByName("second")
+			Expect(u.Role).To(Equal(db.RoleGuest))
+		})
+
+		It("should not allow guests to create items", func() {
+			register("first")
+			register("second")
+
+			body, _ = json.Marshal(db.Item{Name: "Not mine"})
+			req, _ = http.NewRequest("POST", "/items", bytes.NewReader(body))
+			req.Header.Set("Content-Type", restful.MIME_JSON)
+			req.SetBasicAuth("second", "testpw")
+			cont.ServeHTTP(hw, req)
+			Expect(hw.Code).To(Equal(http.StatusForbidden))
+		})
+	})
 })
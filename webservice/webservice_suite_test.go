@@ -20,6 +20,8 @@
 package webservice_test
 
 import (
+	"bytes"
+	"encoding/json"
 	log "github.com/Sirupsen/logrus"
 	"github.com/emicklei/go-restful"
 	. "github.com/onsi/ginkgo"
@@ -27,8 +29,14 @@ import (
 	db "github.com/openlab-aux/lsmsd/database"
 	"github.com/openlab-aux/lsmsd/webservice"
 	"gopkg.in/mgo.v2"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 	"testing"
 )
 
@@ -39,39 +47,198 @@ func TestWebservice(t *testing.T) {
 
 var _ = BeforeSuite(func() {
 	log.SetLevel(log.FatalLevel)
+	// keep password hashing cheap, the suite creates lots of users
+	db.SetPasswordHasher(db.AlgorithmArgon2id, &db.KDFParams{Cost: 1, Memory: 64, Parallelism: 1})
 })
 
-func newTestContainer() (*mgo.Session, *restful.Container, *db.ItemDBProvider, *db.PolicyDBProvider, *db.UserDBProvider) {
-	s, err := mgo.Dial("localhost")
-	if err != nil {
-		Fail("could not setup db " + err.Error())
-	}
+// testStore is the database file of the last test container if
+// LSMSD_TEST_BOLT is set
+var (
+	testStore     *db.BoltStore
+	testStoreFile string
+)
+
+// newTestContainer wires the services against the in-memory backend, set
+// LSMSD_TEST_MONGODB to a server address to run the suite against MongoDB or
+// LSMSD_TEST_BOLT to use a temporary bolt database file. The returned session
+// is nil unless MongoDB is used.
+func newTestContainer() (*mgo.Session, *restful.Container, db.ItemProvider, db.PolicyProvider, db.UserProvider) {
+	var (
+		s     *mgo.Session
+		imgp  db.ImageProvider
+		attp  db.AttachmentProvider
+		itemp db.ItemProvider
+		polp  db.PolicyProvider
+		userp db.UserProvider
+		loanp db.LoanProvider
+		resp  db.ReservationProvider
+		tokp  db.TokenProvider
+	)
 	cont := restful.NewContainer()
 
 	db.ReadPepper("/tmp/lsmsd_test_pepper")
-	imgp := db.NewImageDBProvider(s, "lsmsd_test")
-
-	itemp := db.NewItemDBProvider(s, "lsmsd_test", imgp)
-	polp := db.NewPolicyDBProvider(s, "lsmsd_test")
-	userp := db.NewUserDBProvider(s, itemp, polp, "lsmsd_test")
-	us := webservice.NewUpdateService()
-	auth := webservice.NewBasicAuthService(userp)
-	iws := webservice.NewItemWebService(itemp, imgp, auth, us)
+	if server := os.Getenv("LSMSD_TEST_MONGODB"); server != "" {
+		var err error
+		s, err = mgo.Dial(server)
+		if err != nil {
+			Fail("could not setup db " + err.Error())
+		}
+		imgp = db.NewImageDBProvider(s, "lsmsd_test")
+		attp = db.NewAttachmentDBProvider(s, "lsmsd_test")
+		itemp = db.NewItemDBProvider(s, "lsmsd_test", imgp)
+		polp = db.NewPolicyDBProvider(s, "lsmsd_test")
+		userp = db.NewUserDBProvider(s, itemp, polp, "lsmsd_test")
+		loanp = db.NewLoanDBProvider(s, "lsmsd_test")
+		resp = db.NewReservationDBProvider(s, "lsmsd_test")
+		tokp = db.NewTokenDBProvider(s, "lsmsd_test")
+	} else if os.Getenv("LSMSD_TEST_BOLT") != "" {
+		f, err := ioutil.TempFile("", "lsmsd_test")
+		if err != nil {
+			Fail("could not setup db " + err.Error())
+		}
+		f.Close()
+		testStore, err = db.OpenBoltStore(f.Name())
+		if err != nil {
+			Fail("could not setup db " + err.Error())
+		}
+		imgp, err = db.NewImageBoltProvider(testStore)
+		Expect(err).NotTo(HaveOccurred())
+		attp, err = db.NewAttachmentBoltProvider(testStore)
+		Expect(err).NotTo(HaveOccurred())
+		itemp, err = db.NewItemBoltProvider(testStore, imgp)
+		Expect(err).NotTo(HaveOccurred())
+		polp, err = db.NewPolicyBoltProvider(testStore)
+		Expect(err).NotTo(HaveOccurred())
+		userp, err = db.NewUserBoltProvider(testStore, itemp, polp)
+		Expect(err).NotTo(HaveOccurred())
+		loanp, err = db.NewLoanBoltProvider(testStore)
+		Expect(err).NotTo(HaveOccurred())
+		resp, err = db.NewReservationBoltProvider(testStore)
+		Expect(err).NotTo(HaveOccurred())
+		tokp, err = db.NewTokenBoltProvider(testStore)
+		Expect(err).NotTo(HaveOccurred())
+		testStoreFile = f.Name()
+	} else {
+		imgp = db.NewImageMemProvider()
+		attp = db.NewAttachmentMemProvider()
+		itemp = db.NewItemMemProvider(imgp)
+		polp = db.NewPolicyMemProvider()
+		userp = db.NewUserMemProvider(itemp, polp)
+		loanp = db.NewLoanMemProvider()
+		resp = db.NewReservationMemProvider()
+		tokp = db.NewTokenMemProvider()
+	}
+	auth := webservice.NewBasicAuthService(userp, tokp)
+	us := webservice.NewUpdateService(itemp, auth)
+	iws := webservice.NewItemWebService(itemp, imgp, attp, loanp, polp, resp, auth, us)
 	pws := webservice.NewPolicyService(polp, auth, us)
-	uws := webservice.NewUserService(userp, auth)
+	uws := webservice.NewUserService(userp, loanp, resp, itemp, tokp, auth)
+	sws := webservice.NewSearchService(itemp, polp, userp)
+	lws := webservice.NewLoanService(loanp, itemp, auth, us)
+	aws := webservice.NewAuthWebService(userp, tokp, auth)
+	prws := webservice.NewPasswordResetService(userp, tokp)
+	auws := webservice.NewAuditService(itemp, polp, userp, imgp, attp, auth)
+	imws := webservice.NewImageService(imgp)
+	mails = new(fakeMailer)
+	uws.EnableMail(mails, "http://lsms.test/")
 	cont.Add(iws.S)
 	cont.Add(pws.S)
 	cont.Add(uws.S)
+	cont.Add(sws.S)
+	cont.Add(lws.S)
+	cont.Add(aws.S)
+	cont.Add(prws.S)
+	cont.Add(auws.S)
+	cont.Add(imws.S)
+	cont.Add(us.S)
+	testImages = imgp
+	testAttachments = attp
 	return s, cont, itemp, polp, userp
 }
 
-func populateDB(itm *db.ItemDBProvider, pol *db.PolicyDBProvider, usr *db.UserDBProvider) {
+// testImages and testAttachments are the image and attachment providers of
+// the last test container
+var (
+	testImages      db.ImageProvider
+	testAttachments db.AttachmentProvider
+)
+
+// request sends a request to cont and returns the recorded response. body
+// is sent as it is if it is a []byte and as JSON otherwise, a nil body is
+// left empty. A non empty user authenticates with the test password, header
+// holds pairs of names and values of further headers, which may replace the
+// JSON Content-Type.
+func request(cont *restful.Container, method, path, user string, body interface{}, header ...string) *httptest.ResponseRecorder {
+	var data []byte
+	switch b := body.(type) {
+	case nil:
+	case []byte:
+		data = b
+	default:
+		data, _ = json.Marshal(body)
+	}
+	req, _ := http.NewRequest(method, path, bytes.NewReader(data))
+	req.Header.Set("Content-Type", restful.MIME_JSON)
+	if user != "" {
+		req.SetBasicAuth(user, "testpw")
+	}
+	for i := 0; i+1 < len(header); i += 2 {
+		req.Header.Set(header[i], header[i+1])
+	}
+	res := httptest.NewRecorder()
+	cont.ServeHTTP(res, req)
+	return res
+}
+
+// fakeMailer collects mails instead of sending them
+type fakeMailer struct {
+	sync.Mutex
+	rcpts    []string
+	subjects []string
+	texts    []string
+}
+
+// mails receives the mails sent by the services of the last test container
+var mails *fakeMailer
+
+func (f *fakeMailer) AddMailToQueue(rcpt, subject, text string) {
+	f.Lock()
+	defer f.Unlock()
+	f.rcpts = append(f.rcpts, rcpt)
+	f.subjects = append(f.subjects, subject)
+	f.texts = append(f.texts, text)
+}
+
+func (f *fakeMailer) sent() []string {
+	f.Lock()
+	defer f.Unlock()
+	return append([]string{}, f.rcpts...)
+}
+
+// link returns the last path segment following prefix in the most recent
+// mail to rcpt
+func (f *fakeMailer) link(rcpt, prefix string) string {
+	f.Lock()
+	defer f.Unlock()
+	for i := len(f.rcpts) - 1; i >= 0; i-- {
+		if f.rcpts[i] != rcpt {
+			continue
+		}
+		m := regexp.MustCompile(regexp.QuoteMeta(prefix) + `([0-9a-f]+)`).FindStringSubmatch(f.texts[i])
+		if m != nil {
+			return m[1]
+		}
+	}
+	return ""
+}
+
+func populateDB(itm db.ItemProvider, pol db.PolicyProvider, usr db.UserProvider) {
 	populateItemDB(itm)
 	populatePolicyDB(pol)
 	populateUserDB(usr)
 }
 
-func populateItemDB(itm *db.ItemDBProvider) {
+func populateItemDB(itm db.ItemProvider) {
 	for i := 0; i != 10; i++ {
 		i := db.Item{
 			Name:        "test" + strconv.Itoa(i),
@@ -84,24 +251,24 @@ func populateItemDB(itm *db.ItemDBProvider) {
 		}
 
 		var err error
-		_, err = itm.CreateItem(&i)
+		_, err = itm.CreateItem(&i, "0")
 		if err != nil {
 			Fail("could not populate item db: " + err.Error())
 		}
 	}
 }
 
-func populatePolicyDB(pol *db.PolicyDBProvider) {
+func populatePolicyDB(pol db.PolicyProvider) {
 	for i := 0; i != 10; i++ {
 		p := db.Policy{Name: strconv.Itoa(i), Description: "testdescr"}
-		err := pol.CreatePolicy(&p)
+		err := pol.CreatePolicy(&p, "0")
 		if err != nil {
 			Fail("could not populate policy db: " + err.Error())
 		}
 	}
 }
 
-func populateUserDB(usr *db.UserDBProvider) {
+func populateUserDB(usr db.UserProvider) {
 	for i := 0; i != 10; i++ {
 		sec := new(db.Secret)
 		err := sec.SetPassword("testpw")
@@ -113,6 +280,12 @@ func populateUserDB(usr *db.UserDBProvider) {
 			EMail:  "test" + strconv.Itoa(i) + "@example.com",
 			Secret: *sec,
 		}
+		switch i {
+		case 0:
+			u.Role = db.RoleAdmin
+		case 1:
+			u.Role = db.RoleMaintainer
+		}
 		err = usr.CreateUser(&u)
 		if err != nil {
 			Fail("could not populate user db: " + err.Error())
@@ -120,8 +293,16 @@ func populateUserDB(usr *db.UserDBProvider) {
 	}
 }
 
-func flushDB(s *mgo.Session, itm *db.ItemDBProvider) {
+func flushDB(s *mgo.Session, itm db.ItemProvider) {
 	itm.Stop()
+	if testStore != nil {
+		testStore.Close()
+		os.Remove(testStoreFile)
+		testStore = nil
+	}
+	if s == nil {
+		return
+	}
 	coll, err := s.DB("lsmsd_test").CollectionNames()
 	if err != nil {
 		Fail("failed to clean up: " + err.Error())